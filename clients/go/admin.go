@@ -0,0 +1,236 @@
+package rivetq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// AdminClient groups operational endpoints, for tooling such as a CLI built on
+// top of the client. Get one with Client.Admin.
+type AdminClient struct {
+	client *Client
+}
+
+// Admin returns the client's admin operations
+func (c *Client) Admin() *AdminClient {
+	return &AdminClient{client: c}
+}
+
+// SetAdminToken sets the bearer token sent with admin requests, matching the
+// server's admin_token
+func (c *Client) SetAdminToken(token string) {
+	c.adminToken = token
+}
+
+// RateLimit is a queue's token bucket configuration
+type RateLimit struct {
+	Capacity   float64         `json:"capacity"`
+	RefillRate float64         `json:"refill_rate"`
+	Exists     bool            `json:"exists"`
+	Stats      *RateLimitStats `json:"stats,omitempty"`
+}
+
+// RateLimitStats counts the enqueues a rate limit allowed and rejected over
+// the last WindowMs
+type RateLimitStats struct {
+	WindowMs    int64   `json:"window_ms"`
+	Allowed     uint64  `json:"allowed"`
+	Rejected    uint64  `json:"rejected"`
+	RejectRatio float64 `json:"reject_ratio"`
+}
+
+// DumpedJob is a job as reported by the dump endpoint
+type DumpedJob struct {
+	ID            string            `json:"id"`
+	Queue         string            `json:"queue"`
+	State         string            `json:"state"`
+	Payload       json.RawMessage   `json:"payload"`
+	Encoding      string            `json:"encoding,omitempty"` // "json", or "base64" for payloads that are not JSON
+	Headers       map[string]string `json:"headers,omitempty"`
+	Priority      uint8             `json:"priority"`
+	Tries         uint32            `json:"tries"`
+	MaxRetries    uint32            `json:"max_retries"`
+	ETA           time.Time         `json:"eta"`
+	EnqueuedAt    time.Time         `json:"enqueued_at"`
+	LeaseID       string            `json:"lease_id,omitempty"`
+	LeaseDeadline *time.Time        `json:"lease_deadline,omitempty"`
+	DLQReason     string            `json:"dlq_reason,omitempty"`
+	ExpectedMs    int64             `json:"expected_ms,omitempty"`
+	Overdue       bool              `json:"overdue,omitempty"`
+}
+
+// PayloadBytes returns the job's payload as it was enqueued, decoding it
+// according to Encoding
+func (j *DumpedJob) PayloadBytes() ([]byte, error) {
+	if j.Encoding != "base64" {
+		return j.Payload, nil
+	}
+	var payload []byte
+	if err := json.Unmarshal(j.Payload, &payload); err != nil {
+		return nil, fmt.Errorf("failed to decode base64 payload: %w", err)
+	}
+	return payload, nil
+}
+
+// JobPage is one page of a queue's jobs in one state, with the number of jobs
+// in that state in all
+type JobPage struct {
+	Jobs  []*DumpedJob `json:"jobs"`
+	Total int          `json:"total"`
+}
+
+// ReplayDivergence is a job whose replayed state differs from its live state
+type ReplayDivergence struct {
+	Queue  string `json:"queue"`
+	JobID  string `json:"job_id"`
+	Live   string `json:"live"`
+	Replay string `json:"replay"`
+}
+
+// HeapCheck is the outcome of checking a queue's ready heap
+type HeapCheck struct {
+	Queue    string `json:"queue"`
+	Jobs     int    `json:"jobs"`
+	Problem  string `json:"problem,omitempty"`
+	Repaired bool   `json:"repaired"`
+}
+
+// SetRateLimit limits enqueues to a queue with a token bucket
+func (a *AdminClient) SetRateLimit(ctx context.Context, queue string, capacity, refillRate float64) error {
+	req := map[string]interface{}{
+		"capacity":    capacity,
+		"refill_rate": refillRate,
+	}
+	return a.do(ctx, "POST", fmt.Sprintf("/v1/queues/%s/rate_limit", queue), req, nil)
+}
+
+// ClearRateLimit removes a queue's rate limit
+func (a *AdminClient) ClearRateLimit(ctx context.Context, queue string) error {
+	return a.SetRateLimit(ctx, queue, 0, 0)
+}
+
+// GetRateLimit returns a queue's rate limit
+func (a *AdminClient) GetRateLimit(ctx context.Context, queue string) (*RateLimit, error) {
+	var resp RateLimit
+	if err := a.do(ctx, "GET", fmt.Sprintf("/v1/queues/%s/rate_limit", queue), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Peek returns up to n ready jobs without leasing them. Jobs are not in
+// lease order.
+func (a *AdminClient) Peek(ctx context.Context, queue string, n int) ([]*DumpedJob, error) {
+	return a.dumpJobs(ctx, queue, "ready", n)
+}
+
+// ListInflight returns the queue's leased jobs
+func (a *AdminClient) ListInflight(ctx context.Context, queue string) ([]*DumpedJob, error) {
+	return a.dumpJobs(ctx, queue, "inflight", 0)
+}
+
+// ListDLQ returns the queue's dead-lettered jobs
+func (a *AdminClient) ListDLQ(ctx context.Context, queue string) ([]*DumpedJob, error) {
+	return a.dumpJobs(ctx, queue, "dlq", 0)
+}
+
+// ListJobs returns up to limit of the queue's jobs in state (ready,
+// reserved, inflight or dlq), skipping the first offset, and the number of
+// jobs in that state in all. Ready jobs come by priority, then ETA, the
+// others in enqueue order. A zero limit uses the server's default page size. Without
+// includePayload the jobs come without their payloads.
+func (a *AdminClient) ListJobs(ctx context.Context, queue, state string, offset, limit int, includePayload bool) (*JobPage, error) {
+	params := url.Values{}
+	params.Set("state", state)
+	params.Set("offset", strconv.Itoa(offset))
+	if limit > 0 {
+		params.Set("limit", strconv.Itoa(limit))
+	}
+	if !includePayload {
+		params.Set("include_payload", "false")
+	}
+
+	var page JobPage
+	if err := a.do(ctx, "GET", fmt.Sprintf("/v1/queues/%s/jobs?%s", queue, params.Encode()), nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// ClearIdempotencyKey releases an idempotency key so it can be reused
+func (a *AdminClient) ClearIdempotencyKey(ctx context.Context, queue, key string) error {
+	path := fmt.Sprintf("/v1/queues/%s/idempotency/%s", queue, url.PathEscape(key))
+	return a.do(ctx, "DELETE", path, nil, nil)
+}
+
+// DeleteQueue deletes a queue and its jobs. The server refuses while jobs are
+// leased or reserved, with a 409 StatusError, unless force is set.
+func (a *AdminClient) DeleteQueue(ctx context.Context, queue string, force bool) error {
+	path := fmt.Sprintf("/v1/queues/%s", queue)
+	if force {
+		path += "?force=true"
+	}
+	return a.do(ctx, "DELETE", path, nil, nil)
+}
+
+// VerifyReplay asks the server to check that replaying its WAL reproduces the
+// live state, returning any divergences
+func (a *AdminClient) VerifyReplay(ctx context.Context) ([]ReplayDivergence, error) {
+	var resp struct {
+		OK          bool               `json:"ok"`
+		Divergences []ReplayDivergence `json:"divergences"`
+	}
+	if err := a.do(ctx, "POST", "/v1/admin/verify_replay", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Divergences, nil
+}
+
+// VerifyHeap asks the server to check a queue's ready heap, rebuilding it if
+// it is corrupt
+func (a *AdminClient) VerifyHeap(ctx context.Context, queue string) (*HeapCheck, error) {
+	var resp HeapCheck
+	if err := a.do(ctx, "POST", fmt.Sprintf("/v1/admin/queues/%s/verify_heap", queue), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// do performs an admin-scoped request
+func (a *AdminClient) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var header http.Header
+	if a.client.adminToken != "" {
+		header = http.Header{"Authorization": {"Bearer " + a.client.adminToken}}
+	}
+	return a.client.doRequestWithHeader(ctx, method, path, header, body, result)
+}
+
+// dumpJobs reads up to limit jobs in a state from the dump endpoint, or all
+// of them if limit is zero
+func (a *AdminClient) dumpJobs(ctx context.Context, queue, state string, limit int) ([]*DumpedJob, error) {
+	body, err := a.client.openDump(ctx, queue, state)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	jobs := []*DumpedJob{}
+	decoder := json.NewDecoder(body)
+	for limit <= 0 || len(jobs) < limit {
+		var job DumpedJob
+		if err := decoder.Decode(&job); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to decode dump: %w", err)
+		}
+		jobs = append(jobs, &job)
+	}
+
+	return jobs, nil
+}
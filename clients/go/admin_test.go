@@ -0,0 +1,207 @@
+package rivetq
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// recordedRequest is what the canned admin server saw
+type recordedRequest struct {
+	Method string
+	Path   string
+	Query  string
+	Auth   string
+	Body   map[string]interface{}
+}
+
+// newAdminServer serves canned responses by "METHOD path" and records requests
+func newAdminServer(t *testing.T, responses map[string]string) (*AdminClient, *[]recordedRequest) {
+	var requests []recordedRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := recordedRequest{
+			Method: r.Method,
+			Path:   r.URL.EscapedPath(),
+			Query:  r.URL.RawQuery,
+			Auth:   r.Header.Get("Authorization"),
+		}
+		if data, _ := io.ReadAll(r.Body); len(data) > 0 {
+			if err := json.Unmarshal(data, &rec.Body); err != nil {
+				t.Errorf("request body is not JSON: %v", err)
+			}
+		}
+		requests = append(requests, rec)
+
+		resp, ok := responses[r.Method+" "+r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(resp))
+	}))
+	t.Cleanup(server.Close)
+
+	client := NewClient(server.URL)
+	client.SetAdminToken("secret")
+	return client.Admin(), &requests
+}
+
+func TestAdminRateLimit(t *testing.T) {
+	admin, requests := newAdminServer(t, map[string]string{
+		"POST /v1/queues/emails/rate_limit": `{"success":true}`,
+		"GET /v1/queues/emails/rate_limit":  `{"capacity":100,"refill_rate":10,"exists":true}`,
+	})
+	ctx := context.Background()
+
+	if err := admin.SetRateLimit(ctx, "emails", 100, 10); err != nil {
+		t.Fatal(err)
+	}
+	limit, err := admin.GetRateLimit(ctx, "emails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.ClearRateLimit(ctx, "emails"); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := (RateLimit{Capacity: 100, RefillRate: 10, Exists: true}); *limit != want {
+		t.Errorf("GetRateLimit = %+v, want %+v", *limit, want)
+	}
+
+	want := []recordedRequest{
+		{Method: "POST", Path: "/v1/queues/emails/rate_limit", Auth: "Bearer secret", Body: map[string]interface{}{"capacity": 100.0, "refill_rate": 10.0}},
+		{Method: "GET", Path: "/v1/queues/emails/rate_limit", Auth: "Bearer secret"},
+		{Method: "POST", Path: "/v1/queues/emails/rate_limit", Auth: "Bearer secret", Body: map[string]interface{}{"capacity": 0.0, "refill_rate": 0.0}},
+	}
+	if !reflect.DeepEqual(*requests, want) {
+		t.Errorf("requests = %+v, want %+v", *requests, want)
+	}
+}
+
+func TestAdminPeekAndList(t *testing.T) {
+	admin, requests := newAdminServer(t, map[string]string{
+		"GET /v1/queues/emails/dump": `{"id":"a","state":"ready","payload":{},"priority":5}
+{"id":"b","state":"ready","payload":{},"priority":3}
+{"id":"c","state":"ready","payload":{},"priority":1}
+`,
+	})
+	ctx := context.Background()
+
+	jobs, err := admin.Peek(ctx, "emails", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].ID != "a" || jobs[1].ID != "b" || jobs[0].Priority != 5 {
+		t.Errorf("Peek returned %+v", jobs)
+	}
+
+	jobs, err = admin.ListInflight(ctx, "emails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 3 {
+		t.Errorf("ListInflight returned %d jobs, want 3", len(jobs))
+	}
+
+	if _, err := admin.ListDLQ(ctx, "emails"); err != nil {
+		t.Fatal(err)
+	}
+
+	var queries []string
+	for _, req := range *requests {
+		if req.Method != "GET" || req.Path != "/v1/queues/emails/dump" {
+			t.Errorf("unexpected request %s %s", req.Method, req.Path)
+		}
+		queries = append(queries, req.Query)
+	}
+	if want := []string{"state=ready", "state=inflight", "state=dlq"}; !reflect.DeepEqual(queries, want) {
+		t.Errorf("queries = %v, want %v", queries, want)
+	}
+}
+
+func TestAdminClearIdempotencyKey(t *testing.T) {
+	admin, requests := newAdminServer(t, map[string]string{
+		"DELETE /v1/queues/orders/idempotency/order/42": ``,
+	})
+
+	if err := admin.ClearIdempotencyKey(context.Background(), "orders", "order/42"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []recordedRequest{{Method: "DELETE", Path: "/v1/queues/orders/idempotency/order%2F42", Auth: "Bearer secret"}}
+	if !reflect.DeepEqual(*requests, want) {
+		t.Errorf("requests = %+v, want %+v", *requests, want)
+	}
+}
+
+func TestAdminDeleteQueue(t *testing.T) {
+	admin, requests := newAdminServer(t, map[string]string{
+		"DELETE /v1/queues/orders": ``,
+	})
+
+	if err := admin.DeleteQueue(context.Background(), "orders", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.DeleteQueue(context.Background(), "orders", true); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []recordedRequest{
+		{Method: "DELETE", Path: "/v1/queues/orders", Auth: "Bearer secret"},
+		{Method: "DELETE", Path: "/v1/queues/orders", Query: "force=true", Auth: "Bearer secret"},
+	}
+	if !reflect.DeepEqual(*requests, want) {
+		t.Errorf("requests = %+v, want %+v", *requests, want)
+	}
+}
+
+func TestAdminListJobs(t *testing.T) {
+	admin, requests := newAdminServer(t, map[string]string{
+		"GET /v1/queues/orders/jobs": `{"jobs":[{"id":"j3","queue":"orders","state":"dlq","priority":5}],"total":3,"offset":2,"limit":1}`,
+	})
+
+	page, err := admin.ListJobs(context.Background(), "orders", "dlq", 2, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 3 || len(page.Jobs) != 1 || page.Jobs[0].ID != "j3" || page.Jobs[0].Payload != nil {
+		t.Errorf("page = %+v", page)
+	}
+
+	want := []recordedRequest{{Method: "GET", Path: "/v1/queues/orders/jobs", Query: "include_payload=false&limit=1&offset=2&state=dlq", Auth: "Bearer secret"}}
+	if !reflect.DeepEqual(*requests, want) {
+		t.Errorf("requests = %+v, want %+v", *requests, want)
+	}
+}
+
+func TestAdminVerifyReplay(t *testing.T) {
+	admin, requests := newAdminServer(t, map[string]string{
+		"POST /v1/admin/verify_replay": `{"ok":false,"divergences":[{"queue":"q","job_id":"j","live":"ready","replay":""}]}`,
+	})
+
+	divergences, err := admin.VerifyReplay(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []ReplayDivergence{{Queue: "q", JobID: "j", Live: "ready"}}; !reflect.DeepEqual(divergences, want) {
+		t.Errorf("divergences = %+v, want %+v", divergences, want)
+	}
+	if len(*requests) != 1 || (*requests)[0].Auth != "Bearer secret" {
+		t.Errorf("requests = %+v", *requests)
+	}
+}
+
+func TestAdminStatusError(t *testing.T) {
+	admin, _ := newAdminServer(t, nil)
+
+	err := admin.ClearIdempotencyKey(context.Background(), "orders", "missing")
+	statusErr, ok := err.(*StatusError)
+	if !ok || statusErr.StatusCode != http.StatusNotFound {
+		t.Errorf("err = %v, want 404 StatusError", err)
+	}
+}
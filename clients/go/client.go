@@ -2,18 +2,43 @@ package rivetq
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 )
 
+// ErrLeaseExpired is returned by Ack, Nack and ExtendLease when the lease
+// timed out and the job was handed to another consumer. The ack should not
+// be retried, and work on the job should stop.
+var ErrLeaseExpired = errors.New("lease expired")
+
+// ErrIdempotencyConflict is returned by Enqueue when the server runs with
+// strict idempotency and the idempotency key already maps to a job created
+// with a different payload or headers. Enqueue returns that job's ID with it.
+var ErrIdempotencyConflict = errors.New("idempotency key reused with a different request")
+
+// StatusError is returned when the server responds with a non-2xx status
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server error (%d): %s", e.StatusCode, e.Body)
+}
+
 // Client is a RivetQ client
 type Client struct {
 	baseURL    string
 	httpClient *http.Client
+	adminToken string
 }
 
 // NewClient creates a new RivetQ client
@@ -35,6 +60,11 @@ type Job struct {
 	Priority uint8             `json:"priority"`
 	Tries    uint32            `json:"tries"`
 	LeaseID  string            `json:"lease_id"`
+
+	// FencingToken is set by single-active-consumer queues and increases
+	// with every lease; pass it to downstream systems to reject writes from
+	// a consumer that has been taken over
+	FencingToken uint64 `json:"fencing_token,omitempty"`
 }
 
 // EnqueueOptions for enqueuing jobs
@@ -44,6 +74,10 @@ type EnqueueOptions struct {
 	MaxRetries     uint32
 	IdempotencyKey string
 	Headers        map[string]string
+
+	// AckMode is "durable" (default) or "buffered". Buffered enqueues return
+	// before the server fsyncs the job and can lose it if the server crashes.
+	AckMode string
 }
 
 // Enqueue adds a job to a queue
@@ -75,19 +109,41 @@ func (c *Client) Enqueue(ctx context.Context, queue string, payload interface{},
 		req["headers"] = opts.Headers
 	}
 
+	if opts.AckMode != "" {
+		req["ack_mode"] = opts.AckMode
+	}
+
 	var resp struct {
 		JobID string `json:"job_id"`
 	}
 
 	if err := c.doRequest(ctx, "POST", fmt.Sprintf("/v1/queues/%s/enqueue", queue), req, &resp); err != nil {
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusConflict {
+			var conflict struct {
+				Error string `json:"error"`
+				JobID string `json:"job_id"`
+			}
+			if json.Unmarshal([]byte(statusErr.Body), &conflict) == nil && conflict.Error == "idempotency_conflict" {
+				return conflict.JobID, fmt.Errorf("%w: key maps to job %s", ErrIdempotencyConflict, conflict.JobID)
+			}
+		}
 		return "", err
 	}
 
 	return resp.JobID, nil
 }
 
-// Lease leases jobs from a queue
+// Lease leases jobs from a queue. An empty queue returns no jobs and no error.
 func (c *Client) Lease(ctx context.Context, queue string, maxJobs int, visibilityMs int64) ([]*Job, error) {
+	return c.LeaseWait(ctx, queue, maxJobs, visibilityMs, 0)
+}
+
+// LeaseWait is Lease, except that if no job is ready the server holds the
+// request for up to wait until one is, instead of answering straight away.
+// The server caps wait (30s by default), and wait must be shorter than the
+// HTTP client's timeout.
+func (c *Client) LeaseWait(ctx context.Context, queue string, maxJobs int, visibilityMs int64, wait time.Duration) ([]*Job, error) {
 	if maxJobs <= 0 {
 		maxJobs = 1
 	}
@@ -99,6 +155,9 @@ func (c *Client) Lease(ctx context.Context, queue string, maxJobs int, visibilit
 		"max_jobs":      maxJobs,
 		"visibility_ms": visibilityMs,
 	}
+	if wait > 0 {
+		req["wait_ms"] = wait.Milliseconds()
+	}
 
 	var resp struct {
 		Jobs []*Job `json:"jobs"`
@@ -121,6 +180,46 @@ func (c *Client) Ack(ctx context.Context, jobID, leaseID string) error {
 	return c.doRequest(ctx, "POST", "/v1/ack", req, nil)
 }
 
+// ExtendLease pushes the deadline of a job's lease additional further out,
+// for a job taking longer than the visibility timeout it was leased with.
+// Tries are not incremented. It returns ErrLeaseExpired if the lease already
+// expired: the job may have gone to another consumer, so stop working on it.
+func (c *Client) ExtendLease(ctx context.Context, jobID, leaseID string, additional time.Duration) error {
+	req := map[string]interface{}{
+		"job_id":        jobID,
+		"lease_id":      leaseID,
+		"additional_ms": additional.Milliseconds(),
+	}
+
+	return c.doRequest(ctx, "POST", "/v1/lease/extend", req, nil)
+}
+
+// AckAndLease acks a job, then leases the next job from queue in the same
+// request. It returns nil if no job is ready. The ack stands even if the
+// lease fails.
+func (c *Client) AckAndLease(ctx context.Context, jobID, leaseID, queue string, visibilityMs int64) (*Job, error) {
+	if visibilityMs <= 0 {
+		visibilityMs = 30000
+	}
+
+	req := map[string]interface{}{
+		"job_id":        jobID,
+		"lease_id":      leaseID,
+		"queue":         queue,
+		"visibility_ms": visibilityMs,
+	}
+
+	var resp struct {
+		Job *Job `json:"job"`
+	}
+
+	if err := c.doRequest(ctx, "POST", "/v1/ack_and_lease", req, &resp); err != nil {
+		return nil, err
+	}
+
+	return resp.Job, nil
+}
+
 // Nack negatively acknowledges a job
 func (c *Client) Nack(ctx context.Context, jobID, leaseID, reason string) error {
 	req := map[string]interface{}{
@@ -132,6 +231,155 @@ func (c *Client) Nack(ctx context.Context, jobID, leaseID, reason string) error
 	return c.doRequest(ctx, "POST", "/v1/nack", req, nil)
 }
 
+// NackPermanent negatively acknowledges a job that should not be retried,
+// sending it straight to the DLQ
+func (c *Client) NackPermanent(ctx context.Context, jobID, leaseID, reason string) error {
+	req := map[string]interface{}{
+		"job_id":    jobID,
+		"lease_id":  leaseID,
+		"reason":    reason,
+		"permanent": true,
+	}
+
+	return c.doRequest(ctx, "POST", "/v1/nack", req, nil)
+}
+
+// BatchJob is one job to enqueue with EnqueueBatch
+type BatchJob struct {
+	Payload interface{}
+	JobID   string          // Generated by the server if empty
+	Options *EnqueueOptions // Defaults as for Enqueue if nil; AckMode is ignored
+}
+
+// BatchError is returned by EnqueueBatch when a job of the batch conflicts
+// with an existing job. Nothing in the batch was enqueued.
+type BatchError struct {
+	Index  int    // Position of the job in the batch
+	Reason string // "idempotency_conflict" or "job_id_collision"
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("job %d: %s", e.Index, e.Reason)
+}
+
+// Unwrap returns ErrIdempotencyConflict for an idempotency conflict
+func (e *BatchError) Unwrap() error {
+	if e.Reason == "idempotency_conflict" {
+		return ErrIdempotencyConflict
+	}
+	return nil
+}
+
+// EnqueueBatch adds jobs to a queue in one request and returns their IDs in
+// order. The server enqueues all of them or, if one is invalid or
+// conflicts, none; a job deduped by its idempotency key or job ID gets the
+// existing job's ID.
+func (c *Client) EnqueueBatch(ctx context.Context, queue string, jobs []BatchJob) ([]string, error) {
+	items := make([]map[string]interface{}, len(jobs))
+	for i, job := range jobs {
+		opts := job.Options
+		if opts == nil {
+			opts = &EnqueueOptions{
+				Priority:   5,
+				MaxRetries: 3,
+			}
+		}
+
+		payloadBytes, err := json.Marshal(job.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal payload of job %d: %w", i, err)
+		}
+
+		item := map[string]interface{}{
+			"payload":     json.RawMessage(payloadBytes),
+			"priority":    opts.Priority,
+			"delay_ms":    opts.DelayMs,
+			"max_retries": opts.MaxRetries,
+		}
+		if job.JobID != "" {
+			item["job_id"] = job.JobID
+		}
+		if opts.IdempotencyKey != "" {
+			item["idempotency_key"] = opts.IdempotencyKey
+		}
+		if opts.Headers != nil {
+			item["headers"] = opts.Headers
+		}
+		items[i] = item
+	}
+
+	req := map[string]interface{}{
+		"jobs": items,
+	}
+
+	var resp struct {
+		JobIDs []string `json:"job_ids"`
+	}
+
+	if err := c.doRequest(ctx, "POST", fmt.Sprintf("/v1/queues/%s/enqueue_batch", queue), req, &resp); err != nil {
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusConflict {
+			var conflict struct {
+				Error string `json:"error"`
+				Index int    `json:"index"`
+			}
+			if json.Unmarshal([]byte(statusErr.Body), &conflict) == nil && conflict.Error != "" {
+				return nil, &BatchError{Index: conflict.Index, Reason: conflict.Error}
+			}
+		}
+		return nil, err
+	}
+
+	return resp.JobIDs, nil
+}
+
+// Settlement is one job to settle with AckBatch: an ack, or a nack if Nack
+// is set. A Permanent nack sends the job straight to the DLQ.
+type Settlement struct {
+	JobID     string `json:"job_id"`
+	LeaseID   string `json:"lease_id"`
+	Nack      bool   `json:"nack,omitempty"`
+	Permanent bool   `json:"permanent,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// SettlementResult is the outcome of one settlement
+type SettlementResult struct {
+	JobID   string `json:"job_id"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Err returns the settlement's error, ErrLeaseExpired if the lease timed out
+func (r SettlementResult) Err() error {
+	switch {
+	case r.Success:
+		return nil
+	case r.Error == "lease_expired":
+		return ErrLeaseExpired
+	default:
+		return errors.New(r.Error)
+	}
+}
+
+// AckBatch acks and nacks several jobs in one request. Results are in the
+// order of items; one item failing does not stop the others.
+func (c *Client) AckBatch(ctx context.Context, items []Settlement) ([]SettlementResult, error) {
+	req := map[string]interface{}{
+		"items": items,
+	}
+
+	var resp struct {
+		Results []SettlementResult `json:"results"`
+	}
+
+	if err := c.doRequest(ctx, "POST", "/v1/ack/batch", req, &resp); err != nil {
+		return nil, err
+	}
+
+	return resp.Results, nil
+}
+
 // Stats returns queue statistics
 func (c *Client) Stats(ctx context.Context, queue string) (ready, inflight, dlq int, err error) {
 	var resp struct {
@@ -147,6 +395,39 @@ func (c *Client) Stats(ctx context.Context, queue string) (ready, inflight, dlq
 	return resp.Ready, resp.Inflight, resp.DLQ, nil
 }
 
+// DLQJob is a dead-lettered job with the context of its failure
+type DLQJob struct {
+	ID         string            `json:"id"`
+	Queue      string            `json:"queue"`
+	Payload    json.RawMessage   `json:"payload"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Priority   uint8             `json:"priority"`
+	Tries      uint32            `json:"tries"`
+	MaxRetries uint32            `json:"max_retries"`
+	EnqueuedAt time.Time         `json:"enqueued_at"`
+	DLQReason  string            `json:"dlq_reason,omitempty"`
+	DLQAt      time.Time         `json:"dlq_at"`
+	History    []Attempt         `json:"history"` // Oldest first
+}
+
+// Attempt is one failed attempt of a job
+type Attempt struct {
+	At      int64  `json:"at"` // Unix milliseconds
+	Tries   uint32 `json:"tries"`
+	Reason  string `json:"reason,omitempty"`
+	RetryAt int64  `json:"retry_at,omitempty"` // Unix milliseconds, 0 if not retried
+}
+
+// GetDLQJob returns a job in a queue's DLQ with its failed attempts. A job
+// not in the DLQ yields a *StatusError with status 404.
+func (c *Client) GetDLQJob(ctx context.Context, queue, jobID string) (*DLQJob, error) {
+	var job DLQJob
+	if err := c.doRequest(ctx, "GET", fmt.Sprintf("/v1/queues/%s/dlq/%s", queue, url.PathEscape(jobID)), nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
 // ListQueues returns all queue names
 func (c *Client) ListQueues(ctx context.Context) ([]string, error) {
 	var resp struct {
@@ -160,8 +441,92 @@ func (c *Client) ListQueues(ctx context.Context) ([]string, error) {
 	return resp.Queues, nil
 }
 
+// Dump streams a queue's jobs as newline-delimited JSON to w. State is one of
+// "ready", "reserved", "inflight", "dlq" or "all" (empty means all).
+func (c *Client) Dump(ctx context.Context, queue, state string, w io.Writer) error {
+	body, err := c.openDump(ctx, queue, state)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if _, err := io.Copy(w, body); err != nil {
+		return fmt.Errorf("failed to read dump: %w", err)
+	}
+
+	return nil
+}
+
+// openDump starts a dump request and returns the response body
+func (c *Client) openDump(ctx context.Context, queue, state string) (io.ReadCloser, error) {
+	path := fmt.Sprintf("/v1/queues/%s/dump", queue)
+	if state != "" {
+		path += "?state=" + url.QueryEscape(state)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	// The dump may be large, so don't apply the client-wide timeout
+	httpClient := *c.httpClient
+	httpClient.Timeout = 0
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+
+	body, err := decodeBody(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer body.Close()
+		respBody, _ := io.ReadAll(body)
+		return nil, &StatusError{StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+
+	return body, nil
+}
+
+// gzipBody decompresses a gzipped response body, closing both on Close
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b *gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// decodeBody returns the response body, decompressed if the server gzipped
+// it. Requests set Accept-Encoding themselves, so the transport leaves the
+// decompression to the client.
+func decodeBody(resp *http.Response) (io.ReadCloser, error) {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return resp.Body, nil
+	}
+	reader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress response: %w", err)
+	}
+	return &gzipBody{Reader: reader, body: resp.Body}, nil
+}
+
 // doRequest performs an HTTP request
 func (c *Client) doRequest(ctx context.Context, method, path string, body, result interface{}) error {
+	return c.doRequestWithHeader(ctx, method, path, nil, body, result)
+}
+
+// doRequestWithHeader performs an HTTP request with extra headers
+func (c *Client) doRequestWithHeader(ctx context.Context, method, path string, header http.Header, body, result interface{}) error {
 	var bodyReader io.Reader
 	if body != nil {
 		data, err := json.Marshal(body)
@@ -179,6 +544,10 @@ func (c *Client) doRequest(ctx context.Context, method, path string, body, resul
 	if body != nil {
 		req.Header.Set("Content-Type", "application/json")
 	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	for key, values := range header {
+		req.Header[key] = values
+	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
@@ -186,13 +555,26 @@ func (c *Client) doRequest(ctx context.Context, method, path string, body, resul
 	}
 	defer resp.Body.Close()
 
-	respBody, err := io.ReadAll(resp.Body)
+	decoded, err := decodeBody(resp)
+	if err != nil {
+		return err
+	}
+	defer decoded.Close()
+
+	respBody, err := io.ReadAll(decoded)
 	if err != nil {
 		return fmt.Errorf("failed to read response: %w", err)
 	}
 
-	if resp.StatusCode >= 400 {
-		return fmt.Errorf("server error (%d): %s", resp.StatusCode, string(respBody))
+	// Redirects only surface here if the HTTP client was set not to follow them
+	if resp.StatusCode >= 300 {
+		var errResp struct {
+			Error string `json:"error"`
+		}
+		if resp.StatusCode == http.StatusConflict && json.Unmarshal(respBody, &errResp) == nil && errResp.Error == "lease_expired" {
+			return ErrLeaseExpired
+		}
+		return &StatusError{StatusCode: resp.StatusCode, Body: string(respBody)}
 	}
 
 	if result != nil && len(respBody) > 0 {
@@ -0,0 +1,81 @@
+package rivetq
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientDecompressesResponses(t *testing.T) {
+	responses := map[string]string{
+		"/v1/queues/big/lease": `{"jobs":[{"id":"job-1","queue":"big","payload":{"n":1},"lease_id":"lease-1"}]}`,
+		"/v1/queues/big/dump":  "{\"id\":\"job-1\"}\n{\"id\":\"job-2\"}\n",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Accept-Encoding"); got != "gzip" {
+			t.Errorf("Accept-Encoding = %q, want gzip", got)
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(responses[r.URL.Path]))
+		gz.Close()
+	}))
+	t.Cleanup(server.Close)
+
+	client := NewClient(server.URL)
+	ctx := context.Background()
+
+	jobs, err := client.Lease(ctx, "big", 1, 30000)
+	if err != nil {
+		t.Fatalf("Lease: %v", err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != "job-1" || string(jobs[0].Payload) != `{"n":1}` {
+		t.Fatalf("Lease = %+v", jobs)
+	}
+
+	var dump bytes.Buffer
+	if err := client.Dump(ctx, "big", "", &dump); err != nil {
+		t.Fatalf("Dump: %v", err)
+	}
+	if dump.String() != responses["/v1/queues/big/dump"] {
+		t.Fatalf("Dump = %q", dump.String())
+	}
+}
+
+func TestClientExtendLease(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			JobID        string `json:"job_id"`
+			LeaseID      string `json:"lease_id"`
+			AdditionalMs int64  `json:"additional_ms"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.URL.Path != "/v1/lease/extend" || req.JobID != "job-1" || req.AdditionalMs != 60000 {
+			t.Errorf("got %s %+v", r.URL.Path, req)
+		}
+
+		if req.LeaseID != "lease-1" {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error":"lease_expired"}`))
+			return
+		}
+		w.Write([]byte(`{"success":true}`))
+	}))
+	t.Cleanup(server.Close)
+
+	client := NewClient(server.URL)
+	ctx := context.Background()
+
+	if err := client.ExtendLease(ctx, "job-1", "lease-1", time.Minute); err != nil {
+		t.Fatalf("ExtendLease: %v", err)
+	}
+	if err := client.ExtendLease(ctx, "job-1", "lease-0", time.Minute); !errors.Is(err, ErrLeaseExpired) {
+		t.Fatalf("ExtendLease with an expired lease = %v, want ErrLeaseExpired", err)
+	}
+}
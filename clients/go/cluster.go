@@ -0,0 +1,323 @@
+package rivetq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoLeader is returned when none of the known nodes reports a leader
+var ErrNoLeader = errors.New("no cluster leader found")
+
+// ClusterClient is a RivetQ client for clustered deployments. It discovers the
+// leader from a list of seed addresses via /v1/cluster/info, caches it, and
+// re-discovers it when a request fails in a way that suggests leadership
+// moved (connection errors, redirects, 502/503). Writes always go to the
+// leader; reads go to the leader unless SetReadFromAny is enabled.
+//
+// Reads are retried on the re-discovered leader. Writes are retried only if
+// the first attempt cannot have been applied: the connection was refused, or
+// the node answered with a redirect or 503. A write that timed out or lost
+// its connection may have committed, so it is returned to the caller rather
+// than enqueued twice or leased again.
+type ClusterClient struct {
+	seeds      []string
+	httpClient *http.Client
+
+	mu          sync.RWMutex
+	leader      *Client
+	members     []*Client
+	readFromAny bool
+	nextRead    atomic.Uint64
+}
+
+// clusterMember mirrors the fields of a member in /v1/cluster/info
+type clusterMember struct {
+	ID       string `json:"id"`
+	Addr     string `json:"addr"`
+	Status   string `json:"status"`
+	IsLeader bool   `json:"is_leader"`
+}
+
+// NewClusterClient creates a client that finds the leader through seeds,
+// which are base URLs such as "http://10.0.0.1:8080"
+func NewClusterClient(seeds []string) *ClusterClient {
+	return &ClusterClient{
+		seeds: seeds,
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+			// A redirect means we are talking to the wrong node; surface it
+			// so the leader gets re-discovered instead of following blindly
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// SetReadFromAny lets reads (Stats, ListQueues) go to any alive member
+// instead of the leader, trading freshness for load spreading
+func (c *ClusterClient) SetReadFromAny(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readFromAny = enabled
+}
+
+// Leader returns the cached leader's base URL, discovering it if needed
+func (c *ClusterClient) Leader(ctx context.Context) (string, error) {
+	leader, err := c.leaderClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	return leader.baseURL, nil
+}
+
+// Enqueue adds a job to a queue via the leader
+func (c *ClusterClient) Enqueue(ctx context.Context, queue string, payload interface{}, opts *EnqueueOptions) (string, error) {
+	var jobID string
+	err := c.write(ctx, func(client *Client) error {
+		var err error
+		jobID, err = client.Enqueue(ctx, queue, payload, opts)
+		return err
+	})
+	return jobID, err
+}
+
+// Lease leases jobs from a queue via the leader
+func (c *ClusterClient) Lease(ctx context.Context, queue string, maxJobs int, visibilityMs int64) ([]*Job, error) {
+	var jobs []*Job
+	err := c.write(ctx, func(client *Client) error {
+		var err error
+		jobs, err = client.Lease(ctx, queue, maxJobs, visibilityMs)
+		return err
+	})
+	return jobs, err
+}
+
+// Ack acknowledges job completion via the leader
+func (c *ClusterClient) Ack(ctx context.Context, jobID, leaseID string) error {
+	return c.write(ctx, func(client *Client) error {
+		return client.Ack(ctx, jobID, leaseID)
+	})
+}
+
+// Nack negatively acknowledges a job via the leader
+func (c *ClusterClient) Nack(ctx context.Context, jobID, leaseID, reason string) error {
+	return c.write(ctx, func(client *Client) error {
+		return client.Nack(ctx, jobID, leaseID, reason)
+	})
+}
+
+// Stats returns queue statistics
+func (c *ClusterClient) Stats(ctx context.Context, queue string) (ready, inflight, dlq int, err error) {
+	err = c.read(ctx, func(client *Client) error {
+		var err error
+		ready, inflight, dlq, err = client.Stats(ctx, queue)
+		return err
+	})
+	return ready, inflight, dlq, err
+}
+
+// ListQueues returns all queue names
+func (c *ClusterClient) ListQueues(ctx context.Context) ([]string, error) {
+	var queues []string
+	err := c.read(ctx, func(client *Client) error {
+		var err error
+		queues, err = client.ListQueues(ctx)
+		return err
+	})
+	return queues, err
+}
+
+// write runs fn against the leader, re-discovering it if the failure suggests
+// leadership moved and retrying once if the first attempt was not applied
+func (c *ClusterClient) write(ctx context.Context, fn func(*Client) error) error {
+	return c.onLeader(ctx, fn, notApplied)
+}
+
+// onLeader runs fn against the leader, re-discovering it if the failure
+// suggests leadership moved and retrying once if retry(err) allows
+func (c *ClusterClient) onLeader(ctx context.Context, fn func(*Client) error, retry func(error) bool) error {
+	leader, err := c.leaderClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = fn(leader)
+	if err == nil || !shouldRediscover(err) {
+		return err
+	}
+
+	c.invalidate(leader)
+	if !retry(err) {
+		return err
+	}
+	leader, err = c.leaderClient(ctx)
+	if err != nil {
+		return err
+	}
+	return fn(leader)
+}
+
+// read runs fn against any member if allowed, falling back to the leader
+func (c *ClusterClient) read(ctx context.Context, fn func(*Client) error) error {
+	c.mu.RLock()
+	readFromAny := c.readFromAny
+	members := c.members
+	c.mu.RUnlock()
+
+	if readFromAny && len(members) > 0 {
+		member := members[c.nextRead.Add(1)%uint64(len(members))]
+		if err := fn(member); err == nil || !shouldRediscover(err) {
+			return err
+		}
+	}
+
+	return c.onLeader(ctx, fn, shouldRediscover)
+}
+
+// leaderClient returns the cached leader or discovers it
+func (c *ClusterClient) leaderClient(ctx context.Context) (*Client, error) {
+	c.mu.RLock()
+	leader := c.leader
+	c.mu.RUnlock()
+
+	if leader != nil {
+		return leader, nil
+	}
+	return c.discover(ctx)
+}
+
+// invalidate drops the cached leader if it is still stale
+func (c *ClusterClient) invalidate(stale *Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.leader == stale {
+		c.leader = nil
+	}
+}
+
+// discover asks the known members, then the seeds, for the current leader
+func (c *ClusterClient) discover(ctx context.Context) (*Client, error) {
+	c.mu.RLock()
+	candidates := make([]string, 0, len(c.members)+len(c.seeds))
+	for _, member := range c.members {
+		candidates = append(candidates, member.baseURL)
+	}
+	c.mu.RUnlock()
+	candidates = append(candidates, c.seeds...)
+
+	var lastErr error = ErrNoLeader
+	for _, addr := range candidates {
+		members, err := c.fetchMembers(ctx, addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		var leader *Client
+		alive := make([]*Client, 0, len(members))
+		for _, member := range members {
+			if member.Status != "" && member.Status != "alive" {
+				continue
+			}
+			client := c.nodeClient(member.Addr)
+			alive = append(alive, client)
+			if member.IsLeader {
+				leader = client
+			}
+		}
+		if leader == nil {
+			continue
+		}
+
+		c.mu.Lock()
+		c.leader = leader
+		c.members = alive
+		c.mu.Unlock()
+		return leader, nil
+	}
+
+	return nil, fmt.Errorf("failed to discover leader: %w", lastErr)
+}
+
+// fetchMembers reads the member list from one node
+func (c *ClusterClient) fetchMembers(ctx context.Context, addr string) ([]clusterMember, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimRight(addr, "/")+"/v1/cluster/info", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var info struct {
+		Members []clusterMember `json:"members"`
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cluster info: %w", err)
+	}
+	return info.Members, nil
+}
+
+// nodeClient builds a Client for a member address, which may lack a scheme
+func (c *ClusterClient) nodeClient(addr string) *Client {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &Client{
+		baseURL:    strings.TrimRight(addr, "/"),
+		httpClient: c.httpClient,
+	}
+}
+
+// shouldRediscover reports whether err suggests the node is not (or no
+// longer) the leader, as opposed to a problem with the request itself
+func shouldRediscover(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		code := statusErr.StatusCode
+		return (code >= 300 && code < 400) || code == http.StatusBadGateway || code == http.StatusServiceUnavailable
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	// Transport failures (connection refused, reset, ...) come back as *url.Error
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// notApplied reports whether err shows a request was not applied: the
+// connection was refused before anything was sent, or the node answered with
+// a redirect or 503, which it sends instead of handling the request
+func notApplied(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		code := statusErr.StatusCode
+		return (code >= 300 && code < 400) || code == http.StatusServiceUnavailable
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
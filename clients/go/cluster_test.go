@@ -0,0 +1,141 @@
+package rivetq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// stubCluster serves /v1/cluster/info and enqueue from two fake nodes, only
+// the current leader accepting writes
+type stubCluster struct {
+	nodes       [2]*httptest.Server
+	leader      atomic.Int32
+	infoQueries atomic.Int32
+
+	// The leader drops the connection after taking an enqueue
+	enqueues  atomic.Int32
+	dropReply atomic.Bool
+}
+
+func newStubCluster(t *testing.T) *stubCluster {
+	sc := &stubCluster{}
+	for i := range sc.nodes {
+		i := i
+		mux := http.NewServeMux()
+		mux.HandleFunc("/v1/cluster/info", func(w http.ResponseWriter, r *http.Request) {
+			sc.infoQueries.Add(1)
+			members := make([]map[string]interface{}, len(sc.nodes))
+			for j, node := range sc.nodes {
+				members[j] = map[string]interface{}{
+					"id":        fmt.Sprintf("node%d", j),
+					"addr":      node.URL,
+					"status":    "alive",
+					"is_leader": int32(j) == sc.leader.Load(),
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"members": members})
+		})
+		mux.HandleFunc("/v1/queues/q/enqueue", func(w http.ResponseWriter, r *http.Request) {
+			if int32(i) != sc.leader.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(`{"error":"not the leader"}`))
+				return
+			}
+			sc.enqueues.Add(1)
+			if sc.dropReply.Load() {
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err == nil {
+					conn.Close()
+				}
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"job_id": fmt.Sprintf("node%d-job", i)})
+		})
+		sc.nodes[i] = httptest.NewServer(mux)
+		t.Cleanup(sc.nodes[i].Close)
+	}
+	return sc
+}
+
+func TestClusterClientRediscoversLeader(t *testing.T) {
+	sc := newStubCluster(t)
+	ctx := context.Background()
+
+	// Seed with the follower only; the client must find node0 through it
+	sc.leader.Store(0)
+	client := NewClusterClient([]string{sc.nodes[1].URL})
+
+	jobID, err := client.Enqueue(ctx, "q", map[string]string{"a": "b"}, nil)
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	if jobID != "node0-job" {
+		t.Fatalf("expected write to reach node0, got %q", jobID)
+	}
+
+	// The leader is cached
+	if _, err := client.Enqueue(ctx, "q", nil, nil); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	if n := sc.infoQueries.Load(); n != 1 {
+		t.Fatalf("expected 1 discovery query, got %d", n)
+	}
+
+	// Leadership moves mid-run
+	sc.leader.Store(1)
+
+	jobID, err = client.Enqueue(ctx, "q", nil, nil)
+	if err != nil {
+		t.Fatalf("enqueue after failover: %v", err)
+	}
+	if jobID != "node1-job" {
+		t.Fatalf("expected write to reach new leader node1, got %q", jobID)
+	}
+
+	leader, err := client.Leader(ctx)
+	if err != nil {
+		t.Fatalf("leader: %v", err)
+	}
+	if leader != sc.nodes[1].URL {
+		t.Fatalf("expected cached leader %s, got %s", sc.nodes[1].URL, leader)
+	}
+}
+
+func TestClusterClientWriteRetries(t *testing.T) {
+	sc := newStubCluster(t)
+	ctx := context.Background()
+	sc.leader.Store(0)
+
+	// A refused connection cannot have applied the write, so it is retried
+	// on the re-discovered leader
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	client := NewClusterClient([]string{sc.nodes[0].URL})
+	client.mu.Lock()
+	client.leader = client.nodeClient(down.URL)
+	client.mu.Unlock()
+
+	jobID, err := client.Enqueue(ctx, "q", nil, nil)
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	if jobID != "node0-job" {
+		t.Fatalf("expected write to reach node0, got %q", jobID)
+	}
+
+	// A connection lost after the leader took the write may have committed
+	// it, so it is not sent again
+	sc.enqueues.Store(0)
+	sc.dropReply.Store(true)
+	if _, err := client.Enqueue(ctx, "q", nil, nil); err == nil {
+		t.Fatal("expected the dropped connection to fail the enqueue")
+	}
+	if n := sc.enqueues.Load(); n != 1 {
+		t.Fatalf("expected 1 enqueue attempt, got %d", n)
+	}
+}
@@ -0,0 +1,304 @@
+package rivetq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Handler processes a leased job. Returning nil acks the job; returning an
+// error nacks it with the error message as the reason. Wrap the error with
+// Permanent to dead-letter the job instead of retrying it.
+type Handler func(ctx context.Context, job *Job) error
+
+// PermanentError marks a handler failure that retrying cannot fix
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent wraps err so the consumer dead-letters the job instead of
+// retrying it. Permanent(nil) is nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// ConsumerOptions configure a Consumer. Zero values use the defaults.
+type ConsumerOptions struct {
+	Prefetch     int           // Jobs leased per request (default 10)
+	Concurrency  int           // Handlers running at once (default 1)
+	VisibilityMs int64         // Lease visibility timeout (default 30000)
+	PollInterval time.Duration // Wait after an empty or failed lease (default 1s)
+
+	// LeaseWait has the server hold each lease for up to this long until a
+	// job is ready, so an idle consumer picks up new jobs at once instead of
+	// after PollInterval. It must be shorter than the client's HTTP timeout.
+	// Zero polls.
+	LeaseWait time.Duration
+
+	// AckBatchSize batches acks and nacks: they are sent together through
+	// AckBatch once this many are pending or AckBatchWindow after the first
+	// one, whichever comes first. Zero or one settles each job with its own
+	// request.
+	AckBatchSize   int
+	AckBatchWindow time.Duration // Default 100ms
+
+	// DeadLetterQueue, if set, receives a copy of every job whose handler
+	// returned a Permanent error, with the same payload and headers, so a
+	// separate consumer can deal with them
+	DeadLetterQueue string
+
+	// OnError is called with lease and settlement failures; nil ignores them
+	OnError func(err error)
+}
+
+// Consumer leases jobs from a queue and runs a handler for each
+type Consumer struct {
+	client  *Client
+	queue   string
+	handler Handler
+	opts    ConsumerOptions
+}
+
+// NewConsumer creates a consumer for queue. Call Run to start it.
+func (c *Client) NewConsumer(queue string, handler Handler, opts *ConsumerOptions) *Consumer {
+	var o ConsumerOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Prefetch <= 0 {
+		o.Prefetch = 10
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = 1
+	}
+	if o.VisibilityMs <= 0 {
+		o.VisibilityMs = 30000
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = time.Second
+	}
+	if o.AckBatchWindow <= 0 {
+		o.AckBatchWindow = 100 * time.Millisecond
+	}
+
+	return &Consumer{
+		client:  c,
+		queue:   queue,
+		handler: handler,
+		opts:    o,
+	}
+}
+
+// Run leases and handles jobs until ctx is canceled, then drains: it stops
+// leasing, lets already leased jobs finish and flushes pending acks before
+// returning. Handlers get a context that ctx's cancellation does not reach,
+// so a job in progress is not abandoned half-way.
+//
+// With ack batching, a crash before pending acks are flushed leaves those
+// jobs leased; they are redelivered once their visibility timeout passes.
+// Batching is therefore safe under at-least-once delivery, at the cost of
+// possible duplicates.
+func (c *Consumer) Run(ctx context.Context) error {
+	var acks *ackBatcher
+	if c.opts.AckBatchSize > 1 {
+		acks = &ackBatcher{
+			client:  c.client,
+			size:    c.opts.AckBatchSize,
+			window:  c.opts.AckBatchWindow,
+			onError: c.reportError,
+		}
+	}
+
+	handlerCtx := context.WithoutCancel(ctx)
+	slots := make(chan struct{}, c.opts.Concurrency)
+	var wg sync.WaitGroup
+
+	for ctx.Err() == nil {
+		start := time.Now()
+		jobs, err := c.client.LeaseWait(ctx, c.queue, c.opts.Prefetch, c.opts.VisibilityMs, c.opts.LeaseWait)
+		if err != nil && ctx.Err() == nil {
+			c.reportError(fmt.Errorf("failed to lease from %s: %w", c.queue, err))
+		}
+		// A lease that waited its full time has already spent the time a poll
+		// would sleep. One that came back early found the queue paused.
+		if len(jobs) == 0 && (err != nil || time.Since(start) < c.opts.LeaseWait || c.opts.LeaseWait <= 0) {
+			sleepContext(ctx, c.opts.PollInterval)
+			continue
+		}
+		if len(jobs) == 0 {
+			continue
+		}
+
+		// Leased jobs are handled even if ctx is canceled meanwhile, so they
+		// are settled instead of waiting out their lease
+		for _, job := range jobs {
+			slots <- struct{}{}
+			wg.Add(1)
+			go func(job *Job) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				c.settle(handlerCtx, acks, job, c.handler(handlerCtx, job))
+			}(job)
+		}
+	}
+
+	wg.Wait()
+	if acks != nil {
+		acks.close()
+	}
+	return nil
+}
+
+// settle acks or nacks a handled job, through the batcher if there is one
+func (c *Consumer) settle(ctx context.Context, acks *ackBatcher, job *Job, handlerErr error) {
+	s := Settlement{JobID: job.ID, LeaseID: job.LeaseID}
+	if handlerErr != nil {
+		s.Nack = true
+		s.Reason = handlerErr.Error()
+
+		var permanent *PermanentError
+		if errors.As(handlerErr, &permanent) {
+			s.Permanent = true
+			c.republish(ctx, job)
+		}
+	}
+
+	if acks != nil {
+		acks.add(s)
+		return
+	}
+
+	var err error
+	if s.Permanent {
+		err = c.client.NackPermanent(ctx, s.JobID, s.LeaseID, s.Reason)
+	} else if s.Nack {
+		err = c.client.Nack(ctx, s.JobID, s.LeaseID, s.Reason)
+	} else {
+		err = c.client.Ack(ctx, s.JobID, s.LeaseID)
+	}
+	if err != nil {
+		c.reportError(fmt.Errorf("failed to settle job %s: %w", s.JobID, err))
+	}
+}
+
+// republish copies a permanently failed job to DeadLetterQueue if set. It
+// runs before the nack, so a crash in between can at worst duplicate the
+// copy, never lose it.
+func (c *Consumer) republish(ctx context.Context, job *Job) {
+	if c.opts.DeadLetterQueue == "" {
+		return
+	}
+
+	opts := &EnqueueOptions{Priority: job.Priority, Headers: job.Headers}
+	if _, err := c.client.Enqueue(ctx, c.opts.DeadLetterQueue, job.Payload, opts); err != nil {
+		c.reportError(fmt.Errorf("failed to republish job %s to %s: %w", job.ID, c.opts.DeadLetterQueue, err))
+	}
+}
+
+// reportError passes err to OnError if set
+func (c *Consumer) reportError(err error) {
+	if c.opts.OnError != nil {
+		c.opts.OnError(err)
+	}
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// ackBatcher collects settlements and sends them through AckBatch when the
+// batch is full or its window has passed
+type ackBatcher struct {
+	client  *Client
+	size    int
+	window  time.Duration
+	onError func(err error)
+
+	mu      sync.Mutex
+	pending []Settlement
+	timer   *time.Timer
+	sends   sync.WaitGroup
+}
+
+// add queues a settlement, sending the batch if it is full
+func (b *ackBatcher) add(s Settlement) {
+	b.mu.Lock()
+	b.pending = append(b.pending, s)
+	var batch []Settlement
+	if len(b.pending) >= b.size {
+		batch = b.take()
+	} else if len(b.pending) == 1 {
+		b.timer = time.AfterFunc(b.window, b.flush)
+	}
+	b.mu.Unlock()
+
+	b.send(batch)
+}
+
+// flush sends whatever is pending
+func (b *ackBatcher) flush() {
+	b.mu.Lock()
+	batch := b.take()
+	b.mu.Unlock()
+
+	b.send(batch)
+}
+
+// take removes the pending batch and registers its send. Must be called
+// with b.mu held.
+func (b *ackBatcher) take() []Settlement {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	batch := b.pending
+	b.pending = nil
+	if len(batch) > 0 {
+		b.sends.Add(1)
+	}
+	return batch
+}
+
+// send settles a batch taken with take
+func (b *ackBatcher) send(batch []Settlement) {
+	if len(batch) == 0 {
+		return
+	}
+	defer b.sends.Done()
+
+	results, err := b.client.AckBatch(context.Background(), batch)
+	if err != nil {
+		b.onError(fmt.Errorf("failed to settle batch of %d jobs: %w", len(batch), err))
+		return
+	}
+	for _, result := range results {
+		if err := result.Err(); err != nil {
+			b.onError(fmt.Errorf("failed to settle job %s: %w", result.JobID, err))
+		}
+	}
+}
+
+// close flushes pending settlements and waits for all sends to finish
+func (b *ackBatcher) close() {
+	b.flush()
+	b.sends.Wait()
+}
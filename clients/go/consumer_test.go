@@ -0,0 +1,281 @@
+package rivetq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubQueue hands out a fixed set of jobs and records how they are settled
+type stubQueue struct {
+	mu         sync.Mutex
+	ready      []*Job
+	acked      map[string]bool
+	nacked     map[string]Settlement
+	enqueued   []string
+	ackCalls   int
+	batchCalls int
+	waitMs     int64 // wait_ms of the last lease
+}
+
+func newStubQueue(t *testing.T, jobs int) (*stubQueue, *Client) {
+	sq := &stubQueue{acked: make(map[string]bool), nacked: make(map[string]Settlement)}
+	for i := 0; i < jobs; i++ {
+		sq.ready = append(sq.ready, &Job{ID: fmt.Sprintf("job-%d", i), Queue: "q", LeaseID: fmt.Sprintf("lease-%d", i)})
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/queues/q/lease", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			MaxJobs int   `json:"max_jobs"`
+			WaitMs  int64 `json:"wait_ms"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		sq.mu.Lock()
+		sq.waitMs = req.WaitMs
+		n := min(req.MaxJobs, len(sq.ready))
+		jobs := sq.ready[:n]
+		sq.ready = sq.ready[n:]
+		sq.mu.Unlock()
+
+		// Like the server, an empty lease waits out wait_ms
+		if n == 0 && req.WaitMs > 0 {
+			time.Sleep(time.Duration(req.WaitMs) * time.Millisecond)
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"jobs": jobs})
+	})
+	mux.HandleFunc("/v1/ack", func(w http.ResponseWriter, r *http.Request) {
+		var req Settlement
+		json.NewDecoder(r.Body).Decode(&req)
+
+		sq.mu.Lock()
+		sq.ackCalls++
+		sq.acked[req.JobID] = true
+		sq.mu.Unlock()
+
+		w.Write([]byte(`{"success":true}`))
+	})
+	mux.HandleFunc("/v1/nack", func(w http.ResponseWriter, r *http.Request) {
+		var req Settlement
+		json.NewDecoder(r.Body).Decode(&req)
+
+		sq.mu.Lock()
+		sq.nacked[req.JobID] = req
+		sq.mu.Unlock()
+
+		w.Write([]byte(`{"success":true}`))
+	})
+	mux.HandleFunc("/v1/queues/dead/enqueue", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Payload json.RawMessage `json:"payload"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		sq.mu.Lock()
+		sq.enqueued = append(sq.enqueued, string(req.Payload))
+		sq.mu.Unlock()
+
+		w.Write([]byte(`{"job_id":"dead-1"}`))
+	})
+	mux.HandleFunc("/v1/ack/batch", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Items []Settlement `json:"items"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		sq.mu.Lock()
+		sq.batchCalls++
+		results := make([]SettlementResult, len(req.Items))
+		for i, item := range req.Items {
+			sq.acked[item.JobID] = !item.Nack
+			results[i] = SettlementResult{JobID: item.JobID, Success: true}
+		}
+		sq.mu.Unlock()
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return sq, NewClient(server.URL)
+}
+
+// counts returns the number of acked jobs and of ack requests
+func (sq *stubQueue) counts() (acked, ackCalls, batchCalls int) {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	for _, ok := range sq.acked {
+		if ok {
+			acked++
+		}
+	}
+	return acked, sq.ackCalls, sq.batchCalls
+}
+
+// runConsumer runs a consumer until handled jobs have run, then stops it
+func runConsumer(t *testing.T, consumer *Consumer, handled *sync.WaitGroup) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- consumer.Run(ctx) }()
+
+	handled.Wait()
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer did not stop")
+	}
+}
+
+func TestConsumerBatchesAcks(t *testing.T) {
+	const jobs = 200
+	sq, client := newStubQueue(t, jobs)
+
+	var handled sync.WaitGroup
+	handled.Add(jobs)
+	consumer := client.NewConsumer("q", func(ctx context.Context, job *Job) error {
+		handled.Done()
+		return nil
+	}, &ConsumerOptions{
+		Prefetch:       50,
+		Concurrency:    20,
+		PollInterval:   10 * time.Millisecond,
+		AckBatchSize:   50,
+		AckBatchWindow: 20 * time.Millisecond,
+		OnError:        func(err error) { t.Error(err) },
+	})
+	runConsumer(t, consumer, &handled)
+
+	acked, ackCalls, batchCalls := sq.counts()
+	if acked != jobs {
+		t.Errorf("acked %d jobs, want %d", acked, jobs)
+	}
+	if ackCalls != 0 {
+		t.Errorf("made %d single ack calls, want none", ackCalls)
+	}
+	if batchCalls == 0 || batchCalls > jobs/10 {
+		t.Errorf("made %d batch ack calls for %d jobs, want a few", batchCalls, jobs)
+	}
+}
+
+func TestConsumerDrainFlushesAcks(t *testing.T) {
+	const jobs = 30
+	sq, client := newStubQueue(t, jobs)
+
+	var handled sync.WaitGroup
+	handled.Add(jobs)
+	consumer := client.NewConsumer("q", func(ctx context.Context, job *Job) error {
+		handled.Done()
+		return nil
+	}, &ConsumerOptions{
+		Prefetch:     jobs,
+		Concurrency:  5,
+		PollInterval: 10 * time.Millisecond,
+		// Neither limit is reached, so only the drain flushes
+		AckBatchSize:   1000,
+		AckBatchWindow: time.Hour,
+	})
+	runConsumer(t, consumer, &handled)
+
+	acked, _, batchCalls := sq.counts()
+	if acked != jobs {
+		t.Errorf("acked %d jobs after drain, want %d", acked, jobs)
+	}
+	if batchCalls != 1 {
+		t.Errorf("made %d batch ack calls, want 1", batchCalls)
+	}
+}
+
+func TestConsumerAcksIndividuallyByDefault(t *testing.T) {
+	const jobs = 5
+	sq, client := newStubQueue(t, jobs)
+
+	var handled sync.WaitGroup
+	handled.Add(jobs)
+	consumer := client.NewConsumer("q", func(ctx context.Context, job *Job) error {
+		handled.Done()
+		return nil
+	}, &ConsumerOptions{PollInterval: 10 * time.Millisecond})
+	runConsumer(t, consumer, &handled)
+
+	acked, ackCalls, batchCalls := sq.counts()
+	if acked != jobs || ackCalls != jobs || batchCalls != 0 {
+		t.Errorf("acked %d jobs with %d ack and %d batch calls, want %d, %d, 0", acked, ackCalls, batchCalls, jobs, jobs)
+	}
+}
+
+func TestConsumerLeaseWait(t *testing.T) {
+	const jobs = 3
+	sq, client := newStubQueue(t, 0)
+
+	var handled sync.WaitGroup
+	handled.Add(jobs)
+	consumer := client.NewConsumer("q", func(ctx context.Context, job *Job) error {
+		handled.Done()
+		return nil
+	}, &ConsumerOptions{PollInterval: time.Hour, LeaseWait: 50 * time.Millisecond})
+
+	// Jobs arriving after an empty lease are picked up without sleeping
+	// PollInterval
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		sq.mu.Lock()
+		for i := 0; i < jobs; i++ {
+			sq.ready = append(sq.ready, &Job{ID: fmt.Sprintf("job-%d", i), Queue: "q", LeaseID: fmt.Sprintf("lease-%d", i)})
+		}
+		sq.mu.Unlock()
+	}()
+	runConsumer(t, consumer, &handled)
+
+	sq.mu.Lock()
+	waitMs := sq.waitMs
+	sq.mu.Unlock()
+	if waitMs != 50 {
+		t.Errorf("lease sent wait_ms %d, want 50", waitMs)
+	}
+}
+
+func TestConsumerPermanentError(t *testing.T) {
+	sq, client := newStubQueue(t, 2)
+	sq.ready[0].Payload = json.RawMessage(`{"n":0}`)
+	sq.ready[1].Payload = json.RawMessage(`{"n":1}`)
+
+	var handled sync.WaitGroup
+	handled.Add(2)
+	consumer := client.NewConsumer("q", func(ctx context.Context, job *Job) error {
+		defer handled.Done()
+		if job.ID == "job-0" {
+			return Permanent(fmt.Errorf("malformed payload"))
+		}
+		return fmt.Errorf("downstream unavailable")
+	}, &ConsumerOptions{
+		Prefetch:        2,
+		PollInterval:    10 * time.Millisecond,
+		DeadLetterQueue: "dead",
+		OnError:         func(err error) { t.Error(err) },
+	})
+	runConsumer(t, consumer, &handled)
+
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	if nack := sq.nacked["job-0"]; !nack.Permanent || nack.Reason != "malformed payload" {
+		t.Errorf("job-0 nacked with %+v, want a permanent nack", nack)
+	}
+	if nack := sq.nacked["job-1"]; nack.Permanent {
+		t.Error("job-1 nacked permanently, want a retry")
+	}
+	if len(sq.enqueued) != 1 || sq.enqueued[0] != `{"n":0}` {
+		t.Errorf("republished %v, want only job-0's payload", sq.enqueued)
+	}
+}
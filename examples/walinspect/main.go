@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rivetq/rivetq/internal/wal"
+)
+
+func main() {
+	dir := flag.String("dir", "./data/wal", "WAL directory")
+	jobID := flag.String("job", "", "Only show records for this job")
+	queue := flag.String("queue", "", "Only show records for this queue")
+	flag.Parse()
+
+	reader, err := wal.OpenForRead(*dir)
+	if err != nil {
+		log.Fatalf("Failed to open WAL: %v", err)
+	}
+	defer reader.Close()
+
+	count := 0
+	for reader.Next() {
+		record := reader.Record()
+		if *jobID != "" && record.JobID != *jobID {
+			continue
+		}
+		if *queue != "" && record.Queue != *queue {
+			continue
+		}
+
+		count++
+		fmt.Printf("segment=%d type=%s queue=%s job=%s tries=%d", reader.Segment(), record.Type, record.Queue, record.JobID, record.Tries)
+		if !record.ETA.IsZero() {
+			fmt.Printf(" eta=%s", record.ETA.Format(time.RFC3339Nano))
+		}
+		if record.Reason != "" {
+			fmt.Printf(" reason=%q", record.Reason)
+		}
+		fmt.Println()
+	}
+	if err := reader.Err(); err != nil {
+		log.Fatalf("Failed to read WAL: %v", err)
+	}
+
+	fmt.Printf("%d records\n", count)
+}
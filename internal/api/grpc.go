@@ -2,9 +2,16 @@ package api
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
 
 	pb "github.com/rivetq/rivetq/api/gen"
+	"github.com/rivetq/rivetq/internal/logging"
 	"github.com/rivetq/rivetq/internal/queue"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // GRPCServer implements the gRPC QueueService
@@ -27,27 +34,80 @@ func (s *GRPCServer) Enqueue(ctx context.Context, req *pb.EnqueueRequest) (*pb.E
 		retryPolicy.MaxRetries = req.RetryPolicy.MaxRetries
 	}
 
-	jobID, err := s.manager.Enqueue(
-		req.QueueName,
-		req.Payload,
-		req.Headers,
-		uint8(req.Priority),
-		req.DelayMs,
-		retryPolicy,
-		req.IdempotencyKey,
-	)
+	ackMode, err := queue.ParseAckMode(req.AckMode)
 	if err != nil {
 		return nil, err
 	}
 
-	return &pb.EnqueueResponse{JobId: jobID}, nil
+	jobID, err := s.manager.EnqueueWithOptions(req.QueueName, req.Payload, queue.EnqueueOptions{
+		Headers:        req.Headers,
+		Priority:       uint8(req.Priority),
+		DelayMs:        req.DelayMs,
+		RetryPolicy:    retryPolicy,
+		IdempotencyKey: req.IdempotencyKey,
+		AckMode:        ackMode,
+	})
+	if err != nil {
+		logging.With(logging.Fields{Queue: req.QueueName}).Error().Err(err).Msg("failed to enqueue job")
+		return nil, grpcError(err)
+	}
+
+	resp := &pb.EnqueueResponse{JobId: jobID}
+	if status, limited := s.manager.RateLimitStatus(req.QueueName); limited {
+		resp.RateLimit = &pb.RateLimitStatus{
+			Limit:     uint32(status.Limit),
+			Remaining: uint32(status.Remaining),
+			ResetMs:   status.Reset.Milliseconds(),
+		}
+	}
+
+	return resp, nil
+}
+
+// EnqueueBatch implements QueueService.EnqueueBatch
+func (s *GRPCServer) EnqueueBatch(ctx context.Context, req *pb.EnqueueBatchRequest) (*pb.EnqueueBatchResponse, error) {
+	specs := make([]queue.EnqueueSpec, len(req.Jobs))
+	for i, job := range req.Jobs {
+		if job.Priority > 9 {
+			return nil, status.Errorf(codes.InvalidArgument, "job %d: priority must be between 0 and 9, got %d", i, job.Priority)
+		}
+		retryPolicy := queue.DefaultRetryPolicy()
+		if job.RetryPolicy != nil {
+			retryPolicy.MaxRetries = job.RetryPolicy.MaxRetries
+		}
+		specs[i] = queue.EnqueueSpec{
+			JobID:          job.JobId,
+			Payload:        job.Payload,
+			Headers:        job.Headers,
+			Priority:       uint8(job.Priority),
+			DelayMs:        job.DelayMs,
+			RetryPolicy:    retryPolicy,
+			IdempotencyKey: job.IdempotencyKey,
+		}
+	}
+
+	ids, err := s.manager.EnqueueBatch(req.QueueName, specs)
+	if err != nil {
+		var batchErr *queue.BatchError
+		switch {
+		case errors.As(err, &batchErr) && (errors.Is(err, queue.ErrIdempotencyConflict) || errors.Is(err, queue.ErrJobIDCollision)):
+			return nil, status.Error(codes.AlreadyExists, err.Error())
+		case errors.As(err, &batchErr) && !errors.Is(err, queue.ErrStoreUnavailable):
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		logging.With(logging.Fields{Queue: req.QueueName}).Error().Err(err).Msg("failed to enqueue job batch")
+		return nil, grpcError(err)
+	}
+
+	return &pb.EnqueueBatchResponse{JobIds: ids}, nil
 }
 
 // Lease implements QueueService.Lease
 func (s *GRPCServer) Lease(ctx context.Context, req *pb.LeaseRequest) (*pb.LeaseResponse, error) {
-	jobs, err := s.manager.Lease(req.QueueName, int(req.MaxJobs), req.VisibilityMs)
+	jobs, err := s.manager.LeaseWithOptions(ctx, req.QueueName, int(req.MaxJobs), req.VisibilityMs, queue.LeaseOptions{MaxBytes: req.MaxBytes})
 	if err != nil {
-		return nil, err
+		logging.With(logging.Fields{Queue: req.QueueName}).Error().Err(err).Msg("failed to lease jobs")
+		return nil, grpcError(err)
 	}
 
 	pbJobs := make([]*pb.Job, len(jobs))
@@ -60,6 +120,8 @@ func (s *GRPCServer) Lease(ctx context.Context, req *pb.LeaseRequest) (*pb.Lease
 			Priority: uint32(job.Priority),
 			Tries:    job.Tries,
 			LeaseId:  job.LeaseID,
+
+			FencingToken: job.FencingToken,
 		}
 	}
 
@@ -69,20 +131,110 @@ func (s *GRPCServer) Lease(ctx context.Context, req *pb.LeaseRequest) (*pb.Lease
 // Ack implements QueueService.Ack
 func (s *GRPCServer) Ack(ctx context.Context, req *pb.AckRequest) (*pb.AckResponse, error) {
 	err := s.manager.Ack(req.JobId, req.LeaseId)
-	return &pb.AckResponse{Success: err == nil}, err
+	if err != nil {
+		logging.With(logging.Fields{JobID: req.JobId, LeaseID: req.LeaseId}).Error().Err(err).Msg("failed to ack job")
+	}
+	return &pb.AckResponse{Success: err == nil}, grpcError(err)
+}
+
+// AckAndLease implements QueueService.AckAndLease
+func (s *GRPCServer) AckAndLease(ctx context.Context, req *pb.AckAndLeaseRequest) (*pb.AckAndLeaseResponse, error) {
+	job, err := s.manager.AckAndLease(req.JobId, req.LeaseId, req.QueueName, req.VisibilityMs)
+	if err != nil {
+		logging.With(logging.Fields{Queue: req.QueueName, JobID: req.JobId, LeaseID: req.LeaseId}).Error().Err(err).Msg("failed to ack and lease")
+		return nil, grpcError(err)
+	}
+
+	resp := &pb.AckAndLeaseResponse{Success: true}
+	if job != nil {
+		resp.Job = &pb.Job{
+			Id:       job.ID,
+			Queue:    job.Queue,
+			Payload:  job.Payload,
+			Headers:  job.Headers,
+			Priority: uint32(job.Priority),
+			Tries:    job.Tries,
+			LeaseId:  job.LeaseID,
+
+			FencingToken: job.FencingToken,
+		}
+	}
+	return resp, nil
 }
 
 // Nack implements QueueService.Nack
 func (s *GRPCServer) Nack(ctx context.Context, req *pb.NackRequest) (*pb.NackResponse, error) {
 	err := s.manager.Nack(req.JobId, req.LeaseId, req.Reason)
-	return &pb.NackResponse{Success: err == nil}, err
+	if err != nil {
+		logging.With(logging.Fields{JobID: req.JobId, LeaseID: req.LeaseId}).Error().Err(err).Msg("failed to nack job")
+	}
+	return &pb.NackResponse{Success: err == nil}, grpcError(err)
+}
+
+// Actions a consumer may send over the Settle stream
+const (
+	settleActionAck       = "ack"
+	settleActionNack      = "nack"
+	settleActionHeartbeat = "heartbeat"
+)
+
+// Settle implements QueueService.Settle. Each request is applied in order and
+// confirmed with a response; a failed request is reported in its response
+// without ending the stream. When the stream ends, jobs the consumer did not
+// settle stay leased until their visibility timeout and are then redelivered
+// as usual, so a dropped connection loses nothing.
+func (s *GRPCServer) Settle(stream pb.QueueService_SettleServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			logging.With(logging.Fields{}).Debug().Err(err).Msg("settle stream closed")
+			return err
+		}
+
+		if err := stream.Send(s.settle(req)); err != nil {
+			return err
+		}
+	}
+}
+
+// settle applies one Settle request
+func (s *GRPCServer) settle(req *pb.SettleRequest) *pb.SettleResponse {
+	resp := &pb.SettleResponse{Sequence: req.Sequence, JobId: req.JobId}
+
+	var err error
+	switch req.Action {
+	case settleActionAck:
+		err = s.manager.Ack(req.JobId, req.LeaseId)
+	case settleActionNack:
+		err = s.manager.Nack(req.JobId, req.LeaseId, req.Reason)
+	case settleActionHeartbeat:
+		var deadline time.Time
+		deadline, err = s.manager.Heartbeat(req.JobId, req.LeaseId, req.VisibilityMs)
+		if err == nil {
+			resp.LeaseDeadlineMs = deadline.UnixMilli()
+		}
+	default:
+		err = fmt.Errorf("unknown settle action %q", req.Action)
+	}
+
+	if err != nil {
+		logging.With(logging.Fields{JobID: req.JobId, LeaseID: req.LeaseId}).Warn().Err(err).Str("action", req.Action).Msg("failed to settle job")
+		resp.Error = err.Error()
+		resp.LeaseExpired = errors.Is(err, queue.ErrLeaseExpired)
+		return resp
+	}
+	resp.Success = true
+	return resp
 }
 
 // Stats implements QueueService.Stats
 func (s *GRPCServer) Stats(ctx context.Context, req *pb.StatsRequest) (*pb.StatsResponse, error) {
 	ready, inflight, dlq, err := s.manager.Stats(req.QueueName)
 	if err != nil {
-		return nil, err
+		return nil, grpcError(err)
 	}
 
 	return &pb.StatsResponse{
@@ -113,3 +265,22 @@ func (s *GRPCServer) GetRateLimit(ctx context.Context, req *pb.GetRateLimitReque
 		Exists:     exists,
 	}, nil
 }
+
+// grpcError converts the manager's sentinel errors to gRPC status errors,
+// passing anything else through unchanged
+func grpcError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, queue.ErrQueueNotFound), errors.Is(err, queue.ErrJobNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, queue.ErrInvalidLease), errors.Is(err, queue.ErrLeaseExpired):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, queue.ErrRateLimited):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, queue.ErrManagerClosed):
+		return status.Error(codes.Unavailable, err.Error())
+	default:
+		return err
+	}
+}
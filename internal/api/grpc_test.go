@@ -0,0 +1,211 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	pb "github.com/rivetq/rivetq/api/gen"
+	"github.com/rivetq/rivetq/internal/queue"
+	"github.com/rivetq/rivetq/internal/store"
+	"github.com/rivetq/rivetq/internal/wal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestClient serves a GRPCServer over an in-memory listener and returns a
+// client connected to it, with the manager behind the server
+func newTestClient(t *testing.T) (pb.QueueServiceClient, *queue.Manager) {
+	dir := t.TempDir()
+
+	walInst, err := wal.New(wal.Config{Dir: dir + "/wal", SegmentSize: 1024})
+	require.NoError(t, err)
+	t.Cleanup(func() { walInst.Close() })
+
+	storeInst, err := store.New(dir + "/store")
+	require.NoError(t, err)
+	t.Cleanup(func() { storeInst.Close() })
+
+	mgr := queue.NewManager(storeInst, walInst)
+	require.NoError(t, mgr.Start())
+	t.Cleanup(func() { mgr.Stop() })
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	pb.RegisterQueueServiceServer(server, NewGRPCServer(mgr))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewQueueServiceClient(conn), mgr
+}
+
+func TestSettleStream(t *testing.T) {
+	client, mgr := newTestClient(t)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Enqueue(ctx, &pb.EnqueueRequest{QueueName: "stream", Payload: []byte("job"), Priority: 5})
+		require.NoError(t, err)
+	}
+	leased, err := client.Lease(ctx, &pb.LeaseRequest{QueueName: "stream", MaxJobs: 3, VisibilityMs: 30000})
+	require.NoError(t, err)
+	require.Len(t, leased.Jobs, 3)
+
+	stream, err := client.Settle(ctx)
+	require.NoError(t, err)
+
+	send := func(req *pb.SettleRequest) *pb.SettleResponse {
+		require.NoError(t, stream.Send(req))
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, req.Sequence, resp.Sequence)
+		return resp
+	}
+
+	first, second, third := leased.Jobs[0], leased.Jobs[1], leased.Jobs[2]
+
+	resp := send(&pb.SettleRequest{Sequence: 1, Action: "heartbeat", JobId: first.Id, LeaseId: first.LeaseId, VisibilityMs: 60000})
+	assert.True(t, resp.Success)
+	assert.Greater(t, resp.LeaseDeadlineMs, time.Now().Add(45*time.Second).UnixMilli())
+
+	resp = send(&pb.SettleRequest{Sequence: 2, Action: "ack", JobId: first.Id, LeaseId: first.LeaseId})
+	assert.True(t, resp.Success)
+
+	resp = send(&pb.SettleRequest{Sequence: 3, Action: "nack", JobId: second.Id, LeaseId: second.LeaseId, Reason: "boom"})
+	assert.True(t, resp.Success)
+
+	// Failures are reported without ending the stream
+	resp = send(&pb.SettleRequest{Sequence: 4, Action: "ack", JobId: first.Id, LeaseId: first.LeaseId})
+	assert.False(t, resp.Success)
+	assert.NotEmpty(t, resp.Error)
+	resp = send(&pb.SettleRequest{Sequence: 5, Action: "bogus", JobId: third.Id, LeaseId: third.LeaseId})
+	assert.False(t, resp.Success)
+
+	// The third job is still leased when the stream ends; it is left to its
+	// visibility timeout rather than requeued
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	require.ErrorIs(t, err, io.EOF)
+
+	_, inflight, _, err := mgr.Stats("stream")
+	require.NoError(t, err)
+	assert.Equal(t, 1, inflight)
+}
+
+func TestEnqueueRateLimitStatus(t *testing.T) {
+	client, mgr := newTestClient(t)
+	ctx := context.Background()
+
+	// No limit, no status
+	resp, err := client.Enqueue(ctx, &pb.EnqueueRequest{QueueName: "free", Payload: []byte("job"), Priority: 5})
+	require.NoError(t, err)
+	assert.Nil(t, resp.RateLimit)
+
+	mgr.SetRateLimit("limited", 2, 0.001)
+	resp, err = client.Enqueue(ctx, &pb.EnqueueRequest{QueueName: "limited", Payload: []byte("job"), Priority: 5, AckMode: "buffered"})
+	require.NoError(t, err)
+	require.NotNil(t, resp.RateLimit)
+	assert.Equal(t, uint32(2), resp.RateLimit.Limit)
+	assert.Equal(t, uint32(1), resp.RateLimit.Remaining)
+
+	_, err = client.Enqueue(ctx, &pb.EnqueueRequest{QueueName: "limited", Payload: []byte("job"), Priority: 5})
+	require.NoError(t, err)
+	_, err = client.Enqueue(ctx, &pb.EnqueueRequest{QueueName: "limited", Payload: []byte("job"), Priority: 5})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestEnqueueBatch(t *testing.T) {
+	client, mgr := newTestClient(t)
+	ctx := context.Background()
+
+	resp, err := client.EnqueueBatch(ctx, &pb.EnqueueBatchRequest{QueueName: "bulk", Jobs: []*pb.BatchJob{
+		{Payload: []byte("a"), Priority: 3},
+		{Payload: []byte("b"), IdempotencyKey: "k"},
+		{Payload: []byte("b"), IdempotencyKey: "k"},
+		{Payload: []byte("c"), JobId: "bulk-1"},
+	}})
+	require.NoError(t, err)
+	require.Len(t, resp.JobIds, 4)
+	assert.Equal(t, resp.JobIds[1], resp.JobIds[2])
+	assert.Equal(t, "bulk-1", resp.JobIds[3])
+
+	ready, _, _, err := mgr.Stats("bulk")
+	require.NoError(t, err)
+	assert.Equal(t, 3, ready)
+
+	// One invalid job rejects the whole batch
+	_, err = client.EnqueueBatch(ctx, &pb.EnqueueBatchRequest{QueueName: "bulk", Jobs: []*pb.BatchJob{
+		{Payload: []byte("d")},
+		{Payload: []byte("e"), Priority: 10},
+	}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	ready, _, _, err = mgr.Stats("bulk")
+	require.NoError(t, err)
+	assert.Equal(t, 3, ready)
+}
+
+func TestLeaseMaxBytes(t *testing.T) {
+	client, _ := newTestClient(t)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Enqueue(ctx, &pb.EnqueueRequest{QueueName: "budget", Payload: make([]byte, 100), Priority: 5})
+		require.NoError(t, err)
+	}
+
+	resp, err := client.Lease(ctx, &pb.LeaseRequest{QueueName: "budget", MaxJobs: 3, VisibilityMs: 30000, MaxBytes: 250})
+	require.NoError(t, err)
+	assert.Len(t, resp.Jobs, 2)
+
+	// A job larger than the budget is still leased alone
+	resp, err = client.Lease(ctx, &pb.LeaseRequest{QueueName: "budget", MaxJobs: 3, VisibilityMs: 30000, MaxBytes: 10})
+	require.NoError(t, err)
+	assert.Len(t, resp.Jobs, 1)
+}
+
+func TestAckAndLease(t *testing.T) {
+	client, _ := newTestClient(t)
+	ctx := context.Background()
+
+	for _, payload := range []string{"first", "second"} {
+		_, err := client.Enqueue(ctx, &pb.EnqueueRequest{QueueName: "chain", Payload: []byte(payload), Priority: 5})
+		require.NoError(t, err)
+	}
+	leased, err := client.Lease(ctx, &pb.LeaseRequest{QueueName: "chain", MaxJobs: 1, VisibilityMs: 30000})
+	require.NoError(t, err)
+	require.Len(t, leased.Jobs, 1)
+	first := leased.Jobs[0]
+
+	resp, err := client.AckAndLease(ctx, &pb.AckAndLeaseRequest{JobId: first.Id, LeaseId: first.LeaseId, QueueName: "chain", VisibilityMs: 30000})
+	require.NoError(t, err)
+	assert.True(t, resp.Success)
+	require.NotNil(t, resp.Job)
+	assert.Equal(t, []byte("second"), resp.Job.Payload)
+	assert.NotEmpty(t, resp.Job.LeaseId)
+
+	// An empty queue acks without a next job
+	resp, err = client.AckAndLease(ctx, &pb.AckAndLeaseRequest{JobId: resp.Job.Id, LeaseId: resp.Job.LeaseId, QueueName: "chain", VisibilityMs: 30000})
+	require.NoError(t, err)
+	assert.True(t, resp.Success)
+	assert.Nil(t, resp.Job)
+
+	// A stale lease fails the ack and leases nothing
+	_, err = client.AckAndLease(ctx, &pb.AckAndLeaseRequest{JobId: first.Id, LeaseId: first.LeaseId, QueueName: "chain", VisibilityMs: 30000})
+	assert.Error(t, err)
+}
@@ -12,6 +12,10 @@ type Config struct {
 	MaxDelay   time.Duration
 	Multiplier float64
 	Jitter     float64 // Jitter factor (0.0 to 1.0)
+
+	// MinDelay is the shortest delay returned for a retry, applied after
+	// jitter, so a large jitter cannot retry at once. It wins over MaxDelay.
+	MinDelay time.Duration
 }
 
 // DefaultConfig returns default backoff configuration
@@ -25,7 +29,7 @@ func DefaultConfig() Config {
 }
 
 // Calculate computes the backoff delay for a given attempt
-// Formula: min(base * multiplier^attempt, maxDelay) + jitter
+// Formula: max(min(base * multiplier^attempt, maxDelay) + jitter, minDelay)
 func Calculate(cfg Config, attempt uint32) time.Duration {
 	if attempt == 0 {
 		return 0
@@ -46,10 +50,13 @@ func Calculate(cfg Config, attempt uint32) time.Duration {
 		delay += jitterDelta
 	}
 
-	// Ensure non-negative
+	// Ensure non-negative and at least the floor
 	if delay < 0 {
 		delay = 0
 	}
+	if delay < float64(cfg.MinDelay) {
+		delay = float64(cfg.MinDelay)
+	}
 
 	return time.Duration(delay)
 }
@@ -81,3 +81,27 @@ func TestCalculateWithJitter(t *testing.T) {
 		assert.LessOrEqual(t, float64(r), maxExpected)
 	}
 }
+
+func TestCalculateMinDelay(t *testing.T) {
+	cfg := Config{
+		BaseDelay:  100 * time.Millisecond,
+		MaxDelay:   10 * time.Second,
+		Multiplier: 2.0,
+		Jitter:     1.0, // Full jitter: delays anywhere from 0 to twice the backoff
+		MinDelay:   100 * time.Millisecond,
+	}
+
+	// Without the floor, full jitter puts some first retries near zero
+	var spread bool
+	for i := 0; i < 1000; i++ {
+		for attempt := uint32(1); attempt <= 4; attempt++ {
+			result := Calculate(cfg, attempt)
+			assert.GreaterOrEqual(t, result, cfg.MinDelay, "attempt %d", attempt)
+			spread = spread || result > cfg.MinDelay
+		}
+	}
+	assert.True(t, spread, "delays above the floor keep their jitter")
+
+	// No retry, no delay
+	assert.Equal(t, time.Duration(0), Calculate(cfg, 0))
+}
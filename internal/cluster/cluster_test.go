@@ -1,10 +1,20 @@
 package cluster
 
 import (
-	"os"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/raft"
 	"github.com/rivetq/rivetq/internal/queue"
 	"github.com/rivetq/rivetq/internal/store"
 	"github.com/rivetq/rivetq/internal/wal"
@@ -104,8 +114,31 @@ func TestConsistentHashingRebalance(t *testing.T) {
 	after, err := ch.GetNode("queue1")
 	require.NoError(t, err)
 
-	// Either stays same or moved (can't predict, but should be valid)
-	assert.Contains(t, []string{"node1", "node2", "node3"}, after)
+	// Either stays same or moved to the new node (never between old nodes)
+	assert.Contains(t, []string{before, "node3"}, after)
+}
+
+func TestRingInfo(t *testing.T) {
+	ch := NewConsistentHash()
+	ch.AddNode("node1")
+	ch.AddNode("node2")
+	ch.AddNode("node3")
+
+	info := ch.RingInfo()
+	assert.Equal(t, 3*VirtualNodes, info.TotalPoints)
+	require.Len(t, info.Nodes, 3)
+
+	var total float64
+	for _, node := range info.Nodes {
+		assert.Equal(t, VirtualNodes, node.VirtualNodes)
+		assert.Greater(t, node.Ranges, 0)
+		assert.LessOrEqual(t, node.Ranges, VirtualNodes)
+
+		// Roughly even distribution
+		assert.InDelta(t, 33.3, node.CoveragePercent, 10)
+		total += node.CoveragePercent
+	}
+	assert.InDelta(t, 100.0, total, 0.001)
 }
 
 func TestSharding(t *testing.T) {
@@ -183,6 +216,53 @@ func TestMembership(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestProxyFailoverToReplica(t *testing.T) {
+	sharding := NewSharding("local", 2)
+	sharding.AddNode("nodeA")
+	sharding.AddNode("nodeB")
+
+	membership := NewMembership(nil, "local")
+	servers := make(map[string]*httptest.Server)
+	for _, id := range []string{"nodeA", "nodeB"} {
+		id := id
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"served_by":"` + id + `"}`))
+		}))
+		defer srv.Close()
+		servers[id] = srv
+		require.NoError(t, membership.AddMember(&Member{
+			ID:   id,
+			Addr: strings.TrimPrefix(srv.URL, "http://"),
+		}))
+	}
+
+	nodes, err := sharding.GetQueueNodes("orders")
+	require.NoError(t, err)
+	require.Len(t, nodes, 2)
+	primary, replica := nodes[0], nodes[1]
+
+	// Primary is down
+	membership.UpdateMemberStatus(primary, MemberStatusDead)
+
+	proxy := NewProxy(sharding, membership)
+
+	// Reads fail over to the replica
+	result, err := proxy.Forward(context.Background(), http.MethodGet, "/v1/queues/orders/stats", nil)
+	require.NoError(t, err)
+	assert.Equal(t, replica, result.ServedBy)
+	assert.True(t, result.Failover)
+	assert.Contains(t, string(result.Body), replica)
+
+	// Writes stay on the primary unless write failover is enabled
+	_, err = proxy.Forward(context.Background(), http.MethodPost, "/v1/queues/orders/enqueue", []byte("{}"))
+	assert.Error(t, err)
+
+	proxy.SetWriteFailover(true)
+	result, err = proxy.Forward(context.Background(), http.MethodPost, "/v1/queues/orders/enqueue", []byte("{}"))
+	require.NoError(t, err)
+	assert.Equal(t, replica, result.ServedBy)
+}
+
 func TestPathExtraction(t *testing.T) {
 	tests := []struct {
 		path     string
@@ -200,3 +280,478 @@ func TestPathExtraction(t *testing.T) {
 		assert.Equal(t, tt.expected, result, "path: %s", tt.path)
 	}
 }
+
+// newTestNode bootstraps a single-node cluster backed by a fresh queue manager
+func newTestNode(t *testing.T, nodeID, raftAddr string) (*Node, *queue.Manager) {
+	dir := t.TempDir()
+
+	walInst, err := wal.New(wal.Config{Dir: dir + "/wal", SegmentSize: 1024, Fsync: false})
+	require.NoError(t, err)
+	t.Cleanup(func() { walInst.Close() })
+
+	storeInst, err := store.New(dir + "/store")
+	require.NoError(t, err)
+	t.Cleanup(func() { storeInst.Close() })
+
+	mgr := queue.NewManager(storeInst, walInst)
+	require.NoError(t, mgr.Start())
+	t.Cleanup(func() { mgr.Stop() })
+
+	node, err := NewNode(Config{
+		NodeID:    nodeID,
+		RaftAddr:  raftAddr,
+		RaftDir:   dir + "/raft",
+		Bootstrap: true,
+	}, NewFSM(mgr))
+	require.NoError(t, err)
+	t.Cleanup(func() { node.Shutdown() })
+
+	require.NoError(t, node.WaitForLeader(5*time.Second))
+	return node, mgr
+}
+
+func TestNodeConfiguration(t *testing.T) {
+	node, _ := newTestNode(t, "node1", "127.0.0.1:17002")
+
+	servers, err := node.Configuration()
+	require.NoError(t, err)
+	require.Len(t, servers, 1)
+
+	assert.Equal(t, "node1", servers[0].ID)
+	assert.Equal(t, "127.0.0.1:17002", servers[0].Address)
+	assert.Equal(t, "voter", servers[0].Suffrage)
+}
+
+func TestTransferLeadership(t *testing.T) {
+	node, _ := newTestNode(t, "node1", "127.0.0.1:17003")
+
+	// Unknown target is not a voter
+	err := node.TransferLeadership("node2")
+	assert.ErrorIs(t, err, ErrTargetNotVoter)
+
+	// Transferring to self is rejected
+	err = node.TransferLeadership("node1")
+	assert.Error(t, err)
+
+	// Leadership is unchanged
+	assert.True(t, node.IsLeader())
+}
+
+func TestApplyFailsFastWithoutQuorum(t *testing.T) {
+	node, _ := newTestNode(t, "node1", "127.0.0.1:17004")
+	require.NoError(t, node.CheckQuorum())
+
+	// Add a voter that never comes up, so the leader can only reach 1 of 2
+	go node.Join("node2", "127.0.0.1:17099")
+
+	assert.Eventually(t, func() bool {
+		return errors.Is(node.CheckQuorum(), ErrNoQuorum)
+	}, 5*time.Second, 20*time.Millisecond)
+
+	cmd, err := json.Marshal(Command{Type: CommandSetRateLimit, Data: []byte(`{"queue":"q","capacity":1,"refill_rate":1}`)})
+	require.NoError(t, err)
+
+	start := time.Now()
+	err = node.Apply(cmd, 10*time.Second)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestSnapshotCompressionRoundTrip(t *testing.T) {
+	original := &FSMSnapshot{stats: make(map[string]QueueStats)}
+	for i := 0; i < 2000; i++ {
+		name := fmt.Sprintf("queue-%04d", i)
+		original.queues = append(original.queues, name)
+		original.stats[name] = QueueStats{
+			Ready:      i,
+			Inflight:   i % 7,
+			DLQ:        i % 3,
+			Capacity:   float64(i + 1),
+			RefillRate: float64(i%10 + 1),
+		}
+	}
+
+	snapshots := raft.NewInmemSnapshotStore()
+	sink, err := snapshots.Create(raft.SnapshotVersionMax, 1, 1, raft.Configuration{}, 1, nil)
+	require.NoError(t, err)
+	require.NoError(t, original.Persist(sink))
+
+	_, rc, err := snapshots.Open(sink.ID())
+	require.NoError(t, err)
+	persisted, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	rc.Close()
+
+	uncompressed, err := json.Marshal(snapshotData{Queues: original.queues, Stats: original.stats})
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(persisted, snapshotMagic))
+	assert.Less(t, len(persisted), len(uncompressed)/2, "snapshot should be compressed")
+
+	restored, err := readSnapshot(bytes.NewReader(persisted))
+	require.NoError(t, err)
+	reencoded, err := json.Marshal(restored)
+	require.NoError(t, err)
+	assert.Equal(t, uncompressed, reencoded)
+
+	// Restoring applies the rate limits to the manager
+	mgr := newTestFSMManager(t)
+	require.NoError(t, NewFSM(mgr).Restore(io.NopCloser(bytes.NewReader(persisted))))
+	capacity, refillRate, exists := mgr.GetRateLimit("queue-0042")
+	assert.True(t, exists)
+	assert.Equal(t, 43.0, capacity)
+	assert.Equal(t, 3.0, refillRate)
+}
+
+func TestSnapshotRestoreUncompressed(t *testing.T) {
+	legacy := `{"queues":["emails"],"stats":{"emails":{"ready":1,"inflight":0,"dlq":0,"capacity":10,"refill_rate":2}}}` + "\n"
+
+	mgr := newTestFSMManager(t)
+	require.NoError(t, NewFSM(mgr).Restore(io.NopCloser(strings.NewReader(legacy))))
+
+	capacity, refillRate, exists := mgr.GetRateLimit("emails")
+	assert.True(t, exists)
+	assert.Equal(t, 10.0, capacity)
+	assert.Equal(t, 2.0, refillRate)
+}
+
+func TestSnapshotRestoreGzipJSON(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(gzipSnapshotMagic)
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write([]byte(`{"queues":["emails"],"stats":{"emails":{"ready":1,"inflight":0,"dlq":0,"capacity":10,"refill_rate":2}}}`))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	mgr := newTestFSMManager(t)
+	require.NoError(t, NewFSM(mgr).Restore(io.NopCloser(&buf)))
+
+	capacity, _, exists := mgr.GetRateLimit("emails")
+	assert.True(t, exists)
+	assert.Equal(t, 10.0, capacity)
+}
+
+func TestSnapshotDeltaChain(t *testing.T) {
+	mgr := newTestFSMManager(t)
+	fsm := NewFSM(mgr)
+	fsm.SetMaxSnapshotDeltas(3)
+
+	take := func() (*FSMSnapshot, []byte) {
+		snap, err := fsm.Snapshot()
+		require.NoError(t, err)
+		return snap.(*FSMSnapshot), persistSnapshot(t, snap)
+	}
+	enqueue := func(queueName string) {
+		_, err := mgr.Enqueue(queueName, []byte("job"), nil, 5, 0, queue.DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+	}
+
+	for i := 0; i < 500; i++ {
+		enqueue(fmt.Sprintf("queue-%03d", i))
+		mgr.SetRateLimit(fmt.Sprintf("queue-%03d", i), float64(i+1), 1)
+	}
+
+	base, full := take()
+	require.Len(t, base.frames, 1)
+
+	// Deltas reuse the full frame and only encode what changed since, so a
+	// persisted snapshot is the full frame plus one small delta
+	enqueue("queue-007")
+	mgr.SetRateLimit("queue-042", 99, 9)
+	delta1, persisted1 := take()
+	require.Len(t, delta1.frames, 2)
+	assert.Same(t, base.frames[0], delta1.frames[0])
+	assert.Less(t, len(persisted1), len(full)+200)
+
+	enqueue("queue-new")
+	mgr.SetRateLimit("queue-new", 5, 5)
+	_, persisted2 := take()
+	assert.Less(t, len(persisted2), len(full)+200)
+
+	mgr.SetRateLimit("queue-001", 0, 0)
+	delta3, persisted3 := take()
+	require.Len(t, delta3.frames, 2)
+	assert.Same(t, base.frames[0], delta3.frames[0])
+
+	// A full frame and a delta restore to the same state as a full snapshot
+	chained, err := readSnapshot(bytes.NewReader(persisted3))
+	require.NoError(t, err)
+
+	fullFSM := NewFSM(mgr)
+	fullFSM.SetMaxSnapshotDeltas(0)
+	snap, err := fullFSM.Snapshot()
+	require.NoError(t, err)
+	equivalent := snap.(*FSMSnapshot)
+	require.Len(t, equivalent.frames, 1)
+	assert.Equal(t, equivalent.queues, chained.Queues)
+	assert.Equal(t, equivalent.stats, chained.Stats)
+
+	restored := newTestFSMManager(t)
+	require.NoError(t, NewFSM(restored).Restore(io.NopCloser(bytes.NewReader(persisted3))))
+	capacity, refillRate, exists := restored.GetRateLimit("queue-042")
+	assert.True(t, exists)
+	assert.Equal(t, 99.0, capacity)
+	assert.Equal(t, 9.0, refillRate)
+	_, _, exists = restored.GetRateLimit("queue-new")
+	assert.True(t, exists)
+
+	// After MaxSnapshotDeltas deltas the next snapshot is full again
+	compacted, persisted := take()
+	require.Len(t, compacted.frames, 1)
+	recompacted, err := readSnapshot(bytes.NewReader(persisted))
+	require.NoError(t, err)
+	assert.Equal(t, chained, recompacted)
+
+	// A delta touching most queues is no smaller than a full snapshot
+	for i := 0; i < 300; i++ {
+		mgr.SetRateLimit(fmt.Sprintf("queue-%03d", i), 1000, 1)
+	}
+	wide, _ := take()
+	assert.Len(t, wide.frames, 1)
+
+	// A change of leader or a restore starts from a new full snapshot
+	next, _ := take()
+	require.Len(t, next.frames, 2)
+	fsm.ResetSnapshotBase()
+	next, _ = take()
+	assert.Len(t, next.frames, 1)
+
+	next, _ = take()
+	require.Len(t, next.frames, 2)
+	require.NoError(t, fsm.Restore(io.NopCloser(bytes.NewReader(persisted))))
+	next, _ = take()
+	assert.Len(t, next.frames, 1)
+}
+
+func TestSnapshotDeltaRemovesQueues(t *testing.T) {
+	base := &snapshotData{
+		Queues: []string{"a", "b"},
+		Stats:  map[string]QueueStats{"a": {Ready: 1}, "b": {Ready: 2}},
+	}
+	next := &snapshotData{
+		Queues: []string{"b", "c"},
+		Stats:  map[string]QueueStats{"b": {Ready: 3}, "c": {Ready: 4}},
+	}
+
+	frame := diffSnapshot(base, next)
+	assert.Equal(t, []string{"a"}, frame.Removed)
+	assert.Equal(t, []string{"c"}, frame.Queues)
+	assert.Equal(t, 3, frame.changedQueues())
+
+	base.apply(frame)
+	assert.Equal(t, next, base)
+}
+
+func TestSnapshotRestoreDeltaChain(t *testing.T) {
+	// Any number of deltas restore to the same state as a single full frame
+	full := &snapshotData{
+		Queues: []string{"b", "c"},
+		Stats:  map[string]QueueStats{"b": {Ready: 3, Capacity: 5, RefillRate: 1}, "c": {Ready: 4}},
+	}
+	frames := []*snapshotFrame{
+		{Full: true, Queues: []string{"a", "b"}, Stats: map[string]QueueStats{"a": {Ready: 1}, "b": {Ready: 2}}},
+		{Queues: []string{"c"}, Stats: map[string]QueueStats{"b": {Ready: 3, Capacity: 5, RefillRate: 1}}, Removed: []string{"a"}},
+		{Stats: map[string]QueueStats{"c": {Ready: 4}}},
+	}
+
+	var buf bytes.Buffer
+	buf.Write(snapshotMagic)
+	for _, frame := range frames {
+		require.NoError(t, (&encodedFrame{frame: frame}).writeTo(&buf))
+	}
+	chained, err := readSnapshot(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, full.Queues, chained.Queues)
+	assert.Equal(t, full.Stats, chained.Stats)
+
+	// A chain must start with a full frame
+	buf.Reset()
+	buf.Write(snapshotMagic)
+	require.NoError(t, (&encodedFrame{frame: frames[1]}).writeTo(&buf))
+	_, err = readSnapshot(bytes.NewReader(buf.Bytes()))
+	assert.Error(t, err)
+}
+
+// persistSnapshot persists a snapshot and returns the bytes written
+func persistSnapshot(t *testing.T, snap raft.FSMSnapshot) []byte {
+	snapshots := raft.NewInmemSnapshotStore()
+	sink, err := snapshots.Create(raft.SnapshotVersionMax, 1, 1, raft.Configuration{}, 1, nil)
+	require.NoError(t, err)
+	require.NoError(t, snap.Persist(sink))
+
+	_, rc, err := snapshots.Open(sink.ID())
+	require.NoError(t, err)
+	defer rc.Close()
+	persisted, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	return persisted
+}
+
+// newTestFSMManager returns a queue manager for exercising the FSM directly
+func newTestFSMManager(t *testing.T) *queue.Manager {
+	dir := t.TempDir()
+
+	walInst, err := wal.New(wal.Config{Dir: dir + "/wal", SegmentSize: 1024, Fsync: false})
+	require.NoError(t, err)
+	t.Cleanup(func() { walInst.Close() })
+
+	storeInst, err := store.New(dir + "/store")
+	require.NoError(t, err)
+	t.Cleanup(func() { storeInst.Close() })
+
+	return queue.NewManager(storeInst, walInst)
+}
+
+func TestHealthCheckRoundConcurrent(t *testing.T) {
+	node, _ := newTestNode(t, "node1", "127.0.0.1:17005")
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer fast.Close()
+
+	// Slow members answer only after the health timeout has passed
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer slow.Close()
+
+	membership := NewMembership(node, "node1")
+	membership.healthTimeout = 200 * time.Millisecond
+
+	for i := 0; i < 8; i++ {
+		addr := slow.Listener.Addr().String()
+		if i%4 == 0 {
+			addr = fast.Listener.Addr().String()
+		}
+		require.NoError(t, membership.AddMember(&Member{ID: fmt.Sprintf("node%d", i+2), Addr: addr}))
+	}
+
+	start := time.Now()
+	membership.checkMemberHealth()
+	elapsed := time.Since(start)
+
+	// Six slow members checked one after another would take 1.2s
+	assert.Less(t, elapsed, 600*time.Millisecond)
+
+	for i := 0; i < 8; i++ {
+		member, err := membership.GetMember(fmt.Sprintf("node%d", i+2))
+		require.NoError(t, err)
+		if i%4 == 0 {
+			assert.Equal(t, MemberStatusAlive, member.Status)
+		} else {
+			assert.Equal(t, MemberStatusSuspect, member.Status)
+		}
+	}
+}
+
+func TestCreateQueueThroughFSM(t *testing.T) {
+	node, mgr := newTestNode(t, "node1", "127.0.0.1:17006")
+
+	// An enqueue creates its queue through the log before the job
+	jobID, err := node.Enqueue(EnqueueCommand{Queue: "orders", Payload: []byte("job"), Priority: 5}, 5*time.Second)
+	require.NoError(t, err)
+	assert.NotEmpty(t, jobID)
+
+	cfg, err := mgr.GetQueueConfig("orders")
+	require.NoError(t, err)
+	assert.Equal(t, mgr.DefaultQueueConfig(), cfg)
+
+	// Creating it again keeps the existing config
+	custom := cfg
+	custom.DLQEnabled = false
+	custom.PriorityDemotionStep = 3
+	mgr.SetQueueConfig("orders", custom)
+	require.NoError(t, node.EnsureQueue("orders", 5*time.Second))
+	cmd, err := json.Marshal(CreateQueueCommand{Queue: "orders", Config: mgr.DefaultQueueConfig()})
+	require.NoError(t, err)
+	entry, err := json.Marshal(Command{Type: CommandCreateQueue, Data: cmd})
+	require.NoError(t, err)
+	require.NoError(t, node.Apply(entry, 5*time.Second))
+	cfg, err = mgr.GetQueueConfig("orders")
+	require.NoError(t, err)
+	assert.Equal(t, custom, cfg)
+
+	// The config survives a snapshot restore on another node
+	snap, err := NewFSM(mgr).Snapshot()
+	require.NoError(t, err)
+	snapshots := raft.NewInmemSnapshotStore()
+	sink, err := snapshots.Create(raft.SnapshotVersionMax, 1, 1, raft.Configuration{}, 1, nil)
+	require.NoError(t, err)
+	require.NoError(t, snap.Persist(sink))
+	_, rc, err := snapshots.Open(sink.ID())
+	require.NoError(t, err)
+	defer rc.Close()
+
+	restored := newTestFSMManager(t)
+	require.NoError(t, NewFSM(restored).Restore(rc))
+	cfg, err = restored.GetQueueConfig("orders")
+	require.NoError(t, err)
+	assert.Equal(t, custom, cfg)
+}
+
+func TestEnqueueJobIDCollision(t *testing.T) {
+	node, mgr := newTestNode(t, "node1", "127.0.0.1:17007")
+
+	// Generated IDs travel with the command, so replicas agree on them
+	jobID, err := node.Enqueue(EnqueueCommand{Queue: "orders", Payload: []byte("job"), Priority: 5}, 5*time.Second)
+	require.NoError(t, err)
+	replica := newTestFSMManager(t)
+	require.NoError(t, replica.Start())
+	t.Cleanup(func() { replica.Stop() })
+	cmd, err := json.Marshal(EnqueueCommand{Queue: "orders", JobID: jobID, Payload: []byte("job"), Priority: 5})
+	require.NoError(t, err)
+	entry, err := json.Marshal(Command{Type: CommandEnqueue, Data: cmd})
+	require.NoError(t, err)
+	assert.Equal(t, jobID, NewFSM(replica).Apply(&raft.Log{Data: entry}))
+
+	// A different job under a taken ID is rejected, the same job is not
+	_, err = node.Enqueue(EnqueueCommand{Queue: "orders", JobID: jobID, Payload: []byte("other"), Priority: 5}, 5*time.Second)
+	assert.ErrorIs(t, err, queue.ErrJobIDCollision)
+	again, err := node.Enqueue(EnqueueCommand{Queue: "orders", JobID: jobID, Payload: []byte("job"), Priority: 5}, 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, jobID, again)
+
+	ready, _, _, err := mgr.Stats("orders")
+	require.NoError(t, err)
+	assert.Equal(t, 1, ready)
+}
+
+func TestDefaultHeadersThroughFSM(t *testing.T) {
+	node, mgr := newTestNode(t, "node1", "127.0.0.1:17008")
+
+	headers := map[string]string{"source": "api"}
+	require.NoError(t, node.SetDefaultHeaders("orders", headers, 5*time.Second))
+	cfg, err := mgr.GetQueueConfig("orders")
+	require.NoError(t, err)
+	assert.Equal(t, headers, cfg.DefaultHeaders)
+
+	// A replica applying the command gets the same defaults
+	replica := newTestFSMManager(t)
+	cmd, err := json.Marshal(DefaultHeadersCommand{Queue: "orders", Headers: headers})
+	require.NoError(t, err)
+	entry, err := json.Marshal(Command{Type: CommandSetDefaultHeaders, Data: cmd})
+	require.NoError(t, err)
+	assert.Nil(t, NewFSM(replica).Apply(&raft.Log{Data: entry}))
+	cfg, err = replica.GetQueueConfig("orders")
+	require.NoError(t, err)
+	assert.Equal(t, headers, cfg.DefaultHeaders)
+
+	// A snapshot restore carries them to a node that never saw the command
+	snap, err := NewFSM(mgr).Snapshot()
+	require.NoError(t, err)
+	restored := newTestFSMManager(t)
+	require.NoError(t, NewFSM(restored).Restore(io.NopCloser(bytes.NewReader(persistSnapshot(t, snap)))))
+	cfg, err = restored.GetQueueConfig("orders")
+	require.NoError(t, err)
+	assert.Equal(t, headers, cfg.DefaultHeaders)
+
+	// Empty headers remove them
+	require.NoError(t, node.SetDefaultHeaders("orders", nil, 5*time.Second))
+	cfg, err = mgr.GetQueueConfig("orders")
+	require.NoError(t, err)
+	assert.Empty(t, cfg.DefaultHeaders)
+}
@@ -37,3 +37,27 @@ func DefaultConfig() Config {
 		TrailingLogs:      10240,
 	}
 }
+
+// withDefaults fills unset Raft tuning fields from DefaultConfig
+func (c Config) withDefaults() Config {
+	defaults := DefaultConfig()
+	if c.HeartbeatTimeout == 0 {
+		c.HeartbeatTimeout = defaults.HeartbeatTimeout
+	}
+	if c.ElectionTimeout == 0 {
+		c.ElectionTimeout = defaults.ElectionTimeout
+	}
+	if c.SnapshotInterval == 0 {
+		c.SnapshotInterval = defaults.SnapshotInterval
+	}
+	if c.SnapshotThreshold == 0 {
+		c.SnapshotThreshold = defaults.SnapshotThreshold
+	}
+	if c.MaxAppendEntries == 0 {
+		c.MaxAppendEntries = defaults.MaxAppendEntries
+	}
+	if c.TrailingLogs == 0 {
+		c.TrailingLogs = defaults.TrailingLogs
+	}
+	return c
+}
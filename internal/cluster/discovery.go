@@ -1,6 +1,7 @@
 package cluster
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -147,7 +148,7 @@ func (d *Discovery) requestJoin(seedAddr string) error {
 	resp, err = client.Post(
 		fmt.Sprintf("http://%s/v1/cluster/join", leaderAddr),
 		"application/json",
-		nil,
+		bytes.NewReader(reqBody),
 	)
 	if err != nil {
 		return err
@@ -264,11 +265,12 @@ func (d *Discovery) Announce(ctx context.Context) error {
 			ctx,
 			"POST",
 			fmt.Sprintf("http://%s/v1/cluster/announce", seedAddr),
-			nil,
+			bytes.NewReader(data),
 		)
 		if err != nil {
 			continue
 		}
+		req.Header.Set("Content-Type", "application/json")
 
 		resp, err := client.Do(req)
 		if err != nil {
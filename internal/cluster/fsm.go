@@ -19,6 +19,8 @@ const (
 	CommandAck
 	CommandNack
 	CommandSetRateLimit
+	CommandCreateQueue
+	CommandSetDefaultHeaders
 )
 
 // Command represents a replicated command
@@ -59,16 +61,42 @@ type RateLimitCommand struct {
 	RefillRate float64 `json:"refill_rate"`
 }
 
+// CreateQueueCommand creates a queue on every node with the same config.
+// Applying it to an existing queue does nothing.
+type CreateQueueCommand struct {
+	Queue  string            `json:"queue"`
+	Config queue.QueueConfig `json:"config"`
+}
+
+// DefaultMaxSnapshotDeltas is how many delta snapshots are taken against a
+// full one before the next snapshot is full again
+const DefaultMaxSnapshotDeltas = 8
+
+// DefaultHeadersCommand sets the headers merged into every job enqueued to
+// a queue. Empty headers remove them.
+type DefaultHeadersCommand struct {
+	Queue   string            `json:"queue"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
 // FSM implements raft.FSM for the finite state machine
 type FSM struct {
 	mu      sync.RWMutex
 	manager *queue.Manager
+
+	// base is the full frame deltas are taken against, and baseState the
+	// state it holds. deltas counts the snapshots taken against it.
+	base      *encodedFrame
+	baseState *snapshotData
+	deltas    int
+	maxDeltas int
 }
 
 // NewFSM creates a new FSM
 func NewFSM(manager *queue.Manager) *FSM {
 	return &FSM{
-		manager: manager,
+		manager:   manager,
+		maxDeltas: DefaultMaxSnapshotDeltas,
 	}
 }
 
@@ -89,6 +117,10 @@ func (f *FSM) Apply(l *raft.Log) interface{} {
 		return f.applyNack(cmd.Data)
 	case CommandSetRateLimit:
 		return f.applySetRateLimit(cmd.Data)
+	case CommandCreateQueue:
+		return f.applyCreateQueue(cmd.Data)
+	case CommandSetDefaultHeaders:
+		return f.applySetDefaultHeaders(cmd.Data)
 	default:
 		return fmt.Errorf("unknown command type: %d", cmd.Type)
 	}
@@ -104,15 +136,16 @@ func (f *FSM) applyEnqueue(data []byte) interface{} {
 		MaxRetries: cmd.MaxRetries,
 	}
 
-	jobID, err := f.manager.Enqueue(
-		cmd.Queue,
-		cmd.Payload,
-		cmd.Headers,
-		cmd.Priority,
-		cmd.DelayMs,
-		retryPolicy,
-		cmd.IdempotencyKey,
-	)
+	// The job ID comes with the command so every node enqueues the job under
+	// the same ID
+	jobID, err := f.manager.EnqueueWithOptions(cmd.Queue, cmd.Payload, queue.EnqueueOptions{
+		Headers:        cmd.Headers,
+		Priority:       cmd.Priority,
+		DelayMs:        cmd.DelayMs,
+		RetryPolicy:    retryPolicy,
+		IdempotencyKey: cmd.IdempotencyKey,
+		JobID:          cmd.JobID,
+	})
 
 	if err != nil {
 		log.Error().Err(err).Str("queue", cmd.Queue).Msg("failed to enqueue job")
@@ -160,65 +193,155 @@ func (f *FSM) applySetRateLimit(data []byte) interface{} {
 	return nil
 }
 
-// Snapshot returns a snapshot of the FSM state
+func (f *FSM) applyCreateQueue(data []byte) interface{} {
+	var cmd CreateQueueCommand
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return err
+	}
+
+	if f.manager.CreateQueue(cmd.Queue, cmd.Config) {
+		log.Info().Str("queue", cmd.Queue).Msg("queue created")
+	}
+	return nil
+}
+
+func (f *FSM) applySetDefaultHeaders(data []byte) interface{} {
+	var cmd DefaultHeadersCommand
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return err
+	}
+
+	if err := f.manager.SetDefaultHeaders(cmd.Queue, cmd.Headers); err != nil {
+		log.Error().Err(err).Str("queue", cmd.Queue).Msg("failed to set default headers")
+		return err
+	}
+	return nil
+}
+
+// Snapshot returns a snapshot of the FSM state. Only what changed since the
+// last full snapshot is encoded: the snapshot reuses that snapshot's encoded
+// frame as its base and adds a delta against it. A full snapshot is taken
+// instead after MaxSnapshotDeltas deltas, once the delta covers more than
+// half of the queues, and after a restore or a change of leader.
 func (f *FSM) Snapshot() (raft.FSMSnapshot, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	// Create snapshot of current state
-	snapshot := &FSMSnapshot{
-		queues: f.manager.ListQueues(),
+	state := f.captureState()
+
+	if f.base != nil && f.deltas < f.maxDeltas {
+		delta := diffSnapshot(f.baseState, state)
+		if delta.changedQueues() <= len(state.Queues)/2 {
+			f.deltas++
+			return &FSMSnapshot{
+				queues:  state.Queues,
+				stats:   state.Stats,
+				configs: state.Configs,
+				frames:  []*encodedFrame{f.base, {frame: delta}},
+			}, nil
+		}
 	}
 
-	// Collect stats for all queues
-	snapshot.stats = make(map[string]QueueStats)
-	for _, queueName := range snapshot.queues {
-		ready, inflight, dlq, err := f.manager.Stats(queueName)
-		if err != nil {
-			continue
-		}
-		snapshot.stats[queueName] = QueueStats{
-			Ready:    ready,
-			Inflight: inflight,
-			DLQ:      dlq,
+	f.base = &encodedFrame{frame: &snapshotFrame{Full: true, Queues: state.Queues, Stats: state.Stats, Configs: state.Configs}}
+	f.baseState = state
+	f.deltas = 0
+
+	return &FSMSnapshot{
+		queues:  state.Queues,
+		stats:   state.Stats,
+		configs: state.Configs,
+		frames:  []*encodedFrame{f.base},
+	}, nil
+}
+
+// SetMaxSnapshotDeltas sets how many delta snapshots may be taken against a
+// full one. Zero makes every snapshot full.
+func (f *FSM) SetMaxSnapshotDeltas(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.maxDeltas = n
+}
+
+// ResetSnapshotBase makes the next snapshot a full one. It is called when
+// the leader changes, so that deltas are only ever taken against a base
+// captured in the current term.
+func (f *FSM) ResetSnapshotBase() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.resetBase()
+}
+
+// resetBase drops the snapshot base. Must be called with f.mu held.
+func (f *FSM) resetBase() {
+	f.base = nil
+	f.baseState = nil
+	f.deltas = 0
+}
+
+// captureState collects the queue names and stats to snapshot. Must be
+// called with f.mu held.
+func (f *FSM) captureState() *snapshotData {
+	queues := f.manager.SnapshotState()
+
+	state := &snapshotData{
+		Queues:  make([]string, 0, len(queues)),
+		Stats:   make(map[string]QueueStats, len(queues)),
+		Configs: make(map[string]queue.QueueConfig, len(queues)),
+	}
+	for _, q := range queues {
+		queueName := q.Name
+		state.Queues = append(state.Queues, queueName)
+		state.Configs[queueName] = q.Config
+		stats := QueueStats{
+			Ready:    q.Depth.Ready,
+			Inflight: q.Depth.Inflight,
+			DLQ:      q.Depth.DLQ,
 		}
 
 		// Get rate limits
 		capacity, refillRate, exists := f.manager.GetRateLimit(queueName)
 		if exists {
-			snapshot.stats[queueName] = QueueStats{
-				Ready:      ready,
-				Inflight:   inflight,
-				DLQ:        dlq,
-				Capacity:   capacity,
-				RefillRate: refillRate,
-			}
+			stats.Capacity = capacity
+			stats.RefillRate = refillRate
 		}
+		state.Stats[queueName] = stats
 	}
-
-	return snapshot, nil
+	return state
 }
 
 // Restore restores the FSM from a snapshot
 func (f *FSM) Restore(rc io.ReadCloser) error {
 	defer rc.Close()
 
-	var snapshot FSMSnapshot
-	if err := json.NewDecoder(rc).Decode(&snapshot); err != nil {
+	snapshot, err := readSnapshot(rc)
+	if err != nil {
 		return err
 	}
 
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	// The next snapshot is full, taken from the restored state
+	f.resetBase()
+
+	// Recreate queues with the config they had when the snapshot was taken.
+	// Older snapshots have no configs, and their queues get the default.
+	for _, queueName := range snapshot.Queues {
+		if cfg, ok := snapshot.Configs[queueName]; ok {
+			f.manager.SetQueueConfig(queueName, cfg)
+		} else {
+			f.manager.CreateQueue(queueName, f.manager.DefaultQueueConfig())
+		}
+	}
+
 	// Restore rate limits
-	for queue, stats := range snapshot.stats {
+	for queue, stats := range snapshot.Stats {
 		if stats.Capacity > 0 {
 			f.manager.SetRateLimit(queue, stats.Capacity, stats.RefillRate)
 		}
 	}
 
-	log.Info().Int("queues", len(snapshot.queues)).Msg("restored FSM from snapshot")
+	log.Info().Int("queues", len(snapshot.Queues)).Msg("restored FSM from snapshot")
 	return nil
 }
 
@@ -233,25 +356,32 @@ type QueueStats struct {
 
 // FSMSnapshot represents a point-in-time snapshot
 type FSMSnapshot struct {
-	queues []string
-	stats  map[string]QueueStats
+	queues  []string
+	stats   map[string]QueueStats
+	configs map[string]queue.QueueConfig
+
+	// frames is the full frame, shared with the other snapshots taken
+	// against it, and the delta if any. Without them the snapshot is
+	// persisted as a single full frame built from queues and stats.
+	frames []*encodedFrame
 }
 
-// Persist writes the snapshot to the sink
+// Persist writes the snapshot's frames to the sink after a format marker
 func (s *FSMSnapshot) Persist(sink raft.SnapshotSink) error {
-	err := func() error {
-		data := struct {
-			Queues []string                `json:"queues"`
-			Stats  map[string]QueueStats `json:"stats"`
-		}{
-			Queues: s.queues,
-			Stats:  s.stats,
-		}
+	frames := s.frames
+	if len(frames) == 0 {
+		frames = []*encodedFrame{{frame: &snapshotFrame{Full: true, Queues: s.queues, Stats: s.stats, Configs: s.configs}}}
+	}
 
-		if err := json.NewEncoder(sink).Encode(data); err != nil {
+	err := func() error {
+		if _, err := sink.Write(snapshotMagic); err != nil {
 			return err
 		}
-
+		for _, frame := range frames {
+			if err := frame.writeTo(sink); err != nil {
+				return err
+			}
+		}
 		return sink.Close()
 	}()
 
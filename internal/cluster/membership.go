@@ -19,6 +19,9 @@ const (
 	MemberStatusDead    MemberStatus = "dead"
 )
 
+// DefaultHealthCheckConcurrency is the most member health checks run at once
+const DefaultHealthCheckConcurrency = 16
+
 // Member represents a cluster member
 type Member struct {
 	ID         string       `json:"id"`
@@ -41,6 +44,7 @@ type Membership struct {
 	// Health checking
 	healthCheckInterval time.Duration
 	healthTimeout       time.Duration
+	healthConcurrency   int
 	stopCh              chan struct{}
 	wg                  sync.WaitGroup
 }
@@ -53,10 +57,20 @@ func NewMembership(node *Node, localID string) *Membership {
 		localID:             localID,
 		healthCheckInterval: 5 * time.Second,
 		healthTimeout:       2 * time.Second,
+		healthConcurrency:   DefaultHealthCheckConcurrency,
 		stopCh:              make(chan struct{}),
 	}
 }
 
+// SetHealthCheckConcurrency sets the most member health checks run at once.
+// Must be called before Start.
+func (m *Membership) SetHealthCheckConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	m.healthConcurrency = n
+}
+
 // Start starts the membership manager
 func (m *Membership) Start() {
 	m.wg.Add(1)
@@ -187,32 +201,57 @@ func (m *Membership) healthCheckLoop() {
 	}
 }
 
-// checkMemberHealth checks health of all members
+// checkMemberHealth checks health of all members. Checks run on a bounded
+// pool of workers, so one slow member does not hold up the rest and a round
+// takes roughly one health timeout regardless of cluster size.
 func (m *Membership) checkMemberHealth() {
 	members := m.ListMembers()
 
+	work := make(chan *Member)
+	var wg sync.WaitGroup
+	for i := 0; i < min(m.healthConcurrency, len(members)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for member := range work {
+				m.checkMember(member)
+			}
+		}()
+	}
+
 	for _, member := range members {
 		// Skip self
 		if member.ID == m.localID {
 			continue
 		}
+		work <- member
+	}
+	close(work)
+	wg.Wait()
+}
 
-		// Check health
-		if m.isHealthy(member) {
-			m.UpdateMemberStatus(member.ID, MemberStatusAlive)
-		} else {
-			// Mark as suspect first, then dead if still unhealthy
-			m.mu.RLock()
-			currentStatus := m.members[member.ID].Status
-			m.mu.RUnlock()
-
-			if currentStatus == MemberStatusAlive {
-				m.UpdateMemberStatus(member.ID, MemberStatusSuspect)
-			} else if currentStatus == MemberStatusSuspect {
-				m.UpdateMemberStatus(member.ID, MemberStatusDead)
-				log.Warn().Str("member_id", member.ID).Msg("member marked as dead")
-			}
-		}
+// checkMember checks one member's health and updates its status
+func (m *Membership) checkMember(member *Member) {
+	// Check health
+	if m.isHealthy(member) {
+		m.UpdateMemberStatus(member.ID, MemberStatusAlive)
+		return
+	}
+
+	// Mark as suspect first, then dead if still unhealthy
+	m.mu.RLock()
+	current, exists := m.members[member.ID]
+	var currentStatus MemberStatus
+	if exists {
+		currentStatus = current.Status
+	}
+	m.mu.RUnlock()
+
+	if currentStatus == MemberStatusAlive {
+		m.UpdateMemberStatus(member.ID, MemberStatusSuspect)
+	} else if currentStatus == MemberStatusSuspect {
+		m.UpdateMemberStatus(member.ID, MemberStatusDead)
+		log.Warn().Str("member_id", member.ID).Msg("member marked as dead")
 	}
 }
 
@@ -1,23 +1,31 @@
 package cluster
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"path/filepath"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/hashicorp/raft"
 	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
 	"github.com/rs/zerolog/log"
 )
 
+// ErrTargetNotVoter is returned when a leadership transfer targets a server
+// that is not a voter in the current Raft configuration
+var ErrTargetNotVoter = errors.New("target is not a voter")
+
 // Node represents a cluster node
 type Node struct {
 	config Config
 	raft   *raft.Raft
 	fsm    *FSM
 	trans  *raft.NetworkTransport
+	quorum *quorumTracker
 }
 
 // NewNode creates a new cluster node
@@ -26,6 +34,8 @@ func NewNode(cfg Config, fsm *FSM) (*Node, error) {
 		return nil, fmt.Errorf("failed to create raft directory: %w", err)
 	}
 
+	cfg = cfg.withDefaults()
+
 	node := &Node{
 		config: cfg,
 		fsm:    fsm,
@@ -77,6 +87,8 @@ func NewNode(cfg Config, fsm *FSM) (*Node, error) {
 		return nil, fmt.Errorf("failed to create raft: %w", err)
 	}
 	node.raft = r
+	// Snapshot deltas are only taken against a base from the current term
+	node.quorum = startQuorumTracker(r, fsm.ResetSnapshotBase)
 
 	// Bootstrap or join cluster
 	if cfg.Bootstrap {
@@ -109,20 +121,101 @@ func (n *Node) Leader() string {
 	return string(addr)
 }
 
-// Apply applies a command to the Raft log
+// Apply applies a command to the Raft log. It returns ErrNoQuorum right
+// away, rather than after timeout, if the leader cannot reach a majority.
 func (n *Node) Apply(cmd []byte, timeout time.Duration) error {
+	_, err := n.applyResult(cmd, timeout)
+	return err
+}
+
+// applyResult applies a command and returns what the FSM returned for it
+func (n *Node) applyResult(cmd []byte, timeout time.Duration) (interface{}, error) {
 	if !n.IsLeader() {
-		return fmt.Errorf("not the leader")
+		return nil, fmt.Errorf("not the leader")
+	}
+	if err := n.CheckQuorum(); err != nil {
+		return nil, err
 	}
 
 	f := n.raft.Apply(cmd, timeout)
 	if err := f.Error(); err != nil {
+		return nil, err
+	}
+
+	return f.Response(), nil
+}
+
+// applyCommand encodes and applies a typed command, returning the FSM's
+// response. An error returned by the FSM is returned as the error.
+func (n *Node) applyCommand(typ CommandType, data interface{}, timeout time.Duration) (interface{}, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode command: %w", err)
+	}
+	cmd, err := json.Marshal(Command{Type: typ, Data: payload})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode command: %w", err)
+	}
+
+	resp, err := n.applyResult(cmd, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := resp.(error); ok {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// EnsureQueue creates a queue through the log if this node does not have it
+// yet, so every node creates it with the same config instead of each one
+// creating it on its own when the first job arrives
+func (n *Node) EnsureQueue(name string, timeout time.Duration) error {
+	if _, err := n.fsm.manager.GetQueueConfig(name); err == nil {
+		return nil
+	}
+
+	cmd := CreateQueueCommand{Queue: name, Config: n.fsm.manager.DefaultQueueConfig()}
+	if _, err := n.applyCommand(CommandCreateQueue, cmd, timeout); err != nil {
+		return fmt.Errorf("failed to create queue %s: %w", name, err)
+	}
+	return nil
+}
+
+// SetDefaultHeaders replicates a queue's default headers, creating the
+// queue through the log first if needed
+func (n *Node) SetDefaultHeaders(queueName string, headers map[string]string, timeout time.Duration) error {
+	if err := n.EnsureQueue(queueName, timeout); err != nil {
 		return err
 	}
 
+	cmd := DefaultHeadersCommand{Queue: queueName, Headers: headers}
+	if _, err := n.applyCommand(CommandSetDefaultHeaders, cmd, timeout); err != nil {
+		return fmt.Errorf("failed to set default headers of %s: %w", queueName, err)
+	}
 	return nil
 }
 
+// Enqueue replicates an enqueue, creating its queue through the log first
+// if needed, and returns the new job's ID. Without a job ID in cmd one is
+// generated here, so it is the same on every node. A job ID taken by a
+// different live job fails with queue.ErrJobIDCollision.
+func (n *Node) Enqueue(cmd EnqueueCommand, timeout time.Duration) (string, error) {
+	if err := n.EnsureQueue(cmd.Queue, timeout); err != nil {
+		return "", err
+	}
+	if cmd.JobID == "" {
+		cmd.JobID = uuid.New().String()
+	}
+
+	resp, err := n.applyCommand(CommandEnqueue, cmd, timeout)
+	if err != nil {
+		return "", err
+	}
+	jobID, _ := resp.(string)
+	return jobID, nil
+}
+
 // Join adds a new node to the cluster
 func (n *Node) Join(nodeID, addr string) error {
 	if !n.IsLeader() {
@@ -155,6 +248,84 @@ func (n *Node) Remove(nodeID string) error {
 	return nil
 }
 
+// RaftServer describes a server in the Raft configuration
+type RaftServer struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Suffrage string `json:"suffrage"` // voter, nonvoter or staging
+}
+
+// Configuration returns the current Raft configuration. Unlike Membership,
+// which is health-based, this is the ground truth used for quorum.
+func (n *Node) Configuration() ([]RaftServer, error) {
+	f := n.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return nil, fmt.Errorf("failed to get raft configuration: %w", err)
+	}
+
+	servers := make([]RaftServer, 0, len(f.Configuration().Servers))
+	for _, srv := range f.Configuration().Servers {
+		servers = append(servers, RaftServer{
+			ID:       string(srv.ID),
+			Address:  string(srv.Address),
+			Suffrage: suffrageString(srv.Suffrage),
+		})
+	}
+
+	return servers, nil
+}
+
+// suffrageString converts a raft suffrage to its API representation
+func suffrageString(s raft.ServerSuffrage) string {
+	switch s {
+	case raft.Voter:
+		return "voter"
+	case raft.Nonvoter:
+		return "nonvoter"
+	case raft.Staging:
+		return "staging"
+	default:
+		return "unknown"
+	}
+}
+
+// TransferLeadership hands leadership to the given voter for controlled failover.
+// The transfer fails if the target is not a voter or cannot catch up in time.
+func (n *Node) TransferLeadership(targetID string) error {
+	if !n.IsLeader() {
+		return fmt.Errorf("not the leader")
+	}
+
+	if targetID == n.config.NodeID {
+		return fmt.Errorf("node %s is already the leader", targetID)
+	}
+
+	servers, err := n.Configuration()
+	if err != nil {
+		return err
+	}
+
+	var target *RaftServer
+	for i := range servers {
+		if servers[i].ID == targetID {
+			target = &servers[i]
+			break
+		}
+	}
+	if target == nil || target.Suffrage != "voter" {
+		return fmt.Errorf("%w: %s", ErrTargetNotVoter, targetID)
+	}
+
+	log.Info().Str("target", targetID).Msg("transferring leadership")
+
+	f := n.raft.LeadershipTransferToServer(raft.ServerID(target.ID), raft.ServerAddress(target.Address))
+	if err := f.Error(); err != nil {
+		return fmt.Errorf("failed to transfer leadership: %w", err)
+	}
+
+	return nil
+}
+
 // Stats returns Raft stats
 func (n *Node) Stats() map[string]string {
 	return n.raft.Stats()
@@ -164,6 +335,8 @@ func (n *Node) Stats() map[string]string {
 func (n *Node) Shutdown() error {
 	log.Info().Msg("shutting down raft node")
 
+	n.quorum.stop(n.raft)
+
 	if err := n.raft.Shutdown().Error(); err != nil {
 		return err
 	}
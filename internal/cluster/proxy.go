@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/rivetq/rivetq/internal/metrics"
 	"github.com/rs/zerolog/log"
 )
 
@@ -17,6 +18,8 @@ type Proxy struct {
 	sharding   *Sharding
 	membership *Membership
 	client     *http.Client
+
+	writeFailover bool
 }
 
 // NewProxy creates a new cluster proxy
@@ -30,41 +33,98 @@ func NewProxy(sharding *Sharding, membership *Membership) *Proxy {
 	}
 }
 
+// ForwardResult describes the outcome of a forwarded request
+type ForwardResult struct {
+	Body     []byte
+	ServedBy string // Node ID that served the request
+	Failover bool   // True if a replica served instead of the primary
+}
+
 // ForwardRequest forwards a request to the appropriate node
 func (p *Proxy) ForwardRequest(ctx context.Context, method, path string, body []byte) ([]byte, error) {
+	result, err := p.Forward(ctx, method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	return result.Body, nil
+}
+
+// Forward forwards a request to the queue's owner. Reads walk the ordered
+// replica set and fail over to the next alive replica when the primary is
+// down or pushing back; writes only fail over when write failover is enabled
+// (i.e. replicas forward writes to the leader).
+func (p *Proxy) Forward(ctx context.Context, method, path string, body []byte) (*ForwardResult, error) {
 	// Extract queue name from path (assumes /v1/queues/{queue}/...)
 	queueName := extractQueueName(path)
 	if queueName == "" {
 		return nil, fmt.Errorf("could not determine queue from path: %s", path)
 	}
 
-	// Get the node responsible for this queue
-	targetNode, err := p.sharding.GetQueueNode(queueName)
+	// Get the nodes responsible for this queue, primary first
+	targets, err := p.sharding.GetQueueNodes(queueName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to find node for queue: %w", err)
 	}
 
-	// Get member info
-	member, err := p.membership.GetMember(targetNode)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get member info: %w", err)
+	if !isReadMethod(method) && !p.writeFailover {
+		targets = targets[:1]
 	}
 
-	if member.Status != MemberStatusAlive {
-		return nil, fmt.Errorf("target node is not alive: %s", targetNode)
+	var lastErr error
+	for i, targetNode := range targets {
+		member, err := p.membership.GetMember(targetNode)
+		if err != nil {
+			lastErr = fmt.Errorf("failed to get member info: %w", err)
+			continue
+		}
+
+		if member.Status != MemberStatusAlive {
+			lastErr = fmt.Errorf("target node is not alive: %s", targetNode)
+			continue
+		}
+
+		respBody, retryable, err := p.send(ctx, method, path, body, queueName, member)
+		if err != nil {
+			metrics.ProxyForwardErrorsTotal.Inc()
+			lastErr = err
+			if retryable {
+				continue
+			}
+			return nil, err
+		}
+
+		metrics.ProxyForwardedTotal.WithLabelValues(targetNode).Inc()
+		if i > 0 {
+			log.Info().
+				Str("queue", queueName).
+				Str("primary", targets[0]).
+				Str("served_by", targetNode).
+				Msg("request served by replica")
+		}
+
+		return &ForwardResult{
+			Body:     respBody,
+			ServedBy: targetNode,
+			Failover: i > 0,
+		}, nil
 	}
 
-	// Forward the request
+	return nil, lastErr
+}
+
+// send forwards a request to a single member. The returned bool reports
+// whether the failure is worth retrying on another replica.
+func (p *Proxy) send(ctx context.Context, method, path string, body []byte, queueName string, member *Member) ([]byte, bool, error) {
 	targetURL := fmt.Sprintf("http://%s%s", member.Addr, path)
 	log.Debug().
 		Str("queue", queueName).
-		Str("target_node", targetNode).
+		Str("target_node", member.ID).
 		Str("url", targetURL).
 		Msg("forwarding request")
 
 	req, err := http.NewRequestWithContext(ctx, method, targetURL, bytes.NewReader(body))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, false, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
@@ -72,20 +132,35 @@ func (p *Proxy) ForwardRequest(ctx context.Context, method, path string, body []
 
 	resp, err := p.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to forward request: %w", err)
+		return nil, ctx.Err() == nil, fmt.Errorf("failed to forward request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+		return nil, false, fmt.Errorf("failed to read response: %w", err)
 	}
 
 	if resp.StatusCode >= 400 {
-		return nil, fmt.Errorf("forwarded request failed: %d - %s", resp.StatusCode, string(respBody))
+		// Backpressure and unavailability can be served elsewhere
+		retryable := resp.StatusCode == http.StatusTooManyRequests ||
+			resp.StatusCode == http.StatusServiceUnavailable ||
+			resp.StatusCode == http.StatusBadGateway
+		return nil, retryable, fmt.Errorf("forwarded request failed: %d - %s", resp.StatusCode, string(respBody))
 	}
 
-	return respBody, nil
+	return respBody, false, nil
+}
+
+// SetWriteFailover allows writes to fail over to replicas, which must then
+// forward them to the leader
+func (p *Proxy) SetWriteFailover(enabled bool) {
+	p.writeFailover = enabled
+}
+
+// isReadMethod returns true for methods that don't mutate state
+func isReadMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
 }
 
 // BroadcastCommand broadcasts a command to all nodes
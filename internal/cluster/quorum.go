@@ -0,0 +1,142 @@
+package cluster
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrNoQuorum is returned for writes while the cluster cannot commit them,
+// so callers fail fast instead of blocking until the apply timeout
+var ErrNoQuorum = errors.New("no quorum")
+
+// quorumTracker follows Raft observations to know, without a round trip,
+// which peers the leader is currently failing to heartbeat
+type quorumTracker struct {
+	mu          sync.Mutex
+	failedPeers map[raft.ServerID]bool
+
+	// onLeaderChange is called, without mu held, when the leader changes
+	onLeaderChange func()
+
+	observer *raft.Observer
+	obsCh    chan raft.Observation
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// startQuorumTracker registers an observer on r and starts tracking.
+// onLeaderChange, if not nil, is called on every change of leader.
+func startQuorumTracker(r *raft.Raft, onLeaderChange func()) *quorumTracker {
+	qt := &quorumTracker{
+		failedPeers:    make(map[raft.ServerID]bool),
+		onLeaderChange: onLeaderChange,
+		obsCh:          make(chan raft.Observation, 64),
+		stopCh:         make(chan struct{}),
+	}
+
+	qt.observer = raft.NewObserver(qt.obsCh, false, func(o *raft.Observation) bool {
+		switch o.Data.(type) {
+		case raft.FailedHeartbeatObservation, raft.ResumedHeartbeatObservation, raft.LeaderObservation:
+			return true
+		}
+		return false
+	})
+	r.RegisterObserver(qt.observer)
+
+	qt.wg.Add(1)
+	go qt.run()
+
+	return qt
+}
+
+// run applies observations until stopped
+func (qt *quorumTracker) run() {
+	defer qt.wg.Done()
+
+	for {
+		select {
+		case <-qt.stopCh:
+			return
+		case o := <-qt.obsCh:
+			qt.mu.Lock()
+			_, leaderChanged := o.Data.(raft.LeaderObservation)
+			switch data := o.Data.(type) {
+			case raft.FailedHeartbeatObservation:
+				if !qt.failedPeers[data.PeerID] {
+					log.Warn().Str("peer", string(data.PeerID)).Msg("failing to heartbeat raft peer")
+				}
+				qt.failedPeers[data.PeerID] = true
+			case raft.ResumedHeartbeatObservation:
+				delete(qt.failedPeers, data.PeerID)
+			case raft.LeaderObservation:
+				// Heartbeat state belongs to the previous leader term
+				qt.failedPeers = make(map[raft.ServerID]bool)
+			}
+			qt.mu.Unlock()
+			if leaderChanged && qt.onLeaderChange != nil {
+				qt.onLeaderChange()
+			}
+		}
+	}
+}
+
+// reachableVoters counts the voters in servers that are not failing
+// heartbeats, including the local node
+func (qt *quorumTracker) reachableVoters(servers []raft.Server) (reachable, voters int) {
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+
+	for _, server := range servers {
+		if server.Suffrage != raft.Voter {
+			continue
+		}
+		voters++
+		if !qt.failedPeers[server.ID] {
+			reachable++
+		}
+	}
+	return reachable, voters
+}
+
+// stop deregisters the observer and waits for the tracker to exit
+func (qt *quorumTracker) stop(r *raft.Raft) {
+	r.DeregisterObserver(qt.observer)
+	close(qt.stopCh)
+	qt.wg.Wait()
+}
+
+// CheckQuorum returns ErrNoQuorum if a write issued now could not commit:
+// the leader cannot reach a majority of voters, a follower has not heard
+// from a leader within the heartbeat timeout, or there is no leader at all.
+// It does not block, so mutating endpoints can use it to fail fast.
+func (n *Node) CheckQuorum() error {
+	switch n.raft.State() {
+	case raft.Leader:
+		f := n.raft.GetConfiguration()
+		if err := f.Error(); err != nil {
+			return err
+		}
+
+		reachable, voters := n.quorum.reachableVoters(f.Configuration().Servers)
+		if reachable*2 <= voters {
+			return ErrNoQuorum
+		}
+		return nil
+
+	case raft.Follower:
+		if _, leaderID := n.raft.LeaderWithID(); leaderID == "" {
+			return ErrNoQuorum
+		}
+		if time.Since(n.raft.LastContact()) > n.config.HeartbeatTimeout {
+			return ErrNoQuorum
+		}
+		return nil
+
+	default:
+		return ErrNoQuorum
+	}
+}
@@ -167,6 +167,82 @@ func (ch *ConsistentHash) Nodes() []string {
 	return nodes
 }
 
+// RingNodeInfo summarizes the portion of the hash ring owned by a node
+type RingNodeInfo struct {
+	NodeID          string  `json:"node_id"`
+	VirtualNodes    int     `json:"virtual_nodes"`
+	Ranges          int     `json:"ranges"`        // Contiguous hash ranges owned
+	LargestRange    uint64  `json:"largest_range"` // Width of the largest owned range
+	CoveragePercent float64 `json:"coverage_percent"`
+}
+
+// RingInfo summarizes the hash ring for debugging distribution skew
+type RingInfo struct {
+	TotalPoints int            `json:"total_points"`
+	Nodes       []RingNodeInfo `json:"nodes"`
+}
+
+// RingInfo returns a bounded summary of the ring: per node, the number of
+// virtual nodes, contiguous ranges owned and share of the key space
+func (ch *ConsistentHash) RingInfo() RingInfo {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	info := RingInfo{
+		TotalPoints: len(ch.ring),
+		Nodes:       make([]RingNodeInfo, 0, len(ch.nodes)),
+	}
+	if len(ch.ring) == 0 {
+		return info
+	}
+
+	const keySpace = float64(1 << 32)
+	byNode := make(map[string]*RingNodeInfo, len(ch.nodes))
+	for nodeID := range ch.nodes {
+		byNode[nodeID] = &RingNodeInfo{NodeID: nodeID}
+	}
+
+	// Each point owns the keys between the previous point (exclusive) and itself
+	// (inclusive); the first point also owns the wrap-around past the last point.
+	var run uint64
+	for i, hash := range ch.ring {
+		nodeID := ch.members[hash]
+		node := byNode[nodeID]
+		node.VirtualNodes++
+
+		var width uint64
+		if i == 0 {
+			width = uint64(hash) + (1 << 32) - uint64(ch.ring[len(ch.ring)-1])
+		} else {
+			width = uint64(hash) - uint64(ch.ring[i-1])
+		}
+		node.CoveragePercent += float64(width) / keySpace * 100
+
+		if i == 0 || ch.members[ch.ring[i-1]] != nodeID {
+			node.Ranges++
+			run = 0
+		}
+		run += width
+		if run > node.LargestRange {
+			node.LargestRange = run
+		}
+	}
+
+	// The first and last ranges are contiguous through the wrap-around
+	if len(byNode) > 1 && ch.members[ch.ring[0]] == ch.members[ch.ring[len(ch.ring)-1]] {
+		byNode[ch.members[ch.ring[0]]].Ranges--
+	}
+
+	for _, node := range byNode {
+		info.Nodes = append(info.Nodes, *node)
+	}
+	sort.Slice(info.Nodes, func(i, j int) bool {
+		return info.Nodes[i].NodeID < info.Nodes[j].NodeID
+	})
+
+	return info
+}
+
 // Sharding manages queue distribution across cluster nodes
 type Sharding struct {
 	mu           sync.RWMutex
@@ -194,6 +270,31 @@ func (s *Sharding) RemoveNode(nodeID string) {
 	s.hashRing.RemoveNode(nodeID)
 }
 
+// Nodes returns all node IDs in the shard ring
+func (s *Sharding) Nodes() []string {
+	return s.hashRing.Nodes()
+}
+
+// NodeCount returns the number of nodes in the shard ring
+func (s *Sharding) NodeCount() int {
+	return s.hashRing.NodeCount()
+}
+
+// RingInfo returns a summary of the shard ring
+func (s *Sharding) RingInfo() RingInfo {
+	return s.hashRing.RingInfo()
+}
+
+// Replication returns the configured replication factor
+func (s *Sharding) Replication() int {
+	return s.replication
+}
+
+// LocalNodeID returns this node's ID
+func (s *Sharding) LocalNodeID() string {
+	return s.localNodeID
+}
+
 // GetQueueNode returns the primary node for a queue
 func (s *Sharding) GetQueueNode(queueName string) (string, error) {
 	return s.hashRing.GetNode(queueName)
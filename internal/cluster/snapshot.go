@@ -0,0 +1,270 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/rivetq/rivetq/internal/queue"
+)
+
+// Snapshots are written as frames of gzip-compressed JSON, each behind a
+// 4-byte big-endian length: a full frame holding the whole state, optionally
+// followed by a delta holding only what changed since. The full frame is
+// encoded once and shared by every snapshot taken against it, so taking a
+// snapshot encodes only the delta. A persisted snapshot carries its full
+// frame and a single delta against it, never a chain, so it restores on its
+// own on any follower Raft sends it to, and it is no larger than the full
+// frame plus what changed since.
+//
+// The reader accepts any number of deltas, each applied to the state before.
+
+// snapshotMagic marks a snapshot written as frames
+var snapshotMagic = []byte("RQSNAPD1")
+
+// gzipSnapshotMagic marks a snapshot written as a single gzip-compressed
+// JSON document, before frame chains were added. Older snapshots still are
+// bare JSON, which cannot start with either marker.
+var gzipSnapshotMagic = []byte("RQSNAPGZ")
+
+// maxFrameSize bounds a single encoded frame, to reject corrupt lengths
+const maxFrameSize = 1 << 30
+
+// snapshotData is the state a snapshot restores
+type snapshotData struct {
+	Queues  []string                     `json:"queues"`
+	Stats   map[string]QueueStats        `json:"stats"`
+	Configs map[string]queue.QueueConfig `json:"configs,omitempty"`
+}
+
+// snapshotFrame is one link of a snapshot chain. A full frame replaces the
+// state; a delta adds Queues, overwrites Stats and Configs and deletes
+// Removed queues.
+type snapshotFrame struct {
+	Full    bool                         `json:"full,omitempty"`
+	Queues  []string                     `json:"queues,omitempty"`
+	Stats   map[string]QueueStats        `json:"stats,omitempty"`
+	Configs map[string]queue.QueueConfig `json:"configs,omitempty"`
+	Removed []string                     `json:"removed,omitempty"`
+}
+
+// encodedFrame encodes a frame on first use and keeps the bytes for later
+// snapshots taken against it
+type encodedFrame struct {
+	once  sync.Once
+	frame *snapshotFrame
+	data  []byte
+	err   error
+}
+
+// encoded returns the compressed frame
+func (e *encodedFrame) encoded() ([]byte, error) {
+	e.once.Do(func() {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if err := json.NewEncoder(gz).Encode(e.frame); err != nil {
+			e.err = err
+			return
+		}
+		if err := gz.Close(); err != nil {
+			e.err = err
+			return
+		}
+		e.data = buf.Bytes()
+		e.frame = nil // The state is no longer needed once encoded
+	})
+	return e.data, e.err
+}
+
+// writeTo writes the length-prefixed frame to w
+func (e *encodedFrame) writeTo(w io.Writer) error {
+	data, err := e.encoded()
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot frame: %w", err)
+	}
+	if _, err := w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(data)))); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// diffSnapshot returns the delta frame that turns base into next
+func diffSnapshot(base, next *snapshotData) *snapshotFrame {
+	frame := &snapshotFrame{
+		Stats:   make(map[string]QueueStats),
+		Configs: make(map[string]queue.QueueConfig),
+	}
+
+	known := make(map[string]bool, len(base.Queues))
+	for _, name := range base.Queues {
+		known[name] = true
+	}
+	current := make(map[string]bool, len(next.Queues))
+	for _, name := range next.Queues {
+		current[name] = true
+		if !known[name] {
+			frame.Queues = append(frame.Queues, name)
+		}
+	}
+	for _, name := range base.Queues {
+		if !current[name] {
+			frame.Removed = append(frame.Removed, name)
+		}
+	}
+
+	for name, stats := range next.Stats {
+		if old, exists := base.Stats[name]; !exists || old != stats {
+			frame.Stats[name] = stats
+		}
+	}
+	for name, cfg := range next.Configs {
+		if old, exists := base.Configs[name]; !exists || !reflect.DeepEqual(old, cfg) {
+			frame.Configs[name] = cfg
+		}
+	}
+	return frame
+}
+
+// changedQueues counts the queues a delta frame touches
+func (frame *snapshotFrame) changedQueues() int {
+	changed := make(map[string]bool, len(frame.Queues)+len(frame.Stats)+len(frame.Removed))
+	for _, name := range frame.Queues {
+		changed[name] = true
+	}
+	for name := range frame.Stats {
+		changed[name] = true
+	}
+	for name := range frame.Configs {
+		changed[name] = true
+	}
+	for _, name := range frame.Removed {
+		changed[name] = true
+	}
+	return len(changed)
+}
+
+// apply folds a frame into the state
+func (d *snapshotData) apply(frame *snapshotFrame) {
+	if frame.Full {
+		d.Queues = frame.Queues
+		d.Stats = frame.Stats
+		if d.Stats == nil {
+			d.Stats = make(map[string]QueueStats)
+		}
+		d.Configs = frame.Configs
+		if d.Configs == nil {
+			d.Configs = make(map[string]queue.QueueConfig)
+		}
+		return
+	}
+
+	removed := make(map[string]bool, len(frame.Removed))
+	for _, name := range frame.Removed {
+		removed[name] = true
+		delete(d.Stats, name)
+		delete(d.Configs, name)
+	}
+	queues := d.Queues[:0:0]
+	for _, name := range d.Queues {
+		if !removed[name] {
+			queues = append(queues, name)
+		}
+	}
+	d.Queues = append(queues, frame.Queues...)
+	sort.Strings(d.Queues)
+
+	for name, stats := range frame.Stats {
+		d.Stats[name] = stats
+	}
+	for name, cfg := range frame.Configs {
+		d.Configs[name] = cfg
+	}
+}
+
+// readSnapshot decodes a snapshot written by Persist, or by an older version
+// as a single gzip-compressed or bare JSON document
+func readSnapshot(r io.Reader) (*snapshotData, error) {
+	br := bufio.NewReader(r)
+
+	if marker, err := br.Peek(len(snapshotMagic)); err == nil {
+		switch {
+		case bytes.Equal(marker, snapshotMagic):
+			br.Discard(len(snapshotMagic))
+			return readFrames(br)
+		case bytes.Equal(marker, gzipSnapshotMagic):
+			br.Discard(len(gzipSnapshotMagic))
+			gz, err := gzip.NewReader(br)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open compressed snapshot: %w", err)
+			}
+			defer gz.Close()
+			return decodeSnapshot(gz)
+		}
+	}
+	return decodeSnapshot(br)
+}
+
+// decodeSnapshot decodes a single JSON snapshot document
+func decodeSnapshot(r io.Reader) (*snapshotData, error) {
+	var snapshot snapshotData
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	return &snapshot, nil
+}
+
+// readFrames folds a frame chain into the state it describes
+func readFrames(r io.Reader) (*snapshotData, error) {
+	var state *snapshotData
+	for i := 0; ; i++ {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read snapshot frame %d: %w", i, err)
+		}
+
+		size := binary.BigEndian.Uint32(header[:])
+		if size > maxFrameSize {
+			return nil, fmt.Errorf("snapshot frame %d is too large: %d bytes", i, size)
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("failed to read snapshot frame %d: %w", i, err)
+		}
+
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open snapshot frame %d: %w", i, err)
+		}
+		var frame snapshotFrame
+		err = json.NewDecoder(gz).Decode(&frame)
+		gz.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode snapshot frame %d: %w", i, err)
+		}
+
+		if state == nil {
+			if !frame.Full {
+				return nil, fmt.Errorf("snapshot frame %d is a delta without a base", i)
+			}
+			state = &snapshotData{}
+		}
+		state.apply(&frame)
+	}
+
+	if state == nil {
+		return nil, errors.New("snapshot has no frames")
+	}
+	return state, nil
+}
@@ -20,25 +20,63 @@ type Config struct {
 
 // ServerConfig holds server settings
 type ServerConfig struct {
-	HTTPAddr string `yaml:"http_addr"`
-	GRPCAddr string `yaml:"grpc_addr"`
+	HTTPAddr         string `yaml:"http_addr"`
+	GRPCAddr         string `yaml:"grpc_addr"`
+	AdminToken       string `yaml:"admin_token"`        // Bearer token for admin endpoints, empty leaves them open
+	LegacyEmptyLease bool   `yaml:"legacy_empty_lease"` // Answer leases that find no jobs with 200 and an empty list instead of 204
+
+	Compression         bool `yaml:"compression"`           // Gzip lease and dump responses for clients accepting it
+	CompressionMinBytes int  `yaml:"compression_min_bytes"` // Smaller responses are sent uncompressed
+
+	Metrics bool `yaml:"metrics"` // Serve Prometheus metrics on GET /metrics of the HTTP address
 }
 
 // StorageConfig holds storage settings
 type StorageConfig struct {
-	DataDir string `yaml:"data_dir"`
+	DataDir       string `yaml:"data_dir"`
+	MinFreeBytes  uint64 `yaml:"min_free_bytes"`  // Startup aborts with less free space in the data directory, 0 disables
+	WarnFreeBytes uint64 `yaml:"warn_free_bytes"` // Startup warns with less free space in the data directory, 0 disables
 }
 
 // WALConfig holds WAL settings
 type WALConfig struct {
-	SegmentSize int64 `yaml:"segment_size"`
-	Fsync       bool  `yaml:"fsync"`
+	SegmentSize  int64         `yaml:"segment_size"`
+	Fsync        bool          `yaml:"fsync"`
+	MaxSegments  int           `yaml:"max_segments"`  // Soft threshold, 0 disables
+	SyncInterval time.Duration `yaml:"sync_interval"` // How often ack_mode=buffered enqueues are fsynced
+	TruncateTail bool          `yaml:"truncate_tail"` // Cut a partial record left by a crash off the WAL on startup
+
+	GroupCommitInterval   time.Duration `yaml:"group_commit_interval"`    // Durable writes share one fsync within this window, 0 fsyncs each
+	GroupCommitMaxRecords int           `yaml:"group_commit_max_records"` // A group commit starts early with this many writes waiting
 }
 
 // QueueConfig holds queue settings
 type QueueConfig struct {
-	Shards             int           `yaml:"shards"`
-	LeaseCheckInterval time.Duration `yaml:"lease_check_interval"`
+	Shards                 int           `yaml:"shards"`
+	LeaseCheckInterval     time.Duration `yaml:"lease_check_interval"`
+	LeaseCheckJitter       time.Duration `yaml:"lease_check_jitter"`        // Random delay added to each queue's lease checks so they don't run in lockstep
+	ExpireLeasesOnShutdown bool          `yaml:"expire_leases_on_shutdown"` // Requeue owned inflight jobs on graceful shutdown
+	RequestIDWindow        time.Duration `yaml:"request_id_window"`         // How long X-Request-ID is remembered for enqueue dedup
+	MinVisibilityMs        int64         `yaml:"min_visibility_ms"`
+	MaxVisibilityMs        int64         `yaml:"max_visibility_ms"`              // 0 means no maximum
+	RejectVisibility       bool          `yaml:"reject_out_of_range_visibility"` // Reject instead of clamp
+	MaxReservation         time.Duration `yaml:"max_reservation"`                // Longest window a reserve request is granted
+	MaxReadyInMemory       int           `yaml:"max_ready_in_memory"`            // Ready jobs beyond this per queue are spilled to the store, 0 disables
+	MaxInflightBytes       int64         `yaml:"max_inflight_bytes"`             // Payload bytes per queue that may be leased at once, 0 disables
+	MaxDelay               time.Duration `yaml:"max_delay"`                      // Furthest in the future a job may be scheduled, 0 disables
+	MaxHeaders             int           `yaml:"max_headers"`                    // Most headers a job may carry, 0 leaves only the WAL format's 65535
+	MaxHeaderBytes         int           `yaml:"max_header_bytes"`               // Most bytes of header keys and values per job, 0 disables
+	IdempotencyTTL         time.Duration `yaml:"idempotency_ttl"`                // How long idempotency keys are kept, 0 keeps them until cleared
+	MaxLeaseBatch          int           `yaml:"max_lease_batch"`                // Most jobs one lease request may take, larger requests are clamped, 0 disables
+	MaxLeaseWait           time.Duration `yaml:"max_lease_wait"`                 // Longest a lease may wait for a job, longer waits are clamped, 0 disables
+	MaxSubscribers         int           `yaml:"max_subscribers"`                // Most clients that may wait on one queue at once, more get 429, 0 disables
+	MinRetryDelay          time.Duration `yaml:"min_retry_delay"`                // Shortest wait before a nacked or expired job is retried, after jitter, 0 disables
+	IdempotencyFailOpen    bool          `yaml:"idempotency_fail_open"`          // Enqueue without dedup when idempotency keys can't be read, instead of rejecting
+	IdempotencyStrict      bool          `yaml:"idempotency_strict"`             // Reject a reused idempotency key with 409 when the payload or headers differ
+	MemoryCeiling          uint64        `yaml:"memory_ceiling"`                 // Heap bytes at which ready jobs are shed to the DLQ, 0 disables
+	MemoryShedPolicy       string        `yaml:"memory_shed_policy"`             // Which ready jobs are shed first: lowest_priority or oldest
+	MemoryShedBatch        int           `yaml:"memory_shed_batch"`              // Most jobs shed per second while above the ceiling
+	ReconcileInterval      time.Duration `yaml:"reconcile_interval"`             // How often job metadata in the store is reconciled with the queues, 0 disables
 }
 
 // ClusterConfig holds cluster settings
@@ -55,25 +93,63 @@ type ClusterConfig struct {
 type LoggingConfig struct {
 	Level  string `yaml:"level"`
 	Format string `yaml:"format"` // json or console
+
+	// RedactPayloads replaces user data in logs, such as nack reasons and
+	// idempotency keys, with size/hash placeholders and hides internal error
+	// details from clients, for deployments handling PII. Payloads and header
+	// values are never logged.
+	RedactPayloads bool `yaml:"redact_payloads"`
+
+	// BufferSize keeps the last this many log events in memory for the admin
+	// logs endpoint, 0 disables it
+	BufferSize int `yaml:"buffer_size"`
 }
 
 // Default returns default configuration
 func Default() *Config {
 	return &Config{
 		Server: ServerConfig{
-			HTTPAddr: ":8080",
-			GRPCAddr: ":9090",
+			HTTPAddr:            ":8080",
+			GRPCAddr:            ":9090",
+			Compression:         true,
+			Metrics:             true,
+			CompressionMinBytes: 1024,
 		},
 		Storage: StorageConfig{
-			DataDir: "./data",
+			DataDir:       "./data",
+			MinFreeBytes:  256 * 1024 * 1024,  // 256MB
+			WarnFreeBytes: 1024 * 1024 * 1024, // 1GB
 		},
 		WAL: WALConfig{
-			SegmentSize: 64 * 1024 * 1024, // 64MB
-			Fsync:       true,
+			SegmentSize:  64 * 1024 * 1024, // 64MB
+			Fsync:        true,
+			MaxSegments:  0,
+			SyncInterval: 100 * time.Millisecond,
+			TruncateTail: true,
+
+			GroupCommitInterval:   0,
+			GroupCommitMaxRecords: 256,
 		},
 		Queue: QueueConfig{
-			Shards:             4,
-			LeaseCheckInterval: 1 * time.Second,
+			Shards:                 4,
+			LeaseCheckInterval:     1 * time.Second,
+			LeaseCheckJitter:       100 * time.Millisecond,
+			ExpireLeasesOnShutdown: false,
+			RequestIDWindow:        5 * time.Minute,
+			MinVisibilityMs:        1000,
+			MaxVisibilityMs:        12 * 60 * 60 * 1000, // 12h
+			RejectVisibility:       false,
+			MaxReservation:         30 * time.Second,
+			MaxReadyInMemory:       0,
+			MaxInflightBytes:       0,
+			MaxDelay:               365 * 24 * time.Hour,
+			MaxHeaders:             64,
+			MaxHeaderBytes:         16 * 1024,
+			MaxLeaseBatch:          1000,
+			MaxLeaseWait:           30 * time.Second,
+			MaxSubscribers:         1000,
+			MemoryShedPolicy:       "lowest_priority",
+			MemoryShedBatch:        100,
 		},
 		Cluster: ClusterConfig{
 			Enabled:     false,
@@ -0,0 +1,44 @@
+package logging
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Fields identifies the subject of a log event. Empty fields are omitted.
+type Fields struct {
+	RequestID string
+	Queue     string
+	JobID     string
+	LeaseID   string
+}
+
+// With returns a sub-logger of the global logger carrying the given fields
+func With(f Fields) *zerolog.Logger {
+	ctx := log.Logger.With()
+	if f.RequestID != "" {
+		ctx = ctx.Str("request_id", f.RequestID)
+	}
+	if f.Queue != "" {
+		ctx = ctx.Str("queue", f.Queue)
+	}
+	if f.JobID != "" {
+		ctx = ctx.Str("job_id", f.JobID)
+	}
+	if f.LeaseID != "" {
+		ctx = ctx.Str("lease_id", f.LeaseID)
+	}
+
+	logger := ctx.Logger()
+	return &logger
+}
+
+// FromRequest returns a sub-logger carrying the request ID assigned by the
+// RequestID middleware plus the given fields
+func FromRequest(r *http.Request, f Fields) *zerolog.Logger {
+	f.RequestID = middleware.GetReqID(r.Context())
+	return With(f)
+}
@@ -0,0 +1,51 @@
+package logging
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync/atomic"
+)
+
+// maxLoggedValue is the most bytes of a value written to a log line when
+// redaction is off
+const maxLoggedValue = 256
+
+var redact atomic.Bool
+
+// SetRedaction enables or disables redaction. When enabled, user-supplied
+// strings such as nack reasons are replaced in logs by a size and hash
+// placeholder, and internal error details are withheld from clients.
+// Deployments handling PII should enable it.
+func SetRedaction(enabled bool) {
+	redact.Store(enabled)
+}
+
+// Redacting reports whether redaction is enabled
+func Redacting() bool {
+	return redact.Load()
+}
+
+// Value returns a user-supplied string, such as a nack reason or idempotency
+// key, for logging: truncated, or a placeholder when redacting
+func Value(s string) string {
+	if redact.Load() {
+		return placeholder([]byte(s))
+	}
+	if len(s) > maxLoggedValue {
+		return fmt.Sprintf("%s...(%d bytes)", s[:maxLoggedValue], len(s))
+	}
+	return s
+}
+
+// Digest identifies data by size and a short hash, so equal values can be
+// correlated across log lines without revealing them. Job payloads are only
+// ever logged this way, whether or not redaction is enabled.
+func Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("%d bytes sha256:%x", len(data), sum[:4])
+}
+
+// placeholder replaces redacted data
+func placeholder(data []byte) string {
+	return "[redacted " + Digest(data) + "]"
+}
@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// RingBuffer is a zerolog writer keeping the most recent log events in
+// memory, so they can be served over the admin API without access to the
+// host. Install it next to the regular output with zerolog.MultiLevelWriter.
+type RingBuffer struct {
+	mu      sync.Mutex
+	entries []ringEntry
+	next    int // Slot the next event is written to
+	full    bool
+}
+
+// ringEntry is one buffered log event
+type ringEntry struct {
+	level zerolog.Level
+	line  json.RawMessage
+}
+
+// NewRingBuffer creates a buffer holding the last size events
+func NewRingBuffer(size int) *RingBuffer {
+	if size < 1 {
+		size = 1
+	}
+	return &RingBuffer{entries: make([]ringEntry, size)}
+}
+
+// Write buffers an event without a known level
+func (b *RingBuffer) Write(p []byte) (int, error) {
+	return b.WriteLevel(zerolog.NoLevel, p)
+}
+
+// WriteLevel buffers an event, evicting the oldest one if the buffer is full.
+// zerolog reuses p, so the event is copied.
+func (b *RingBuffer) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	line := bytes.TrimRight(p, "\n")
+	entry := ringEntry{level: level, line: append(json.RawMessage(nil), line...)}
+
+	b.mu.Lock()
+	b.entries[b.next] = entry
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+	b.mu.Unlock()
+
+	return len(p), nil
+}
+
+// Size returns how many events the buffer holds at most
+func (b *RingBuffer) Size() int {
+	return len(b.entries)
+}
+
+// Recent returns up to limit of the most recent events at minLevel or above,
+// oldest first. Events without a level are always included. A limit of zero
+// returns every match.
+func (b *RingBuffer) Recent(minLevel zerolog.Level, limit int) []json.RawMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	count := b.next
+	if b.full {
+		count = len(b.entries)
+	}
+
+	// Walk back from the newest event so the limit keeps the latest ones
+	var matches []json.RawMessage
+	for i := 0; i < count && (limit <= 0 || len(matches) < limit); i++ {
+		entry := b.entries[(b.next-1-i+len(b.entries))%len(b.entries)]
+		if entry.level >= minLevel || entry.level == zerolog.NoLevel {
+			matches = append(matches, entry.line)
+		}
+	}
+
+	for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+		matches[i], matches[j] = matches[j], matches[i]
+	}
+	return matches
+}
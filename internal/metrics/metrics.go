@@ -42,6 +42,75 @@ var (
 		[]string{"queue"},
 	)
 
+	// JobsDLQTotal counts jobs entering the DLQ by how they got there
+	JobsDLQTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rivetq_jobs_dlq_total",
+			Help: "Total number of jobs dead-lettered, by reason",
+		},
+		[]string{"queue", "reason"},
+	)
+
+	// JobsDroppedTotal counts exhausted jobs dropped because the DLQ is disabled
+	JobsDroppedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rivetq_jobs_dropped_total",
+			Help: "Total number of exhausted jobs dropped instead of dead-lettered",
+		},
+		[]string{"queue"},
+	)
+
+	// TimeToFirstLease observes how long jobs wait to be picked up the first
+	// time, from enqueue (or their ETA, if later) to first lease
+	TimeToFirstLease = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "rivetq_time_to_first_lease_seconds",
+			Help:    "Time from a job becoming ready to its first lease",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 16), // 5ms to ~164s
+		},
+		[]string{"queue"},
+	)
+
+	// MemoryInUse is the heap in use as last checked against the memory
+	// pressure ceiling
+	MemoryInUse = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "rivetq_memory_in_use_bytes",
+			Help: "Go heap in use when memory pressure was last checked",
+		},
+	)
+
+	// MemoryPressureShedTotal counts ready jobs dead-lettered because memory
+	// use reached its ceiling
+	MemoryPressureShedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rivetq_memory_pressure_shed_total",
+			Help: "Total number of ready jobs shed under memory pressure, by policy",
+		},
+		[]string{"queue", "policy"},
+	)
+
+	// ReconcileDiscrepancies counts job metadata entries the reconciler
+	// found out of line with the queues and fixed
+	ReconcileDiscrepancies = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rivetq_reconcile_discrepancies_total",
+			Help: "Total number of job metadata entries corrected by the reconciler, by kind",
+		},
+		[]string{"kind"},
+	)
+
+	// BackoffDelay observes the delay before each retry of a nacked or
+	// expired job, to check backoff is growing as configured
+	BackoffDelay = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "rivetq_backoff_delay_seconds",
+			Help:    "Delay before a nacked or expired job is retried",
+			Buckets: prometheus.ExponentialBuckets(0.125, 2, 11), // 125ms to 128s
+		},
+		[]string{"queue"},
+	)
+
 	// JobsReady gauge for ready jobs
 	JobsReady = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -85,6 +154,42 @@ var (
 		},
 	)
 
+	// WALSegmentThresholdExceeded counts rotations that left the WAL above its segment threshold
+	WALSegmentThresholdExceeded = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "rivetq_wal_segment_threshold_exceeded",
+			Help: "Number of times the WAL segment count exceeded the configured threshold",
+		},
+	)
+
+	// IdempotencyStoreErrors counts store failures while checking ("get") or
+	// recording ("set") idempotency keys
+	IdempotencyStoreErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rivetq_idempotency_store_errors_total",
+			Help: "Total number of store failures while checking or recording idempotency keys",
+		},
+		[]string{"op"},
+	)
+
+	// IdempotencyKeys gauge for stored idempotency keys
+	IdempotencyKeys = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "rivetq_idempotency_keys",
+			Help: "Number of stored idempotency keys",
+		},
+	)
+
+	// SubscribersActive gauge for clients holding a connection open on a
+	// queue, such as waiting leases
+	SubscribersActive = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "rivetq_subscribers_active",
+			Help: "Number of subscribers currently connected to a queue",
+		},
+		[]string{"queue"},
+	)
+
 	// RateLimitRejections counts rate limit rejections
 	RateLimitRejections = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -138,3 +243,27 @@ var (
 		},
 	)
 )
+
+// ForgetQueue removes every series labeled with a queue, so a purged queue
+// stops being reported
+func ForgetQueue(queue string) {
+	labels := prometheus.Labels{"queue": queue}
+	for _, vec := range []*prometheus.MetricVec{
+		JobsEnqueuedTotal.MetricVec,
+		JobsLeasedTotal.MetricVec,
+		JobsAckedTotal.MetricVec,
+		JobsNackedTotal.MetricVec,
+		JobsDLQTotal.MetricVec,
+		JobsDroppedTotal.MetricVec,
+		TimeToFirstLease.MetricVec,
+		MemoryPressureShedTotal.MetricVec,
+		BackoffDelay.MetricVec,
+		JobsReady.MetricVec,
+		JobsInflight.MetricVec,
+		JobsDLQ.MetricVec,
+		RateLimitRejections.MetricVec,
+		SubscribersActive.MetricVec,
+	} {
+		vec.DeletePartialMatch(labels)
+	}
+}
@@ -0,0 +1,228 @@
+package queue
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rivetq/rivetq/internal/logging"
+	"github.com/rivetq/rivetq/internal/metrics"
+	"github.com/rivetq/rivetq/internal/wal"
+)
+
+// EnqueueSpec describes one job of an EnqueueBatch
+type EnqueueSpec struct {
+	JobID          string // Generated if empty, see EnqueueWithOptions
+	Payload        []byte
+	Headers        map[string]string
+	Priority       uint8
+	DelayMs        int64
+	RetryPolicy    RetryPolicy
+	IdempotencyKey string
+}
+
+// BatchError reports the job that made a batch enqueue fail
+type BatchError struct {
+	Index int // Position of the job in the batch
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("job %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// EnqueueBatch adds jobs to a queue with a single WAL write and a single
+// acquisition of the queue lock, and returns their IDs in batch order.
+// Every job is checked before anything is written: if one is invalid or
+// conflicts, nothing is enqueued and the returned *BatchError names it.
+//
+// Idempotency keys and provided job IDs are checked per job, as by
+// EnqueueWithOptions. A job whose key or ID maps to a job already enqueued,
+// or to one earlier in the batch, is not enqueued again and gets that job's
+// ID. The queue's rate limit takes a token per new job and rejects the whole
+// batch if it cannot take them all.
+func (m *Manager) EnqueueBatch(queueName string, specs []EnqueueSpec) ([]string, error) {
+	if err := m.checkOpen(); err != nil {
+		return nil, err
+	}
+	if m.Maintenance().RejectEnqueues {
+		return nil, ErrMaintenance
+	}
+
+	var defaults map[string]string
+	var transforms []Transform
+	if queue := m.getQueue(queueName); queue != nil {
+		queue.mu.RLock()
+		defaults = queue.config.DefaultHeaders
+		transforms = queue.config.Transforms
+		queue.mu.RUnlock()
+	}
+
+	// Headers and priorities of the jobs as enqueued
+	now := time.Now()
+	headers := make([]map[string]string, len(specs))
+	priorities := make([]uint8, len(specs))
+
+	providedIDs := false
+	for i, spec := range specs {
+		err := validateJobID(spec.JobID)
+		if err == nil {
+			err = m.checkDelay(spec.DelayMs)
+		}
+		if err == nil {
+			err = m.checkHeaders(spec.Headers)
+		}
+		// Default headers and transforms may push the job over the limits
+		if err == nil {
+			headers[i], priorities[i] = applyTransforms(transforms, withDefaultHeaders(defaults, spec.Headers), spec.Priority, now)
+			err = m.checkHeaders(headers[i])
+		}
+		if err != nil {
+			return nil, &BatchError{Index: i, Err: err}
+		}
+		providedIDs = providedIDs || spec.JobID != ""
+	}
+
+	// As in EnqueueWithOptions, the lock is held until the jobs are added
+	if providedIDs {
+		m.jobIDMu.Lock()
+		defer m.jobIDMu.Unlock()
+	}
+
+	ids := make([]string, len(specs))
+	hashes := make([]string, len(specs))
+	fresh := make([]int, 0, len(specs)) // Indexes of the jobs to enqueue
+	byKey := make(map[string]int)
+	byID := make(map[string]int)
+	for i, spec := range specs {
+		if spec.IdempotencyKey != "" {
+			hashes[i] = requestHash(spec.Payload, spec.Headers)
+			if j, ok := byKey[spec.IdempotencyKey]; ok {
+				if err := m.checkIdempotencyConflict(queueName, ids[j], hashes[j], hashes[i]); err != nil {
+					return nil, &BatchError{Index: i, Err: err}
+				}
+				ids[i] = ids[j]
+				continue
+			}
+			existingJobID, existingHash, err := m.lookupIdempotencyKey(queueName, spec.IdempotencyKey)
+			if err != nil {
+				return nil, &BatchError{Index: i, Err: err}
+			}
+			if existingJobID != "" {
+				if err := m.checkIdempotencyConflict(queueName, existingJobID, existingHash, hashes[i]); err != nil {
+					return nil, &BatchError{Index: i, Err: err}
+				}
+				ids[i] = existingJobID
+				continue
+			}
+		}
+
+		if spec.JobID != "" {
+			if j, ok := byID[spec.JobID]; ok {
+				if requestHash(specs[j].Payload, specs[j].Headers) != requestHash(spec.Payload, spec.Headers) {
+					return nil, &BatchError{Index: i, Err: fmt.Errorf("%w: %s is taken by job %d of the batch", ErrJobIDCollision, spec.JobID, j)}
+				}
+				ids[i] = spec.JobID
+				continue
+			}
+			duplicate, err := m.checkJobID(queueName, spec.JobID, spec.Payload, spec.Headers)
+			if err != nil {
+				return nil, &BatchError{Index: i, Err: err}
+			}
+			if duplicate {
+				ids[i] = spec.JobID
+				continue
+			}
+		}
+
+		ids[i] = spec.JobID
+		if ids[i] == "" {
+			ids[i] = uuid.New().String()
+		} else {
+			byID[ids[i]] = i
+		}
+		if spec.IdempotencyKey != "" {
+			byKey[spec.IdempotencyKey] = i
+		}
+		fresh = append(fresh, i)
+	}
+
+	if len(fresh) == 0 {
+		return ids, nil
+	}
+	if !m.rateLimiter.AllowN(queueName, float64(len(fresh))) {
+		metrics.RateLimitRejections.WithLabelValues(queueName).Add(float64(len(fresh)))
+		return nil, fmt.Errorf("%w for queue %s", ErrRateLimited, queueName)
+	}
+
+	jobs := make([]*Job, len(fresh))
+	records := make([]*wal.Record, len(fresh))
+	for n, i := range fresh {
+		spec := specs[i]
+		eta := time.Now()
+		if spec.DelayMs > 0 {
+			eta = eta.Add(time.Duration(spec.DelayMs) * time.Millisecond)
+		}
+
+		jobs[n] = &Job{
+			ID:         ids[i],
+			Queue:      queueName,
+			Payload:    spec.Payload,
+			Headers:    headers[i],
+			Priority:   priorities[i],
+			MaxRetries: spec.RetryPolicy.MaxRetries,
+			ETA:        eta,
+			Status:     JobStatusReady,
+			EnqueuedAt: time.Now(),
+			Seq:        m.nextSeq(),
+			BaseDelay:  spec.RetryPolicy.BaseDelay,
+			MaxDelay:   spec.RetryPolicy.MaxDelay,
+			Multiplier: spec.RetryPolicy.Multiplier,
+		}
+		records[n] = &wal.Record{
+			Type:       wal.RecordTypeEnqueue,
+			Queue:      queueName,
+			JobID:      ids[i],
+			Payload:    spec.Payload,
+			Headers:    headers[i],
+			Priority:   priorities[i],
+			MaxRetries: spec.RetryPolicy.MaxRetries,
+			ETA:        eta,
+			BaseDelay:  spec.RetryPolicy.BaseDelay,
+			MaxDelay:   spec.RetryPolicy.MaxDelay,
+			Multiplier: spec.RetryPolicy.Multiplier,
+			Seq:        jobs[n].Seq,
+		}
+	}
+
+	if err := m.wal.WriteBatch(records); err != nil {
+		return nil, fmt.Errorf("failed to write to WAL: %w", err)
+	}
+
+	for _, i := range fresh {
+		if key := specs[i].IdempotencyKey; key != "" {
+			m.storeIdempotencyKey(queueName, key, ids[i], hashes[i])
+		}
+	}
+
+	queue := m.getOrCreateQueue(queueName)
+	queue.mu.Lock()
+	for queue.deleted {
+		queue.mu.Unlock()
+		queue = m.getOrCreateQueue(queueName)
+		queue.mu.Lock()
+	}
+	for _, job := range jobs {
+		queue.pushReady(job)
+	}
+	queue.updateGauges()
+	queue.mu.Unlock()
+	metrics.JobsEnqueuedTotal.WithLabelValues(queueName).Add(float64(len(jobs)))
+
+	logging.With(logging.Fields{Queue: queueName}).Debug().Int("jobs", len(jobs)).Msg("job batch enqueued")
+	return ids, nil
+}
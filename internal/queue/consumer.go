@@ -0,0 +1,20 @@
+package queue
+
+import "time"
+
+// hasActiveConsumer reports whether any job is leased or reserved. Must be
+// called with q.mu held.
+func (q *Queue) hasActiveConsumer() bool {
+	return len(q.inflight) > 0 || len(q.reserved) > 0
+}
+
+// nextFencingToken issues a fencing token greater than any issued before.
+// Tokens are logged with their lease and replay restores the greatest, so they
+// keep increasing across restarts even if the clock went backwards. Tokens are
+// also seeded from the clock (in microseconds, so they stay exact as JSON
+// numbers), which covers leases whose records were compacted away or lost
+// in a crash. Must be called with q.mu held.
+func (q *Queue) nextFencingToken(now time.Time) uint64 {
+	q.fence = max(q.fence+1, uint64(now.UnixMicro()))
+	return q.fence
+}
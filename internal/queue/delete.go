@@ -0,0 +1,84 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rivetq/rivetq/internal/logging"
+)
+
+// ErrQueueBusy is returned when deleting a queue that still has jobs leased
+// or reserved, without forcing it
+var ErrQueueBusy = errors.New("queue has outstanding jobs")
+
+// DeleteQueue deletes a queue with its ready and DLQ jobs. Unless force is
+// set, it fails with ErrQueueBusy while any of the queue's jobs are leased or
+// reserved; forcing it drops those too, and their consumers get
+// ErrJobNotFound when they ack. Leases waiting on the queue return
+// ErrQueueNotFound.
+//
+// The jobs and the queue are logged as deleted in the WAL, so neither comes
+// back after a restart. An enqueue to the queue afterwards creates it anew,
+// with the default config.
+func (m *Manager) DeleteQueue(name string, force bool) error {
+	m.mu.Lock()
+	m.awaitDeletion(name)
+	queue, exists := m.queues[name]
+	if !exists {
+		m.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrQueueNotFound, name)
+	}
+	queue.mu.RLock()
+	outstanding := len(queue.inflight) + len(queue.reserved)
+	queue.mu.RUnlock()
+	if !force && outstanding > 0 {
+		m.mu.Unlock()
+		return fmt.Errorf("%w: %d jobs leased or reserved in %s", ErrQueueBusy, outstanding, name)
+	}
+
+	// The queue leaves m.queues before its jobs are purged, so the rest of
+	// the node is not held up by a large queue. Creating it anew waits until
+	// the purge is logged, see awaitDeletion.
+	delete(m.queues, name)
+	done := make(chan struct{})
+	m.deletingQueues[name] = done
+	m.mu.Unlock()
+
+	purged, err := m.purgeQueue(queue, force)
+
+	m.mu.Lock()
+	if err != nil {
+		m.queues[name] = queue // Nothing was purged
+	}
+	delete(m.deletingQueues, name)
+	close(done)
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	logging.With(logging.Fields{Queue: name}).Warn().Int("jobs", purged).Bool("force", force).Msg("queue deleted")
+
+	return nil
+}
+
+// awaitDeletion waits out a deletion of queue name, or a purge of its
+// namespace, so that a queue created with the name logs its records after
+// the deletion's. Must be called with m.mu held for writing; it is released
+// while waiting.
+func (m *Manager) awaitDeletion(name string) {
+	namespace, _ := SplitQueueName(name)
+	for {
+		done, deleting := m.deletingQueues[name]
+		if !deleting && namespace != "" {
+			done, deleting = m.purgingNamespaces[namespace]
+		}
+		if !deleting {
+			return
+		}
+
+		m.mu.Unlock()
+		<-done
+		m.mu.Lock()
+	}
+}
@@ -0,0 +1,58 @@
+package queue
+
+import (
+	"fmt"
+
+	"github.com/rivetq/rivetq/internal/wal"
+)
+
+// DeliveryMode controls what happens to a leased job that is never acked
+type DeliveryMode string
+
+const (
+	// DeliveryAtLeastOnce redelivers a job whose lease times out or whose
+	// consumer crashes, so a job may be processed more than once (default)
+	DeliveryAtLeastOnce DeliveryMode = "at_least_once"
+	// DeliveryAtMostOnce marks a job consumed when it is leased: it is never
+	// redelivered, even if the consumer crashes before finishing it. Use it
+	// where processing a job twice is worse than losing it.
+	DeliveryAtMostOnce DeliveryMode = "at_most_once"
+)
+
+// ParseDeliveryMode parses a delivery mode, defaulting to at-least-once when
+// empty
+func ParseDeliveryMode(s string) (DeliveryMode, error) {
+	switch DeliveryMode(s) {
+	case "", DeliveryAtLeastOnce:
+		return DeliveryAtLeastOnce, nil
+	case DeliveryAtMostOnce:
+		return DeliveryAtMostOnce, nil
+	default:
+		return "", fmt.Errorf("unknown delivery mode %q (want %q or %q)", s, DeliveryAtLeastOnce, DeliveryAtMostOnce)
+	}
+}
+
+// consume logs acks for jobs being handed out by an at-most-once queue, so
+// neither a lease timeout nor a restart brings them back. The jobs stay
+// inflight until the consumer acks or nacks them or the lease runs out, but
+// those only release them. Must be called with q.mu held; the acks are
+// written as one batch, which fsyncs without waiting for a group commit.
+func (m *Manager) consume(jobs []*Job) error {
+	records := make([]*wal.Record, len(jobs))
+	for i, job := range jobs {
+		records[i] = &wal.Record{
+			Type:         wal.RecordTypeAck,
+			Queue:        job.Queue,
+			JobID:        job.ID,
+			LeaseID:      job.LeaseID,
+			FencingToken: job.FencingToken,
+		}
+	}
+	if err := m.wal.WriteBatch(records); err != nil {
+		return fmt.Errorf("failed to write to WAL: %w", err)
+	}
+	for _, job := range jobs {
+		job.Consumed = true
+	}
+	return nil
+}
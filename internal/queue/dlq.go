@@ -0,0 +1,394 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rivetq/rivetq/internal/logging"
+	"github.com/rivetq/rivetq/internal/metrics"
+	"github.com/rivetq/rivetq/internal/store"
+	"github.com/rivetq/rivetq/internal/wal"
+)
+
+// ErrDLQDisabled is returned by MoveToDLQ for queues without a DLQ
+var ErrDLQDisabled = errors.New("dlq disabled")
+
+// Reason labels of rivetq_jobs_dlq_total besides DLQReasonRepeatedCrash and
+// DLQReasonManual. Nack reasons are free text, so the metric labels a job by
+// how it reached the DLQ instead, keeping the label's values bounded.
+const (
+	dlqMetricRetriesExhausted = "retries_exhausted"
+	dlqMetricNackRule         = "nack_rule"
+	dlqMetricPermanent        = "permanent"
+	dlqMetricLeaseExpired     = "lease_expired"
+)
+
+// countDLQ counts jobs entering a queue's DLQ
+func countDLQ(queueName, reason string, jobs int) {
+	metrics.JobsDLQTotal.WithLabelValues(queueName, reason).Add(float64(jobs))
+}
+
+// Jobs shed into the DLQ under memory pressure keep their payloads in the
+// store rather than in the DLQ map, or shedding would free little. Readers
+// load them back on demand, and a requeued job takes its payload back into
+// memory. Like spilled jobs, offloaded payloads are not written durably: the
+// WAL holds them, and the area is cleared and rebuilt on startup.
+
+// dlqPayloadPrefix returns the store prefix of a queue's offloaded DLQ
+// payloads
+func dlqPayloadPrefix(queueName string) []byte {
+	return []byte("dlqpayload:" + queueName + "\x00")
+}
+
+// dlqPayloadKey returns the store key of a DLQ job's offloaded payload
+func dlqPayloadKey(queueName, jobID string) []byte {
+	return append(dlqPayloadPrefix(queueName), jobID...)
+}
+
+// offloadPayload moves a DLQ job's payload to the store. The job keeps its
+// payload if the write fails. Must be called with q.mu held.
+func (q *Queue) offloadPayload(job *Job) {
+	if q.store == nil || job.payloadOffloaded || len(job.Payload) == 0 {
+		return
+	}
+	if err := q.store.SetNoSync(dlqPayloadKey(q.name, job.ID), job.Payload); err != nil {
+		logging.With(logging.Fields{Queue: q.name, JobID: job.ID}).Warn().Err(err).Msg("failed to offload DLQ payload, keeping it in memory")
+		return
+	}
+	job.Payload = nil
+	job.payloadOffloaded = true
+}
+
+// loadPayload reads an offloaded payload back into job, which must be a copy
+// of the DLQ job, not the job itself. Must be called with q.mu held.
+func (q *Queue) loadPayload(job *Job) error {
+	if !job.payloadOffloaded {
+		return nil
+	}
+	payload, err := q.store.Get(dlqPayloadKey(q.name, job.ID))
+	if err != nil {
+		return fmt.Errorf("failed to load DLQ payload: %w", err)
+	}
+	if payload == nil {
+		return fmt.Errorf("failed to load DLQ payload: %w: %s", ErrJobNotFound, job.ID)
+	}
+	job.Payload = payload
+	job.payloadOffloaded = false
+	return nil
+}
+
+// restorePayload moves an offloaded payload back into a job leaving the DLQ
+// for the ready jobs. Must be called with q.mu held.
+func (q *Queue) restorePayload(job *Job) error {
+	if !job.payloadOffloaded {
+		return nil
+	}
+	if err := q.loadPayload(job); err != nil {
+		return err
+	}
+	q.dropPayload(job.ID)
+	return nil
+}
+
+// dropPayload deletes a job's offloaded payload, if any. Must be called with
+// q.mu held.
+func (q *Queue) dropPayload(jobID string) {
+	if q.store == nil {
+		return
+	}
+	if err := q.store.DeleteNoSync(dlqPayloadKey(q.name, jobID)); err != nil {
+		logging.With(logging.Fields{Queue: q.name, JobID: jobID}).Warn().Err(err).Msg("failed to delete offloaded DLQ payload")
+	}
+}
+
+// HeaderFilter selects jobs whose headers contain every key with the given
+// value. An empty filter matches every job.
+type HeaderFilter map[string]string
+
+// Matches reports whether headers satisfy the filter
+func (f HeaderFilter) Matches(headers map[string]string) bool {
+	for k, v := range f {
+		if got, ok := headers[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// MoveToDLQ dead-letters every ready job matching filter, including delayed
+// ones, with reason DLQReasonManual, and returns how many were moved. It lets
+// operators pull jobs out of circulation without processing them, e.g. jobs
+// produced by a bad deploy. Leased and reserved jobs are left alone.
+func (m *Manager) MoveToDLQ(queueName string, filter HeaderFilter) (int, error) {
+	queue := m.getQueue(queueName)
+	if queue == nil {
+		return 0, fmt.Errorf("%w: %s", ErrQueueNotFound, queueName)
+	}
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if !queue.config.DLQEnabled {
+		return 0, fmt.Errorf("%w: %s", ErrDLQDisabled, queueName)
+	}
+
+	var matched []*Job
+	for _, job := range queue.readyJobs() {
+		if filter.Matches(job.Headers) {
+			matched = append(matched, job)
+		}
+	}
+	if len(matched) == 0 {
+		return 0, nil
+	}
+
+	if err := m.deadLetterReady(queue, matched, DLQReasonManual); err != nil {
+		return 0, err
+	}
+
+	logging.With(logging.Fields{Queue: queueName}).Warn().Int("jobs", len(matched)).Msg("jobs moved to DLQ manually")
+
+	return len(matched), nil
+}
+
+// PurgeDLQ deletes the jobs in a queue's DLQ and returns how many were
+// purged. With olderThan above zero, only jobs that entered the DLQ at least
+// that long ago are purged. Purged jobs are tombstoned in the WAL so they do
+// not come back after a restart.
+func (m *Manager) PurgeDLQ(queueName string, olderThan time.Duration) (int, error) {
+	queue := m.getQueue(queueName)
+	if queue == nil {
+		return 0, fmt.Errorf("%w: %s", ErrQueueNotFound, queueName)
+	}
+
+	// Jobs nacked into the DLQ meanwhile wait for the lock, and are kept
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	cutoff := time.Now().Add(-olderThan)
+	var records []*wal.Record
+	for _, job := range queue.dlq {
+		if olderThan > 0 && job.DLQAt.After(cutoff) {
+			continue
+		}
+		records = append(records, &wal.Record{
+			Type:   wal.RecordTypeTombstone,
+			Queue:  queueName,
+			JobID:  job.ID,
+			Reason: "dlq purged",
+			Tries:  job.Tries,
+		})
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+
+	if err := m.wal.WriteBatch(records); err != nil {
+		return 0, fmt.Errorf("failed to write to WAL: %w", err)
+	}
+
+	for _, record := range records {
+		if queue.dlq[record.JobID].payloadOffloaded {
+			queue.dropPayload(record.JobID)
+		}
+		delete(queue.dlq, record.JobID)
+		if err := m.store.DeleteJob(record.JobID); err != nil {
+			logging.With(logging.Fields{Queue: queueName, JobID: record.JobID}).Warn().Err(err).Msg("failed to delete job history")
+		}
+	}
+	queue.updateGauges()
+
+	logging.With(logging.Fields{Queue: queueName}).Warn().Int("jobs", len(records)).Dur("older_than", olderThan).Msg("DLQ purged")
+
+	return len(records), nil
+}
+
+// DLQJob is a dead-lettered job with the retry history that led it there
+type DLQJob struct {
+	*Job
+	// History holds the job's failed attempts, oldest first, capped at
+	// MaxHistoryEntries
+	History []store.JobTransition
+}
+
+// GetDLQJob returns a job in a queue's DLQ together with its retry history,
+// for debugging why it failed. Returns ErrJobNotFound if the job is not in
+// the DLQ.
+func (m *Manager) GetDLQJob(queueName, jobID string) (*DLQJob, error) {
+	queue := m.getQueue(queueName)
+	if queue == nil {
+		return nil, fmt.Errorf("%w: %s", ErrQueueNotFound, queueName)
+	}
+
+	queue.mu.RLock()
+	job, exists := queue.dlq[jobID]
+	var err error
+	if exists {
+		job = job.clone()
+		job.Status = JobStatusDLQ
+		err = queue.loadPayload(job)
+	}
+	queue.mu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("%w: %s in DLQ of queue %s", ErrJobNotFound, jobID, queueName)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := m.JobHistory(jobID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load job history: %w", err)
+	}
+
+	return &DLQJob{Job: job, History: history}, nil
+}
+
+// RequeueDLQ moves a job out of a queue's DLQ back to its ready jobs, as if
+// new: its tries are reset and it is ready right away. For replaying
+// dead-lettered jobs once whatever made them fail has been fixed.
+func (m *Manager) RequeueDLQ(queueName, jobID string) error {
+	queue := m.getQueue(queueName)
+	if queue == nil {
+		return fmt.Errorf("%w: %s", ErrQueueNotFound, queueName)
+	}
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	job, exists := queue.dlq[jobID]
+	if !exists {
+		return fmt.Errorf("%w: %s in DLQ of queue %s", ErrJobNotFound, jobID, queueName)
+	}
+	if err := m.requeueDead(queue, []*Job{job}); err != nil {
+		return err
+	}
+
+	logging.With(logging.Fields{Queue: queueName, JobID: jobID}).Info().Msg("job requeued from DLQ")
+
+	return nil
+}
+
+// RequeueAllDLQ requeues every job in a queue's DLQ like RequeueDLQ, and
+// returns how many were requeued
+func (m *Manager) RequeueAllDLQ(queueName string) (int, error) {
+	queue := m.getQueue(queueName)
+	if queue == nil {
+		return 0, fmt.Errorf("%w: %s", ErrQueueNotFound, queueName)
+	}
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if len(queue.dlq) == 0 {
+		return 0, nil
+	}
+	jobs := make([]*Job, 0, len(queue.dlq))
+	for _, job := range queue.dlq {
+		jobs = append(jobs, job)
+	}
+	if err := m.requeueDead(queue, jobs); err != nil {
+		return 0, err
+	}
+
+	logging.With(logging.Fields{Queue: queueName}).Info().Int("jobs", len(jobs)).Msg("jobs requeued from DLQ")
+
+	return len(jobs), nil
+}
+
+// requeueDead moves jobs from the queue's DLQ to its ready jobs with their
+// tries reset. Must be called with q.mu held.
+func (m *Manager) requeueDead(q *Queue, jobs []*Job) error {
+	// Payloads are read before anything is logged, so a failed read leaves
+	// the jobs in the DLQ
+	payloads := make([][]byte, len(jobs))
+	for i, job := range jobs {
+		if !job.payloadOffloaded {
+			continue
+		}
+		loaded := *job
+		if err := q.loadPayload(&loaded); err != nil {
+			return err
+		}
+		payloads[i] = loaded.Payload
+	}
+
+	now := time.Now()
+	records := make([]*wal.Record, len(jobs))
+	for i, job := range jobs {
+		records[i] = &wal.Record{
+			Type:       wal.RecordTypeRequeue,
+			Queue:      q.name,
+			JobID:      job.ID,
+			ETA:        now,
+			Priority:   job.Priority,
+			MaxRetries: job.MaxRetries,
+		}
+	}
+	if err := m.wal.WriteBatch(records); err != nil {
+		return fmt.Errorf("failed to write to WAL: %w", err)
+	}
+
+	for i, job := range jobs {
+		delete(q.dlq, job.ID)
+		if job.payloadOffloaded {
+			job.Payload, job.payloadOffloaded = payloads[i], false
+			q.dropPayload(job.ID)
+		}
+		job.Status = JobStatusReady
+		job.Tries = 0
+		job.Expiries = 0
+		job.ETA = now
+		job.DLQReason = ""
+		job.DLQAt = time.Time{}
+		q.pushReady(job)
+
+		// Keep the job's history, which explains why it was dead-lettered
+		meta := jobMetadata(job)
+		err := m.store.UpdateJob(job.ID, func(stored *store.JobMetadata) *store.JobMetadata {
+			if stored == nil {
+				return nil
+			}
+			meta.History = stored.History
+			return &meta
+		})
+		if err != nil {
+			logging.With(logging.Fields{Queue: q.name, JobID: job.ID}).Warn().Err(err).Msg("failed to update job metadata")
+		}
+	}
+	q.updateGauges()
+	return nil
+}
+
+// deadLetterReady moves ready jobs to the queue's DLQ with reason. Must be
+// called with q.mu held, on a queue with its DLQ enabled.
+func (m *Manager) deadLetterReady(q *Queue, jobs []*Job, reason string) error {
+	records := make([]*wal.Record, len(jobs))
+	for i, job := range jobs {
+		records[i] = &wal.Record{
+			Type:   wal.RecordTypeDLQ,
+			Queue:  q.name,
+			JobID:  job.ID,
+			Reason: reason,
+			Tries:  job.Tries,
+		}
+	}
+	if err := m.wal.WriteBatch(records); err != nil {
+		return fmt.Errorf("failed to write to WAL: %w", err)
+	}
+
+	now := time.Now()
+	for _, job := range jobs {
+		q.removeReady(job.ID)
+		job.Status = JobStatusDLQ
+		job.DLQReason = reason
+		job.DLQAt = now
+		q.dlq[job.ID] = job
+	}
+	q.refill()
+	q.updateGauges()
+	countDLQ(q.name, reason, len(jobs))
+	return nil
+}
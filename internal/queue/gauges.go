@@ -0,0 +1,55 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/rivetq/rivetq/internal/metrics"
+)
+
+// DefaultWALMetricsInterval is how often the WAL size gauges are refreshed
+const DefaultWALMetricsInterval = 10 * time.Second
+
+// updateGauges reports the queue's current depth. Called by every operation
+// that changes it, before releasing the queue. Must be called with q.mu
+// held.
+func (q *Queue) updateGauges() {
+	if q.deleted {
+		return
+	}
+	depth := q.depth()
+	metrics.JobsReady.WithLabelValues(q.name).Set(float64(depth.Ready))
+	metrics.JobsInflight.WithLabelValues(q.name).Set(float64(depth.Inflight))
+	metrics.JobsDLQ.WithLabelValues(q.name).Set(float64(depth.DLQ))
+}
+
+// updateAllGauges reports the depth of every queue
+func (m *Manager) updateAllGauges() {
+	for _, queue := range m.allQueues() {
+		queue.mu.RLock()
+		queue.updateGauges()
+		queue.mu.RUnlock()
+	}
+}
+
+// updateWALGauges reports the WAL's segment count and size
+func (m *Manager) updateWALGauges() {
+	metrics.WALSegments.Set(float64(m.wal.SegmentCount()))
+	metrics.WALSize.Set(float64(m.wal.TotalSize()))
+}
+
+// walMetricsWorker periodically refreshes the WAL size gauges
+func (m *Manager) walMetricsWorker() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(DefaultWALMetricsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stopCh:
+			return
+		case <-ticker.C:
+			m.updateWALGauges()
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/rivetq/rivetq/internal/logging"
+)
+
+// defaultHeadersPrefix is the store key prefix of persisted default
+// headers. Like queue modes, they are kept in the store and applied before
+// the WAL is replayed.
+const defaultHeadersPrefix = "queue_headers:"
+
+// defaultHeadersKey returns the store key of a queue's default headers
+func defaultHeadersKey(queueName string) []byte {
+	return []byte(defaultHeadersPrefix + queueName)
+}
+
+// SetDefaultHeaders sets the headers merged into every job enqueued to a
+// queue from now on, creating the queue if needed. A nil or empty map
+// removes them. The headers are persisted, so they survive a restart, and
+// must fit the node's header limits.
+func (m *Manager) SetDefaultHeaders(queueName string, headers map[string]string) error {
+	if err := m.checkHeaders(headers); err != nil {
+		return err
+	}
+
+	var defaults map[string]string
+	if len(headers) > 0 {
+		defaults = maps.Clone(headers)
+	}
+	if err := m.saveDefaultHeaders(queueName, defaults); err != nil {
+		return err
+	}
+
+	queue := m.getOrCreateQueue(queueName)
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.config.DefaultHeaders = defaults
+	return nil
+}
+
+// saveDefaultHeaders persists a queue's default headers. None are not
+// stored.
+func (m *Manager) saveDefaultHeaders(queueName string, headers map[string]string) error {
+	var err error
+	if len(headers) > 0 {
+		var data []byte
+		if data, err = json.Marshal(headers); err == nil {
+			err = m.store.Set(defaultHeadersKey(queueName), data)
+		}
+	} else {
+		err = m.store.Delete(defaultHeadersKey(queueName))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to persist default headers: %w", err)
+	}
+	return nil
+}
+
+// loadDefaultHeaders applies the persisted default headers, creating the
+// queues they belong to if needed, before the WAL is replayed into them
+func (m *Manager) loadDefaultHeaders() error {
+	defaults := make(map[string]map[string]string)
+	err := m.store.Scan([]byte(defaultHeadersPrefix), func(key, value []byte) error {
+		var headers map[string]string
+		if err := json.Unmarshal(value, &headers); err != nil {
+			return err
+		}
+		defaults[strings.TrimPrefix(string(key), defaultHeadersPrefix)] = headers
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, headers := range defaults {
+		queue, exists := m.queues[name]
+		if !exists {
+			cfg := m.defaultQueueConfig()
+			cfg.DefaultHeaders = headers
+			m.queues[name] = m.newQueue(name, cfg)
+		} else {
+			queue.mu.Lock()
+			queue.config.DefaultHeaders = headers
+			queue.mu.Unlock()
+		}
+		logging.With(logging.Fields{Queue: name}).Debug().Int("headers", len(headers)).Msg("restored default headers")
+	}
+	return nil
+}
@@ -2,25 +2,32 @@ package queue
 
 import (
 	"container/heap"
+	"fmt"
+	"sort"
 	"time"
 )
 
 // jobHeapItem wraps a job for heap operations
 type jobHeapItem struct {
-	job   *Job
-	index int
+	job      *Job
+	index    int
+	priority uint8 // Effective priority, fixed while the item is in the heap
+
+	fifoIndex int  // Position in priorityQueue.fifo
+	etaIndex  int  // Position in priorityQueue.eta
+	delayed   bool // In eta rather than heap and fifo
 }
 
 // jobHeap implements heap.Interface for priority queue
-// Jobs are ordered by: priority (DESC), ETA (ASC), enqueued time (ASC)
+// Jobs are ordered by: effective priority (DESC), ETA (ASC), enqueue sequence (ASC)
 type jobHeap []*jobHeapItem
 
 func (h jobHeap) Len() int { return len(h) }
 
 func (h jobHeap) Less(i, j int) bool {
 	// Higher priority comes first
-	if h[i].job.Priority != h[j].job.Priority {
-		return h[i].job.Priority > h[j].job.Priority
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
 	}
 
 	// Earlier ETA comes first
@@ -28,8 +35,8 @@ func (h jobHeap) Less(i, j int) bool {
 		return h[i].job.ETA.Before(h[j].job.ETA)
 	}
 
-	// Earlier enqueue time comes first
-	return h[i].job.EnqueuedAt.Before(h[j].job.EnqueuedAt)
+	// Earlier enqueued comes first
+	return h[i].job.Seq < h[j].job.Seq
 }
 
 func (h jobHeap) Swap(i, j int) {
@@ -54,19 +61,101 @@ func (h *jobHeap) Pop() interface{} {
 	return item
 }
 
-// priorityQueue manages jobs in priority order
+// fifoHeap orders the same items as jobHeap by enqueue sequence alone, for
+// leases that ignore priority
+type fifoHeap []*jobHeapItem
+
+func (h fifoHeap) Len() int { return len(h) }
+
+func (h fifoHeap) Less(i, j int) bool {
+	return h[i].job.Seq < h[j].job.Seq
+}
+
+func (h fifoHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].fifoIndex = i
+	h[j].fifoIndex = j
+}
+
+func (h *fifoHeap) Push(x interface{}) {
+	item := x.(*jobHeapItem)
+	item.fifoIndex = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *fifoHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.fifoIndex = -1
+	*h = old[0 : n-1]
+	return item
+}
+
+// etaHeap orders delayed items by ETA, so the next one due is on top
+type etaHeap []*jobHeapItem
+
+func (h etaHeap) Len() int { return len(h) }
+
+func (h etaHeap) Less(i, j int) bool {
+	if !h[i].job.ETA.Equal(h[j].job.ETA) {
+		return h[i].job.ETA.Before(h[j].job.ETA)
+	}
+	return h[i].job.Seq < h[j].job.Seq
+}
+
+func (h etaHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].etaIndex = i
+	h[j].etaIndex = j
+}
+
+func (h *etaHeap) Push(x interface{}) {
+	item := x.(*jobHeapItem)
+	item.etaIndex = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *etaHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.etaIndex = -1
+	*h = old[0 : n-1]
+	return item
+}
+
+// priorityQueue manages jobs in priority order, with a secondary enqueue-time
+// order for FIFO leases. Jobs whose ETA has not passed are kept apart in an
+// ETA-ordered heap and promoted into the priority and FIFO heaps when due, so
+// a delayed job never blocks ready ones and the next due time is a peek away.
 type priorityQueue struct {
-	heap  jobHeap
+	heap  jobHeap                 // Ready items
+	fifo  fifoHeap                // Ready items by enqueue time
+	eta   etaHeap                 // Delayed items by ETA
 	items map[string]*jobHeapItem // jobID -> item
+
+	// demotionStep is subtracted from a job's priority for each try
+	demotionStep uint8
+
+	// ignorePriority gives every job the same effective priority, for FIFO
+	// queues
+	ignorePriority bool
 }
 
 // newPriorityQueue creates a new priority queue
 func newPriorityQueue() *priorityQueue {
 	pq := &priorityQueue{
 		heap:  make(jobHeap, 0),
+		fifo:  make(fifoHeap, 0),
+		eta:   make(etaHeap, 0),
 		items: make(map[string]*jobHeapItem),
 	}
 	heap.Init(&pq.heap)
+	heap.Init(&pq.fifo)
+	heap.Init(&pq.eta)
 	return pq
 }
 
@@ -76,23 +165,106 @@ func (pq *priorityQueue) Push(job *Job) {
 		return // Already exists
 	}
 
-	item := &jobHeapItem{job: job}
+	item := &jobHeapItem{job: job, priority: pq.effectivePriority(job)}
 	pq.items[job.ID] = item
+	if !dueBy(job, time.Now()) {
+		item.delayed = true
+		heap.Push(&pq.eta, item)
+		return
+	}
 	heap.Push(&pq.heap, item)
+	heap.Push(&pq.fifo, item)
+}
+
+// dueBy reports whether a job's ETA has passed by now
+func dueBy(job *Job, now time.Time) bool {
+	return !job.ETA.After(now)
+}
+
+// promote moves delayed items whose ETA has passed into the ready heaps, in
+// ETA order
+func (pq *priorityQueue) promote(now time.Time) {
+	for pq.eta.Len() > 0 && dueBy(pq.eta[0].job, now) {
+		item := heap.Pop(&pq.eta).(*jobHeapItem)
+		item.delayed = false
+		heap.Push(&pq.heap, item)
+		heap.Push(&pq.fifo, item)
+	}
 }
 
-// Pop removes and returns the highest priority job
+// NextDue returns the ETA of the delayed job due first, or false if no job
+// is delayed
+func (pq *priorityQueue) NextDue() (time.Time, bool) {
+	if pq.eta.Len() == 0 {
+		return time.Time{}, false
+	}
+	return pq.eta[0].job.ETA, true
+}
+
+// DelayedLen returns the number of jobs waiting on their ETA
+func (pq *priorityQueue) DelayedLen() int {
+	return pq.eta.Len()
+}
+
+// effectivePriority returns the job's priority after demotion for failed tries,
+// bounded at zero
+func (pq *priorityQueue) effectivePriority(job *Job) uint8 {
+	if pq.ignorePriority {
+		return 0
+	}
+	if pq.demotionStep == 0 || job.Tries == 0 {
+		return job.Priority
+	}
+
+	demotion := uint64(job.Tries) * uint64(pq.demotionStep)
+	if demotion >= uint64(job.Priority) {
+		return 0
+	}
+	return job.Priority - uint8(demotion)
+}
+
+// SetDemotionStep updates the per-try priority demotion and reorders the heap
+func (pq *priorityQueue) SetDemotionStep(step uint8) {
+	if pq.demotionStep == step {
+		return
+	}
+
+	pq.demotionStep = step
+	for _, item := range pq.items {
+		item.priority = pq.effectivePriority(item.job)
+	}
+	heap.Init(&pq.heap)
+}
+
+// SetIgnorePriority makes every job's effective priority zero, or restores
+// priorities, and reorders the heap
+func (pq *priorityQueue) SetIgnorePriority(ignore bool) {
+	if pq.ignorePriority == ignore {
+		return
+	}
+
+	pq.ignorePriority = ignore
+	for _, item := range pq.items {
+		item.priority = pq.effectivePriority(item.job)
+	}
+	heap.Init(&pq.heap)
+}
+
+// Pop removes and returns the highest priority job among those promoted to
+// ready. Delayed jobs are not considered.
 func (pq *priorityQueue) Pop() *Job {
 	if pq.heap.Len() == 0 {
 		return nil
 	}
 
 	item := heap.Pop(&pq.heap).(*jobHeapItem)
+	heap.Remove(&pq.fifo, item.fifoIndex)
 	delete(pq.items, item.job.ID)
 	return item.job
 }
 
-// Peek returns the highest priority job without removing it
+// Peek returns the highest priority job among those promoted to ready,
+// without removing it
 func (pq *priorityQueue) Peek() *Job {
 	if pq.heap.Len() == 0 {
 		return nil
@@ -107,18 +279,42 @@ func (pq *priorityQueue) Remove(jobID string) *Job {
 		return nil
 	}
 
-	heap.Remove(&pq.heap, item.index)
+	if item.delayed {
+		heap.Remove(&pq.eta, item.etaIndex)
+	} else {
+		heap.Remove(&pq.heap, item.index)
+		heap.Remove(&pq.fifo, item.fifoIndex)
+	}
 	delete(pq.items, jobID)
 	return item.job
 }
 
-// Len returns the number of jobs in the queue
+// Contains reports whether a job is in the queue
+func (pq *priorityQueue) Contains(jobID string) bool {
+	_, exists := pq.items[jobID]
+	return exists
+}
+
+// Jobs returns all queued jobs, delayed ones last, in heap order (not sorted)
+func (pq *priorityQueue) Jobs() []*Job {
+	jobs := make([]*Job, 0, pq.Len())
+	for _, item := range pq.heap {
+		jobs = append(jobs, item.job)
+	}
+	for _, item := range pq.eta {
+		jobs = append(jobs, item.job)
+	}
+	return jobs
+}
+
+// Len returns the number of jobs in the queue, delayed ones included
 func (pq *priorityQueue) Len() int {
-	return pq.heap.Len()
+	return pq.heap.Len() + pq.eta.Len()
 }
 
 // PeekReady returns the next ready job (ETA has passed) without removing it
 func (pq *priorityQueue) PeekReady(now time.Time) *Job {
+	pq.promote(now)
 	if pq.heap.Len() == 0 {
 		return nil
 	}
@@ -133,6 +329,7 @@ func (pq *priorityQueue) PeekReady(now time.Time) *Job {
 
 // PopReady removes and returns the next ready job
 func (pq *priorityQueue) PopReady(now time.Time) *Job {
+	pq.promote(now)
 	if pq.heap.Len() == 0 {
 		return nil
 	}
@@ -144,3 +341,127 @@ func (pq *priorityQueue) PopReady(now time.Time) *Job {
 
 	return pq.Pop()
 }
+
+// oldestReady returns the earliest enqueued item whose ETA has passed,
+// ignoring priority
+func (pq *priorityQueue) oldestReady(now time.Time) *jobHeapItem {
+	pq.promote(now)
+	if pq.fifo.Len() == 0 || !pq.fifo[0].job.IsReady(now) {
+		return nil
+	}
+	return pq.fifo[0]
+}
+
+// PeekOldestReady returns the earliest enqueued ready job without removing it
+func (pq *priorityQueue) PeekOldestReady(now time.Time) *Job {
+	item := pq.oldestReady(now)
+	if item == nil {
+		return nil
+	}
+	return item.job
+}
+
+// PopOldestReady removes and returns the earliest enqueued ready job
+func (pq *priorityQueue) PopOldestReady(now time.Time) *Job {
+	item := pq.oldestReady(now)
+	if item == nil {
+		return nil
+	}
+	return pq.Remove(item.job.ID)
+}
+
+// VerifyIntegrity checks the queue's internal invariants: every heap is
+// ordered, each item's recorded index matches its position, each item sits
+// in the heaps its delayed flag says, items indexes exactly the jobs in the
+// heaps, and priorities match the demotion step. It returns the first
+// violation found, or nil.
+func (pq *priorityQueue) VerifyIntegrity() error {
+	if pq.heap.Len() != pq.fifo.Len() {
+		return fmt.Errorf("priority heap has %d items but FIFO heap has %d", pq.heap.Len(), pq.fifo.Len())
+	}
+	if len(pq.items) != pq.Len() {
+		return fmt.Errorf("index has %d items but heaps hold %d", len(pq.items), pq.Len())
+	}
+
+	check := func(name string, h sort.Interface, i int, item *jobHeapItem, index int, delayed bool) error {
+		if item == nil || item.job == nil {
+			return fmt.Errorf("%s heap slot %d is empty", name, i)
+		}
+		if index != i {
+			return fmt.Errorf("%s heap item %s records index %d but is at %d", name, item.job.ID, index, i)
+		}
+		if item.delayed != delayed {
+			return fmt.Errorf("%s heap item %s has delayed=%t", name, item.job.ID, item.delayed)
+		}
+		if pq.items[item.job.ID] != item {
+			return fmt.Errorf("%s heap item %s is not the indexed item for its job", name, item.job.ID)
+		}
+		if parent := (i - 1) / 2; i > 0 && h.Less(i, parent) {
+			return fmt.Errorf("%s heap item %s at %d orders before its parent at %d", name, item.job.ID, i, parent)
+		}
+		return nil
+	}
+
+	for i, item := range pq.heap {
+		if err := check("priority", pq.heap, i, item, item.index, false); err != nil {
+			return err
+		}
+		if want := pq.effectivePriority(item.job); item.priority != want {
+			return fmt.Errorf("priority heap item %s has priority %d, want %d", item.job.ID, item.priority, want)
+		}
+	}
+	for i, item := range pq.fifo {
+		if err := check("FIFO", pq.fifo, i, item, item.fifoIndex, false); err != nil {
+			return err
+		}
+	}
+	for i, item := range pq.eta {
+		if err := check("ETA", pq.eta, i, item, item.etaIndex, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rebuild reconstructs the heaps and index from every job found in any of
+// them, recomputing priorities and indexes, to repair a violation reported by
+// VerifyIntegrity. Jobs whose ETA has passed are promoted.
+func (pq *priorityQueue) Rebuild() {
+	jobs := make(map[string]*Job, len(pq.items))
+	for id, item := range pq.items {
+		if item != nil && item.job != nil {
+			jobs[id] = item.job
+		}
+	}
+	for _, items := range [][]*jobHeapItem{pq.heap, pq.fifo, pq.eta} {
+		for _, item := range items {
+			if item != nil && item.job != nil {
+				jobs[item.job.ID] = item.job
+			}
+		}
+	}
+
+	pq.heap = make(jobHeap, 0, len(jobs))
+	pq.fifo = make(fifoHeap, 0, len(jobs))
+	pq.eta = make(etaHeap, 0)
+	pq.items = make(map[string]*jobHeapItem, len(jobs))
+
+	now := time.Now()
+	for id, job := range jobs {
+		item := &jobHeapItem{job: job, priority: pq.effectivePriority(job)}
+		pq.items[id] = item
+		if !dueBy(job, now) {
+			item.delayed = true
+			item.etaIndex = len(pq.eta)
+			pq.eta = append(pq.eta, item)
+			continue
+		}
+		item.index = len(pq.heap)
+		pq.heap = append(pq.heap, item)
+		item.fifoIndex = len(pq.fifo)
+		pq.fifo = append(pq.fifo, item)
+	}
+	heap.Init(&pq.heap)
+	heap.Init(&pq.fifo)
+	heap.Init(&pq.eta)
+}
@@ -0,0 +1,105 @@
+package queue
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rivetq/rivetq/internal/logging"
+)
+
+// Heartbeat renews the lease of an inflight job for visibilityMs from now,
+// subject to the same limits as Lease, and returns the new deadline. Tries
+// are not incremented. A consumer working on a long job heartbeats so the
+// job is not redelivered; a lease that already expired cannot be renewed
+// and is reported as ErrLeaseExpired, telling the consumer to stop.
+func (m *Manager) Heartbeat(jobID, leaseID string, visibilityMs int64) (time.Time, error) {
+	m.mu.RLock()
+	limits := m.visibility
+	m.mu.RUnlock()
+
+	visibilityMs, err := limits.apply(visibilityMs)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	queue, job, err := m.findInflight(jobID, leaseID)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	// The lease may have expired between the lookup and taking the lock
+	if job.LeaseID != leaseID || queue.inflight[jobID] != job {
+		return time.Time{}, fmt.Errorf("%w: job %s was reassigned", ErrLeaseExpired, jobID)
+	}
+
+	if err := m.renewLease(job, time.Now().Add(time.Duration(visibilityMs)*time.Millisecond)); err != nil {
+		return time.Time{}, err
+	}
+
+	logging.With(logging.Fields{Queue: job.Queue, JobID: jobID, LeaseID: leaseID}).Debug().Msg("lease renewed")
+
+	return job.LeaseDeadline, nil
+}
+
+// ExtendLease pushes the deadline of an inflight job's lease additionalMs
+// further out, for a consumer that needs longer than it leased the job for.
+// Tries are not incremented. The time left on the extended lease is subject
+// to the same limits as Lease. A lease that already expired, whether or not
+// its job was requeued yet, cannot be extended and is reported as
+// ErrLeaseExpired, telling the consumer to stop.
+func (m *Manager) ExtendLease(jobID, leaseID string, additionalMs int64) error {
+	if additionalMs <= 0 {
+		return fmt.Errorf("%w: extension must be positive, got %dms", ErrVisibilityOutOfRange, additionalMs)
+	}
+
+	m.mu.RLock()
+	limits := m.visibility
+	m.mu.RUnlock()
+
+	queue, job, err := m.findInflight(jobID, leaseID)
+	if err != nil {
+		return err
+	}
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	now := time.Now()
+	if job.LeaseID != leaseID || queue.inflight[jobID] != job || !now.Before(job.LeaseDeadline) {
+		return fmt.Errorf("%w: job %s", ErrLeaseExpired, jobID)
+	}
+
+	remaining := job.LeaseDeadline.Add(time.Duration(additionalMs) * time.Millisecond).Sub(now)
+	remainingMs, err := limits.apply(remaining.Milliseconds())
+	if err != nil {
+		return err
+	}
+	if err := m.renewLease(job, now.Add(time.Duration(remainingMs)*time.Millisecond)); err != nil {
+		return err
+	}
+
+	logging.With(logging.Fields{Queue: job.Queue, JobID: jobID, LeaseID: leaseID}).Debug().
+		Time("lease_deadline", job.LeaseDeadline).
+		Msg("lease extended")
+
+	return nil
+}
+
+// renewLease moves an inflight job's lease deadline, logging the new one so a
+// restart does not expire the lease early. Jobs consumed when leased are not
+// replayed, so theirs is not logged. Must be called with q.mu held.
+func (m *Manager) renewLease(job *Job, deadline time.Time) error {
+	previous := job.LeaseDeadline
+	job.LeaseDeadline = deadline
+	if job.Consumed {
+		return nil
+	}
+	if err := m.logLease(job); err != nil {
+		job.LeaseDeadline = previous
+		return err
+	}
+	return nil
+}
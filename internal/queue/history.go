@@ -0,0 +1,46 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/rivetq/rivetq/internal/logging"
+	"github.com/rivetq/rivetq/internal/store"
+)
+
+const (
+	// MaxHistoryEntries caps the number of retry transitions kept per job
+	MaxHistoryEntries = 32
+
+	// MaxHistoryBytes caps the approximate encoded size of a job's history
+	MaxHistoryBytes = 8 * 1024
+)
+
+// recordHistory appends a nack to the job's persisted retry history. History
+// is diagnostic, so a failure to persist it is logged rather than returned.
+func (m *Manager) recordHistory(job *Job, reason string, retry bool) {
+	transition := store.JobTransition{
+		At:     time.Now().UnixMilli(),
+		Tries:  job.Tries,
+		Reason: reason,
+	}
+	if retry {
+		transition.RetryAt = job.ETA.UnixMilli()
+	}
+
+	if err := m.store.AppendJobHistory(job.ID, job.Queue, transition, MaxHistoryEntries, MaxHistoryBytes); err != nil {
+		logging.With(logging.Fields{Queue: job.Queue, JobID: job.ID}).Warn().Err(err).Msg("failed to record job history")
+	}
+}
+
+// JobHistory returns a job's retry transitions, oldest first, or nil if the
+// job has none. History is removed once the job is acknowledged.
+func (m *Manager) JobHistory(jobID string) ([]store.JobTransition, error) {
+	meta, err := m.store.GetJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return nil, nil
+	}
+	return meta.History, nil
+}
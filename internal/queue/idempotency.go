@@ -0,0 +1,138 @@
+package queue
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/rivetq/rivetq/internal/logging"
+	"github.com/rivetq/rivetq/internal/metrics"
+)
+
+// ErrStoreUnavailable is returned by Enqueue when an idempotency key cannot
+// be checked because the store failed, and the manager fails closed
+var ErrStoreUnavailable = errors.New("store unavailable")
+
+// ErrIdempotencyConflict is returned by Enqueue with strict idempotency when
+// an idempotency key is reused for a request with a different payload or
+// headers than the one that created its job
+var ErrIdempotencyConflict = errors.New("idempotency key reused with a different request")
+
+// storeProbeKey is looked up by CheckStore. It is never set.
+const storeProbeKey = "\x00health"
+
+// idempotencyStore is the part of the store that enqueue dedup relies on.
+// Tests replace it to simulate store failures.
+type idempotencyStore interface {
+	GetIdempotencyEntry(key string) (string, string, error)
+	SetIdempotencyEntry(key, jobID, hash string, ttl time.Duration) error
+}
+
+// SetIdempotencyFailOpen chooses what Enqueue does when the store cannot be
+// read to check an idempotency key. Failing closed (the default) rejects the
+// enqueue with ErrStoreUnavailable, so a retried request never creates a
+// duplicate; failing open enqueues without dedup, keeping producers going
+// through a store outage at the cost of possible duplicates. Either way the
+// failure is logged and counted in rivetq_idempotency_store_errors_total.
+func (m *Manager) SetIdempotencyFailOpen(failOpen bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.idempotencyFailOpen = failOpen
+}
+
+// SetIdempotencyStrict chooses what Enqueue does when an idempotency key is
+// reused for a request whose payload or headers differ from the one that
+// created its job. By default the existing job ID is returned as for any
+// retry; strict mode returns ErrIdempotencyConflict instead, exposing callers
+// that reuse keys for different content. Requests are compared by a hash
+// stored with the key, so keys stored before the hash was recorded always
+// match.
+func (m *Manager) SetIdempotencyStrict(strict bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.idempotencyStrict = strict
+}
+
+// CheckStore reports whether the store can serve idempotency lookups
+func (m *Manager) CheckStore() error {
+	if _, _, err := m.idempotency.GetIdempotencyEntry(storeProbeKey); err != nil {
+		return fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
+	}
+	return nil
+}
+
+// lookupIdempotencyKey returns the job an idempotency key maps to and the
+// hash of the request that created it, or "" if it maps to none or the store
+// failed and the manager fails open
+func (m *Manager) lookupIdempotencyKey(queueName, key string) (string, string, error) {
+	jobID, hash, err := m.idempotency.GetIdempotencyEntry(scopedIdempotencyKey(queueName, key))
+	if err == nil {
+		return jobID, hash, nil
+	}
+
+	metrics.IdempotencyStoreErrors.WithLabelValues("get").Inc()
+
+	m.mu.RLock()
+	failOpen := m.idempotencyFailOpen
+	m.mu.RUnlock()
+
+	if failOpen {
+		logging.With(logging.Fields{Queue: queueName}).Warn().Err(err).Str("idempotency_key", logging.Value(key)).Msg("failed to check idempotency key, enqueuing without dedup")
+		return "", "", nil
+	}
+	return "", "", fmt.Errorf("%w: failed to check idempotency key: %w", ErrStoreUnavailable, err)
+}
+
+// checkIdempotencyConflict returns ErrIdempotencyConflict if strict mode is
+// on and a request reusing the key of jobID differs from the one that
+// created it. An empty stored hash predates hashing and always matches.
+func (m *Manager) checkIdempotencyConflict(queueName, jobID, storedHash, hash string) error {
+	m.mu.RLock()
+	strict := m.idempotencyStrict
+	m.mu.RUnlock()
+
+	if !strict || storedHash == "" || storedHash == hash {
+		return nil
+	}
+
+	logging.With(logging.Fields{Queue: queueName, JobID: jobID}).Warn().Msg("idempotency key reused with a different request")
+	return fmt.Errorf("%w: key maps to job %s", ErrIdempotencyConflict, jobID)
+}
+
+// requestHash returns a hash of an enqueue request's payload and headers,
+// independent of header order
+func requestHash(payload []byte, headers map[string]string) string {
+	h := sha256.New()
+	writeField := func(b []byte) {
+		h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(b))))
+		h.Write(b)
+	}
+
+	writeField(payload)
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writeField([]byte(k))
+		writeField([]byte(headers[k]))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// storeIdempotencyKey maps an idempotency key to a newly enqueued job and the
+// hash of the request that created it. The
+// job is already in the WAL, so a failure cannot fail the enqueue; it is
+// logged and counted, since later retries with the key will not be deduped.
+func (m *Manager) storeIdempotencyKey(queueName, key, jobID, hash string) {
+	if err := m.idempotency.SetIdempotencyEntry(scopedIdempotencyKey(queueName, key), jobID, hash, m.IdempotencyTTL()); err != nil {
+		metrics.IdempotencyStoreErrors.WithLabelValues("set").Inc()
+		logging.With(logging.Fields{Queue: queueName, JobID: jobID}).Error().Err(err).Msg("failed to store idempotency key")
+	}
+	metrics.IdempotencyKeys.Set(float64(m.store.IdempotencyStats().Keys))
+}
@@ -0,0 +1,38 @@
+package queue
+
+// Every change to a queue's inflight jobs goes through these helpers, so the
+// payload bytes held by consumers are tracked as jobs are leased and settled
+// and QueueConfig.MaxInflightBytes can be enforced without summing them.
+
+// addInflight moves a job to the queue's inflight jobs. Must be called with
+// q.mu held.
+func (q *Queue) addInflight(job *Job) {
+	if old, exists := q.inflight[job.ID]; exists {
+		q.inflightBytes -= int64(len(old.Payload))
+	}
+	q.inflight[job.ID] = job
+	q.inflightBytes += int64(len(job.Payload))
+}
+
+// removeInflight drops a job from the queue's inflight jobs, if there. Must
+// be called with q.mu held.
+func (q *Queue) removeInflight(jobID string) {
+	job, exists := q.inflight[jobID]
+	if !exists {
+		return
+	}
+	delete(q.inflight, jobID)
+	q.inflightBytes -= int64(len(job.Payload))
+
+	// Settling a job may let a waiting lease past the inflight limits
+	q.notifyReady()
+}
+
+// inflightFull reports whether leasing job would take the queue's inflight
+// payload bytes past QueueConfig.MaxInflightBytes. A job is always allowed
+// when nothing is inflight, so a payload larger than the cap is still
+// delivered rather than blocking the queue. Must be called with q.mu held.
+func (q *Queue) inflightFull(job *Job) bool {
+	limit := q.config.MaxInflightBytes
+	return limit > 0 && len(q.inflight) > 0 && q.inflightBytes+int64(len(job.Payload)) > limit
+}
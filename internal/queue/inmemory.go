@@ -0,0 +1,30 @@
+package queue
+
+import (
+	"fmt"
+
+	"github.com/rivetq/rivetq/internal/store"
+	"github.com/rivetq/rivetq/internal/wal"
+)
+
+// NewInMemoryManager creates a manager for embedding RivetQ in-process,
+// without a data directory: its store is held in memory and its WAL keeps
+// nothing, so jobs are lost when the process exits. Enqueue, Lease, Ack and
+// Nack behave as they do on a server. Call Start before use; Stop also
+// releases the store.
+func NewInMemoryManager() (*Manager, error) {
+	st, err := store.NewInMemory()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create in-memory store: %w", err)
+	}
+	w := wal.NewInMemory()
+
+	m := NewManager(st, w)
+	m.closeStorage = func() error {
+		if err := w.Close(); err != nil {
+			return err
+		}
+		return st.Close()
+	}
+	return m, nil
+}
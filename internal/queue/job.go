@@ -1,7 +1,11 @@
 package queue
 
 import (
+	"fmt"
 	"time"
+
+	"github.com/rivetq/rivetq/internal/backoff"
+	"github.com/rivetq/rivetq/internal/metrics"
 )
 
 // Job represents a queued job
@@ -10,7 +14,7 @@ type Job struct {
 	Queue         string
 	Payload       []byte
 	Headers       map[string]string
-	Priority      uint8  // 0-9, higher is more important
+	Priority      uint8 // 0-9, higher is more important
 	Tries         uint32
 	MaxRetries    uint32
 	ETA           time.Time // Execute Time After
@@ -18,6 +22,50 @@ type Job struct {
 	LeaseDeadline time.Time
 	Status        JobStatus
 	EnqueuedAt    time.Time
+
+	// Seq is the job's position in the manager's enqueue order. It breaks
+	// ties between jobs of the same priority and ETA deterministically,
+	// where enqueue times may be equal, and is logged, so the order
+	// survives replay.
+	Seq uint64
+
+	// Expiries counts consecutive lease expirations without a nack. A job
+	// whose consumers keep dying without reporting failure is likely poison.
+	Expiries uint32
+	// DLQReason records why the job was moved to the DLQ
+	DLQReason string
+	// DLQAt is when the job was moved to the DLQ. The WAL does not record
+	// it, so jobs replayed into the DLQ get the time of the replay.
+	DLQAt time.Time
+	// FirstLeasedAt is when the job was first leased by this node, zero if
+	// it has not been
+	FirstLeasedAt time.Time
+	// Consumed is set when an at-most-once queue hands the job out; it has
+	// already been acked in the WAL and is never redelivered
+	Consumed bool
+	// FencingToken is set on leases from single-active-consumer queues. It
+	// increases with every lease, so a consumer (or a system it writes to)
+	// can detect that it has been taken over.
+	FencingToken uint64
+	// LeasedAt is when the current lease began
+	LeasedAt time.Time
+	// ExpectedMs is how long the consumer holding the current lease expects
+	// to take, zero if it did not say. A job held longer is overdue.
+	ExpectedMs int64
+
+	// Backoff between retries, from the job's RetryPolicy. Zero values use
+	// the backoff package defaults.
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	Multiplier float64
+
+	// overdueWarned is set once the lease checker has warned about the
+	// current lease running past ExpectedMs
+	overdueWarned bool
+
+	// payloadOffloaded is set on a DLQ job whose payload was moved to the
+	// store to free memory, see offloadPayload. Payload is nil meanwhile.
+	payloadOffloaded bool
 }
 
 // JobStatus represents the current status of a job
@@ -27,13 +75,173 @@ const (
 	JobStatusReady    JobStatus = "ready"
 	JobStatusInflight JobStatus = "inflight"
 	JobStatusDLQ      JobStatus = "dlq"
+	JobStatusReserved JobStatus = "reserved"
 )
 
+// DLQReasonRepeatedCrash is the DLQ reason for jobs quarantined after
+// QueueConfig.MaxConsecutiveExpiries lease expirations in a row
+const DLQReasonRepeatedCrash = "repeated_crash"
+
+// DLQReasonManual is the DLQ reason for jobs dead-lettered by an operator
+// through MoveToDLQ
+const DLQReasonManual = "manual"
+
 // RetryPolicy defines retry behavior for a job
 type RetryPolicy struct {
-	MaxRetries uint32
-	BaseDelay  time.Duration
-	MaxDelay   time.Duration
+	MaxRetries uint32        // Most deliveries, the first included, before the DLQ
+	BaseDelay  time.Duration // Delay before the first retry
+	MaxDelay   time.Duration // Longest delay between retries
+	Multiplier float64       // Growth of the delay with each retry
+}
+
+// VisibilityLimits bounds the visibility timeout consumers may request
+type VisibilityLimits struct {
+	MinMs int64
+	MaxMs int64 // Zero means no maximum
+
+	// Reject fails out-of-range requests with ErrVisibilityOutOfRange
+	// instead of clamping them into range
+	Reject bool
+}
+
+// DefaultVisibilityLimits returns the default visibility bounds (1s to 12h)
+func DefaultVisibilityLimits() VisibilityLimits {
+	return VisibilityLimits{
+		MinMs: 1000,
+		MaxMs: 12 * 60 * 60 * 1000,
+	}
+}
+
+// QueueConfig holds per-queue settings
+type QueueConfig struct {
+	// PriorityDemotionStep is subtracted from a job's effective priority for
+	// each failed try, so repeatedly failing jobs drift behind fresh work
+	// without being dead-lettered. Zero disables demotion.
+	PriorityDemotionStep uint8 `json:"priority_demotion_step,omitempty"`
+
+	// DLQEnabled keeps jobs that exhaust their retries in the DLQ. When false
+	// they are tombstoned and dropped instead.
+	DLQEnabled bool `json:"dlq_enabled"`
+
+	// NackRules map nack reasons to behaviors, see SetNackRules
+	NackRules []NackRule `json:"nack_rules,omitempty"`
+
+	// MaxConsecutiveExpiries quarantines a job to the DLQ with reason
+	// repeated_crash once its lease expires this many times in a row without
+	// a nack, even if it has retries left. Zero disables quarantine.
+	MaxConsecutiveExpiries uint32 `json:"max_consecutive_expiries,omitempty"`
+
+	// MaxReadyInMemory caps the ready jobs held in memory. Beyond it, ready
+	// jobs are kept only in the store and paged in as the queue drains, so
+	// huge backlogs don't exhaust RAM. Zero keeps every ready job in memory.
+	MaxReadyInMemory int `json:"max_ready_in_memory,omitempty"`
+
+	// MaxInflightBytes caps the payload bytes of the queue's inflight jobs
+	// across all consumers. Leases stop handing out jobs once the next one
+	// would exceed it, until inflight jobs are acked, nacked or expire. Zero
+	// disables the cap.
+	MaxInflightBytes int64 `json:"max_inflight_bytes,omitempty"`
+
+	// Mode chooses between leasing by priority (the default) and strictly in
+	// enqueue order, see QueueMode
+	Mode QueueMode `json:"mode,omitempty"`
+
+	// DeliveryMode chooses between redelivering unacked jobs (at-least-once,
+	// the default) and never redelivering them (at-most-once)
+	DeliveryMode DeliveryMode `json:"delivery_mode,omitempty"`
+
+	// SingleActiveConsumer allows only one outstanding lease (or
+	// reservation) across the whole queue. Each lease carries a fencing
+	// token, and a consumer whose lease timed out is fenced off when the job
+	// is handed to its successor.
+	SingleActiveConsumer bool `json:"single_active_consumer,omitempty"`
+
+	// DefaultHeaders are merged into the headers of every job enqueued to
+	// the queue. A header the producer sets wins over the default.
+	DefaultHeaders map[string]string `json:"default_headers,omitempty"`
+
+	// Transforms are applied to every job enqueued to the queue, after the
+	// default headers, see SetQueueTransforms
+	Transforms []Transform `json:"transforms,omitempty"`
+}
+
+// withDefaultHeaders returns headers merged over defaults, leaving both maps
+// untouched
+func withDefaultHeaders(defaults, headers map[string]string) map[string]string {
+	if len(defaults) == 0 {
+		return headers
+	}
+
+	merged := make(map[string]string, len(defaults)+len(headers))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range headers {
+		merged[k] = v
+	}
+	return merged
+}
+
+// DefaultQueueConfig returns the default queue settings
+func DefaultQueueConfig() QueueConfig {
+	return QueueConfig{
+		DLQEnabled:   true,
+		DeliveryMode: DeliveryAtLeastOnce,
+	}
+}
+
+// AckMode controls when Enqueue returns relative to the WAL fsync
+type AckMode string
+
+const (
+	// AckModeDurable returns once the job is fsynced to the WAL (default)
+	AckModeDurable AckMode = "durable"
+	// AckModeBuffered returns once the job is written to the OS, before
+	// fsync. The WAL syncs it within its sync interval; a machine crash or
+	// power loss before then loses the job even though Enqueue succeeded.
+	AckModeBuffered AckMode = "buffered"
+)
+
+// ParseAckMode parses an ack mode, defaulting to durable when empty
+func ParseAckMode(s string) (AckMode, error) {
+	switch AckMode(s) {
+	case "", AckModeDurable:
+		return AckModeDurable, nil
+	case AckModeBuffered:
+		return AckModeBuffered, nil
+	default:
+		return "", fmt.Errorf("unknown ack mode %q (want %q or %q)", s, AckModeDurable, AckModeBuffered)
+	}
+}
+
+// LeaseOrdering selects which ready jobs a lease hands out first
+type LeaseOrdering string
+
+const (
+	// OrderingPriority leases by effective priority, then ETA, then enqueue
+	// time (default). This order is part of the API: among ready jobs the
+	// highest priority always goes first, and within a priority the job that
+	// became ready first (when enqueued, or when its delay or retry backoff
+	// ended), with ties in enqueue order. A nacked job therefore queues
+	// behind jobs that were ready before its retry was due.
+	OrderingPriority LeaseOrdering = "priority"
+	// OrderingFIFO leases the oldest ready jobs first regardless of priority,
+	// e.g. to replay a backlog in order. It is chosen per lease call, so
+	// FIFO and priority leases can be mixed on the same queue.
+	OrderingFIFO LeaseOrdering = "fifo"
+)
+
+// ParseLeaseOrdering parses a lease ordering, defaulting to priority when
+// empty
+func ParseLeaseOrdering(s string) (LeaseOrdering, error) {
+	switch LeaseOrdering(s) {
+	case "", OrderingPriority:
+		return OrderingPriority, nil
+	case OrderingFIFO:
+		return OrderingFIFO, nil
+	default:
+		return "", fmt.Errorf("unknown ordering %q (want %q or %q)", s, OrderingPriority, OrderingFIFO)
+	}
 }
 
 // DefaultRetryPolicy returns the default retry policy
@@ -42,7 +250,58 @@ func DefaultRetryPolicy() RetryPolicy {
 		MaxRetries: 3,
 		BaseDelay:  100 * time.Millisecond,
 		MaxDelay:   60 * time.Second,
+		Multiplier: 2,
+	}
+}
+
+// clone returns a deep copy of the job, so it can be handed out without
+// callers reaching into the live job through its payload or headers
+func (j *Job) clone() *Job {
+	c := *j
+	c.Payload = append([]byte(nil), j.Payload...)
+	if j.Headers != nil {
+		c.Headers = make(map[string]string, len(j.Headers))
+		for k, v := range j.Headers {
+			c.Headers[k] = v
+		}
+	}
+	return &c
+}
+
+// startLease resets the per-lease processing expectation
+func (j *Job) startLease(now time.Time, expectedMs int64) {
+	j.LeasedAt = now
+	j.ExpectedMs = expectedMs
+	j.overdueWarned = false
+}
+
+// Overdue reports whether an inflight job has been held longer than its
+// consumer expected. It says nothing about the lease, which may still have
+// plenty of visibility left.
+func (j *Job) Overdue(now time.Time) bool {
+	if j.Status != JobStatusInflight || j.ExpectedMs <= 0 {
+		return false
 	}
+	return now.After(j.LeasedAt.Add(time.Duration(j.ExpectedMs) * time.Millisecond))
+}
+
+// markLeased records the job's first lease, observing how long it waited to
+// be picked up. Jobs replayed with tries were leased before a restart and
+// are not observed again.
+func (j *Job) markLeased(now time.Time) {
+	if !j.FirstLeasedAt.IsZero() {
+		return
+	}
+	j.FirstLeasedAt = now
+	if j.Tries > 0 {
+		return
+	}
+
+	readyAt := j.EnqueuedAt
+	if j.ETA.After(readyAt) {
+		readyAt = j.ETA
+	}
+	metrics.TimeToFirstLease.WithLabelValues(j.Queue).Observe(now.Sub(readyAt).Seconds())
 }
 
 // IsReady returns true if job is ready to be leased
@@ -60,7 +319,53 @@ func (j *Job) IsDLQ() bool {
 	return j.Status == JobStatusDLQ
 }
 
-// ShouldRetry returns true if job should be retried
+// retryDelay returns how long the job waits before its next try, from its
+// own backoff settings and at least minDelay
+func (j *Job) retryDelay(minDelay time.Duration) time.Duration {
+	cfg := backoff.DefaultConfig()
+	cfg.MinDelay = minDelay
+	if j.BaseDelay > 0 {
+		cfg.BaseDelay = j.BaseDelay
+	}
+	if j.MaxDelay > 0 {
+		cfg.MaxDelay = j.MaxDelay
+	}
+	if j.Multiplier > 0 {
+		cfg.Multiplier = j.Multiplier
+	}
+	return backoff.Calculate(cfg, j.Tries)
+}
+
+// ShouldRetry returns true if job should be retried: it has failed fewer
+// than MaxRetries times, so MaxRetries bounds the number of deliveries, the
+// first included
 func (j *Job) ShouldRetry() bool {
 	return j.Tries < j.MaxRetries
 }
+
+// validate checks that the limits form a usable range
+func (l VisibilityLimits) validate() error {
+	if l.MinMs < 0 || l.MaxMs < 0 {
+		return fmt.Errorf("visibility limits must not be negative")
+	}
+	if l.MaxMs > 0 && l.MaxMs < l.MinMs {
+		return fmt.Errorf("max visibility %dms is below min visibility %dms", l.MaxMs, l.MinMs)
+	}
+	return nil
+}
+
+// apply clamps visibilityMs into range, or rejects it if l.Reject is set
+func (l VisibilityLimits) apply(visibilityMs int64) (int64, error) {
+	inRange := visibilityMs >= l.MinMs && (l.MaxMs == 0 || visibilityMs <= l.MaxMs)
+	if inRange {
+		return visibilityMs, nil
+	}
+	if l.Reject {
+		return 0, fmt.Errorf("%w: %dms not in [%dms, %dms]", ErrVisibilityOutOfRange, visibilityMs, l.MinMs, l.MaxMs)
+	}
+
+	if visibilityMs < l.MinMs {
+		return l.MinMs, nil
+	}
+	return l.MaxMs, nil
+}
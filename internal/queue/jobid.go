@@ -0,0 +1,64 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Job IDs are UUIDs generated on enqueue unless the caller provides one, e.g.
+// a ULID or an ID from its own system. Provided IDs may collide, so an
+// enqueue with an ID already taken by a live job, in any queue, is either
+// the same job enqueued again or a collision. Acked and purged jobs are no
+// longer live and free their ID.
+
+// MaxJobIDLength is the longest job ID a caller may provide
+const MaxJobIDLength = 256
+
+// ErrInvalidJobID is returned for a provided job ID that is too long
+var ErrInvalidJobID = errors.New("invalid job ID")
+
+// ErrJobIDCollision is returned when a provided job ID is taken by a
+// different live job
+var ErrJobIDCollision = errors.New("job ID collision")
+
+// validateJobID checks a provided job ID. An empty ID is valid and means one
+// is generated.
+func validateJobID(jobID string) error {
+	if len(jobID) > MaxJobIDLength {
+		return fmt.Errorf("%w: longer than %d bytes", ErrInvalidJobID, MaxJobIDLength)
+	}
+	return nil
+}
+
+// checkJobID looks for a live job with the provided ID. It reports a
+// duplicate if the job is in the same queue with the same payload and
+// headers, so a producer retrying an enqueue gets the job it already
+// created, and ErrJobIDCollision for any other job. Must be called with
+// m.jobIDMu held.
+func (m *Manager) checkJobID(queueName, jobID string, payload []byte, headers map[string]string) (bool, error) {
+	for _, queue := range m.allQueues() {
+		queue.mu.RLock()
+		job, _, err := queue.findJob(jobID)
+		same := false
+		if job != nil && queue.name == queueName {
+			// Received-at stamps differ between enqueues of the same job
+			transforms := queue.config.Transforms
+			merged, _ := applyTransforms(transforms, withDefaultHeaders(queue.config.DefaultHeaders, headers), 0, time.Time{})
+			same = requestHash(job.Payload, unstamped(transforms, job.Headers)) == requestHash(payload, unstamped(transforms, merged))
+		}
+		queue.mu.RUnlock()
+
+		if err != nil {
+			return false, fmt.Errorf("failed to check job ID: %w", err)
+		}
+		if job == nil {
+			continue
+		}
+		if same {
+			return true, nil
+		}
+		return false, fmt.Errorf("%w: %s is taken by another job in queue %s", ErrJobIDCollision, jobID, queue.name)
+	}
+	return false, nil
+}
@@ -0,0 +1,108 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	// DefaultListJobsLimit is the page size of ListJobs when none is given
+	DefaultListJobsLimit = 50
+
+	// MaxListJobsLimit caps the page size of ListJobs, larger pages are clamped
+	MaxListJobsLimit = 1000
+)
+
+// ErrInvalidJobState is returned for a job state that cannot be listed
+var ErrInvalidJobState = errors.New("invalid job state")
+
+// ListJobs returns a page of a queue's jobs in one state (ready, reserved,
+// inflight or dlq), for browsing what a queue holds, and how many jobs are in
+// that state in all. Jobs are copies: listing does not lease or otherwise
+// touch them.
+//
+// Ready jobs, delayed ones included, are listed by effective priority (after
+// demotion for failed tries), then ETA, then enqueue order, or in enqueue
+// order alone in a FIFO queue. Jobs in the other states are listed in enqueue
+// order. Every call sorts a snapshot of the whole state, so paging through a
+// busy queue may skip or repeat jobs that change state meanwhile. A limit of
+// zero or less lists DefaultListJobsLimit jobs, and one over MaxListJobsLimit
+// is clamped.
+func (m *Manager) ListJobs(queueName string, state JobStatus, offset, limit int) ([]*Job, int, error) {
+	queue := m.getQueue(queueName)
+	if queue == nil {
+		return nil, 0, fmt.Errorf("%w: %s", ErrQueueNotFound, queueName)
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 {
+		limit = DefaultListJobsLimit
+	}
+	if limit > MaxListJobsLimit {
+		limit = MaxListJobsLimit
+	}
+
+	queue.mu.RLock()
+	defer queue.mu.RUnlock()
+
+	var jobs []*Job
+	switch state {
+	case JobStatusReady:
+		jobs = queue.readyJobs()
+	case JobStatusReserved:
+		for _, r := range queue.reserved {
+			jobs = append(jobs, r.job)
+		}
+	case JobStatusInflight:
+		for _, job := range queue.inflight {
+			jobs = append(jobs, job)
+		}
+	case JobStatusDLQ:
+		for _, job := range queue.dlq {
+			jobs = append(jobs, job)
+		}
+	default:
+		return nil, 0, fmt.Errorf("%w: %q", ErrInvalidJobState, state)
+	}
+
+	byLeaseOrder := state == JobStatusReady && !queue.isFIFO()
+	sort.Slice(jobs, func(i, j int) bool {
+		a, b := jobs[i], jobs[j]
+		if byLeaseOrder {
+			pa, pb := queue.ready.effectivePriority(a), queue.ready.effectivePriority(b)
+			if pa != pb {
+				return pa > pb
+			}
+			if !a.ETA.Equal(b.ETA) {
+				return a.ETA.Before(b.ETA)
+			}
+		}
+		if a.Seq != b.Seq {
+			return a.Seq < b.Seq
+		}
+		return a.ID < b.ID
+	})
+
+	total := len(jobs)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+
+	page := make([]*Job, 0, end-offset)
+	for _, job := range jobs[offset:end] {
+		snapshot := job.clone()
+		snapshot.Status = state
+		if err := queue.loadPayload(snapshot); err != nil {
+			return nil, 0, err
+		}
+		page = append(page, snapshot)
+	}
+	return page, total, nil
+}
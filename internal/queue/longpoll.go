@@ -0,0 +1,115 @@
+package queue
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultMaxLeaseWait is the longest a lease may wait for a job by default
+const DefaultMaxLeaseWait = 30 * time.Second
+
+// leaseRetry tells a waiting lease that found nothing when to try again:
+// once ready is closed, or at due if it is set. A nil ready means it should
+// not wait.
+type leaseRetry struct {
+	ready <-chan struct{}
+	due   time.Time
+}
+
+// leaseRetry returns when a lease that just found nothing to lease should
+// try again. Must be called with q.mu held for writing.
+func (q *Queue) leaseRetry() leaseRetry {
+	if q.readyCh == nil {
+		q.readyCh = make(chan struct{})
+	}
+	retry := leaseRetry{ready: q.readyCh}
+	if due, ok := q.ready.NextDue(); ok {
+		retry.due = due
+	}
+	if q.spillDelayed > 0 && (retry.due.IsZero() || q.spillNextDue.Before(retry.due)) {
+		retry.due = q.spillNextDue
+	}
+	return retry
+}
+
+// notifyReady wakes the leases waiting on the queue, after a job was made
+// ready or an inflight job was settled, or the queue was paused or deleted.
+// Must be called with q.mu held for writing.
+func (q *Queue) notifyReady() {
+	if q.readyCh != nil {
+		close(q.readyCh)
+		q.readyCh = nil
+	}
+}
+
+// SetMaxLeaseWait sets the longest a lease may wait for a job. Longer waits
+// are clamped. Zero removes the limit.
+func (m *Manager) SetMaxLeaseWait(max time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxLeaseWait = max
+}
+
+// LeaseWithOptions is Lease with the options in opts. With opts.Wait set, a
+// consumer willing to wait for jobs blocks, if none can be leased, for up
+// to opts.Wait until one is enqueued, requeued or comes due, rather than
+// getting an empty list straight away. The wait is clamped to the
+// SetMaxLeaseWait limit. It returns ctx's error if ctx is done first.
+//
+// A lease on a paused queue, or during maintenance, does not wait, and
+// pausing the queue ends the waits in progress: they return no jobs. A
+// wait on a queue that is deleted meanwhile returns ErrQueueNotFound.
+//
+// A waiting lease is a subscriber of the queue (see Subscribe) until it
+// returns. If the queue has too many already, it returns
+// ErrTooManySubscribers rather than wait.
+func (m *Manager) LeaseWithOptions(ctx context.Context, queueName string, maxJobs int, visibilityMs int64, opts LeaseOptions) ([]*Job, error) {
+	wait := opts.Wait
+	m.mu.RLock()
+	maxWait := m.maxLeaseWait
+	m.mu.RUnlock()
+	if maxWait > 0 && wait > maxWait {
+		wait = maxWait
+	}
+
+	deadline := time.Now().Add(wait)
+	var release func()
+	defer func() {
+		if release != nil {
+			release()
+		}
+	}()
+	for {
+		jobs, retry, err := m.lease(queueName, maxJobs, visibilityMs, opts, wait > 0)
+		if err != nil || len(jobs) > 0 {
+			return jobs, err
+		}
+
+		now := time.Now()
+		if retry.ready == nil || !now.Before(deadline) {
+			return jobs, nil
+		}
+		if release == nil {
+			if release, err = m.Subscribe(queueName); err != nil {
+				return nil, err
+			}
+		}
+		next := deadline
+		if !retry.due.IsZero() && retry.due.Before(next) {
+			next = retry.due
+		}
+
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-m.stopCh:
+			timer.Stop()
+			return nil, ErrManagerClosed
+		case <-retry.ready:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package queue
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rivetq/rivetq/internal/logging"
+)
+
+// QueueMode controls the order in which a queue hands out ready jobs
+type QueueMode string
+
+const (
+	// QueueModePriority leases higher priority jobs first, then by ETA and
+	// enqueue time (default)
+	QueueModePriority QueueMode = "priority"
+	// QueueModeFIFO leases jobs strictly in enqueue order and ignores their
+	// priority, for queues that act as a plain FIFO
+	QueueModeFIFO QueueMode = "fifo"
+)
+
+// ParseQueueMode parses a queue mode, defaulting to priority when empty
+func ParseQueueMode(s string) (QueueMode, error) {
+	switch QueueMode(s) {
+	case "", QueueModePriority:
+		return QueueModePriority, nil
+	case QueueModeFIFO:
+		return QueueModeFIFO, nil
+	default:
+		return "", fmt.Errorf("unknown queue mode %q (want %q or %q)", s, QueueModePriority, QueueModeFIFO)
+	}
+}
+
+// queueModePrefix is the store key prefix of persisted queue modes. The WAL
+// only holds jobs, so a queue's mode is kept in the store and applied before
+// replay, so replayed jobs are ordered the way they were before the restart.
+const queueModePrefix = "queue_mode:"
+
+// queueModeKey returns the store key of a queue's mode
+func queueModeKey(queueName string) []byte {
+	return []byte(queueModePrefix + queueName)
+}
+
+// SetQueueMode sets the order in which a queue hands out jobs, creating the
+// queue if needed. Jobs already queued are reordered. The mode is persisted,
+// so it survives a restart.
+func (m *Manager) SetQueueMode(queueName string, mode QueueMode) error {
+	mode, err := ParseQueueMode(string(mode))
+	if err != nil {
+		return err
+	}
+	if err := m.saveQueueMode(queueName, mode); err != nil {
+		return err
+	}
+
+	queue := m.getOrCreateQueue(queueName)
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.setMode(mode)
+	return nil
+}
+
+// setMode switches the queue's mode and reorders its ready jobs. Must be
+// called with q.mu held.
+func (q *Queue) setMode(mode QueueMode) {
+	changed := q.config.Mode != mode
+	q.config.Mode = mode
+	q.ready.SetIgnorePriority(mode == QueueModeFIFO)
+	if changed && len(q.spilled) > 0 {
+		q.respill()
+	}
+}
+
+// isFIFO reports whether the queue leases in enqueue order. Must be called
+// with q.mu held.
+func (q *Queue) isFIFO() bool {
+	return q.config.Mode == QueueModeFIFO
+}
+
+// saveQueueMode persists a queue's mode. The default mode is not stored.
+func (m *Manager) saveQueueMode(queueName string, mode QueueMode) error {
+	var err error
+	if mode == QueueModeFIFO {
+		err = m.store.Set(queueModeKey(queueName), []byte(mode))
+	} else {
+		err = m.store.Delete(queueModeKey(queueName))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to persist queue mode: %w", err)
+	}
+	return nil
+}
+
+// loadQueueModes creates the queues whose mode was persisted, with that
+// mode, before the WAL is replayed into them
+func (m *Manager) loadQueueModes() error {
+	modes := make(map[string]QueueMode)
+	err := m.store.Scan([]byte(queueModePrefix), func(key, value []byte) error {
+		mode, err := ParseQueueMode(string(value))
+		if err != nil {
+			return err
+		}
+		modes[strings.TrimPrefix(string(key), queueModePrefix)] = mode
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, mode := range modes {
+		if _, exists := m.queues[name]; exists {
+			continue
+		}
+		cfg := m.defaultQueueConfig()
+		cfg.Mode = mode
+		m.queues[name] = m.newQueue(name, cfg)
+		logging.With(logging.Fields{Queue: name}).Debug().Str("mode", string(mode)).Msg("restored queue mode")
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rivetq/rivetq/internal/logging"
+	"github.com/rivetq/rivetq/internal/metrics"
+	"github.com/rivetq/rivetq/internal/wal"
+)
+
+// Tenants share a node by namespacing their queues: a queue named
+// "tenant:emails" is queue "emails" in namespace "tenant". State keyed by the
+// exact queue name, i.e. WAL records, rate limits and metric labels, is
+// therefore kept apart per namespace. Store keys that put more after the
+// queue name, i.e. spilled jobs, offloaded DLQ payloads and request IDs, end
+// it with a "\x00" so that neither a key nor a per-queue prefix of queue "a"
+// can overlap those of queue "a:b". Idempotency keys are global, so they are
+// scoped to the namespace of the queue they are used with. A namespace can be
+// purged as a whole with PurgeNamespace.
+
+// NamespaceSeparator separates a queue's namespace from its name
+const NamespaceSeparator = ":"
+
+// idempotencyScopeSeparator separates the namespace from a scoped idempotency
+// key. Keys are free text, so it is a byte clients do not send.
+const idempotencyScopeSeparator = "\x00"
+
+// ErrInvalidNamespace is returned for an empty namespace or one containing
+// NamespaceSeparator
+var ErrInvalidNamespace = errors.New("invalid namespace")
+
+// SplitQueueName splits a queue name into its namespace and the name within
+// it. Queues outside any namespace have an empty namespace.
+func SplitQueueName(queueName string) (namespace, name string) {
+	if i := strings.Index(queueName, NamespaceSeparator); i > 0 {
+		return queueName[:i], queueName[i+len(NamespaceSeparator):]
+	}
+	return "", queueName
+}
+
+// NamespacedQueue returns the name of queue name in namespace
+func NamespacedQueue(namespace, name string) (string, error) {
+	if err := checkNamespace(namespace); err != nil {
+		return "", err
+	}
+	return namespace + NamespaceSeparator + name, nil
+}
+
+// checkNamespace validates a namespace
+func checkNamespace(namespace string) error {
+	if namespace == "" || strings.Contains(namespace, NamespaceSeparator) {
+		return fmt.Errorf("%w: %q", ErrInvalidNamespace, namespace)
+	}
+	return nil
+}
+
+// scopedIdempotencyKey returns the store key of an idempotency key used with
+// queueName. Keys of queues outside any namespace are stored as they are.
+func scopedIdempotencyKey(queueName, key string) string {
+	namespace, _ := SplitQueueName(queueName)
+	if namespace == "" {
+		return key
+	}
+	return namespace + idempotencyScopeSeparator + key
+}
+
+// PurgeNamespace deletes every queue in a namespace with all of its jobs,
+// whatever their state, and the namespace's idempotency keys, leaving other
+// namespaces untouched. Returns how many jobs were purged. Consumers holding
+// leases on purged jobs get ErrJobNotFound when they ack.
+//
+// Purged jobs and queues are logged in the WAL, so they do not come back
+// after a restart.
+func (m *Manager) PurgeNamespace(namespace string) (int, error) {
+	if err := checkNamespace(namespace); err != nil {
+		return 0, err
+	}
+
+	// The namespace's queues leave m.queues up front and are purged without
+	// m.mu held. Creating a queue in the namespace waits until the purge is
+	// done, see awaitDeletion.
+	m.mu.Lock()
+	for {
+		done, purging := m.purgingNamespaces[namespace]
+		if !purging {
+			break
+		}
+		m.mu.Unlock()
+		<-done
+		m.mu.Lock()
+	}
+	var queues []*Queue
+	for name, queue := range m.queues {
+		if ns, _ := SplitQueueName(name); ns == namespace {
+			queues = append(queues, queue)
+			delete(m.queues, name)
+		}
+	}
+	done := make(chan struct{})
+	m.purgingNamespaces[namespace] = done
+	m.mu.Unlock()
+
+	purged := 0
+	var err error
+	var unpurged []*Queue
+	for i, queue := range queues {
+		n, purgeErr := m.purgeQueue(queue, true)
+		if purgeErr != nil {
+			err = fmt.Errorf("failed to purge queue %s: %w", queue.name, purgeErr)
+			unpurged = queues[i:]
+			break
+		}
+		purged += n
+	}
+	if err == nil {
+		if _, deleteErr := m.store.DeleteIdempotencyKeys(namespace + idempotencyScopeSeparator); deleteErr != nil {
+			err = fmt.Errorf("failed to delete idempotency keys: %w", deleteErr)
+		}
+		metrics.IdempotencyKeys.Set(float64(m.store.IdempotencyStats().Keys))
+	}
+
+	m.mu.Lock()
+	for _, queue := range unpurged {
+		m.queues[queue.name] = queue
+	}
+	delete(m.purgingNamespaces, namespace)
+	close(done)
+	m.mu.Unlock()
+	if err != nil {
+		return purged, err
+	}
+
+	logging.With(logging.Fields{}).Warn().Str("namespace", namespace).Int("jobs", purged).Msg("namespace purged")
+
+	return purged, nil
+}
+
+// purgeQueue tombstones every job of a queue, logs the queue's deletion and
+// drops what the node keeps about it. Unless force is set, it fails with
+// ErrQueueBusy if any job is leased or reserved. The caller takes the queue
+// out of m.queues first and must not hold m.mu, as the store cleanup takes
+// time on a large queue.
+func (m *Manager) purgeQueue(q *Queue, force bool) (int, error) {
+	q.mu.Lock()
+	if outstanding := len(q.inflight) + len(q.reserved); !force && outstanding > 0 {
+		q.mu.Unlock()
+		return 0, fmt.Errorf("%w: %d jobs leased or reserved in %s", ErrQueueBusy, outstanding, q.name)
+	}
+
+	jobs := q.readyJobs()
+	for _, job := range q.inflight {
+		jobs = append(jobs, job)
+	}
+	for _, r := range q.reserved {
+		jobs = append(jobs, r.job)
+	}
+	for _, job := range q.dlq {
+		jobs = append(jobs, job)
+	}
+
+	records := make([]*wal.Record, 0, len(jobs)+1)
+	for _, job := range jobs {
+		records = append(records, &wal.Record{
+			Type:  wal.RecordTypeTombstone,
+			Queue: q.name,
+			JobID: job.ID,
+			Tries: job.Tries,
+		})
+	}
+	records = append(records, &wal.Record{Type: wal.RecordTypeDeleteQueue, Queue: q.name})
+	if err := m.wal.WriteBatch(records); err != nil {
+		q.mu.Unlock()
+		return 0, fmt.Errorf("failed to write to WAL: %w", err)
+	}
+
+	q.ready = newPriorityQueue()
+	q.inflight = make(map[string]*Job)
+	q.inflightBytes = 0
+	q.reserved = make(map[string]*reservation)
+	q.dlq = make(map[string]*Job)
+	q.spilled = make(map[string][]byte)
+	q.spillHead, q.spillHeadKey = nil, nil
+	q.spillDelayed, q.spillNextDue = 0, time.Time{}
+	q.deleted = true
+	q.notifyReady() // Waiting leases look the queue up again
+	q.mu.Unlock()
+
+	for _, job := range jobs {
+		if err := m.store.DeleteJob(job.ID); err != nil {
+			logging.With(logging.Fields{Queue: q.name, JobID: job.ID}).Warn().Err(err).Msg("failed to delete job history")
+		}
+	}
+	if err := m.store.DeletePrefix(spillPrefix(q.name)); err != nil {
+		logging.With(logging.Fields{Queue: q.name}).Warn().Err(err).Msg("failed to delete spilled jobs")
+	}
+	if err := m.store.DeletePrefix(dlqPayloadPrefix(q.name)); err != nil {
+		logging.With(logging.Fields{Queue: q.name}).Warn().Err(err).Msg("failed to delete offloaded DLQ payloads")
+	}
+	if err := m.store.DeleteRequestIDs(q.name); err != nil {
+		logging.With(logging.Fields{Queue: q.name}).Warn().Err(err).Msg("failed to delete request IDs")
+	}
+	if err := m.store.Delete(queueModeKey(q.name)); err != nil {
+		logging.With(logging.Fields{Queue: q.name}).Warn().Err(err).Msg("failed to delete queue mode")
+	}
+	if err := m.store.Delete(defaultHeadersKey(q.name)); err != nil {
+		logging.With(logging.Fields{Queue: q.name}).Warn().Err(err).Msg("failed to delete default headers")
+	}
+
+	m.rateLimiter.Remove(q.name)
+	metrics.ForgetQueue(q.name)
+
+	return len(jobs), nil
+}
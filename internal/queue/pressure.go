@@ -0,0 +1,237 @@
+package queue
+
+import (
+	"container/heap"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/rivetq/rivetq/internal/logging"
+	"github.com/rivetq/rivetq/internal/metrics"
+)
+
+// DLQReasonMemoryPressure is the DLQ reason for ready jobs shed because the
+// node's memory use reached its ceiling
+const DLQReasonMemoryPressure = "memory_pressure"
+
+// ShedPolicy chooses which ready jobs are shed first under memory pressure
+type ShedPolicy string
+
+const (
+	// ShedLowestPriority sheds the jobs with the lowest effective priority
+	// first, the oldest first among equal priorities
+	ShedLowestPriority ShedPolicy = "lowest_priority"
+
+	// ShedOldest sheds the jobs enqueued longest ago first
+	ShedOldest ShedPolicy = "oldest"
+)
+
+// ParseShedPolicy parses a shed policy name. An empty name means
+// ShedLowestPriority.
+func ParseShedPolicy(s string) (ShedPolicy, error) {
+	switch ShedPolicy(s) {
+	case "", ShedLowestPriority:
+		return ShedLowestPriority, nil
+	case ShedOldest:
+		return ShedOldest, nil
+	default:
+		return "", fmt.Errorf("invalid shed policy %q: must be %q or %q", s, ShedLowestPriority, ShedOldest)
+	}
+}
+
+// DefaultShedBatchSize is the most jobs shed per check by default
+const DefaultShedBatchSize = 100
+
+// DefaultMemoryCheckInterval is how often memory use is compared against the
+// ceiling by default
+const DefaultMemoryCheckInterval = time.Second
+
+// MemoryPressure is a safety valve for pathological backlogs: once the Go
+// heap reaches Ceiling bytes, every check dead-letters up to BatchSize ready
+// jobs, chosen by Policy, with reason DLQReasonMemoryPressure. Only jobs held
+// in memory are shed: spilled jobs are on disk already, queues without a DLQ
+// are skipped so nothing is dropped outright, and inflight jobs are left to
+// their consumers. The payloads of shed jobs are moved to the store, see
+// offloadPayload, so shedding frees their memory.
+type MemoryPressure struct {
+	Ceiling   uint64     `json:"ceiling"` // Zero disables shedding
+	Policy    ShedPolicy `json:"policy"`
+	BatchSize int        `json:"batch_size"`
+}
+
+// SetMemoryPressure configures shedding under memory pressure
+func (m *Manager) SetMemoryPressure(cfg MemoryPressure) error {
+	policy, err := ParseShedPolicy(string(cfg.Policy))
+	if err != nil {
+		return err
+	}
+	cfg.Policy = policy
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultShedBatchSize
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.memoryPressure = cfg
+	return nil
+}
+
+// heapInUse reports the bytes of Go heap in use
+func heapInUse() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// memoryPressureWorker periodically sheds jobs while memory is above the
+// ceiling
+func (m *Manager) memoryPressureWorker() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(DefaultMemoryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stopCh:
+			return
+		case <-ticker.C:
+			m.checkMemoryPressure()
+		}
+	}
+}
+
+// shedCandidate is a ready job that may be shed, with the fields it is
+// ordered by copied under its queue's lock
+type shedCandidate struct {
+	queue      *Queue
+	job        *Job
+	priority   uint8
+	enqueuedAt time.Time
+}
+
+// shedHeap keeps the candidates to shed first among those seen so far, with
+// the one to shed last on top, so that it is the one replaced by a better
+// candidate once the heap is full
+type shedHeap struct {
+	candidates []shedCandidate
+	policy     ShedPolicy
+}
+
+// shedsBefore reports whether a is shed before b under the heap's policy
+func (h *shedHeap) shedsBefore(a, b shedCandidate) bool {
+	if h.policy == ShedLowestPriority && a.priority != b.priority {
+		return a.priority < b.priority
+	}
+	return a.enqueuedAt.Before(b.enqueuedAt)
+}
+
+func (h *shedHeap) Len() int { return len(h.candidates) }
+
+func (h *shedHeap) Less(i, j int) bool {
+	return h.shedsBefore(h.candidates[j], h.candidates[i])
+}
+
+func (h *shedHeap) Swap(i, j int) {
+	h.candidates[i], h.candidates[j] = h.candidates[j], h.candidates[i]
+}
+
+func (h *shedHeap) Push(x interface{}) {
+	h.candidates = append(h.candidates, x.(shedCandidate))
+}
+
+func (h *shedHeap) Pop() interface{} {
+	n := len(h.candidates)
+	c := h.candidates[n-1]
+	h.candidates[n-1] = shedCandidate{}
+	h.candidates = h.candidates[:n-1]
+	return c
+}
+
+// offer adds a candidate if fewer than limit are kept, or replaces the kept
+// one shed last if c is shed before it
+func (h *shedHeap) offer(c shedCandidate, limit int) {
+	if h.Len() < limit {
+		heap.Push(h, c)
+		return
+	}
+	if h.shedsBefore(c, h.candidates[0]) {
+		h.candidates[0] = c
+		heap.Fix(h, 0)
+	}
+}
+
+// checkMemoryPressure sheds one batch of ready jobs if memory use is at or
+// above the ceiling, and returns how many were shed
+func (m *Manager) checkMemoryPressure() int {
+	m.mu.RLock()
+	cfg := m.memoryPressure
+	usage := m.memoryUsage
+	m.mu.RUnlock()
+
+	if cfg.Ceiling == 0 {
+		return 0
+	}
+
+	inUse := usage()
+	metrics.MemoryInUse.Set(float64(inUse))
+	if inUse < cfg.Ceiling {
+		return 0
+	}
+
+	// Only the batch is kept while walking the ready jobs, so a check costs
+	// O(N log BatchSize) and no memory per ready job
+	victims := &shedHeap{candidates: make([]shedCandidate, 0, cfg.BatchSize), policy: cfg.Policy}
+	for _, queue := range m.allQueues() {
+		queue.mu.Lock()
+		if queue.config.DLQEnabled {
+			for _, item := range queue.ready.items {
+				victims.offer(shedCandidate{
+					queue:      queue,
+					job:        item.job,
+					priority:   item.priority,
+					enqueuedAt: item.job.EnqueuedAt,
+				}, cfg.BatchSize)
+			}
+		}
+		queue.mu.Unlock()
+	}
+
+	byQueue := make(map[*Queue][]*Job)
+	for _, c := range victims.candidates {
+		byQueue[c.queue] = append(byQueue[c.queue], c.job)
+	}
+
+	shed := 0
+	for queue, jobs := range byQueue {
+		queue.mu.Lock()
+		// Jobs leased or removed since they were collected are left alone
+		var still []*Job
+		for _, job := range jobs {
+			if queue.ready.Contains(job.ID) {
+				still = append(still, job)
+			}
+		}
+		var err error
+		if len(still) > 0 {
+			err = m.deadLetterReady(queue, still, DLQReasonMemoryPressure)
+		}
+		if err == nil {
+			for _, job := range still {
+				queue.offloadPayload(job)
+			}
+		}
+		queue.mu.Unlock()
+
+		if err != nil {
+			logging.With(logging.Fields{Queue: queue.name}).Error().Err(err).Msg("failed to shed jobs under memory pressure")
+			continue
+		}
+		if len(still) > 0 {
+			shed += len(still)
+			metrics.MemoryPressureShedTotal.WithLabelValues(queue.name, string(cfg.Policy)).Add(float64(len(still)))
+			logging.With(logging.Fields{Queue: queue.name}).Warn().Int("jobs", len(still)).Uint64("heap_bytes", inUse).Msg("jobs shed under memory pressure")
+		}
+	}
+	return shed
+}
@@ -1,26 +1,107 @@
 package queue
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	"math"
+	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/rivetq/rivetq/internal/backoff"
+	"github.com/rivetq/rivetq/internal/logging"
+	"github.com/rivetq/rivetq/internal/metrics"
 	"github.com/rivetq/rivetq/internal/ratelimit"
 	"github.com/rivetq/rivetq/internal/store"
 	"github.com/rivetq/rivetq/internal/wal"
 	"github.com/rs/zerolog/log"
 )
 
+// ErrQueueNotFound is returned when an operation names a queue that does not
+// exist
+var ErrQueueNotFound = errors.New("queue not found")
+
+// ErrJobNotFound is returned when a job is not where an operation expects it,
+// e.g. acking a job that is not inflight
+var ErrJobNotFound = errors.New("job not found")
+
+// ErrInvalidLease is returned when acking or nacking an inflight job with a
+// lease ID other than its current one
+var ErrInvalidLease = errors.New("invalid lease ID")
+
+// ErrRateLimited is returned by Enqueue when the queue's rate limit rejects
+// the job
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// ErrManagerClosed is returned by operations on a manager that was stopped
+var ErrManagerClosed = errors.New("manager closed")
+
+// ErrLeaseExpired is returned when acking or nacking with a lease that timed
+// out and whose job has since been returned to the queue. The job will be
+// redelivered, so the caller should not retry.
+var ErrLeaseExpired = errors.New("lease expired")
+
+// ErrVisibilityOutOfRange is returned by Lease when the requested visibility
+// timeout is outside the configured limits and rejection is enabled
+var ErrVisibilityOutOfRange = errors.New("visibility timeout out of range")
+
+// ErrDelayOutOfRange is returned by Enqueue when the delay is negative or
+// schedules the job beyond the maximum delay
+var ErrDelayOutOfRange = errors.New("delay out of range")
+
+// ErrHeadersTooLarge is returned by Enqueue when a job has more headers, or
+// more header bytes, than the configured maximum or the WAL format allows
+var ErrHeadersTooLarge = errors.New("headers too large")
+
+// ErrIdempotencyKeyNotFound is returned when clearing an idempotency key that
+// is not mapped to a job in the queue
+var ErrIdempotencyKeyNotFound = errors.New("idempotency key not found")
+
 // Queue manages a single named queue
 type Queue struct {
 	mu sync.RWMutex
 
-	name   string
-	ready  *priorityQueue
-	inflight map[string]*Job // jobID -> job
-	dlq    map[string]*Job // jobID -> job
+	name     string
+	config   QueueConfig
+	ready    *priorityQueue
+	inflight map[string]*Job         // jobID -> job, see inflight.go
+	dlq      map[string]*Job         // jobID -> job
+	reserved map[string]*reservation // jobID -> reservation
+
+	// Ready jobs beyond config.MaxReadyInMemory, see spill.go
+	spilled      map[string][]byte // jobID -> store key
+	spillHead    *Job              // Cached first spilled job, nil if not loaded
+	spillHeadKey []byte
+	spillDelayed int       // Spilled jobs in the delayed key space
+	spillNextDue time.Time // No delayed spilled job is due before this
+
+	// Payload bytes of the inflight jobs
+	inflightBytes int64
+
+	// Last fencing token issued, see QueueConfig.SingleActiveConsumer
+	fence uint64
+
+	// Nothing is leased or reserved while paused, see QuiesceQueue
+	paused bool
+
+	// Closed to wake waiting leases, nil while none is waiting, see
+	// LeaseWithOptions
+	readyCh chan struct{}
+
+	// Set once the queue is purged and dropped from the manager, so an
+	// enqueue that looked it up just before goes to its replacement
+	deleted bool
+
+	// Registered subscribers, see Subscribe
+	subscribers int
+
+	// When the lease timeout worker next scans the queue
+	nextLeaseCheck time.Time
 
 	store   *store.Store
 	wal     *wal.WAL
@@ -36,51 +117,483 @@ type Manager struct {
 	wal         *wal.WAL
 	rateLimiter *ratelimit.Limiter
 
+	// Queues being deleted and namespaces being purged, each with a channel
+	// closed once done, see awaitDeletion
+	deletingQueues    map[string]chan struct{}
+	purgingNamespaces map[string]chan struct{}
+
+	// Serializes enqueues with caller-provided job IDs, see checkJobID
+	jobIDMu sync.Mutex
+
+	// Last enqueue sequence number handed out, see Job.Seq
+	enqueueSeq atomic.Uint64
+
+	// Shortest delay before a retry, in nanoseconds. Atomic as it is read
+	// with queue locks held, see SetMinRetryDelay.
+	minRetryDelay atomic.Int64
+
+	// Recently expired leases (leaseID -> expiry time), for fencing late acks
+	expiredMu     sync.Mutex
+	expiredLeases map[string]time.Time
+
+	// Bounds on requested visibility timeouts
+	visibility VisibilityLimits
+
+	// Longest a job may be held by a reservation
+	maxReservation time.Duration
+
+	// Furthest in the future a job may be scheduled
+	maxDelay time.Duration
+
+	// Most jobs a single lease call may take
+	maxLeaseBatch int
+
+	// Longest a lease may wait for a job
+	maxLeaseWait time.Duration
+
+	// Most subscribers a queue may have at once
+	maxSubscribers int
+
+	// Most headers a job may carry, and most bytes of keys and values
+	maxHeaders     int
+	maxHeaderBytes int
+
+	// Default MaxReadyInMemory for new queues
+	maxReadyInMemory int
+
+	// How long client request IDs are remembered for enqueue dedup
+	requestIDWindow time.Duration
+
+	// How long idempotency keys are kept; zero keeps them until cleared
+	idempotencyTTL time.Duration
+
+	// How often each queue is scanned for expired leases, and the random
+	// spread added to each queue's scans
+	leaseCheckInterval time.Duration
+	leaseCheckJitter   time.Duration
+
+	// Where enqueue dedup reads and writes idempotency keys, normally the
+	// store, whether to enqueue without dedup when it fails, and whether a
+	// reused key with a different request is rejected
+	idempotency         idempotencyStore
+	idempotencyFailOpen bool
+	idempotencyStrict   bool
+
+	// Node-wide maintenance mode
+	maintenance MaintenanceMode
+
+	// Shedding of ready jobs once memory use reaches a ceiling, and how
+	// memory use is measured
+	memoryPressure MemoryPressure
+	memoryUsage    func() uint64
+
+	// How often job metadata in the store is reconciled with the queues,
+	// zero to never
+	reconcileInterval time.Duration
+
+	// Shutdown behavior
+	ownsQueue          func(queueName string) bool // nil means every queue is local
+	expireLeasesOnStop bool
+
+	// Closes the store and WAL on Stop when the manager created them
+	closeStorage func() error
+
 	// Background workers
 	stopCh chan struct{}
 	wg     sync.WaitGroup
 }
 
+// expiredLeaseTTL is how long an expired lease is remembered
+const expiredLeaseTTL = 5 * time.Minute
+
+// DefaultMaxDelay is the furthest in the future a job may be scheduled by
+// default. Jobs scheduled decades out would otherwise sit in memory forever.
+const DefaultMaxDelay = 365 * 24 * time.Hour
+
+// DefaultMaxLeaseBatch is the most jobs a single lease call may take by
+// default, so one consumer cannot drain a queue in one request
+const DefaultMaxLeaseBatch = 1000
+
+// DefaultMaxHeaders is the most headers a job may carry by default
+const DefaultMaxHeaders = 64
+
+// DefaultMaxHeaderBytes is the most bytes of header keys and values a job may
+// carry by default
+const DefaultMaxHeaderBytes = 16 * 1024
+
+// ExpectedVisibilityFactor sizes the visibility timeout of a lease that
+// declares an expected processing time but no visibility timeout
+const ExpectedVisibilityFactor = 2
+
+// DefaultRequestIDWindow is how long client request IDs are remembered by default
+const DefaultRequestIDWindow = 5 * time.Minute
+
+// DefaultLeaseCheckInterval is how often each queue is scanned for expired
+// leases by default
+const DefaultLeaseCheckInterval = time.Second
+
+// DefaultLeaseCheckJitter is the random delay added to each queue's lease
+// scans by default, so queues are not all scanned at the same instant
+const DefaultLeaseCheckJitter = 100 * time.Millisecond
+
+// leaseCheckResolution is the shortest the lease timeout worker sleeps, so
+// many queues due at nearly the same time are scanned in one pass
+const leaseCheckResolution = 10 * time.Millisecond
+
 // NewManager creates a new queue manager
 func NewManager(store *store.Store, wal *wal.WAL) *Manager {
 	return &Manager{
-		queues:      make(map[string]*Queue),
-		store:       store,
-		wal:         wal,
-		rateLimiter: ratelimit.NewLimiter(),
-		stopCh:      make(chan struct{}),
+		queues:            make(map[string]*Queue),
+		deletingQueues:    make(map[string]chan struct{}),
+		purgingNamespaces: make(map[string]chan struct{}),
+		store:             store,
+		idempotency:       store,
+		wal:               wal,
+		rateLimiter:       ratelimit.NewLimiter(),
+		expiredLeases:     make(map[string]time.Time),
+		visibility:        DefaultVisibilityLimits(),
+		maxReservation:    DefaultMaxReservation,
+		maxDelay:          DefaultMaxDelay,
+		maxLeaseBatch:     DefaultMaxLeaseBatch,
+		maxLeaseWait:      DefaultMaxLeaseWait,
+		maxSubscribers:    DefaultMaxSubscribers,
+		maxHeaders:        DefaultMaxHeaders,
+		maxHeaderBytes:    DefaultMaxHeaderBytes,
+		requestIDWindow:   DefaultRequestIDWindow,
+		stopCh:            make(chan struct{}),
+
+		leaseCheckInterval: DefaultLeaseCheckInterval,
+		leaseCheckJitter:   DefaultLeaseCheckJitter,
+
+		memoryPressure: MemoryPressure{Policy: ShedLowestPriority, BatchSize: DefaultShedBatchSize},
+		memoryUsage:    heapInUse,
 	}
 }
 
 // Start starts background workers
 func (m *Manager) Start() error {
+	// Spilled jobs and offloaded DLQ payloads from a previous run are
+	// rebuilt from the WAL
+	if err := m.store.DeletePrefix([]byte("spill:")); err != nil {
+		return fmt.Errorf("failed to clear spilled jobs: %w", err)
+	}
+	if err := m.store.DeletePrefix([]byte("dlqpayload:")); err != nil {
+		return fmt.Errorf("failed to clear offloaded DLQ payloads: %w", err)
+	}
+
+	if err := m.loadQueueModes(); err != nil {
+		return fmt.Errorf("failed to load queue modes: %w", err)
+	}
+	if err := m.loadDefaultHeaders(); err != nil {
+		return fmt.Errorf("failed to load default headers: %w", err)
+	}
+
 	// Replay WAL to rebuild state
 	if err := m.replayWAL(); err != nil {
 		return fmt.Errorf("failed to replay WAL: %w", err)
 	}
 
+	if err := m.loadMaintenance(); err != nil {
+		return fmt.Errorf("failed to load maintenance mode: %w", err)
+	}
+
+	m.updateAllGauges()
+	m.updateWALGauges()
+
+	// Start WAL size reporting
+	m.wg.Add(1)
+	go m.walMetricsWorker()
+
 	// Start lease timeout checker
 	m.wg.Add(1)
 	go m.leaseTimeoutWorker()
 
+	metrics.IdempotencyKeys.Set(float64(m.store.IdempotencyStats().Keys))
+
+	// Start request ID and idempotency key pruner
+	m.wg.Add(1)
+	go m.pruneWorker()
+
+	// Start memory pressure valve
+	m.wg.Add(1)
+	go m.memoryPressureWorker()
+
+	// Start job metadata reconciler
+	if m.reconcileInterval > 0 {
+		m.wg.Add(1)
+		go m.reconcileWorker()
+	}
+
 	return nil
 }
 
-// Stop stops the manager
+// Stop stops the manager. If SetExpireLeasesOnStop is enabled, inflight jobs
+// are returned to their queues first so another node can pick them up.
 func (m *Manager) Stop() error {
 	close(m.stopCh)
 	m.wg.Wait()
+
+	if m.expireLeasesOnStop {
+		if _, err := m.ForceExpireAllLeases(); err != nil {
+			return fmt.Errorf("failed to expire leases on stop: %w", err)
+		}
+	}
+	if m.closeStorage != nil {
+		if err := m.closeStorage(); err != nil {
+			return fmt.Errorf("failed to close storage: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkOpen returns ErrManagerClosed once Stop has been called
+func (m *Manager) checkOpen() error {
+	select {
+	case <-m.stopCh:
+		return ErrManagerClosed
+	default:
+		return nil
+	}
+}
+
+// SetExpireLeasesOnStop makes Stop requeue all inflight jobs of owned queues
+func (m *Manager) SetExpireLeasesOnStop(enabled bool) {
+	m.expireLeasesOnStop = enabled
+}
+
+// SetVisibilityLimits sets the range of visibility timeouts Lease accepts
+func (m *Manager) SetVisibilityLimits(limits VisibilityLimits) error {
+	if err := limits.validate(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.visibility = limits
+	return nil
+}
+
+// SetMaxDelay sets the furthest in the future Enqueue may schedule a job.
+// Zero removes the limit, except that delays too large to represent are
+// still rejected.
+func (m *Manager) SetMaxDelay(max time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxDelay = max
+}
+
+// SetMaxLeaseBatch sets the most jobs a single lease call may take. Larger
+// requests are clamped. Zero removes the limit.
+func (m *Manager) SetMaxLeaseBatch(max int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxLeaseBatch = max
+}
+
+// SetMinRetryDelay sets the shortest a nacked or expired job waits before
+// it is retried, whatever its backoff and jitter, so a job failing against a
+// downstream that is down cannot retry in a tight loop. Zero disables the
+// floor.
+func (m *Manager) SetMinRetryDelay(d time.Duration) {
+	m.minRetryDelay.Store(int64(d))
+}
+
+// MinRetryDelay returns the floor set by SetMinRetryDelay
+func (m *Manager) MinRetryDelay() time.Duration {
+	return time.Duration(m.minRetryDelay.Load())
+}
+
+// checkDelay rejects negative delays and delays beyond the maximum
+func (m *Manager) checkDelay(delayMs int64) error {
+	m.mu.RLock()
+	max := m.maxDelay
+	m.mu.RUnlock()
+
+	if delayMs < 0 {
+		return fmt.Errorf("%w: %dms is negative", ErrDelayOutOfRange, delayMs)
+	}
+
+	// Beyond this the delay overflows a time.Duration
+	limitMs := int64(math.MaxInt64 / int64(time.Millisecond))
+	if max > 0 {
+		limitMs = max.Milliseconds()
+	}
+	if delayMs > limitMs {
+		return fmt.Errorf("%w: %dms exceeds the maximum of %dms", ErrDelayOutOfRange, delayMs, limitMs)
+	}
+	return nil
+}
+
+// SetHeaderLimits sets the most headers a job may carry and the most bytes
+// their keys and values may add up to. Zero removes a limit, except that the
+// WAL format still caps the count and each key and value at 65535.
+func (m *Manager) SetHeaderLimits(maxHeaders, maxBytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxHeaders = maxHeaders
+	m.maxHeaderBytes = maxBytes
+}
+
+// checkHeaders rejects headers beyond the configured limits, or that the WAL
+// record cannot represent since it stores counts and lengths as uint16
+func (m *Manager) checkHeaders(headers map[string]string) error {
+	m.mu.RLock()
+	maxHeaders := m.maxHeaders
+	maxBytes := m.maxHeaderBytes
+	m.mu.RUnlock()
+
+	if maxHeaders <= 0 || maxHeaders > math.MaxUint16 {
+		maxHeaders = math.MaxUint16
+	}
+	if len(headers) > maxHeaders {
+		return fmt.Errorf("%w: %d headers exceeds the maximum of %d", ErrHeadersTooLarge, len(headers), maxHeaders)
+	}
+
+	total := 0
+	for k, v := range headers {
+		if len(k) > math.MaxUint16 || len(v) > math.MaxUint16 {
+			return fmt.Errorf("%w: header keys and values may not exceed %d bytes", ErrHeadersTooLarge, math.MaxUint16)
+		}
+		total += len(k) + len(v)
+	}
+	if maxBytes > 0 && total > maxBytes {
+		return fmt.Errorf("%w: %d header bytes exceeds the maximum of %d", ErrHeadersTooLarge, total, maxBytes)
+	}
 	return nil
 }
 
+// SetRequestIDWindow sets how long client request IDs are remembered for
+// enqueue dedup. Must be called before Start.
+func (m *Manager) SetRequestIDWindow(window time.Duration) {
+	m.requestIDWindow = window
+}
+
+// SetLeaseCheckInterval sets how often each queue is scanned for expired
+// leases. Each scan is delayed by a random share of jitter, so queues created
+// together, or nodes started together, drift apart instead of scanning in
+// lockstep. Must be called before Start.
+func (m *Manager) SetLeaseCheckInterval(interval, jitter time.Duration) {
+	if interval <= 0 {
+		interval = DefaultLeaseCheckInterval
+	}
+	if jitter < 0 {
+		jitter = 0
+	}
+	m.leaseCheckInterval = interval
+	m.leaseCheckJitter = jitter
+}
+
+// SetIdempotencyTTL sets how long idempotency keys are kept before they are
+// swept and may be reused. Zero keeps them until cleared. Applies to keys
+// stored after the call.
+func (m *Manager) SetIdempotencyTTL(ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.idempotencyTTL = ttl
+}
+
+// IdempotencyTTL returns how long idempotency keys are kept
+func (m *Manager) IdempotencyTTL() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.idempotencyTTL
+}
+
+// IdempotencyStats returns the number of stored idempotency keys
+func (m *Manager) IdempotencyStats() store.IdempotencyStats {
+	return m.store.IdempotencyStats()
+}
+
+// SetOwnershipCheck restricts ForceExpireAllLeases to queues for which fn
+// returns true. In a cluster this should report whether the local node owns
+// the queue; without it every queue is treated as local.
+func (m *Manager) SetOwnershipCheck(fn func(queueName string) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ownsQueue = fn
+}
+
+// ForceExpireAllLeases immediately returns every inflight job of the queues
+// this node owns to the ready queue, without counting it as a failed attempt.
+// It is meant for graceful shutdown, so a replacement node does not have to
+// wait out visibility timeouts. Returns the number of jobs requeued.
+func (m *Manager) ForceExpireAllLeases() (int, error) {
+	now := time.Now()
+
+	m.mu.RLock()
+	queues := make([]*Queue, 0, len(m.queues))
+	for name, q := range m.queues {
+		if m.ownsQueue == nil || m.ownsQueue(name) {
+			queues = append(queues, q)
+		}
+	}
+	m.mu.RUnlock()
+
+	var firstErr error
+	count := 0
+	for _, queue := range queues {
+		queue.mu.Lock()
+		// One batch per queue, as durable writes one by one would each wait
+		// out a group commit with the queue locked
+		var records []*wal.Record
+		for _, job := range queue.inflight {
+			m.rememberExpiredLease(job.LeaseID, now)
+
+			// At-most-once jobs were acked when leased and are not handed out again
+			if job.Consumed {
+				queue.removeInflight(job.ID)
+				continue
+			}
+
+			job.ETA = now
+			job.Status = JobStatusReady
+			job.LeaseID = ""
+			job.LeaseDeadline = time.Time{}
+			queue.removeInflight(job.ID)
+			queue.pushReady(job)
+			count++
+
+			records = append(records, &wal.Record{
+				Type:       wal.RecordTypeRequeue,
+				Queue:      job.Queue,
+				JobID:      job.ID,
+				Tries:      job.Tries,
+				ETA:        job.ETA,
+				Priority:   job.Priority,
+				MaxRetries: job.MaxRetries,
+			})
+		}
+		if err := m.wal.WriteBatch(records); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to write requeue records: %w", err)
+		}
+		queue.updateGauges()
+		queue.mu.Unlock()
+	}
+
+	log.Info().Int("jobs", count).Msg("force-expired inflight leases")
+	return count, firstErr
+}
+
 // replayWAL replays the WAL to rebuild in-memory state
 func (m *Manager) replayWAL() error {
 	log.Info().Msg("replaying WAL")
 
-	return m.wal.Replay(func(record *wal.Record) error {
+	return m.replayWith(m.wal.Replay)
+}
+
+// replayWith rebuilds in-memory state from the records replay passes to its
+// callback
+func (m *Manager) replayWith(replay func(func(*wal.Record) error) error) error {
+	return replay(func(record *wal.Record) error {
 		switch record.Type {
 		case wal.RecordTypeEnqueue:
 			queue := m.getOrCreateQueue(record.Queue)
+			seq := record.Seq
+			if seq == 0 {
+				seq = m.nextSeq() // Logged before jobs had one
+			} else if seq > m.enqueueSeq.Load() {
+				m.enqueueSeq.Store(seq)
+			}
 			job := &Job{
 				ID:         record.JobID,
 				Queue:      record.Queue,
@@ -92,14 +605,21 @@ func (m *Manager) replayWAL() error {
 				ETA:        record.ETA,
 				Status:     JobStatusReady,
 				EnqueuedAt: time.Now(),
+				Seq:        seq,
+				BaseDelay:  record.BaseDelay,
+				MaxDelay:   record.MaxDelay,
+				Multiplier: record.Multiplier,
 			}
-			queue.ready.Push(job)
+			queue.pushReady(job)
 
 		case wal.RecordTypeAck:
 			queue := m.getQueue(record.Queue)
 			if queue != nil {
 				queue.mu.Lock()
-				delete(queue.inflight, record.JobID)
+				// The job replays as ready if its lease was not logged
+				queue.removeReady(record.JobID)
+				queue.removeInflight(record.JobID)
+				queue.fence = max(queue.fence, record.FencingToken)
 				queue.mu.Unlock()
 			}
 
@@ -107,38 +627,133 @@ func (m *Manager) replayWAL() error {
 			queue := m.getQueue(record.Queue)
 			if queue != nil {
 				queue.mu.Lock()
-				if job, exists := queue.inflight[record.JobID]; exists {
-					delete(queue.inflight, record.JobID)
+				job, exists := queue.inflight[record.JobID]
+				fromDLQ := false
+				if exists {
+					queue.removeInflight(record.JobID)
+				} else if record.Type == wal.RecordTypeRequeue {
+					// Requeued out of the DLQ
+					if job, fromDLQ = queue.dlq[record.JobID]; fromDLQ {
+						delete(queue.dlq, record.JobID)
+						if err := queue.restorePayload(job); err != nil {
+							queue.mu.Unlock()
+							return err
+						}
+						job.DLQReason = ""
+						job.DLQAt = time.Time{}
+						exists = true
+					}
+				}
+				if exists {
 					job.Tries = record.Tries
+					job.Expiries = record.Expiries
 					job.ETA = record.ETA
 					job.Status = JobStatusReady
 					job.LeaseID = ""
 					job.LeaseDeadline = time.Time{}
 
-					if job.ShouldRetry() {
-						queue.ready.Push(job)
+					// Nacks into the DLQ, permanent ones included, log no ETA
+					dead := record.Type == wal.RecordTypeNack && record.ETA.IsZero()
+					if fromDLQ || (!dead && job.ShouldRetry()) {
+						queue.pushReady(job)
 					} else {
 						job.Status = JobStatusDLQ
+						job.DLQReason = record.Reason
+						job.DLQAt = time.Now()
 						queue.dlq[job.ID] = job
 					}
 				}
 				queue.mu.Unlock()
 			}
 
+		case wal.RecordTypeLease:
+			queue := m.getQueue(record.Queue)
+			if queue != nil {
+				queue.mu.Lock()
+				job := queue.inflight[record.JobID]
+				if job == nil {
+					job = queue.takeReady(record.JobID)
+				}
+				// Lease timeouts are checked as usual from here on
+				if job != nil {
+					job.Status = JobStatusInflight
+					job.LeaseID = record.LeaseID
+					job.LeaseDeadline = record.ETA
+					job.FencingToken = record.FencingToken
+					queue.addInflight(job)
+				}
+				queue.fence = max(queue.fence, record.FencingToken)
+				queue.mu.Unlock()
+			}
+
+		case wal.RecordTypeDLQ:
+			queue := m.getQueue(record.Queue)
+			if queue != nil {
+				queue.mu.Lock()
+				job := queue.takeReady(record.JobID)
+				if job == nil {
+					job = queue.inflight[record.JobID]
+					queue.removeInflight(record.JobID)
+				}
+				if job != nil {
+					job.Status = JobStatusDLQ
+					job.DLQReason = record.Reason
+					job.DLQAt = time.Now()
+					job.LeaseID = ""
+					job.LeaseDeadline = time.Time{}
+					queue.dlq[job.ID] = job
+					if record.Reason == DLQReasonMemoryPressure {
+						queue.offloadPayload(job)
+					}
+				}
+				queue.mu.Unlock()
+			}
+
 		case wal.RecordTypeTombstone:
 			queue := m.getQueue(record.Queue)
 			if queue != nil {
 				queue.mu.Lock()
-				delete(queue.inflight, record.JobID)
+				queue.removeReady(record.JobID)
+				queue.removeInflight(record.JobID)
+				if job, exists := queue.dlq[record.JobID]; exists && job.payloadOffloaded {
+					queue.dropPayload(record.JobID)
+				}
 				delete(queue.dlq, record.JobID)
 				queue.mu.Unlock()
 			}
+
+		case wal.RecordTypeDeleteQueue:
+			// Records that follow are for a queue created again since
+			m.mu.Lock()
+			delete(m.queues, record.Queue)
+			m.mu.Unlock()
 		}
 
 		return nil
 	})
 }
 
+// SetMaxReadyInMemory sets the MaxReadyInMemory of queues created from now
+// on; existing queues keep theirs (see SetQueueConfig)
+func (m *Manager) SetMaxReadyInMemory(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxReadyInMemory = n
+}
+
+// defaultQueueConfig returns the settings for a new queue. Must be called
+// with m.mu held.
+func (m *Manager) defaultQueueConfig() QueueConfig {
+	cfg := DefaultQueueConfig()
+	cfg.MaxReadyInMemory = m.maxReadyInMemory
+	return cfg
+}
+
+// nextSeq returns the next enqueue sequence number
+func (m *Manager) nextSeq() uint64 {
+	return m.enqueueSeq.Add(1)
+}
+
 // getOrCreateQueue gets or creates a queue
 func (m *Manager) getOrCreateQueue(name string) *Queue {
 	m.mu.Lock()
@@ -146,21 +761,69 @@ func (m *Manager) getOrCreateQueue(name string) *Queue {
 
 	queue, exists := m.queues[name]
 	if !exists {
-		queue = &Queue{
-			name:     name,
-			ready:    newPriorityQueue(),
-			inflight: make(map[string]*Job),
-			dlq:      make(map[string]*Job),
-			store:    m.store,
-			wal:      m.wal,
-			limiter:  ratelimit.NewTokenBucket(0, 0), // No limit by default
-		}
+		m.awaitDeletion(name)
+		queue, exists = m.queues[name]
+	}
+	if !exists {
+		queue = m.newQueue(name, m.defaultQueueConfig())
 		m.queues[name] = queue
 	}
 
 	return queue
 }
 
+// newQueue builds an empty queue. Must be called with m.mu held.
+func (m *Manager) newQueue(name string, cfg QueueConfig) *Queue {
+	queue := &Queue{
+		name:     name,
+		config:   cfg,
+		ready:    newPriorityQueue(),
+		inflight: make(map[string]*Job),
+		reserved: make(map[string]*reservation),
+		spilled:  make(map[string][]byte),
+		dlq:      make(map[string]*Job),
+		store:    m.store,
+		wal:      m.wal,
+		limiter:  ratelimit.NewTokenBucket(0, 0), // No limit by default
+	}
+	queue.ready.SetDemotionStep(cfg.PriorityDemotionStep)
+	queue.ready.SetIgnorePriority(cfg.Mode == QueueModeFIFO)
+	queue.nextLeaseCheck = time.Now().Add(m.leaseCheckDelay())
+	return queue
+}
+
+// CreateQueue creates a queue with cfg unless it already exists, and reports
+// whether it did. An existing queue keeps its config, so creating a queue is
+// idempotent and can be replicated to every node of a cluster.
+func (m *Manager) CreateQueue(name string, cfg QueueConfig) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.awaitDeletion(name)
+	if _, exists := m.queues[name]; exists {
+		return false
+	}
+	if cfg.Mode == QueueModeFIFO {
+		if err := m.saveQueueMode(name, cfg.Mode); err != nil {
+			logging.With(logging.Fields{Queue: name}).Warn().Err(err).Msg("queue mode will not survive a restart")
+		}
+	}
+	if len(cfg.DefaultHeaders) > 0 {
+		if err := m.saveDefaultHeaders(name, cfg.DefaultHeaders); err != nil {
+			logging.With(logging.Fields{Queue: name}).Warn().Err(err).Msg("default headers will not survive a restart")
+		}
+	}
+	m.queues[name] = m.newQueue(name, cfg)
+	return true
+}
+
+// DefaultQueueConfig returns the config a queue created by an enqueue gets
+func (m *Manager) DefaultQueueConfig() QueueConfig {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.defaultQueueConfig()
+}
+
 // getQueue gets a queue by name
 func (m *Manager) getQueue(name string) *Queue {
 	m.mu.RLock()
@@ -168,32 +831,144 @@ func (m *Manager) getQueue(name string) *Queue {
 	return m.queues[name]
 }
 
+// EnqueueOptions are the optional parts of an enqueue. The zero value
+// enqueues durably under a generated ID, with no deduplication.
+type EnqueueOptions struct {
+	Headers     map[string]string
+	Priority    uint8
+	DelayMs     int64
+	RetryPolicy RetryPolicy
+
+	// IdempotencyKey deduplicates on a key the client chooses. With strict
+	// idempotency, a reused key whose request differs returns
+	// ErrIdempotencyConflict together with the existing job's ID.
+	IdempotencyKey string
+
+	// RequestID deduplicates on the client's request ID. A repeat of the
+	// same request ID on the same queue within the request ID window returns
+	// the originally created job instead of enqueuing again, which catches
+	// retries of requests that actually succeeded.
+	RequestID string
+
+	// JobID is the job's ID, chosen by the caller instead of generated, see
+	// checkJobID. Empty generates one.
+	JobID string
+
+	// AckMode chooses when to return: AckModeBuffered skips waiting for the
+	// WAL fsync, trading a small window of crash loss for lower enqueue
+	// latency. Empty means AckModeDurable.
+	AckMode AckMode
+
+	// Depth, if not nil, is filled with the queue's depth right after the
+	// enqueue. The depth is taken under the same lock that adds the job, for
+	// producers applying their own backpressure. If the request is a
+	// duplicate, it is the current depth.
+	Depth *QueueDepth
+}
+
 // Enqueue adds a job to a queue
 func (m *Manager) Enqueue(queueName string, payload []byte, headers map[string]string, priority uint8, delayMs int64, retryPolicy RetryPolicy, idempotencyKey string) (string, error) {
+	return m.EnqueueWithOptions(queueName, payload, EnqueueOptions{
+		Headers:        headers,
+		Priority:       priority,
+		DelayMs:        delayMs,
+		RetryPolicy:    retryPolicy,
+		IdempotencyKey: idempotencyKey,
+	})
+}
+
+// EnqueueWithOptions adds a job to a queue, see EnqueueOptions
+func (m *Manager) EnqueueWithOptions(queueName string, payload []byte, opts EnqueueOptions) (string, error) {
+	jobID, headers, priority := opts.JobID, opts.Headers, opts.Priority
+	if err := m.checkOpen(); err != nil {
+		return "", err
+	}
+	if err := validateJobID(jobID); err != nil {
+		return "", err
+	}
+	if m.Maintenance().RejectEnqueues {
+		return "", ErrMaintenance
+	}
+	if err := m.checkDelay(opts.DelayMs); err != nil {
+		return "", err
+	}
+	if err := m.checkHeaders(headers); err != nil {
+		return "", err
+	}
+
+	// Check request ID
+	if opts.RequestID != "" {
+		existingJobID, err := m.store.GetRequestID(queueName, opts.RequestID)
+		if err != nil {
+			return "", fmt.Errorf("failed to check request ID: %w", err)
+		}
+		if existingJobID != "" {
+			logging.With(logging.Fields{RequestID: opts.RequestID, Queue: queueName, JobID: existingJobID}).Debug().Msg("duplicate request, returning existing job")
+			m.fillDepth(queueName, opts.Depth)
+			return existingJobID, nil
+		}
+	}
+
 	// Check idempotency key
-	if idempotencyKey != "" {
-		existingJobID, err := m.store.GetIdempotencyKey(idempotencyKey)
+	var hash string
+	if opts.IdempotencyKey != "" {
+		hash = requestHash(payload, headers)
+		existingJobID, existingHash, err := m.lookupIdempotencyKey(queueName, opts.IdempotencyKey)
 		if err != nil {
-			return "", fmt.Errorf("failed to check idempotency key: %w", err)
+			return "", err
 		}
 		if existingJobID != "" {
-			log.Debug().Str("job_id", existingJobID).Str("idempotency_key", idempotencyKey).Msg("idempotent request, returning existing job")
+			if err := m.checkIdempotencyConflict(queueName, existingJobID, existingHash, hash); err != nil {
+				return existingJobID, err
+			}
+			logging.With(logging.Fields{Queue: queueName, JobID: existingJobID}).Debug().Str("idempotency_key", logging.Value(opts.IdempotencyKey)).Msg("idempotent request, returning existing job")
+			m.fillDepth(queueName, opts.Depth)
 			return existingJobID, nil
 		}
 	}
 
+	// Check the provided job ID. The lock is held until the job is added so
+	// two enqueues cannot both take the same ID.
+	if jobID != "" {
+		m.jobIDMu.Lock()
+		defer m.jobIDMu.Unlock()
+
+		duplicate, err := m.checkJobID(queueName, jobID, payload, headers)
+		if err != nil {
+			return "", err
+		}
+		if duplicate {
+			logging.With(logging.Fields{Queue: queueName, JobID: jobID}).Debug().Msg("job already enqueued, returning it")
+			m.fillDepth(queueName, opts.Depth)
+			return jobID, nil
+		}
+	}
+
 	// Check rate limit
 	if !m.rateLimiter.Allow(queueName) {
-		return "", fmt.Errorf("rate limit exceeded for queue %s", queueName)
+		metrics.RateLimitRejections.WithLabelValues(queueName).Inc()
+		return "", fmt.Errorf("%w for queue %s", ErrRateLimited, queueName)
 	}
 
 	queue := m.getOrCreateQueue(queueName)
 
+	queue.mu.RLock()
+	headers = withDefaultHeaders(queue.config.DefaultHeaders, headers)
+	headers, priority = applyTransforms(queue.config.Transforms, headers, priority, time.Now())
+	queue.mu.RUnlock()
+
+	// Default headers and transforms may push the job over the limits
+	if err := m.checkHeaders(headers); err != nil {
+		return "", err
+	}
+
 	// Create job
-	jobID := uuid.New().String()
+	if jobID == "" {
+		jobID = uuid.New().String()
+	}
 	eta := time.Now()
-	if delayMs > 0 {
-		eta = eta.Add(time.Duration(delayMs) * time.Millisecond)
+	if opts.DelayMs > 0 {
+		eta = eta.Add(time.Duration(opts.DelayMs) * time.Millisecond)
 	}
 
 	job := &Job{
@@ -203,10 +978,14 @@ func (m *Manager) Enqueue(queueName string, payload []byte, headers map[string]s
 		Headers:    headers,
 		Priority:   priority,
 		Tries:      0,
-		MaxRetries: retryPolicy.MaxRetries,
+		MaxRetries: opts.RetryPolicy.MaxRetries,
 		ETA:        eta,
 		Status:     JobStatusReady,
 		EnqueuedAt: time.Now(),
+		Seq:        m.nextSeq(),
+		BaseDelay:  opts.RetryPolicy.BaseDelay,
+		MaxDelay:   opts.RetryPolicy.MaxDelay,
+		Multiplier: opts.RetryPolicy.Multiplier,
 	}
 
 	// Write to WAL
@@ -218,77 +997,330 @@ func (m *Manager) Enqueue(queueName string, payload []byte, headers map[string]s
 		Headers:    headers,
 		Priority:   priority,
 		Tries:      0,
-		MaxRetries: retryPolicy.MaxRetries,
+		MaxRetries: opts.RetryPolicy.MaxRetries,
 		ETA:        eta,
+		BaseDelay:  opts.RetryPolicy.BaseDelay,
+		MaxDelay:   opts.RetryPolicy.MaxDelay,
+		Multiplier: opts.RetryPolicy.Multiplier,
+		Seq:        job.Seq,
 	}
 
-	if err := m.wal.Write(record); err != nil {
+	write := m.wal.Write
+	if opts.AckMode == AckModeBuffered {
+		write = m.wal.WriteBuffered
+	}
+	if err := write(record); err != nil {
 		return "", fmt.Errorf("failed to write to WAL: %w", err)
 	}
 
 	// Store idempotency key
-	if idempotencyKey != "" {
-		if err := m.store.SetIdempotencyKey(idempotencyKey, jobID); err != nil {
-			log.Error().Err(err).Msg("failed to store idempotency key")
+	if opts.IdempotencyKey != "" {
+		m.storeIdempotencyKey(queueName, opts.IdempotencyKey, jobID, hash)
+	}
+
+	// Remember request ID
+	if opts.RequestID != "" {
+		if err := m.store.SetRequestID(queueName, opts.RequestID, jobID, m.requestIDWindow); err != nil {
+			logging.With(logging.Fields{RequestID: opts.RequestID, Queue: queueName, JobID: jobID}).Error().Err(err).Msg("failed to store request ID")
 		}
 	}
 
 	// Add to ready queue
 	queue.mu.Lock()
-	queue.ready.Push(job)
-	queue.mu.Unlock()
+	for queue.deleted {
+		queue.mu.Unlock()
+		queue = m.getOrCreateQueue(queueName)
+		queue.mu.Lock()
+	}
+	queue.pushReady(job)
+	if opts.Depth != nil {
+		*opts.Depth = queue.depth()
+	}
+	queue.updateGauges()
+	queue.mu.Unlock()
+	metrics.JobsEnqueuedTotal.WithLabelValues(queueName).Inc()
 
-	log.Debug().Str("job_id", jobID).Str("queue", queueName).Uint8("priority", priority).Msg("job enqueued")
+	logging.With(logging.Fields{Queue: queueName, JobID: jobID}).Debug().
+		Uint8("priority", priority).
+		Str("payload", logging.Digest(payload)).
+		Int("headers", len(headers)).
+		Msg("job enqueued")
 	return jobID, nil
 }
 
-// Lease leases jobs from a queue
+// ClearIdempotencyKey releases an idempotency key so the next enqueue with it
+// creates a new job instead of returning the old one. Keys are shared by the
+// queues of a namespace (and by all queues outside any namespace), see
+// scopedIdempotencyKey, so the key is only cleared if its job is not live in
+// a different queue. Returns ErrIdempotencyKeyNotFound if the key is not
+// mapped.
+func (m *Manager) ClearIdempotencyKey(queueName, key string) error {
+	scoped := scopedIdempotencyKey(queueName, key)
+	jobID, err := m.store.GetIdempotencyKey(scoped)
+	if err != nil {
+		return fmt.Errorf("failed to look up idempotency key: %w", err)
+	}
+	if jobID == "" {
+		return fmt.Errorf("%w: %s", ErrIdempotencyKeyNotFound, key)
+	}
+
+	if owner := m.jobQueue(jobID); owner != "" && owner != queueName {
+		return fmt.Errorf("%w: %s belongs to queue %s", ErrIdempotencyKeyNotFound, key, owner)
+	}
+
+	if err := m.store.DeleteIdempotencyKey(scoped); err != nil {
+		return fmt.Errorf("failed to delete idempotency key: %w", err)
+	}
+	metrics.IdempotencyKeys.Set(float64(m.store.IdempotencyStats().Keys))
+
+	logging.With(logging.Fields{Queue: queueName, JobID: jobID}).Info().Str("idempotency_key", logging.Value(key)).Msg("idempotency key cleared")
+	return nil
+}
+
+// jobQueue returns the name of the queue holding a live job, or ""
+func (m *Manager) jobQueue(jobID string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for name, q := range m.queues {
+		q.mu.RLock()
+		_, inflight := q.inflight[jobID]
+		_, dlq := q.dlq[jobID]
+		_, reserved := q.reserved[jobID]
+		found := inflight || dlq || reserved || q.containsReady(jobID)
+		q.mu.RUnlock()
+		if found {
+			return name
+		}
+	}
+	return ""
+}
+
+// LeaseOptions are the optional parts of a lease. The zero value leases by
+// priority, with no byte budget, and returns straight away.
+type LeaseOptions struct {
+	// MaxBytes caps the total payload bytes of the jobs leased, so consumers
+	// with memory limits are not handed more than they can hold. At least
+	// one job is returned if any is ready, even if it alone exceeds the
+	// budget. Zero means no budget.
+	MaxBytes int64
+
+	// Ordering chooses which ready jobs go first: OrderingFIFO hands out the
+	// oldest jobs regardless of priority. Empty means OrderingPriority.
+	Ordering LeaseOrdering
+
+	// ExpectedMs is how long the consumer expects to process each job. Jobs
+	// held longer are reported as overdue and logged once, ahead of their
+	// lease expiring. A zero visibilityMs is derived from it
+	// (ExpectedVisibilityFactor times it); zero declares no expectation.
+	ExpectedMs int64
+
+	// Wait is how long to wait for jobs if none can be leased straight
+	// away, see LeaseWithOptions. Zero does not wait.
+	Wait time.Duration
+}
+
+// Lease leases up to maxJobs jobs from a queue. maxJobs above the
+// SetMaxLeaseBatch limit is clamped to it. Nothing is leased while the node
+// is in maintenance mode or the queue is paused.
 func (m *Manager) Lease(queueName string, maxJobs int, visibilityMs int64) ([]*Job, error) {
+	return m.LeaseWithOptions(context.Background(), queueName, maxJobs, visibilityMs, LeaseOptions{})
+}
+
+// lease makes one lease attempt for LeaseWithOptions. If nothing is leased
+// and waiting is set, it also returns when a waiting lease should try again,
+// unless the queue is paused or the node in maintenance: then it should not
+// wait at all.
+func (m *Manager) lease(queueName string, maxJobs int, visibilityMs int64, opts LeaseOptions, waiting bool) (jobs []*Job, retry leaseRetry, err error) {
+	if err := m.checkOpen(); err != nil {
+		return nil, retry, err
+	}
 	queue := m.getQueue(queueName)
 	if queue == nil {
-		return nil, fmt.Errorf("queue not found: %s", queueName)
+		return nil, retry, fmt.Errorf("%w: %s", ErrQueueNotFound, queueName)
 	}
 
 	if maxJobs <= 0 {
 		maxJobs = 1
 	}
 
+	m.mu.RLock()
+	limits := m.visibility
+	maxBatch := m.maxLeaseBatch
+	maintenance := m.maintenance.Enabled
+	m.mu.RUnlock()
+
+	// Nothing is handed out while the node is quiesced
+	if maintenance {
+		return []*Job{}, retry, nil
+	}
+
+	if maxBatch > 0 && maxJobs > maxBatch {
+		logging.With(logging.Fields{Queue: queueName}).Warn().
+			Int("max_jobs", maxJobs).
+			Int("max_lease_batch", maxBatch).
+			Msg("lease asked for too many jobs, clamping")
+		maxJobs = maxBatch
+	}
+
+	expectedMs := opts.ExpectedMs
+	if expectedMs < 0 {
+		expectedMs = 0
+	}
+	if visibilityMs <= 0 && expectedMs > 0 {
+		visibilityMs = expectedMs * ExpectedVisibilityFactor
+	}
+
+	visibilityMs, err = limits.apply(visibilityMs)
+	if err != nil {
+		return nil, retry, err
+	}
+
 	visibilityTimeout := time.Duration(visibilityMs) * time.Millisecond
 	now := time.Now()
 	leaseDeadline := now.Add(visibilityTimeout)
 
-	jobs := make([]*Job, 0, maxJobs)
+	jobs = make([]*Job, 0, maxJobs)
 
 	queue.mu.Lock()
 	defer queue.mu.Unlock()
+	defer func() {
+		if len(jobs) > 0 {
+			queue.updateGauges()
+			metrics.JobsLeasedTotal.WithLabelValues(queueName).Add(float64(len(jobs)))
+		} else if waiting && err == nil && !queue.paused {
+			retry = queue.leaseRetry()
+		}
+	}()
+
+	// The queue was deleted after the lookup
+	if queue.deleted {
+		return nil, retry, fmt.Errorf("%w: %s", ErrQueueNotFound, queueName)
+	}
+	if queue.paused {
+		return jobs, retry, nil
+	}
+
+	// A single active consumer gets one job at a time, and nothing while a
+	// lease is outstanding
+	if queue.config.SingleActiveConsumer {
+		if queue.hasActiveConsumer() {
+			return jobs, retry, nil
+		}
+		maxJobs = 1
+	}
+
+	peek, pop := queue.peekReady, queue.popReady
+	if opts.Ordering == OrderingFIFO || queue.isFIFO() {
+		peek, pop = queue.peekOldestReady, queue.popOldestReady
+	}
+
+	// At-most-once jobs are consumed below, with one durable write for the
+	// batch rather than one per job with the queue locked
+	atMostOnce := queue.config.DeliveryMode == DeliveryAtMostOnce
 
+	var totalBytes int64
 	for i := 0; i < maxJobs; i++ {
-		job := queue.ready.PopReady(now)
-		if job == nil {
+		next := peek(now)
+		if next == nil {
+			break
+		}
+		if opts.MaxBytes > 0 && len(jobs) > 0 && totalBytes+int64(len(next.Payload)) > opts.MaxBytes {
 			break
 		}
+		if queue.inflightFull(next) {
+			break
+		}
+
+		job := pop(now)
 
 		// Generate lease ID
 		leaseID := uuid.New().String()
 		job.LeaseID = leaseID
 		job.LeaseDeadline = leaseDeadline
 		job.Status = JobStatusInflight
+		if queue.config.SingleActiveConsumer {
+			job.FencingToken = queue.nextFencingToken(now)
+		}
+
+		if !atMostOnce {
+			if err := m.logLease(job); err != nil {
+				queue.unlease(job)
+				if len(jobs) == 0 {
+					return nil, retry, err
+				}
+				break
+			}
+		}
+
+		totalBytes += int64(len(job.Payload))
 
 		// Move to inflight
-		queue.inflight[job.ID] = job
+		queue.addInflight(job)
 		jobs = append(jobs, job)
+	}
 
-		log.Debug().Str("job_id", job.ID).Str("lease_id", leaseID).Msg("job leased")
+	if atMostOnce && len(jobs) > 0 {
+		if err := m.consume(jobs); err != nil {
+			for _, job := range jobs {
+				queue.removeInflight(job.ID)
+				queue.unlease(job)
+			}
+			return nil, retry, err
+		}
 	}
 
-	return jobs, nil
+	for _, job := range jobs {
+		job.markLeased(now)
+		job.startLease(now, expectedMs)
+
+		logging.With(logging.Fields{Queue: queueName, JobID: job.ID, LeaseID: job.LeaseID}).Debug().Msg("job leased")
+	}
+
+	return jobs, retry, nil
 }
 
-// Ack acknowledges a job completion
-func (m *Manager) Ack(jobID, leaseID string) error {
-	// Find the job
+// unlease returns a job whose lease could not be logged to the ready jobs.
+// Must be called with q.mu held.
+func (q *Queue) unlease(job *Job) {
+	job.LeaseID = ""
+	job.LeaseDeadline = time.Time{}
+	job.FencingToken = 0
+	job.Status = JobStatusReady
+	q.pushReady(job)
+}
+
+// logLease records an inflight job's lease and deadline in the WAL, so a
+// restart keeps the job inflight until the lease runs out rather than
+// redelivering it straight away, and with its fencing token, if any, so
+// tokens issued after the restart are greater. The record is not fsynced:
+// losing it in a machine crash only means the job is redelivered early.
+func (m *Manager) logLease(job *Job) error {
+	record := &wal.Record{
+		Type:         wal.RecordTypeLease,
+		Queue:        job.Queue,
+		JobID:        job.ID,
+		LeaseID:      job.LeaseID,
+		ETA:          job.LeaseDeadline,
+		FencingToken: job.FencingToken,
+	}
+	if err := m.wal.WriteBuffered(record); err != nil {
+		return fmt.Errorf("failed to write to WAL: %w", err)
+	}
+	return nil
+}
+
+// findInflight locates an inflight job and validates its lease. A lease that
+// recently expired is reported as ErrLeaseExpired so a late consumer knows the
+// job was reassigned and must not retry.
+func (m *Manager) findInflight(jobID, leaseID string) (*Queue, *Job, error) {
+	if err := m.checkOpen(); err != nil {
+		return nil, nil, err
+	}
+
 	var queue *Queue
 	var job *Job
+	var currentLease string
 
 	m.mu.RLock()
 	for _, q := range m.queues {
@@ -296,6 +1328,7 @@ func (m *Manager) Ack(jobID, leaseID string) error {
 		if j, exists := q.inflight[jobID]; exists {
 			queue = q
 			job = j
+			currentLease = j.LeaseID
 		}
 		q.mu.RUnlock()
 		if job != nil {
@@ -304,75 +1337,177 @@ func (m *Manager) Ack(jobID, leaseID string) error {
 	}
 	m.mu.RUnlock()
 
-	if job == nil {
-		return fmt.Errorf("job not found or not inflight: %s", jobID)
+	if job == nil || currentLease != leaseID {
+		if m.isExpiredLease(leaseID) {
+			return nil, nil, fmt.Errorf("%w: job %s was reassigned", ErrLeaseExpired, jobID)
+		}
+		if job == nil {
+			return nil, nil, fmt.Errorf("%w or not inflight: %s", ErrJobNotFound, jobID)
+		}
+		return nil, nil, fmt.Errorf("%w: job %s", ErrInvalidLease, jobID)
+	}
+
+	return queue, job, nil
+}
+
+// rememberExpiredLease records a lease that timed out so late acks can be
+// told apart from bogus ones
+func (m *Manager) rememberExpiredLease(leaseID string, now time.Time) {
+	if leaseID == "" {
+		return
 	}
 
-	if job.LeaseID != leaseID {
-		return fmt.Errorf("invalid lease ID")
+	m.expiredMu.Lock()
+	defer m.expiredMu.Unlock()
+	m.expiredLeases[leaseID] = now
+}
+
+// isExpiredLease returns true if the lease expired within expiredLeaseTTL
+func (m *Manager) isExpiredLease(leaseID string) bool {
+	m.expiredMu.Lock()
+	defer m.expiredMu.Unlock()
+
+	expiredAt, exists := m.expiredLeases[leaseID]
+	return exists && time.Since(expiredAt) < expiredLeaseTTL
+}
+
+// pruneExpiredLeases forgets expired leases older than expiredLeaseTTL
+func (m *Manager) pruneExpiredLeases(now time.Time) {
+	m.expiredMu.Lock()
+	defer m.expiredMu.Unlock()
+
+	for leaseID, expiredAt := range m.expiredLeases {
+		if now.Sub(expiredAt) >= expiredLeaseTTL {
+			delete(m.expiredLeases, leaseID)
+		}
 	}
+}
 
-	// Write to WAL
-	record := &wal.Record{
-		Type:    wal.RecordTypeAck,
-		Queue:   job.Queue,
-		JobID:   jobID,
-		LeaseID: leaseID,
+// Ack acknowledges a job completion
+func (m *Manager) Ack(jobID, leaseID string) error {
+	queue, job, err := m.findInflight(jobID, leaseID)
+	if err != nil {
+		return err
 	}
 
-	if err := m.wal.Write(record); err != nil {
-		return fmt.Errorf("failed to write to WAL: %w", err)
+	// Write to WAL, unless it was acked when leased
+	if !job.Consumed {
+		record := &wal.Record{
+			Type:    wal.RecordTypeAck,
+			Queue:   job.Queue,
+			JobID:   jobID,
+			LeaseID: leaseID,
+		}
+
+		if err := m.wal.Write(record); err != nil {
+			return fmt.Errorf("failed to write to WAL: %w", err)
+		}
 	}
 
 	// Remove from inflight
 	queue.mu.Lock()
-	delete(queue.inflight, jobID)
+	queue.removeInflight(jobID)
+	queue.updateGauges()
 	queue.mu.Unlock()
+	metrics.JobsAckedTotal.WithLabelValues(job.Queue).Inc()
+
+	// Only retried jobs have history to clean up
+	if job.Tries > 0 {
+		if err := m.store.DeleteJob(jobID); err != nil {
+			logging.With(logging.Fields{Queue: job.Queue, JobID: jobID}).Warn().Err(err).Msg("failed to delete job history")
+		}
+	}
 
-	log.Debug().Str("job_id", jobID).Msg("job acknowledged")
+	logging.With(logging.Fields{Queue: job.Queue, JobID: jobID, LeaseID: leaseID}).Debug().Msg("job acknowledged")
 	return nil
 }
 
-// Nack negatively acknowledges a job (requeue with backoff or move to DLQ)
-func (m *Manager) Nack(jobID, leaseID, reason string) error {
-	// Find the job
-	var queue *Queue
-	var job *Job
+// AckAndLease acks a job and then leases the next job from queueName, saving
+// serial consumers a round trip. The queue and visibility timeout are checked
+// before the ack, so a bad request acks nothing; once the ack is applied it
+// stands even if the lease fails. Returns a nil job if none is ready.
+func (m *Manager) AckAndLease(jobID, leaseID, queueName string, visibilityMs int64) (*Job, error) {
+	if m.getQueue(queueName) == nil {
+		return nil, fmt.Errorf("%w: %s", ErrQueueNotFound, queueName)
+	}
 
 	m.mu.RLock()
-	for _, q := range m.queues {
-		q.mu.RLock()
-		if j, exists := q.inflight[jobID]; exists {
-			queue = q
-			job = j
-		}
-		q.mu.RUnlock()
-		if job != nil {
-			break
-		}
-	}
+	limits := m.visibility
 	m.mu.RUnlock()
 
-	if job == nil {
-		return fmt.Errorf("job not found or not inflight: %s", jobID)
+	if _, err := limits.apply(visibilityMs); err != nil {
+		return nil, err
+	}
+
+	if err := m.Ack(jobID, leaseID); err != nil {
+		return nil, err
 	}
 
-	if job.LeaseID != leaseID {
-		return fmt.Errorf("invalid lease ID")
+	jobs, err := m.Lease(queueName, 1, visibilityMs)
+	if err != nil {
+		return nil, fmt.Errorf("job acked, but failed to lease the next one: %w", err)
 	}
+	if len(jobs) == 0 {
+		return nil, nil
+	}
+	return jobs[0], nil
+}
+
+// Nack negatively acknowledges a job (requeue with backoff or move to DLQ)
+func (m *Manager) Nack(jobID, leaseID, reason string) error {
+	return m.nack(jobID, leaseID, reason, false)
+}
 
-	// Increment tries
+// NackPermanent negatively acknowledges a job that failed in a way retrying
+// cannot fix, skipping its remaining retries: it is dead-lettered, or dropped
+// if the queue has no DLQ
+func (m *Manager) NackPermanent(jobID, leaseID, reason string) error {
+	return m.nack(jobID, leaseID, reason, true)
+}
+
+// nack settles a failed job, retrying it unless permanent is set, a nack
+// rule says otherwise or it is out of retries
+func (m *Manager) nack(jobID, leaseID, reason string, permanent bool) error {
+	queue, job, err := m.findInflight(jobID, leaseID)
+	if err != nil {
+		return err
+	}
+
+	// At-most-once jobs were acked when leased and cannot be retried
+	if job.Consumed {
+		queue.mu.Lock()
+		queue.removeInflight(jobID)
+		queue.updateGauges()
+		queue.mu.Unlock()
+
+		metrics.JobsNackedTotal.WithLabelValues(job.Queue).Inc()
+		logging.With(logging.Fields{Queue: job.Queue, JobID: jobID, LeaseID: leaseID}).Warn().Str("reason", logging.Value(reason)).Msg("job nacked in at-most-once queue, dropping")
+		return nil
+	}
+
+	queue.mu.RLock()
+	dlqEnabled := queue.config.DLQEnabled
+	rule := matchNackRule(queue.config.NackRules, reason)
+	queue.mu.RUnlock()
+
+	// Increment tries. A nack proves the consumer is alive, so the job is not
+	// crashing consumers.
 	job.Tries++
+	job.Expiries = 0
 
-	// Calculate backoff
-	backoffDelay := backoff.CalculateDefault(job.Tries)
+	// Calculate backoff, letting a matching nack rule adjust it
+	backoffDelay, retryable := applyNackRule(rule, job.retryDelay(m.MinRetryDelay()))
 	job.ETA = time.Now().Add(backoffDelay)
 	job.LeaseID = ""
 	job.LeaseDeadline = time.Time{}
 
-	// Check if should retry or move to DLQ
-	if job.ShouldRetry() {
+	retry := retryable && !permanent && job.ShouldRetry()
+	m.recordHistory(job, reason, retry)
+
+	// Check if should retry, move to DLQ or drop
+	if retry {
 		job.Status = JobStatusReady
+		metrics.BackoffDelay.WithLabelValues(job.Queue).Observe(backoffDelay.Seconds())
 
 		// Write to WAL
 		record := &wal.Record{
@@ -393,13 +1528,25 @@ func (m *Manager) Nack(jobID, leaseID, reason string) error {
 
 		// Move back to ready queue
 		queue.mu.Lock()
-		delete(queue.inflight, jobID)
-		queue.ready.Push(job)
+		queue.removeInflight(jobID)
+		queue.pushReady(job)
+		queue.updateGauges()
 		queue.mu.Unlock()
 
-		log.Debug().Str("job_id", jobID).Uint32("tries", job.Tries).Msg("job nacked, requeued")
+		logging.With(logging.Fields{Queue: job.Queue, JobID: jobID, LeaseID: leaseID}).Debug().Uint32("tries", job.Tries).Msg("job nacked, requeued")
+	} else if !dlqEnabled {
+		if err := m.dropJob(job, reason); err != nil {
+			return err
+		}
+
+		queue.mu.Lock()
+		queue.removeInflight(jobID)
+		queue.updateGauges()
+		queue.mu.Unlock()
 	} else {
 		job.Status = JobStatusDLQ
+		job.DLQReason = reason
+		job.DLQAt = time.Now()
 
 		// Write to WAL
 		record := &wal.Record{
@@ -417,21 +1564,96 @@ func (m *Manager) Nack(jobID, leaseID, reason string) error {
 
 		// Move to DLQ
 		queue.mu.Lock()
-		delete(queue.inflight, jobID)
+		queue.removeInflight(jobID)
 		queue.dlq[jobID] = job
+		queue.updateGauges()
 		queue.mu.Unlock()
 
-		log.Warn().Str("job_id", jobID).Uint32("tries", job.Tries).Msg("job moved to DLQ")
+		switch {
+		case permanent:
+			countDLQ(job.Queue, dlqMetricPermanent, 1)
+		case !retryable:
+			countDLQ(job.Queue, dlqMetricNackRule, 1)
+		default:
+			countDLQ(job.Queue, dlqMetricRetriesExhausted, 1)
+		}
+
+		logging.With(logging.Fields{Queue: job.Queue, JobID: jobID, LeaseID: leaseID}).Warn().Uint32("tries", job.Tries).Str("reason", logging.Value(reason)).Msg("job moved to DLQ")
 	}
 
+	metrics.JobsNackedTotal.WithLabelValues(job.Queue).Inc()
+	return nil
+}
+
+// dropJob tombstones an exhausted job instead of dead-lettering it, for
+// queues with the DLQ disabled. The caller removes it from in-memory state.
+// The write is durable, so it must not be made with q.mu held; see
+// dropRecord.
+func (m *Manager) dropJob(job *Job, reason string) error {
+	if err := m.wal.Write(dropRecord(job, reason)); err != nil {
+		return fmt.Errorf("failed to write to WAL: %w", err)
+	}
+	m.jobDropped(job)
 	return nil
 }
 
-// leaseTimeoutWorker checks for expired leases and returns them to ready queue
+// dropRecord returns the tombstone that drops an exhausted job, for callers
+// holding q.mu to log in a batch
+func dropRecord(job *Job, reason string) *wal.Record {
+	return &wal.Record{
+		Type:   wal.RecordTypeTombstone,
+		Queue:  job.Queue,
+		JobID:  job.ID,
+		Reason: reason,
+		Tries:  job.Tries,
+	}
+}
+
+// jobDropped counts and logs a dropped job and deletes its history. The
+// delete does not wait for fsync, so it may be made with q.mu held.
+func (m *Manager) jobDropped(job *Job) {
+	if err := m.store.DeleteJobNoSync(job.ID); err != nil {
+		logging.With(logging.Fields{Queue: job.Queue, JobID: job.ID}).Warn().Err(err).Msg("failed to delete job history")
+	}
+	metrics.JobsDroppedTotal.WithLabelValues(job.Queue).Inc()
+	logging.With(logging.Fields{Queue: job.Queue, JobID: job.ID}).Warn().Uint32("tries", job.Tries).Msg("job exhausted retries, dropped (DLQ disabled)")
+}
+
+// leaseTimeoutWorker checks for expired leases and returns them to ready
+// queue, scanning each queue when its own lease check is due
 func (m *Manager) leaseTimeoutWorker() {
 	defer m.wg.Done()
 
-	ticker := time.NewTicker(1 * time.Second)
+	timer := time.NewTimer(m.leaseCheckInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-m.stopCh:
+			return
+		case <-timer.C:
+			now := time.Now()
+			next := m.checkDueLeaseTimeouts(now)
+			timer.Reset(max(next.Sub(now), leaseCheckResolution))
+		}
+	}
+}
+
+// leaseCheckDelay returns the time until a queue's next lease scan: the check
+// interval plus a random share of the jitter
+func (m *Manager) leaseCheckDelay() time.Duration {
+	delay := m.leaseCheckInterval
+	if m.leaseCheckJitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(m.leaseCheckJitter)))
+	}
+	return delay
+}
+
+// pruneWorker periodically deletes expired request IDs and idempotency keys
+func (m *Manager) pruneWorker() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 
 	for {
@@ -439,79 +1661,475 @@ func (m *Manager) leaseTimeoutWorker() {
 		case <-m.stopCh:
 			return
 		case <-ticker.C:
-			m.checkLeaseTimeouts()
+			m.pruneExpired(time.Now())
 		}
 	}
 }
 
-// checkLeaseTimeouts checks for expired leases
+// pruneExpired deletes request IDs and idempotency keys that expired by now
+func (m *Manager) pruneExpired(now time.Time) {
+	if _, err := m.store.PruneRequestIDs(now); err != nil {
+		log.Error().Err(err).Msg("failed to prune request IDs")
+	}
+	if _, err := m.store.PruneIdempotencyKeys(now); err != nil {
+		log.Error().Err(err).Msg("failed to prune idempotency keys")
+	}
+	metrics.IdempotencyKeys.Set(float64(m.store.IdempotencyStats().Keys))
+}
+
+// checkLeaseTimeouts checks every queue for expired leases now
 func (m *Manager) checkLeaseTimeouts() {
 	now := time.Now()
+	m.pruneExpiredLeases(now)
 
+	for _, queue := range m.allQueues() {
+		queue.mu.Lock()
+		m.expireLeases(queue, now)
+		queue.mu.Unlock()
+	}
+}
+
+// checkDueLeaseTimeouts checks the queues whose lease check is due by now for
+// expired leases, and returns when the worker should next wake: at the
+// earliest upcoming check, and at most one interval from now so queues
+// created meanwhile are not missed for long
+func (m *Manager) checkDueLeaseTimeouts(now time.Time) time.Time {
+	m.pruneExpiredLeases(now)
+
+	next := now.Add(m.leaseCheckInterval)
+	for _, queue := range m.allQueues() {
+		queue.mu.Lock()
+		if !now.Before(queue.nextLeaseCheck) {
+			m.expireLeases(queue, now)
+			queue.nextLeaseCheck = now.Add(m.leaseCheckDelay())
+		}
+		if queue.nextLeaseCheck.Before(next) {
+			next = queue.nextLeaseCheck
+		}
+		queue.mu.Unlock()
+	}
+	return next
+}
+
+// allQueues returns every queue
+func (m *Manager) allQueues() []*Queue {
 	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	queues := make([]*Queue, 0, len(m.queues))
 	for _, q := range m.queues {
 		queues = append(queues, q)
 	}
+	return queues
+}
+
+// expireLeases returns the queue's jobs whose lease expired by now to ready,
+// or dead-letters them, and expires stale reservations. Must be called with
+// queue.mu held.
+func (m *Manager) expireLeases(queue *Queue, now time.Time) {
+	expiredJobs := make([]*Job, 0)
+	for _, job := range queue.inflight {
+		if !job.LeaseDeadline.IsZero() && job.LeaseDeadline.Before(now) {
+			expiredJobs = append(expiredJobs, job)
+			continue
+		}
+
+		// Warn once per lease when a job outlives its expected processing
+		// time, while there is still time before the lease expires
+		if !job.overdueWarned && job.Overdue(now) {
+			job.overdueWarned = true
+			logging.With(logging.Fields{Queue: job.Queue, JobID: job.ID, LeaseID: job.LeaseID}).Warn().
+				Int64("expected_ms", job.ExpectedMs).
+				Dur("lease_remaining", job.LeaseDeadline.Sub(now)).
+				Msg("job overdue, lease may expire before it is acked")
+		}
+	}
+
+	// Expiry records are written as one batch so a mass expiry, such as a
+	// crashed consumer holding many leases, costs a single fsync
+	var records []*wal.Record
+	for _, job := range expiredJobs {
+		if job.Consumed {
+			logging.With(logging.Fields{Queue: job.Queue, JobID: job.ID, LeaseID: job.LeaseID}).Warn().Msg("lease expired in at-most-once queue, dropping")
+			m.rememberExpiredLease(job.LeaseID, now)
+			queue.removeInflight(job.ID)
+			continue
+		}
+
+		logging.With(logging.Fields{Queue: job.Queue, JobID: job.ID, LeaseID: job.LeaseID}).Warn().Msg("lease expired, returning to ready queue")
+		m.rememberExpiredLease(job.LeaseID, now)
+
+		job.Tries++
+		job.Expiries++
+		backoffDelay := job.retryDelay(m.MinRetryDelay())
+		job.ETA = now.Add(backoffDelay)
+		job.LeaseID = ""
+		job.LeaseDeadline = time.Time{}
+
+		maxExpiries := queue.config.MaxConsecutiveExpiries
+		quarantine := maxExpiries > 0 && job.Expiries >= maxExpiries
+
+		if !quarantine && job.ShouldRetry() {
+			job.Status = JobStatusReady
+			metrics.BackoffDelay.WithLabelValues(job.Queue).Observe(backoffDelay.Seconds())
+			queue.removeInflight(job.ID)
+			queue.pushReady(job)
+
+			records = append(records, &wal.Record{
+				Type:       wal.RecordTypeRequeue,
+				Queue:      job.Queue,
+				JobID:      job.ID,
+				Tries:      job.Tries,
+				ETA:        job.ETA,
+				Priority:   job.Priority,
+				MaxRetries: job.MaxRetries,
+				Expiries:   job.Expiries,
+			})
+			continue
+		}
+
+		reason, metricReason := "lease expired", dlqMetricLeaseExpired
+		if quarantine {
+			reason, metricReason = DLQReasonRepeatedCrash, DLQReasonRepeatedCrash
+			logging.With(logging.Fields{Queue: job.Queue, JobID: job.ID}).Warn().Uint32("expiries", job.Expiries).Msg("job keeps expiring without a nack, quarantining")
+		}
+
+		if !queue.config.DLQEnabled {
+			queue.removeInflight(job.ID)
+			records = append(records, dropRecord(job, reason))
+			m.jobDropped(job)
+		} else {
+			job.Status = JobStatusDLQ
+			job.DLQReason = reason
+			job.DLQAt = now
+			queue.removeInflight(job.ID)
+			queue.dlq[job.ID] = job
+			countDLQ(job.Queue, metricReason, 1)
+
+			records = append(records, &wal.Record{
+				Type:     wal.RecordTypeNack,
+				Queue:    job.Queue,
+				JobID:    job.ID,
+				Reason:   reason,
+				Tries:    job.Tries,
+				Expiries: job.Expiries,
+			})
+		}
+	}
+
+	if err := m.wal.WriteBatch(records); err != nil {
+		logging.With(logging.Fields{Queue: queue.name}).Error().Err(err).Int("records", len(records)).Msg("failed to write lease expiry records")
+	}
+
+	expireReservations(queue, now)
+	queue.updateGauges()
+}
+
+// QueueDepth is a consistent count of a queue's jobs by state
+type QueueDepth struct {
+	Ready    int
+	Inflight int
+	DLQ      int
+}
+
+// depth counts the queue's jobs. Must be called with q.mu held.
+func (q *Queue) depth() QueueDepth {
+	// Reserved jobs are invisible to consumers like leased ones
+	return QueueDepth{
+		Ready:    q.readyLen(),
+		Inflight: len(q.inflight) + len(q.reserved),
+		DLQ:      len(q.dlq),
+	}
+}
+
+// fillDepth sets depth to the queue's current depth, if depth is not nil
+func (m *Manager) fillDepth(queueName string, depth *QueueDepth) {
+	if depth == nil {
+		return
+	}
+	if queue := m.getQueue(queueName); queue != nil {
+		queue.mu.RLock()
+		*depth = queue.depth()
+		queue.mu.RUnlock()
+	}
+}
+
+// NextDue returns when the queue's next delayed job in memory is due, or
+// false if none is delayed. Spilled jobs are not considered.
+func (m *Manager) NextDue(queueName string) (time.Time, bool) {
+	queue := m.getQueue(queueName)
+	if queue == nil {
+		return time.Time{}, false
+	}
+
+	queue.mu.RLock()
+	defer queue.mu.RUnlock()
+	return queue.ready.NextDue()
+}
+
+// Stats returns statistics for a queue
+func (m *Manager) Stats(queueName string) (ready, inflight, dlq int, err error) {
+	queue := m.getQueue(queueName)
+	if queue == nil {
+		return 0, 0, 0, fmt.Errorf("%w: %s", ErrQueueNotFound, queueName)
+	}
+
+	queue.mu.RLock()
+	defer queue.mu.RUnlock()
+
+	d := queue.depth()
+	return d.Ready, d.Inflight, d.DLQ, nil
+}
+
+// QueueState is a queue's depth and config as captured by SnapshotState
+type QueueState struct {
+	Name   string
+	Depth  QueueDepth
+	Config QueueConfig
+}
+
+// SnapshotState captures every queue's depth and config in one consistent
+// cut, sorted by name. The queue set is held while every queue is locked, in
+// name order, so no queue is created or changed between being listed and
+// being read.
+func (m *Manager) SnapshotState() []QueueState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	names := make([]string, 0, len(m.queues))
+	for name := range m.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		m.queues[name].mu.RLock()
+	}
+	states := make([]QueueState, len(names))
+	for i, name := range names {
+		queue := m.queues[name]
+		states[i] = QueueState{Name: name, Depth: queue.depth(), Config: queue.config}
+	}
+	for _, name := range names {
+		m.queues[name].mu.RUnlock()
+	}
+
+	return states
+}
+
+// StorageStats describes the node's queue count and on-disk state
+type StorageStats struct {
+	Queues         int
+	WALSegments    int
+	WALSizeBytes   int64
+	WALWriteP99    time.Duration
+	StoreSizeBytes uint64
+}
+
+// StorageStats returns the node's queue count and WAL and store usage
+func (m *Manager) StorageStats() StorageStats {
+	m.mu.RLock()
+	stats := StorageStats{Queues: len(m.queues)}
 	m.mu.RUnlock()
 
-	for _, queue := range queues {
-		queue.mu.Lock()
+	if m.wal != nil {
+		stats.WALSegments = m.wal.SegmentCount()
+		stats.WALSizeBytes = m.wal.TotalSize()
+		stats.WALWriteP99 = m.wal.WriteLatency(99)
+	}
+	if m.store != nil {
+		stats.StoreSizeBytes = m.store.Size()
+	}
+	return stats
+}
 
-		expiredJobs := make([]*Job, 0)
-		for _, job := range queue.inflight {
-			if !job.LeaseDeadline.IsZero() && job.LeaseDeadline.Before(now) {
-				expiredJobs = append(expiredJobs, job)
+// DumpPageSize is the most jobs DumpJobs hands to its callback at a time
+const DumpPageSize = 256
+
+// SnapshotJobs returns copies of the queue's jobs in the given states (all
+// states if none are given), collected like DumpJobs. Payloads and headers
+// are shared, not copied.
+func (m *Manager) SnapshotJobs(queueName string, states ...JobStatus) ([]Job, error) {
+	var jobs []Job
+	err := m.DumpJobs(queueName, states, func(page []Job) error {
+		jobs = append(jobs, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// DumpJobs calls fn with copies of the queue's jobs in the given states (all
+// states if none are given), up to DumpPageSize at a time. The dump is a
+// consistent snapshot of the queue: the job records are copied under one
+// hold of the queue lock, together with a store snapshot for the ready jobs
+// spilled to disk and the offloaded DLQ payloads, and the pages are read
+// from those copies, so jobs that change state while the dump runs are
+// dumped as they were. fn is called without the lock held; an error from it
+// ends the dump. Payloads and headers are shared, not copied.
+func (m *Manager) DumpJobs(queueName string, states []JobStatus, fn func([]Job) error) error {
+	queue := m.getQueue(queueName)
+	if queue == nil {
+		return fmt.Errorf("%w: %s", ErrQueueNotFound, queueName)
+	}
+
+	want := func(status JobStatus) bool {
+		if len(states) == 0 {
+			return true
+		}
+		for _, s := range states {
+			if s == status {
+				return true
 			}
 		}
+		return false
+	}
 
-		for _, job := range expiredJobs {
-			log.Warn().Str("job_id", job.ID).Msg("lease expired, returning to ready queue")
+	// A copy of a job, or the store key of a spilled one
+	type dumpEntry struct {
+		job      Job
+		spillKey []byte
+	}
+	var entries []dumpEntry
+	onDisk := false
+	add := func(job *Job, status JobStatus) {
+		entry := dumpEntry{job: *job}
+		entry.job.Status = status
+		onDisk = onDisk || job.payloadOffloaded
+		entries = append(entries, entry)
+	}
 
-			job.Tries++
-			backoffDelay := backoff.CalculateDefault(job.Tries)
-			job.ETA = now.Add(backoffDelay)
-			job.LeaseID = ""
-			job.LeaseDeadline = time.Time{}
+	queue.mu.RLock()
+	if want(JobStatusReady) {
+		for _, item := range queue.ready.items {
+			add(item.job, JobStatusReady)
+		}
+		for _, key := range queue.spilled {
+			entries = append(entries, dumpEntry{spillKey: key})
+			onDisk = true
+		}
+	}
+	if want(JobStatusReserved) {
+		for _, r := range queue.reserved {
+			add(r.job, JobStatusReserved)
+		}
+	}
+	if want(JobStatusInflight) {
+		for _, job := range queue.inflight {
+			add(job, JobStatusInflight)
+		}
+	}
+	if want(JobStatusDLQ) {
+		for _, job := range queue.dlq {
+			add(job, JobStatusDLQ)
+		}
+	}
+	var snap *store.Snapshot
+	if onDisk {
+		snap = queue.store.Snapshot()
+		defer snap.Close()
+	}
+	queue.mu.RUnlock()
+
+	for start := 0; start < len(entries); start += DumpPageSize {
+		end := start + DumpPageSize
+		if end > len(entries) {
+			end = len(entries)
+		}
 
-			if job.ShouldRetry() {
+		page := make([]Job, 0, end-start)
+		for _, entry := range entries[start:end] {
+			job := entry.job
+			switch {
+			case entry.spillKey != nil:
+				value, err := snap.Get(entry.spillKey)
+				if err != nil {
+					return fmt.Errorf("failed to load spilled job: %w", err)
+				}
+				if value == nil {
+					continue
+				}
+				if err := json.Unmarshal(value, &job); err != nil {
+					return fmt.Errorf("failed to load spilled job: %w", err)
+				}
 				job.Status = JobStatusReady
-				delete(queue.inflight, job.ID)
-				queue.ready.Push(job)
-
-				// Write requeue record
-				record := &wal.Record{
-					Type:       wal.RecordTypeRequeue,
-					Queue:      job.Queue,
-					JobID:      job.ID,
-					Tries:      job.Tries,
-					ETA:        job.ETA,
-					Priority:   job.Priority,
-					MaxRetries: job.MaxRetries,
+			case job.payloadOffloaded:
+				payload, err := snap.Get(dlqPayloadKey(queueName, job.ID))
+				if err != nil {
+					return fmt.Errorf("failed to load DLQ payload: %w", err)
 				}
-				m.wal.Write(record)
-			} else {
-				job.Status = JobStatusDLQ
-				delete(queue.inflight, job.ID)
-				queue.dlq[job.ID] = job
+				job.Payload = payload
+				job.payloadOffloaded = false
 			}
+			page = append(page, job)
 		}
 
-		queue.mu.Unlock()
+		if len(page) == 0 {
+			continue
+		}
+		if err := fn(page); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-// Stats returns statistics for a queue
-func (m *Manager) Stats(queueName string) (ready, inflight, dlq int, err error) {
+// GetJob returns a copy of a job in any state, with Status naming the state
+// it is in, without leasing or otherwise touching it. Returns ErrJobNotFound
+// if the queue has no such job.
+func (m *Manager) GetJob(queueName, jobID string) (*Job, error) {
 	queue := m.getQueue(queueName)
 	if queue == nil {
-		return 0, 0, 0, fmt.Errorf("queue not found: %s", queueName)
+		return nil, fmt.Errorf("%w: %s", ErrQueueNotFound, queueName)
 	}
 
 	queue.mu.RLock()
 	defer queue.mu.RUnlock()
 
-	return queue.ready.Len(), len(queue.inflight), len(queue.dlq), nil
+	job, status, err := queue.findJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+	if job == nil {
+		return nil, fmt.Errorf("%w: %s in queue %s", ErrJobNotFound, jobID, queueName)
+	}
+
+	snapshot := job.clone()
+	snapshot.Status = status
+	return snapshot, nil
+}
+
+// findJob returns a live job of the queue, whatever its state, and that
+// state. Spilled jobs, and DLQ jobs whose payload was offloaded, are loaded
+// from the store into a copy. Returns a nil job if the queue has no such job.
+// Must be called with q.mu held.
+func (q *Queue) findJob(jobID string) (*Job, JobStatus, error) {
+	if item, exists := q.ready.items[jobID]; exists {
+		return item.job, JobStatusReady, nil
+	}
+	if r, exists := q.reserved[jobID]; exists {
+		return r.job, JobStatusReserved, nil
+	}
+	if job, exists := q.inflight[jobID]; exists {
+		return job, JobStatusInflight, nil
+	}
+	if job, exists := q.dlq[jobID]; exists {
+		if job.payloadOffloaded {
+			loaded := *job
+			if err := q.loadPayload(&loaded); err != nil {
+				return nil, "", err
+			}
+			job = &loaded
+		}
+		return job, JobStatusDLQ, nil
+	}
+	job, err := q.loadSpilled(jobID)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load spilled job: %w", err)
+	}
+	return job, JobStatusReady, nil
 }
 
 // ListQueues returns list of all queue names
@@ -526,6 +2144,62 @@ func (m *Manager) ListQueues() []string {
 	return names
 }
 
+// SetQueueConfig sets per-queue settings, creating the queue if needed
+func (m *Manager) SetQueueConfig(queueName string, cfg QueueConfig) {
+	queue := m.getOrCreateQueue(queueName)
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if queue.config.Mode != cfg.Mode {
+		if err := m.saveQueueMode(queueName, cfg.Mode); err != nil {
+			logging.With(logging.Fields{Queue: queueName}).Warn().Err(err).Msg("queue mode will not survive a restart")
+		}
+	}
+	if !maps.Equal(queue.config.DefaultHeaders, cfg.DefaultHeaders) {
+		if err := m.saveDefaultHeaders(queueName, cfg.DefaultHeaders); err != nil {
+			logging.With(logging.Fields{Queue: queueName}).Warn().Err(err).Msg("default headers will not survive a restart")
+		}
+	}
+
+	orderChanged := queue.config.PriorityDemotionStep != cfg.PriorityDemotionStep || queue.config.Mode != cfg.Mode
+	queue.config = cfg
+	queue.ready.SetDemotionStep(cfg.PriorityDemotionStep)
+	queue.ready.SetIgnorePriority(cfg.Mode == QueueModeFIFO)
+	if orderChanged && len(queue.spilled) > 0 {
+		queue.respill()
+	}
+	queue.refill()
+}
+
+// SetNackRules sets the rules mapping nack reasons to retry behavior for a queue.
+// Rules are evaluated in order and the first match wins.
+func (m *Manager) SetNackRules(queueName string, rules []NackRule) error {
+	if err := validateNackRules(rules); err != nil {
+		return err
+	}
+
+	queue := m.getOrCreateQueue(queueName)
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	queue.config.NackRules = append([]NackRule(nil), rules...)
+	return nil
+}
+
+// GetQueueConfig returns per-queue settings
+func (m *Manager) GetQueueConfig(queueName string) (QueueConfig, error) {
+	queue := m.getQueue(queueName)
+	if queue == nil {
+		return QueueConfig{}, fmt.Errorf("%w: %s", ErrQueueNotFound, queueName)
+	}
+
+	queue.mu.RLock()
+	defer queue.mu.RUnlock()
+	return queue.config, nil
+}
+
 // SetRateLimit sets rate limit for a queue
 func (m *Manager) SetRateLimit(queueName string, capacity, refillRate float64) {
 	m.rateLimiter.SetRate(queueName, capacity, refillRate)
@@ -535,3 +2209,15 @@ func (m *Manager) SetRateLimit(queueName string, capacity, refillRate float64) {
 func (m *Manager) GetRateLimit(queueName string) (capacity, refillRate float64, exists bool) {
 	return m.rateLimiter.GetRate(queueName)
 }
+
+// RateLimitStatus returns the queue's current rate-limit headroom, or false
+// if the queue is not rate limited
+func (m *Manager) RateLimitStatus(queueName string) (ratelimit.Status, bool) {
+	return m.rateLimiter.Status(queueName)
+}
+
+// RateLimitStats returns the queue's recent allowed and rejected enqueues,
+// or false if the queue is not rate limited
+func (m *Manager) RateLimitStats(queueName string) (ratelimit.WindowStats, bool) {
+	return m.rateLimiter.Stats(queueName)
+}
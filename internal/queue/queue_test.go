@@ -1,15 +1,73 @@
 package queue
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rivetq/rivetq/internal/logging"
+	"github.com/rivetq/rivetq/internal/metrics"
 	"github.com/rivetq/rivetq/internal/store"
 	"github.com/rivetq/rivetq/internal/wal"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// newTestManager creates a started manager backed by a temporary WAL and store
+func newTestManager(t *testing.T) *Manager {
+	dir := t.TempDir()
+
+	walInst, err := wal.New(wal.Config{
+		Dir:         dir + "/wal",
+		SegmentSize: 1024,
+		Fsync:       false,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { walInst.Close() })
+
+	storeInst, err := store.New(dir + "/store")
+	require.NoError(t, err)
+	t.Cleanup(func() { storeInst.Close() })
+
+	mgr := NewManager(storeInst, walInst)
+	require.NoError(t, mgr.Start())
+	t.Cleanup(func() { mgr.Stop() })
+
+	return mgr
+}
+
+// leaseEventually leases one job, waiting out any backoff delay
+func leaseEventually(t *testing.T, mgr *Manager, queueName string) []*Job {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		jobs, err := mgr.Lease(queueName, 1, 30000)
+		require.NoError(t, err)
+		if len(jobs) > 0 {
+			return jobs
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no job became ready in queue %s", queueName)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestEnqueueAndLease(t *testing.T) {
 	dir := t.TempDir()
 
@@ -160,30 +218,19 @@ func TestRetryAndDLQ(t *testing.T) {
 	require.NoError(t, err)
 	defer mgr.Stop()
 
-	// Enqueue with max 2 retries
+	// MaxRetries bounds the number of deliveries, the first included
 	retryPolicy := RetryPolicy{MaxRetries: 2, BaseDelay: 10 * time.Millisecond, MaxDelay: 1 * time.Second}
 	_, err = mgr.Enqueue("test", []byte("retry-test"), nil, 5, 0, retryPolicy, "")
 	require.NoError(t, err)
 
-	// Lease and nack 3 times
-	for i := 0; i < 3; i++ {
-		jobs, err := mgr.Lease("test", 1, 30000)
+	// The first nack requeues after the backoff, the second moves the job
+	// to the DLQ
+	for i := 0; i < 2; i++ {
+		jobs := leaseEventually(t, mgr, "test")
+		require.Len(t, jobs, 1)
+		assert.Equal(t, uint32(i), jobs[0].Tries)
+		err = mgr.Nack(jobs[0].ID, jobs[0].LeaseID, "test failure")
 		require.NoError(t, err)
-		
-		if i < 2 {
-			// First 2 nacks should requeue
-			require.Len(t, jobs, 1)
-			err = mgr.Nack(jobs[0].ID, jobs[0].LeaseID, "test failure")
-			require.NoError(t, err)
-			
-			// Wait for backoff
-			time.Sleep(50 * time.Millisecond)
-		} else {
-			// Third nack should move to DLQ
-			require.Len(t, jobs, 1)
-			err = mgr.Nack(jobs[0].ID, jobs[0].LeaseID, "test failure")
-			require.NoError(t, err)
-		}
 	}
 
 	// Should be in DLQ now
@@ -290,3 +337,3850 @@ func TestWALReplay(t *testing.T) {
 	ready, _, _, _ = mgr2.Stats("test")
 	assert.Equal(t, 2, ready)
 }
+
+func TestDelayedJobIndex(t *testing.T) {
+	pq := newPriorityQueue()
+	base := time.Now().Add(time.Hour)
+
+	// Pushed out of ETA order, with priorities unrelated to ETA
+	const n = 1000
+	for i := 0; i < n; i++ {
+		slot := (i * 7919) % n // A permutation of 0..n-1
+		pq.Push(&Job{
+			ID:         fmt.Sprintf("job-%d", slot),
+			Priority:   uint8(i % 10),
+			ETA:        base.Add(time.Duration(slot) * time.Millisecond),
+			Status:     JobStatusReady,
+			EnqueuedAt: time.Now(),
+		})
+	}
+	assert.Equal(t, n, pq.Len())
+	assert.Equal(t, n, pq.DelayedLen())
+
+	// The next due job is the top of the ETA heap, no scan needed
+	due, ok := pq.NextDue()
+	require.True(t, ok)
+	assert.True(t, due.Equal(base))
+	assert.Equal(t, "job-0", pq.eta[0].job.ID)
+
+	// A ready job is not blocked by higher priority delayed ones
+	pq.Push(&Job{ID: "now", Priority: 0, Status: JobStatusReady, EnqueuedAt: time.Now()})
+	job := pq.PopReady(time.Now())
+	require.NotNil(t, job)
+	assert.Equal(t, "now", job.ID)
+
+	// Jobs are promoted in ETA order as time passes
+	for i := 0; i < n; i++ {
+		pq.promote(base.Add(time.Duration(i) * time.Millisecond))
+		assert.Equal(t, i+1, pq.heap.Len())
+		assert.False(t, pq.items[fmt.Sprintf("job-%d", i)].delayed)
+
+		if i < n-1 {
+			assert.True(t, pq.items[fmt.Sprintf("job-%d", i+1)].delayed)
+			due, ok := pq.NextDue()
+			require.True(t, ok)
+			assert.True(t, due.Equal(base.Add(time.Duration(i+1)*time.Millisecond)))
+		}
+	}
+	_, ok = pq.NextDue()
+	assert.False(t, ok)
+	assert.Equal(t, 0, pq.DelayedLen())
+	assert.Equal(t, n, pq.Len())
+}
+
+func TestPriorityDemotion(t *testing.T) {
+	mgr := newTestManager(t)
+	cfg := DefaultQueueConfig()
+	cfg.PriorityDemotionStep = 1
+	mgr.SetQueueConfig("test", cfg)
+
+	failingID, err := mgr.Enqueue("test", []byte("failing"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	// Fail the job twice
+	for i := 0; i < 2; i++ {
+		jobs := leaseEventually(t, mgr, "test")
+		require.NoError(t, mgr.Nack(jobs[0].ID, jobs[0].LeaseID, "boom"))
+	}
+
+	freshID, err := mgr.Enqueue("test", []byte("fresh"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	// Wait for the failing job's backoff to pass so both are ready
+	time.Sleep(400 * time.Millisecond)
+
+	jobs, err := mgr.Lease("test", 2, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 2)
+	assert.Equal(t, freshID, jobs[0].ID)
+	assert.Equal(t, failingID, jobs[1].ID)
+}
+
+func TestEnqueueLogContext(t *testing.T) {
+	mgr := newTestManager(t)
+
+	var buf bytes.Buffer
+	orig := log.Logger
+	log.Logger = zerolog.New(&buf).Level(zerolog.DebugLevel)
+	defer func() { log.Logger = orig }()
+
+	jobID, err := mgr.Enqueue("logged", []byte("payload"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	var found bool
+	for _, line := range bytes.Split(buf.Bytes(), []byte("\n")) {
+		var event map[string]interface{}
+		if json.Unmarshal(line, &event) != nil || event["message"] != "job enqueued" {
+			continue
+		}
+		found = true
+		assert.Equal(t, "logged", event["queue"])
+		assert.Equal(t, jobID, event["job_id"])
+	}
+	assert.True(t, found, "expected a job enqueued log line")
+}
+
+func TestDLQDisabledDropsExhaustedJobs(t *testing.T) {
+	dir := t.TempDir()
+	walCfg := wal.Config{Dir: dir + "/wal", SegmentSize: 1024, Fsync: false}
+
+	walInst, err := wal.New(walCfg)
+	require.NoError(t, err)
+	storeInst, err := store.New(dir + "/store")
+	require.NoError(t, err)
+
+	mgr := NewManager(storeInst, walInst)
+	require.NoError(t, mgr.Start())
+
+	cfg := DefaultQueueConfig()
+	cfg.DLQEnabled = false
+	mgr.SetQueueConfig("test", cfg)
+
+	retryPolicy := RetryPolicy{MaxRetries: 1}
+	_, err = mgr.Enqueue("test", []byte("best-effort"), nil, 5, 0, retryPolicy, "")
+	require.NoError(t, err)
+
+	jobs := leaseEventually(t, mgr, "test")
+	require.NoError(t, mgr.Nack(jobs[0].ID, jobs[0].LeaseID, "boom"))
+
+	ready, inflight, dlq, err := mgr.Stats("test")
+	require.NoError(t, err)
+	assert.Equal(t, 0, ready)
+	assert.Equal(t, 0, inflight)
+	assert.Equal(t, 0, dlq)
+
+	mgr.Stop()
+	walInst.Close()
+	storeInst.Close()
+
+	// Replay must not resurrect the dropped job
+	walInst2, err := wal.New(walCfg)
+	require.NoError(t, err)
+	defer walInst2.Close()
+	storeInst2, err := store.New(dir + "/store")
+	require.NoError(t, err)
+	defer storeInst2.Close()
+
+	mgr2 := NewManager(storeInst2, walInst2)
+	require.NoError(t, mgr2.Start())
+	defer mgr2.Stop()
+
+	ready, inflight, dlq, err = mgr2.Stats("test")
+	require.NoError(t, err)
+	assert.Equal(t, 0, ready+inflight+dlq)
+}
+
+func TestNackRules(t *testing.T) {
+	mgr := newTestManager(t)
+
+	err := mgr.SetNackRules("test", []NackRule{
+		{Prefix: "validation:", Action: NackActionDLQ},
+		{Prefix: "throttle:", Action: NackActionRetry, BackoffMultiplier: 10},
+	})
+	require.NoError(t, err)
+
+	validationID, err := mgr.Enqueue("test", []byte("invalid"), nil, 9, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	plainID, err := mgr.Enqueue("test", []byte("flaky"), nil, 1, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	jobs, err := mgr.Lease("test", 2, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 2)
+	require.Equal(t, validationID, jobs[0].ID)
+	require.Equal(t, plainID, jobs[1].ID)
+
+	// A validation failure goes straight to the DLQ despite remaining retries
+	require.NoError(t, mgr.Nack(jobs[0].ID, jobs[0].LeaseID, "validation: missing field"))
+	// A plain failure retries
+	require.NoError(t, mgr.Nack(jobs[1].ID, jobs[1].LeaseID, "connection reset"))
+
+	ready, inflight, dlq, err := mgr.Stats("test")
+	require.NoError(t, err)
+	assert.Equal(t, 1, ready)
+	assert.Equal(t, 0, inflight)
+	assert.Equal(t, 1, dlq)
+
+	// Rule count is bounded
+	err = mgr.SetNackRules("test", make([]NackRule, MaxNackRules+1))
+	assert.Error(t, err)
+}
+
+func TestNackPermanent(t *testing.T) {
+	mgr := newTestManager(t)
+
+	jobID, err := mgr.Enqueue("test", []byte("malformed"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	jobs, err := mgr.Lease("test", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+
+	// The job is dead-lettered on its first failure despite remaining retries
+	require.NoError(t, mgr.NackPermanent(jobID, jobs[0].LeaseID, "malformed payload"))
+
+	ready, inflight, dlq, err := mgr.Stats("test")
+	require.NoError(t, err)
+	assert.Equal(t, 0, ready)
+	assert.Equal(t, 0, inflight)
+	assert.Equal(t, 1, dlq)
+}
+
+func TestLateAckAfterLeaseExpired(t *testing.T) {
+	mgr := newTestManager(t)
+	require.NoError(t, mgr.SetVisibilityLimits(VisibilityLimits{MinMs: 1}))
+
+	_, err := mgr.Enqueue("test", []byte("slow"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	jobs, err := mgr.Lease("test", 1, 10)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	staleLease := jobs[0].LeaseID
+
+	time.Sleep(20 * time.Millisecond)
+	mgr.checkLeaseTimeouts()
+
+	// The job is redelivered to a new consumer
+	reassigned := leaseEventually(t, mgr, "test")
+	require.Equal(t, jobs[0].ID, reassigned[0].ID)
+	require.NotEqual(t, staleLease, reassigned[0].LeaseID)
+
+	// The original consumer's late ack is fenced off
+	err = mgr.Ack(jobs[0].ID, staleLease)
+	assert.ErrorIs(t, err, ErrLeaseExpired)
+	err = mgr.Nack(jobs[0].ID, staleLease, "late")
+	assert.ErrorIs(t, err, ErrLeaseExpired)
+
+	// The new owner can still ack, after which the stale lease stays fenced
+	require.NoError(t, mgr.Ack(reassigned[0].ID, reassigned[0].LeaseID))
+	err = mgr.Ack(jobs[0].ID, staleLease)
+	assert.ErrorIs(t, err, ErrLeaseExpired)
+
+	// Unknown leases are not mistaken for expired ones
+	err = mgr.Ack(jobs[0].ID, "bogus")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrLeaseExpired)
+}
+
+func TestForceExpireAllLeases(t *testing.T) {
+	mgr := newTestManager(t)
+
+	for _, q := range []string{"mine", "theirs"} {
+		for i := 0; i < 3; i++ {
+			_, err := mgr.Enqueue(q, []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+			require.NoError(t, err)
+		}
+	}
+
+	mine, err := mgr.Lease("mine", 3, 30000)
+	require.NoError(t, err)
+	require.Len(t, mine, 3)
+	staleJobID, staleLease := mine[0].ID, mine[0].LeaseID
+	_, err = mgr.Lease("theirs", 3, 30000)
+	require.NoError(t, err)
+
+	// Only owned queues are touched
+	mgr.SetOwnershipCheck(func(queueName string) bool { return queueName == "mine" })
+	count, err := mgr.ForceExpireAllLeases()
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	ready, inflight, _, err := mgr.Stats("mine")
+	require.NoError(t, err)
+	assert.Equal(t, 3, ready)
+	assert.Equal(t, 0, inflight)
+
+	ready, inflight, _, err = mgr.Stats("theirs")
+	require.NoError(t, err)
+	assert.Equal(t, 0, ready)
+	assert.Equal(t, 3, inflight)
+
+	// Jobs are immediately leasable and the attempt was not counted
+	jobs, err := mgr.Lease("mine", 3, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 3)
+	for _, job := range jobs {
+		assert.Equal(t, uint32(0), job.Tries)
+	}
+
+	// The old lease holders are fenced off
+	assert.ErrorIs(t, mgr.Ack(staleJobID, staleLease), ErrLeaseExpired)
+}
+
+func TestRequestIDWindowExpires(t *testing.T) {
+	mgr := newTestManager(t)
+	mgr.SetRequestIDWindow(50 * time.Millisecond)
+
+	first, err := mgr.EnqueueWithOptions("test", []byte("a"), EnqueueOptions{Priority: 5, RetryPolicy: DefaultRetryPolicy(), RequestID: "req-1"})
+	require.NoError(t, err)
+	dup, err := mgr.EnqueueWithOptions("test", []byte("a"), EnqueueOptions{Priority: 5, RetryPolicy: DefaultRetryPolicy(), RequestID: "req-1"})
+	require.NoError(t, err)
+	assert.Equal(t, first, dup)
+
+	time.Sleep(60 * time.Millisecond)
+
+	pruned, err := mgr.store.PruneRequestIDs(time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 1, pruned)
+
+	second, err := mgr.EnqueueWithOptions("test", []byte("a"), EnqueueOptions{Priority: 5, RetryPolicy: DefaultRetryPolicy(), RequestID: "req-1"})
+	require.NoError(t, err)
+	assert.NotEqual(t, first, second)
+}
+
+func TestIdempotencyKeyCount(t *testing.T) {
+	mgr := newTestManager(t)
+	mgr.SetIdempotencyTTL(50 * time.Millisecond)
+	assert.Equal(t, int64(0), mgr.IdempotencyStats().Keys)
+
+	first, err := mgr.Enqueue("test", []byte("a"), nil, 5, 0, DefaultRetryPolicy(), "key-1")
+	require.NoError(t, err)
+	_, err = mgr.Enqueue("test", []byte("b"), nil, 5, 0, DefaultRetryPolicy(), "key-2")
+	require.NoError(t, err)
+	_, err = mgr.Enqueue("test", []byte("c"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	// A duplicate returns the existing job and adds no key
+	dup, err := mgr.Enqueue("test", []byte("a"), nil, 5, 0, DefaultRetryPolicy(), "key-1")
+	require.NoError(t, err)
+	assert.Equal(t, first, dup)
+
+	stats := mgr.IdempotencyStats()
+	assert.Equal(t, int64(2), stats.Keys)
+	assert.Equal(t, uint64(2), stats.AddedTotal)
+
+	time.Sleep(60 * time.Millisecond)
+
+	// Expired keys no longer dedup, even before they are swept
+	second, err := mgr.Enqueue("test", []byte("a"), nil, 5, 0, DefaultRetryPolicy(), "key-1")
+	require.NoError(t, err)
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, int64(2), mgr.IdempotencyStats().Keys)
+
+	mgr.pruneExpired(time.Now().Add(time.Second))
+	stats = mgr.IdempotencyStats()
+	assert.Equal(t, int64(0), stats.Keys)
+	assert.Equal(t, uint64(2), stats.ExpiredTotal)
+}
+
+func TestVisibilityLimits(t *testing.T) {
+	mgr := newTestManager(t)
+	require.NoError(t, mgr.SetVisibilityLimits(VisibilityLimits{MinMs: 1000, MaxMs: 60000}))
+
+	for i := 0; i < 3; i++ {
+		_, err := mgr.Enqueue("test", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+	}
+
+	// Too small is clamped up to the minimum
+	before := time.Now()
+	jobs, err := mgr.Lease("test", 1, 0)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.WithinDuration(t, before.Add(time.Second), jobs[0].LeaseDeadline, 100*time.Millisecond)
+
+	// Too large is clamped down to the maximum
+	before = time.Now()
+	jobs, err = mgr.Lease("test", 1, 24*60*60*1000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.WithinDuration(t, before.Add(time.Minute), jobs[0].LeaseDeadline, 100*time.Millisecond)
+
+	// In reject mode out-of-range requests fail without leasing anything
+	require.NoError(t, mgr.SetVisibilityLimits(VisibilityLimits{MinMs: 1000, MaxMs: 60000, Reject: true}))
+	_, err = mgr.Lease("test", 1, 10)
+	assert.ErrorIs(t, err, ErrVisibilityOutOfRange)
+	_, err = mgr.Lease("test", 1, 120000)
+	assert.ErrorIs(t, err, ErrVisibilityOutOfRange)
+
+	ready, _, _, err := mgr.Stats("test")
+	require.NoError(t, err)
+	assert.Equal(t, 1, ready)
+
+	// Inverted ranges are refused
+	assert.Error(t, mgr.SetVisibilityLimits(VisibilityLimits{MinMs: 5000, MaxMs: 1000}))
+}
+
+func TestRepeatedExpiryQuarantine(t *testing.T) {
+	mgr := newTestManager(t)
+	require.NoError(t, mgr.SetVisibilityLimits(VisibilityLimits{MinMs: 1}))
+
+	cfg := DefaultQueueConfig()
+	cfg.MaxConsecutiveExpiries = 3
+	mgr.SetQueueConfig("test", cfg)
+
+	jobID, err := mgr.Enqueue("test", []byte("poison"), nil, 5, 0, RetryPolicy{MaxRetries: 10}, "")
+	require.NoError(t, err)
+
+	// expireOnce leases the job with a tiny visibility and lets the lease lapse
+	// without a nack, as if the consumer crashed
+	expireOnce := func() {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			jobs, err := mgr.Lease("test", 1, 1)
+			require.NoError(t, err)
+			if len(jobs) == 1 {
+				break
+			}
+			require.True(t, time.Now().Before(deadline), "job never became ready")
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(5 * time.Millisecond)
+		mgr.checkLeaseTimeouts()
+	}
+
+	expireOnce()
+	expireOnce()
+
+	ready, _, dlq, err := mgr.Stats("test")
+	require.NoError(t, err)
+	assert.Equal(t, 1, ready)
+	assert.Equal(t, 0, dlq)
+
+	// The third crash in a row quarantines the job despite retries left
+	expireOnce()
+
+	ready, inflight, dlq, err := mgr.Stats("test")
+	require.NoError(t, err)
+	assert.Equal(t, 0, ready+inflight)
+	assert.Equal(t, 1, dlq)
+
+	jobs, err := mgr.SnapshotJobs("test", JobStatusDLQ)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, jobID, jobs[0].ID)
+	assert.Equal(t, DLQReasonRepeatedCrash, jobs[0].DLQReason)
+	assert.Equal(t, uint32(3), jobs[0].Expiries)
+}
+
+func TestNackResetsExpiries(t *testing.T) {
+	mgr := newTestManager(t)
+	require.NoError(t, mgr.SetVisibilityLimits(VisibilityLimits{MinMs: 1}))
+
+	_, err := mgr.Enqueue("test", []byte("flaky"), nil, 5, 0, RetryPolicy{MaxRetries: 10}, "")
+	require.NoError(t, err)
+
+	jobs, err := mgr.Lease("test", 1, 1)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	time.Sleep(5 * time.Millisecond)
+	mgr.checkLeaseTimeouts()
+
+	jobs = leaseEventually(t, mgr, "test")
+	assert.Equal(t, uint32(1), jobs[0].Expiries)
+
+	require.NoError(t, mgr.Nack(jobs[0].ID, jobs[0].LeaseID, "handled error"))
+	assert.Equal(t, uint32(0), jobs[0].Expiries)
+}
+
+func TestLeaseByteBudget(t *testing.T) {
+	mgr := newTestManager(t)
+
+	// Equal priority, so jobs lease in enqueue order
+	for _, size := range []int{400, 300, 200, 100} {
+		_, err := mgr.Enqueue("test", bytes.Repeat([]byte("x"), size), nil, 5, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+	}
+
+	// 400 + 300 fits in 750, adding 200 would not
+	jobs, err := mgr.LeaseWithOptions(context.Background(), "test", 10, 30000, LeaseOptions{MaxBytes: 750})
+	require.NoError(t, err)
+	require.Len(t, jobs, 2)
+	assert.Len(t, jobs[0].Payload, 400)
+	assert.Len(t, jobs[1].Payload, 300)
+
+	// A single job over budget is still returned
+	jobs, err = mgr.LeaseWithOptions(context.Background(), "test", 10, 30000, LeaseOptions{MaxBytes: 50})
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Len(t, jobs[0].Payload, 200)
+
+	// maxJobs still applies within the budget
+	_, err = mgr.Enqueue("test", []byte("y"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	jobs, err = mgr.LeaseWithOptions(context.Background(), "test", 1, 30000, LeaseOptions{MaxBytes: 10000})
+	require.NoError(t, err)
+	assert.Len(t, jobs, 1)
+}
+
+func TestVerifyReplay(t *testing.T) {
+	mgr := newTestManager(t)
+
+	for i := 0; i < 5; i++ {
+		_, err := mgr.Enqueue("test", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+	}
+
+	divergences, err := mgr.VerifyReplay()
+	require.NoError(t, err)
+	assert.Empty(t, divergences)
+
+	// Inject a job that never reached the WAL
+	queue := mgr.getQueue("test")
+	queue.mu.Lock()
+	queue.ready.Push(&Job{ID: "unlogged", Queue: "test", Status: JobStatusReady})
+	queue.mu.Unlock()
+
+	divergences, err = mgr.VerifyReplay()
+	require.NoError(t, err)
+	require.Len(t, divergences, 1)
+	assert.Equal(t, ReplayDivergence{Queue: "test", JobID: "unlogged", Live: JobStatusReady, Replay: ""}, divergences[0])
+}
+
+// reserveEventually polls Reserve until a job comes back
+func reserveEventually(t *testing.T, mgr *Manager, queueName string, windowMs int64) (*Job, string) {
+	t.Helper()
+
+	var job *Job
+	var token string
+	require.Eventually(t, func() bool {
+		var err error
+		job, token, _, err = mgr.Reserve(queueName, windowMs)
+		require.NoError(t, err)
+		return job != nil
+	}, 2*time.Second, 10*time.Millisecond)
+	return job, token
+}
+
+func TestReserveClaim(t *testing.T) {
+	mgr := newTestManager(t)
+
+	jobID, err := mgr.Enqueue("test", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	job, token := reserveEventually(t, mgr, "test", 5000)
+	assert.Equal(t, jobID, job.ID)
+	assert.NotEmpty(t, token)
+
+	// Reserved jobs are not leasable
+	jobs, err := mgr.Lease("test", 1, 30000)
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
+
+	_, err = mgr.Claim("test", jobID, "wrong-token", 30000)
+	assert.ErrorIs(t, err, ErrReservationNotFound)
+
+	claimed, err := mgr.Claim("test", jobID, token, 30000)
+	require.NoError(t, err)
+	assert.Equal(t, JobStatusInflight, claimed.Status)
+	assert.NotEmpty(t, claimed.LeaseID)
+	assert.Equal(t, uint32(0), claimed.Tries)
+
+	// The claim is a normal lease
+	require.NoError(t, mgr.Ack(jobID, claimed.LeaseID))
+
+	ready, inflight, _, err := mgr.Stats("test")
+	require.NoError(t, err)
+	assert.Equal(t, 0, ready)
+	assert.Equal(t, 0, inflight)
+}
+
+func TestReserveRelease(t *testing.T) {
+	mgr := newTestManager(t)
+
+	jobID, err := mgr.Enqueue("test", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	_, token := reserveEventually(t, mgr, "test", 5000)
+
+	_, inflight, _, err := mgr.Stats("test")
+	require.NoError(t, err)
+	assert.Equal(t, 1, inflight)
+
+	require.NoError(t, mgr.Release("test", jobID, token))
+	assert.ErrorIs(t, mgr.Release("test", jobID, token), ErrReservationNotFound)
+
+	jobs := leaseEventually(t, mgr, "test")
+	require.Len(t, jobs, 1)
+	assert.Equal(t, jobID, jobs[0].ID)
+	assert.Equal(t, uint32(0), jobs[0].Tries)
+}
+
+func TestReserveTimeout(t *testing.T) {
+	mgr := newTestManager(t)
+
+	jobID, err := mgr.Enqueue("test", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	_, token := reserveEventually(t, mgr, "test", 50)
+
+	time.Sleep(100 * time.Millisecond)
+	mgr.checkLeaseTimeouts()
+
+	_, err = mgr.Claim("test", jobID, token, 30000)
+	assert.ErrorIs(t, err, ErrReservationNotFound)
+
+	jobs := leaseEventually(t, mgr, "test")
+	require.Len(t, jobs, 1)
+	assert.Equal(t, jobID, jobs[0].ID)
+	assert.Equal(t, uint32(0), jobs[0].Tries)
+}
+
+func TestJobHistoryBounded(t *testing.T) {
+	mgr := newTestManager(t)
+
+	policy := DefaultRetryPolicy()
+	policy.MaxRetries = 100
+	jobID, err := mgr.Enqueue("test", []byte("job"), nil, 5, 0, policy, "")
+	require.NoError(t, err)
+
+	queue := mgr.getQueue("test")
+	nacks := MaxHistoryEntries + 5
+	for i := 1; i <= nacks; i++ {
+		jobs := leaseEventually(t, mgr, "test")
+		require.NoError(t, mgr.Nack(jobID, jobs[0].LeaseID, fmt.Sprintf("attempt %d", i)))
+
+		// Skip the backoff
+		queue.mu.Lock()
+		job := queue.ready.Remove(jobID)
+		job.ETA = time.Now()
+		queue.ready.Push(job)
+		queue.mu.Unlock()
+	}
+
+	history, err := mgr.JobHistory(jobID)
+	require.NoError(t, err)
+	require.Len(t, history, MaxHistoryEntries)
+
+	// The oldest entries were dropped
+	first := nacks - MaxHistoryEntries + 1
+	for i, entry := range history {
+		assert.Equal(t, uint32(first+i), entry.Tries)
+		assert.Equal(t, fmt.Sprintf("attempt %d", first+i), entry.Reason)
+	}
+
+	// Acking clears the history
+	jobs := leaseEventually(t, mgr, "test")
+	require.NoError(t, mgr.Ack(jobID, jobs[0].LeaseID))
+	history, err = mgr.JobHistory(jobID)
+	require.NoError(t, err)
+	assert.Nil(t, history)
+
+	// An oversized reason is cut on a rune boundary
+	jobID, err = mgr.Enqueue("test", []byte("job"), nil, 5, 0, policy, "")
+	require.NoError(t, err)
+	jobs = leaseEventually(t, mgr, "test")
+	require.NoError(t, mgr.Nack(jobID, jobs[0].LeaseID, "x"+strings.Repeat("é", MaxHistoryBytes)))
+	history, err = mgr.JobHistory(jobID)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.True(t, utf8.ValidString(history[0].Reason))
+	assert.LessOrEqual(t, len(history[0].Reason), MaxHistoryBytes)
+	assert.Greater(t, len(history[0].Reason), MaxHistoryBytes-100)
+}
+
+func TestDroppedJobHistoryDeleted(t *testing.T) {
+	mgr := newTestManager(t)
+
+	cfg := DefaultQueueConfig()
+	cfg.DLQEnabled = false
+	mgr.SetQueueConfig("test", cfg)
+	queue := mgr.getQueue("test")
+
+	// nack retries the job once and leaves history behind
+	nackOnce := func() string {
+		jobID, err := mgr.Enqueue("test", []byte("job"), nil, 5, 0, RetryPolicy{MaxRetries: 2}, "")
+		require.NoError(t, err)
+		jobs := leaseEventually(t, mgr, "test")
+		require.NoError(t, mgr.Nack(jobID, jobs[0].LeaseID, "boom"))
+
+		queue.mu.Lock()
+		job := queue.ready.Remove(jobID)
+		job.ETA = time.Now()
+		queue.ready.Push(job)
+		queue.mu.Unlock()
+
+		history, err := mgr.JobHistory(jobID)
+		require.NoError(t, err)
+		require.Len(t, history, 1)
+		return jobID
+	}
+
+	// Dropped on a nack
+	jobID := nackOnce()
+	jobs := leaseEventually(t, mgr, "test")
+	require.NoError(t, mgr.Nack(jobID, jobs[0].LeaseID, "boom"))
+	history, err := mgr.JobHistory(jobID)
+	require.NoError(t, err)
+	assert.Nil(t, history)
+
+	// Dropped on a lease expiry
+	jobID = nackOnce()
+	leaseEventually(t, mgr, "test")
+	queue.mu.Lock()
+	mgr.expireLeases(queue, time.Now().Add(time.Hour))
+	queue.mu.Unlock()
+	history, err = mgr.JobHistory(jobID)
+	require.NoError(t, err)
+	assert.Nil(t, history)
+}
+
+func TestTimeToFirstLeaseMetric(t *testing.T) {
+	mgr := newTestManager(t)
+
+	histogram := func() *dto.Histogram {
+		var m dto.Metric
+		require.NoError(t, metrics.TimeToFirstLease.WithLabelValues("ttfl").(prometheus.Histogram).Write(&m))
+		return m.GetHistogram()
+	}
+	before := histogram()
+
+	jobID, err := mgr.Enqueue("ttfl", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	const gap = 200 * time.Millisecond
+	time.Sleep(gap)
+
+	jobs := leaseEventually(t, mgr, "ttfl")
+	require.Equal(t, jobID, jobs[0].ID)
+
+	after := histogram()
+	require.Equal(t, before.GetSampleCount()+1, after.GetSampleCount())
+	observed := after.GetSampleSum() - before.GetSampleSum()
+	assert.GreaterOrEqual(t, observed, gap.Seconds())
+	assert.Less(t, observed, gap.Seconds()+2)
+
+	// Later leases of the same job are not observed again
+	queue := mgr.getQueue("ttfl")
+	queue.mu.Lock()
+	delete(queue.inflight, jobID)
+	jobs[0].Status = JobStatusReady
+	queue.ready.Push(jobs[0])
+	queue.mu.Unlock()
+
+	leaseEventually(t, mgr, "ttfl")
+	assert.Equal(t, after.GetSampleCount(), histogram().GetSampleCount())
+}
+
+func TestSpillToStore(t *testing.T) {
+	mgr := newTestManager(t)
+
+	const maxInMemory = 3
+	cfg := DefaultQueueConfig()
+	cfg.MaxReadyInMemory = maxInMemory
+	mgr.SetQueueConfig("spill", cfg)
+
+	priorities := []uint8{2, 5, 1, 9, 3, 7, 0, 8, 4, 6}
+	for _, priority := range priorities {
+		_, err := mgr.Enqueue("spill", []byte{priority}, nil, priority, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+	}
+
+	queue := mgr.getQueue("spill")
+	queue.mu.RLock()
+	assert.Equal(t, maxInMemory, queue.ready.Len())
+	assert.Len(t, queue.spilled, len(priorities)-maxInMemory)
+	queue.mu.RUnlock()
+
+	ready, _, _, err := mgr.Stats("spill")
+	require.NoError(t, err)
+	assert.Equal(t, len(priorities), ready)
+
+	// Jobs come out in priority order whether they were in memory or spilled
+	for want := 9; want >= 0; want-- {
+		jobs := leaseEventually(t, mgr, "spill")
+		require.Len(t, jobs, 1)
+		assert.Equal(t, uint8(want), jobs[0].Priority)
+		assert.Equal(t, []byte{uint8(want)}, jobs[0].Payload)
+
+		queue.mu.RLock()
+		assert.LessOrEqual(t, queue.ready.Len(), maxInMemory)
+		queue.mu.RUnlock()
+	}
+
+	ready, inflight, _, err := mgr.Stats("spill")
+	require.NoError(t, err)
+	assert.Equal(t, 0, ready)
+	assert.Equal(t, len(priorities), inflight)
+}
+
+func TestSpilledDelayedJobs(t *testing.T) {
+	mgr := newTestManager(t)
+
+	cfg := DefaultQueueConfig()
+	cfg.MaxReadyInMemory = 1
+	mgr.SetQueueConfig("blocked", cfg)
+	mgr.SetQueueConfig("due", cfg)
+
+	// A delayed high-priority job spilled to the store must not hide a due
+	// job in memory
+	readyID, err := mgr.Enqueue("blocked", []byte("a"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	_, err = mgr.Enqueue("blocked", []byte("b"), nil, 9, time.Hour.Milliseconds(), DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	queue := mgr.getQueue("blocked")
+	queue.mu.RLock()
+	assert.Len(t, queue.spilled, 1)
+	queue.mu.RUnlock()
+
+	jobs, err := mgr.Lease("blocked", 10, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, readyID, jobs[0].ID)
+
+	// Once due, a spilled job is leased in priority order again
+	_, err = mgr.Enqueue("due", []byte("low"), nil, 1, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	highID, err := mgr.Enqueue("due", []byte("high"), nil, 9, 30, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	queue = mgr.getQueue("due")
+	queue.mu.RLock()
+	assert.Contains(t, queue.spilled, highID)
+	queue.mu.RUnlock()
+
+	time.Sleep(50 * time.Millisecond)
+	jobs, err = mgr.Lease("due", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, highID, jobs[0].ID)
+}
+
+func TestDeliveryModes(t *testing.T) {
+	for _, tc := range []struct {
+		mode        DeliveryMode
+		redelivered bool
+	}{
+		{DeliveryAtLeastOnce, true},
+		{DeliveryAtMostOnce, false},
+	} {
+		t.Run(string(tc.mode), func(t *testing.T) {
+			mgr := newTestManager(t)
+			require.NoError(t, mgr.SetVisibilityLimits(VisibilityLimits{MinMs: 1}))
+
+			cfg := DefaultQueueConfig()
+			cfg.DeliveryMode = tc.mode
+			mgr.SetQueueConfig("test", cfg)
+
+			jobID, err := mgr.Enqueue("test", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+			require.NoError(t, err)
+
+			jobs, err := mgr.Lease("test", 1, 10)
+			require.NoError(t, err)
+			require.Len(t, jobs, 1)
+
+			// The consumer crashes without acking
+			time.Sleep(20 * time.Millisecond)
+			mgr.checkLeaseTimeouts()
+
+			ready, inflight, dlq, err := mgr.Stats("test")
+			require.NoError(t, err)
+			assert.Equal(t, 0, inflight)
+			assert.Equal(t, 0, dlq)
+
+			if tc.redelivered {
+				assert.Equal(t, 1, ready)
+				assert.Equal(t, jobID, leaseEventually(t, mgr, "test")[0].ID)
+			} else {
+				assert.Equal(t, 0, ready)
+			}
+		})
+	}
+}
+
+func TestAtMostOnceSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	open := func() (*Manager, func()) {
+		walInst, err := wal.New(wal.Config{Dir: dir + "/wal", SegmentSize: 1024, Fsync: false})
+		require.NoError(t, err)
+		storeInst, err := store.New(dir + "/store")
+		require.NoError(t, err)
+
+		mgr := NewManager(storeInst, walInst)
+		require.NoError(t, mgr.Start())
+		return mgr, func() {
+			mgr.Stop()
+			walInst.Close()
+			storeInst.Close()
+		}
+	}
+
+	mgr, closeMgr := open()
+	cfg := DefaultQueueConfig()
+	cfg.DeliveryMode = DeliveryAtMostOnce
+	mgr.SetQueueConfig("test", cfg)
+
+	_, err := mgr.Enqueue("test", []byte("leased"), nil, 9, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	pendingID, err := mgr.Enqueue("test", []byte("pending"), nil, 1, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	jobs, err := mgr.Lease("test", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.True(t, jobs[0].Consumed)
+
+	// The node crashes while the job is leased
+	closeMgr()
+	mgr, closeMgr = open()
+	defer closeMgr()
+
+	ready, inflight, _, err := mgr.Stats("test")
+	require.NoError(t, err)
+	assert.Equal(t, 1, ready)
+	assert.Equal(t, 0, inflight)
+
+	jobs, err = mgr.Lease("test", 10, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, pendingID, jobs[0].ID)
+}
+
+func TestGroupCommitUnderQueueLock(t *testing.T) {
+	// Durable writes made with a queue locked are batched, rather than each
+	// waiting out a group commit and stalling the queue meanwhile
+	const interval = 200 * time.Millisecond
+	dir := t.TempDir()
+	walInst, err := wal.New(wal.Config{Dir: dir + "/wal", Fsync: true, SyncInterval: time.Hour, GroupCommitInterval: interval})
+	require.NoError(t, err)
+	t.Cleanup(func() { walInst.Close() })
+	storeInst, err := store.New(dir + "/store")
+	require.NoError(t, err)
+	t.Cleanup(func() { storeInst.Close() })
+	mgr := NewManager(storeInst, walInst)
+	require.NoError(t, mgr.Start())
+	t.Cleanup(func() { mgr.Stop() })
+	require.NoError(t, mgr.SetVisibilityLimits(VisibilityLimits{MinMs: 1}))
+
+	atMostOnce := DefaultQueueConfig()
+	atMostOnce.DeliveryMode = DeliveryAtMostOnce
+	mgr.SetQueueConfig("at-most-once", atMostOnce)
+	noDLQ := DefaultQueueConfig()
+	noDLQ.DLQEnabled = false
+	noDLQ.MaxConsecutiveExpiries = 1
+	mgr.SetQueueConfig("no-dlq", noDLQ)
+
+	specs := make([]EnqueueSpec, 10)
+	for i := range specs {
+		specs[i] = EnqueueSpec{Payload: []byte("job"), RetryPolicy: DefaultRetryPolicy()}
+	}
+	for _, queueName := range []string{"at-most-once", "no-dlq", "force"} {
+		_, err := mgr.EnqueueBatch(queueName, specs)
+		require.NoError(t, err)
+	}
+
+	elapsed := func(fn func()) time.Duration {
+		start := time.Now()
+		fn()
+		return time.Since(start)
+	}
+
+	// At-most-once leases consume the jobs in one write
+	assert.Less(t, elapsed(func() {
+		jobs, err := mgr.Lease("at-most-once", 10, 30000)
+		require.NoError(t, err)
+		assert.Len(t, jobs, 10)
+	}), 5*interval)
+
+	// Expired jobs dropped for want of a DLQ are tombstoned in one write
+	jobs, err := mgr.Lease("no-dlq", 10, 1)
+	require.NoError(t, err)
+	require.Len(t, jobs, 10)
+	time.Sleep(5 * time.Millisecond)
+	assert.Less(t, elapsed(mgr.checkLeaseTimeouts), 5*interval)
+	ready, inflight, dlq, err := mgr.Stats("no-dlq")
+	require.NoError(t, err)
+	assert.Equal(t, [3]int{0, 0, 0}, [3]int{ready, inflight, dlq})
+
+	// Force-expired leases are requeued in one write per queue
+	jobs, err = mgr.Lease("force", 10, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 10)
+	assert.Less(t, elapsed(func() {
+		count, err := mgr.ForceExpireAllLeases()
+		require.NoError(t, err)
+		assert.Equal(t, 10, count)
+	}), 5*interval)
+}
+
+func TestLeaseSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	open := func() (*Manager, func()) {
+		walInst, err := wal.New(wal.Config{Dir: dir + "/wal", SegmentSize: 1024, Fsync: false})
+		require.NoError(t, err)
+		storeInst, err := store.New(dir + "/store")
+		require.NoError(t, err)
+
+		mgr := NewManager(storeInst, walInst)
+		require.NoError(t, mgr.Start())
+		return mgr, func() {
+			mgr.Stop()
+			walInst.Close()
+			storeInst.Close()
+		}
+	}
+
+	mgr, closeMgr := open()
+	require.NoError(t, mgr.SetVisibilityLimits(VisibilityLimits{MinMs: 1}))
+
+	leasedID, err := mgr.Enqueue("test", []byte("leased"), nil, 9, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	shortID, err := mgr.Enqueue("test", []byte("short"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	pendingID, err := mgr.Enqueue("test", []byte("pending"), nil, 1, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	jobs, err := mgr.Lease("test", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	leased := jobs[0]
+	require.Equal(t, leasedID, leased.ID)
+	deadline, err := mgr.Heartbeat(leased.ID, leased.LeaseID, 60000)
+	require.NoError(t, err)
+
+	jobs, err = mgr.Lease("test", 1, 50)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	require.Equal(t, shortID, jobs[0].ID)
+
+	// The node restarts while both jobs are leased
+	closeMgr()
+	mgr, closeMgr = open()
+	defer closeMgr()
+
+	ready, inflight, _, err := mgr.Stats("test")
+	require.NoError(t, err)
+	assert.Equal(t, 1, ready)
+	assert.Equal(t, 2, inflight)
+
+	job, err := mgr.GetJob("test", leased.ID)
+	require.NoError(t, err)
+	assert.Equal(t, JobStatusInflight, job.Status)
+	assert.Equal(t, leased.LeaseID, job.LeaseID)
+	assert.Equal(t, deadline.UnixMilli(), job.LeaseDeadline.UnixMilli())
+
+	// Only the job that was ready is handed out
+	jobs, err = mgr.Lease("test", 10, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, pendingID, jobs[0].ID)
+
+	// The replayed leases are still tracked: one can be acked, and the one
+	// that ran out while the node was down expires
+	require.NoError(t, mgr.Ack(leased.ID, leased.LeaseID))
+	time.Sleep(50 * time.Millisecond)
+	mgr.checkLeaseTimeouts()
+	jobs = leaseEventually(t, mgr, "test")
+	assert.Equal(t, shortID, jobs[0].ID)
+	assert.Equal(t, uint32(1), jobs[0].Tries)
+
+	divergences, err := mgr.VerifyReplay()
+	require.NoError(t, err)
+	assert.Empty(t, divergences)
+}
+
+func TestMassLeaseExpiry(t *testing.T) {
+	mgr := newTestManager(t)
+	require.NoError(t, mgr.SetVisibilityLimits(VisibilityLimits{MinMs: 1}))
+
+	const n = 1000
+	for i := 0; i < n; i++ {
+		_, err := mgr.Enqueue("test", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+	}
+
+	// A consumer takes every job and crashes
+	jobs, err := mgr.Lease("test", n, 1)
+	require.NoError(t, err)
+	require.Len(t, jobs, n)
+
+	time.Sleep(10 * time.Millisecond)
+	mgr.checkLeaseTimeouts()
+
+	ready, inflight, _, err := mgr.Stats("test")
+	require.NoError(t, err)
+	assert.Equal(t, n, ready)
+	assert.Equal(t, 0, inflight)
+
+	requeues := 0
+	require.NoError(t, mgr.wal.Replay(func(record *wal.Record) error {
+		if record.Type == wal.RecordTypeRequeue {
+			requeues++
+		}
+		return nil
+	}))
+	assert.Equal(t, n, requeues)
+}
+
+func TestLogRedaction(t *testing.T) {
+	mgr := newTestManager(t)
+
+	var buf bytes.Buffer
+	orig := log.Logger
+	log.Logger = zerolog.New(&buf).Level(zerolog.DebugLevel)
+	defer func() { log.Logger = orig }()
+
+	fail := func() string {
+		jobID, err := mgr.Enqueue("pii", []byte(`{"ssn":"078-05-1120"}`), map[string]string{"email": "jane@example.com"}, 5, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+		jobs := leaseEventually(t, mgr, "pii")
+		require.NoError(t, mgr.NackPermanent(jobs[0].ID, jobs[0].LeaseID, "bad ssn 078-05-1120"))
+		return jobID
+	}
+
+	// Payloads and header values are never logged, only a digest
+	fail()
+	out := buf.String()
+	assert.Contains(t, out, `"payload":"21 bytes sha256:`)
+	assert.NotContains(t, out, "jane@example.com")
+	assert.Contains(t, out, "bad ssn 078-05-1120")
+
+	logging.SetRedaction(true)
+	defer logging.SetRedaction(false)
+	buf.Reset()
+
+	jobID := fail()
+	out = buf.String()
+	assert.Contains(t, out, jobID)
+	assert.Contains(t, out, "[redacted 19 bytes sha256:")
+	assert.NotContains(t, out, "078-05-1120")
+	assert.NotContains(t, out, "jane@example.com")
+}
+
+func TestSingleActiveConsumer(t *testing.T) {
+	mgr := newTestManager(t)
+	require.NoError(t, mgr.SetVisibilityLimits(VisibilityLimits{MinMs: 1}))
+
+	cfg := DefaultQueueConfig()
+	cfg.SingleActiveConsumer = true
+	mgr.SetQueueConfig("singleton", cfg)
+
+	for i := 0; i < 3; i++ {
+		_, err := mgr.Enqueue("singleton", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+	}
+
+	// Only one job is handed out, whatever the batch size
+	jobs, err := mgr.Lease("singleton", 5, 10)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	staleJobID, staleLease, staleToken := jobs[0].ID, jobs[0].LeaseID, jobs[0].FencingToken
+	assert.NotZero(t, staleToken)
+
+	// Nothing more while the lease is outstanding
+	jobs, err = mgr.Lease("singleton", 1, 30000)
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
+	job, _, _, err := mgr.Reserve("singleton", 1000)
+	require.NoError(t, err)
+	assert.Nil(t, job)
+
+	// The consumer stalls and a successor takes over
+	time.Sleep(20 * time.Millisecond)
+	mgr.checkLeaseTimeouts()
+
+	jobs, err = mgr.Lease("singleton", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Greater(t, jobs[0].FencingToken, staleToken)
+
+	// The stale consumer is fenced off
+	assert.ErrorIs(t, mgr.Ack(staleJobID, staleLease), ErrLeaseExpired)
+
+	// Once the successor acks, the next job can be leased
+	require.NoError(t, mgr.Ack(jobs[0].ID, jobs[0].LeaseID))
+	jobs, err = mgr.Lease("singleton", 1, 30000)
+	require.NoError(t, err)
+	assert.Len(t, jobs, 1)
+}
+
+func TestFencingTokenSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	walCfg := wal.Config{Dir: dir + "/wal", SegmentSize: 1 << 20, Fsync: false}
+
+	cfg := DefaultQueueConfig()
+	cfg.SingleActiveConsumer = true
+
+	walInst, err := wal.New(walCfg)
+	require.NoError(t, err)
+	storeInst, err := store.New(dir + "/store")
+	require.NoError(t, err)
+	mgr := NewManager(storeInst, walInst)
+	require.NoError(t, mgr.Start())
+	mgr.SetQueueConfig("singleton", cfg)
+
+	for i := 0; i < 2; i++ {
+		_, err := mgr.Enqueue("singleton", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+	}
+
+	// Tokens issued ahead of the clock, as after the clock stepped back
+	queue := mgr.getQueue("singleton")
+	ahead := uint64(time.Now().Add(time.Hour).UnixMicro())
+	queue.mu.Lock()
+	queue.fence = ahead
+	queue.mu.Unlock()
+
+	jobs, err := mgr.Lease("singleton", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	leased := jobs[0]
+	assert.Equal(t, ahead+1, leased.FencingToken)
+
+	mgr.Stop()
+	walInst.Close()
+	storeInst.Close()
+
+	walInst2, err := wal.New(walCfg)
+	require.NoError(t, err)
+	defer walInst2.Close()
+	storeInst2, err := store.New(dir + "/store")
+	require.NoError(t, err)
+	defer storeInst2.Close()
+	mgr2 := NewManager(storeInst2, walInst2)
+	require.NoError(t, mgr2.Start())
+	defer mgr2.Stop()
+	mgr2.SetQueueConfig("singleton", cfg)
+
+	// The replayed lease keeps its token, and later ones are greater
+	job, err := mgr2.GetJob("singleton", leased.ID)
+	require.NoError(t, err)
+	assert.Equal(t, leased.FencingToken, job.FencingToken)
+
+	require.NoError(t, mgr2.Ack(leased.ID, leased.LeaseID))
+	jobs, err = mgr2.Lease("singleton", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Greater(t, jobs[0].FencingToken, leased.FencingToken)
+}
+
+func TestEnqueueDelayHorizon(t *testing.T) {
+	mgr := newTestManager(t)
+	mgr.SetMaxDelay(time.Hour)
+
+	enqueue := func(delayMs int64) error {
+		_, err := mgr.Enqueue("scheduled", []byte("job"), nil, 5, delayMs, DefaultRetryPolicy(), "")
+		return err
+	}
+
+	// Just within the horizon
+	require.NoError(t, enqueue(time.Hour.Milliseconds()))
+
+	assert.ErrorIs(t, enqueue(time.Hour.Milliseconds()+1), ErrDelayOutOfRange)
+	assert.ErrorIs(t, enqueue(-1), ErrDelayOutOfRange)
+
+	// Without a horizon, delays that would overflow are still rejected
+	mgr.SetMaxDelay(0)
+	require.NoError(t, enqueue(100*365*24*time.Hour.Milliseconds()))
+	assert.ErrorIs(t, enqueue(math.MaxInt64), ErrDelayOutOfRange)
+
+	ready, _, _, err := mgr.Stats("scheduled")
+	require.NoError(t, err)
+	assert.Equal(t, 2, ready)
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	dir := t.TempDir()
+
+	open := func() (*Manager, func()) {
+		walInst, err := wal.New(wal.Config{Dir: dir + "/wal", SegmentSize: 1024 * 1024, Fsync: false})
+		require.NoError(t, err)
+		storeInst, err := store.New(dir + "/store")
+		require.NoError(t, err)
+
+		mgr := NewManager(storeInst, walInst)
+		require.NoError(t, mgr.Start())
+		return mgr, func() {
+			mgr.Stop()
+			walInst.Close()
+			storeInst.Close()
+		}
+	}
+
+	mgr, closeMgr := open()
+
+	for i := 0; i < 3; i++ {
+		_, err := mgr.Enqueue("test", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+	}
+	leased, err := mgr.Lease("test", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, leased, 1)
+
+	require.NoError(t, mgr.SetMaintenance(MaintenanceMode{Enabled: true}))
+	assert.False(t, mgr.Maintenance().Since.IsZero())
+
+	// Leasing and reserving are suspended on every queue
+	jobs, err := mgr.Lease("test", 10, 30000)
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
+	job, _, _, err := mgr.Reserve("test", 1000)
+	require.NoError(t, err)
+	assert.Nil(t, job)
+
+	// Inflight jobs can still be acked, and enqueues still work
+	require.NoError(t, mgr.Ack(leased[0].ID, leased[0].LeaseID))
+	_, err = mgr.Enqueue("other", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	// Unless they are rejected too
+	require.NoError(t, mgr.SetMaintenance(MaintenanceMode{Enabled: true, RejectEnqueues: true}))
+	_, err = mgr.Enqueue("test", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+	assert.ErrorIs(t, err, ErrMaintenance)
+
+	// A restart stays in maintenance until it is cleared
+	closeMgr()
+	mgr, closeMgr = open()
+	defer func() { closeMgr() }()
+
+	assert.True(t, mgr.Maintenance().Enabled)
+	assert.True(t, mgr.Maintenance().RejectEnqueues)
+	jobs, err = mgr.Lease("test", 10, 30000)
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
+
+	require.NoError(t, mgr.SetMaintenance(MaintenanceMode{}))
+	jobs, err = mgr.Lease("test", 10, 30000)
+	require.NoError(t, err)
+	assert.Len(t, jobs, 2)
+
+	closeMgr()
+	mgr, closeMgr = open()
+	assert.False(t, mgr.Maintenance().Enabled)
+}
+
+func TestMoveToDLQ(t *testing.T) {
+	dir := t.TempDir()
+
+	open := func() (*Manager, func()) {
+		walInst, err := wal.New(wal.Config{Dir: dir + "/wal", SegmentSize: 1024 * 1024, Fsync: false})
+		require.NoError(t, err)
+		storeInst, err := store.New(dir + "/store")
+		require.NoError(t, err)
+
+		mgr := NewManager(storeInst, walInst)
+		require.NoError(t, mgr.Start())
+		return mgr, func() {
+			mgr.Stop()
+			walInst.Close()
+			storeInst.Close()
+		}
+	}
+
+	mgr, closeMgr := open()
+
+	bad := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		id, err := mgr.Enqueue("deploys", []byte("bad"), map[string]string{"version": "bad", "region": "eu"}, 5, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+		bad[id] = true
+	}
+	for i := 0; i < 2; i++ {
+		_, err := mgr.Enqueue("deploys", []byte("good"), map[string]string{"version": "good"}, 5, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+	}
+	_, err := mgr.Enqueue("deploys", []byte("plain"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	moved, err := mgr.MoveToDLQ("deploys", HeaderFilter{"version": "bad"})
+	require.NoError(t, err)
+	assert.Equal(t, 3, moved)
+
+	// Nothing left to match
+	moved, err = mgr.MoveToDLQ("deploys", HeaderFilter{"version": "bad"})
+	require.NoError(t, err)
+	assert.Equal(t, 0, moved)
+
+	check := func(mgr *Manager) {
+		ready, inflight, dlq, err := mgr.Stats("deploys")
+		require.NoError(t, err)
+		assert.Equal(t, 3, ready)
+		assert.Equal(t, 0, inflight)
+		assert.Equal(t, 3, dlq)
+
+		jobs, err := mgr.SnapshotJobs("deploys", JobStatusDLQ)
+		require.NoError(t, err)
+		for _, job := range jobs {
+			assert.True(t, bad[job.ID])
+			assert.Equal(t, DLQReasonManual, job.DLQReason)
+		}
+
+		leased, err := mgr.Lease("deploys", 10, 30000)
+		require.NoError(t, err)
+		assert.Len(t, leased, 3)
+		for _, job := range leased {
+			assert.NotEqual(t, "bad", job.Headers["version"])
+			require.NoError(t, mgr.Nack(job.ID, job.LeaseID, "put back"))
+		}
+	}
+	check(mgr)
+
+	// The moves survive a restart
+	closeMgr()
+	mgr, closeMgr = open()
+	defer closeMgr()
+
+	ready, _, dlq, err := mgr.Stats("deploys")
+	require.NoError(t, err)
+	assert.Equal(t, 3, ready)
+	assert.Equal(t, 3, dlq)
+
+	_, err = mgr.MoveToDLQ("missing", HeaderFilter{"version": "bad"})
+	assert.Error(t, err)
+
+	cfg := DefaultQueueConfig()
+	cfg.DLQEnabled = false
+	mgr.SetQueueConfig("no-dlq", cfg)
+	_, err = mgr.MoveToDLQ("no-dlq", nil)
+	assert.ErrorIs(t, err, ErrDLQDisabled)
+}
+
+func TestLeaseBatchCap(t *testing.T) {
+	mgr := newTestManager(t)
+	mgr.SetMaxLeaseBatch(5)
+
+	for i := 0; i < 8; i++ {
+		_, err := mgr.Enqueue("test", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+	}
+
+	jobs, err := mgr.Lease("test", 1000000, 30000)
+	require.NoError(t, err)
+	assert.Len(t, jobs, 5)
+
+	// Requests within the cap are unaffected
+	jobs, err = mgr.Lease("test", 2, 30000)
+	require.NoError(t, err)
+	assert.Len(t, jobs, 2)
+
+	// Zero removes the cap
+	mgr.SetMaxLeaseBatch(0)
+	jobs, err = mgr.Lease("test", 1000000, 30000)
+	require.NoError(t, err)
+	assert.Len(t, jobs, 1)
+}
+
+func TestLeaseExpectedOverdue(t *testing.T) {
+	mgr := newTestManager(t)
+
+	for i := 0; i < 3; i++ {
+		_, err := mgr.Enqueue("test", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+	}
+
+	expected, err := mgr.LeaseWithOptions(context.Background(), "test", 1, 30000, LeaseOptions{ExpectedMs: 20})
+	require.NoError(t, err)
+	require.Len(t, expected, 1)
+	plain, err := mgr.Lease("test", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, plain, 1)
+
+	// Without a visibility timeout, one is derived from the expected time
+	before := time.Now()
+	derived, err := mgr.LeaseWithOptions(context.Background(), "test", 1, 0, LeaseOptions{ExpectedMs: 5000})
+	require.NoError(t, err)
+	require.Len(t, derived, 1)
+	assert.WithinDuration(t, before.Add(10*time.Second), derived[0].LeaseDeadline, 100*time.Millisecond)
+
+	time.Sleep(40 * time.Millisecond)
+	mgr.checkLeaseTimeouts()
+
+	jobs, err := mgr.SnapshotJobs("test", JobStatusInflight)
+	require.NoError(t, err)
+	require.Len(t, jobs, 3)
+
+	now := time.Now()
+	for _, job := range jobs {
+		// All still within their visibility timeout
+		assert.True(t, job.LeaseDeadline.After(now))
+		assert.Equal(t, job.ID == expected[0].ID, job.Overdue(now), job.ID)
+	}
+
+	// Acking an overdue job still works
+	require.NoError(t, mgr.Ack(expected[0].ID, expected[0].LeaseID))
+}
+
+func TestLeaseFIFOOrdering(t *testing.T) {
+	mgr := newTestManager(t)
+
+	priorities := []uint8{1, 9, 5, 0, 9, 3}
+	ids := make([]string, len(priorities))
+	for i, priority := range priorities {
+		id, err := mgr.Enqueue("backlog", []byte(fmt.Sprintf("job-%d", i)), nil, priority, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+		ids[i] = id
+	}
+
+	// A delayed job is skipped even though it is the oldest
+	_, err := mgr.Enqueue("delayed", []byte("later"), nil, 9, 60000, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	nowID, err := mgr.Enqueue("delayed", []byte("now"), nil, 0, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	var leased []string
+	for len(leased) < 4 {
+		jobs, err := mgr.LeaseWithOptions(context.Background(), "backlog", 2, 30000, LeaseOptions{Ordering: OrderingFIFO})
+		require.NoError(t, err)
+		require.NotEmpty(t, jobs)
+		for _, job := range jobs {
+			leased = append(leased, job.ID)
+		}
+	}
+	assert.Equal(t, ids[:4], leased)
+
+	// Priority leases still work on the same queue
+	jobs, err := mgr.Lease("backlog", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, ids[4], jobs[0].ID)
+
+	jobs, err = mgr.LeaseWithOptions(context.Background(), "backlog", 10, 30000, LeaseOptions{Ordering: OrderingFIFO})
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, ids[5], jobs[0].ID)
+
+	jobs, err = mgr.LeaseWithOptions(context.Background(), "delayed", 10, 30000, LeaseOptions{Ordering: OrderingFIFO})
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, nowID, jobs[0].ID)
+}
+
+func TestSnapshotState(t *testing.T) {
+	mgr := newTestManager(t)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// Enqueues to "a" then "b", so a consistent cut never shows b ahead of a
+	// or a more than one job ahead of b
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			mgr.Enqueue("a", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+			mgr.Enqueue("b", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+		}
+	}()
+
+	// Keeps creating queues and moving jobs through them
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			name := fmt.Sprintf("churn-%d", i%50)
+			mgr.Enqueue(name, []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+			jobs, _ := mgr.Lease(name, 1, 30000)
+			for _, job := range jobs {
+				mgr.Ack(job.ID, job.LeaseID)
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		states := mgr.SnapshotState()
+		byName := make(map[string]QueueState, len(states))
+		for j, state := range states {
+			if j > 0 {
+				require.Less(t, states[j-1].Name, state.Name)
+			}
+			byName[state.Name] = state
+		}
+
+		a, b := byName["a"].Depth.Ready, byName["b"].Depth.Ready
+		require.True(t, a == b || a == b+1, "inconsistent cut: a=%d b=%d", a, b)
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
+func TestQueueMetrics(t *testing.T) {
+	mgr := newTestManager(t)
+	require.NoError(t, mgr.SetVisibilityLimits(VisibilityLimits{MinMs: 1}))
+
+	value := func(c prometheus.Collector) float64 {
+		var m dto.Metric
+		require.NoError(t, c.(prometheus.Metric).Write(&m))
+		if m.Counter != nil {
+			return m.GetCounter().GetValue()
+		}
+		return m.GetGauge().GetValue()
+	}
+	counter := func(vec *prometheus.CounterVec) float64 { return value(vec.WithLabelValues("metered")) }
+	gauge := func(vec *prometheus.GaugeVec) float64 { return value(vec.WithLabelValues("metered")) }
+
+	policy := RetryPolicy{MaxRetries: 1}
+	for i := 0; i < 3; i++ {
+		_, err := mgr.Enqueue("metered", []byte("job"), nil, 5, 0, policy, "")
+		require.NoError(t, err)
+	}
+	_, err := mgr.EnqueueBatch("metered", []EnqueueSpec{{Payload: []byte("a"), RetryPolicy: policy}, {Payload: []byte("b"), RetryPolicy: policy}})
+	require.NoError(t, err)
+	assert.Equal(t, 5.0, counter(metrics.JobsEnqueuedTotal))
+	assert.Equal(t, 5.0, gauge(metrics.JobsReady))
+
+	jobs, err := mgr.Lease("metered", 3, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 3)
+	assert.Equal(t, 3.0, counter(metrics.JobsLeasedTotal))
+	assert.Equal(t, 2.0, gauge(metrics.JobsReady))
+	assert.Equal(t, 3.0, gauge(metrics.JobsInflight))
+
+	require.NoError(t, mgr.Ack(jobs[0].ID, jobs[0].LeaseID))
+	require.NoError(t, mgr.Nack(jobs[1].ID, jobs[1].LeaseID, "boom"))
+	assert.Equal(t, 1.0, counter(metrics.JobsAckedTotal))
+	assert.Equal(t, 1.0, counter(metrics.JobsNackedTotal))
+	assert.Equal(t, 1.0, gauge(metrics.JobsInflight))
+	assert.Equal(t, 1.0, gauge(metrics.JobsDLQ))
+
+	// A job whose lease expires without retries left is dead-lettered
+	_, err = mgr.Lease("metered", 1, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, gauge(metrics.JobsInflight))
+	time.Sleep(20 * time.Millisecond)
+	mgr.checkLeaseTimeouts()
+	assert.Equal(t, 1.0, gauge(metrics.JobsReady))
+	assert.Equal(t, 1.0, gauge(metrics.JobsInflight))
+	assert.Equal(t, 2.0, gauge(metrics.JobsDLQ))
+
+	mgr.updateWALGauges()
+	assert.Greater(t, value(metrics.WALSegments), 0.0)
+	assert.Greater(t, value(metrics.WALSize), 0.0)
+}
+
+func TestDLQReasonMetric(t *testing.T) {
+	mgr := newTestManager(t)
+	require.NoError(t, mgr.SetVisibilityLimits(VisibilityLimits{MinMs: 1}))
+	require.NoError(t, mgr.SetNackRules("dlqmetric", []NackRule{{Prefix: "validation:", Action: NackActionDLQ}}))
+
+	count := func(reason string) float64 {
+		var m dto.Metric
+		require.NoError(t, metrics.JobsDLQTotal.WithLabelValues("dlqmetric", reason).(prometheus.Counter).Write(&m))
+		return m.GetCounter().GetValue()
+	}
+	lease := func() *Job {
+		_, err := mgr.Enqueue("dlqmetric", []byte("job"), nil, 5, 0, RetryPolicy{MaxRetries: 1}, "")
+		require.NoError(t, err)
+		jobs, err := mgr.Lease("dlqmetric", 1, 30000)
+		require.NoError(t, err)
+		require.Len(t, jobs, 1)
+		return jobs[0]
+	}
+
+	job := lease()
+	require.NoError(t, mgr.Nack(job.ID, job.LeaseID, "connection reset"))
+	job = lease()
+	require.NoError(t, mgr.Nack(job.ID, job.LeaseID, "validation: missing field"))
+	job = lease()
+	require.NoError(t, mgr.NackPermanent(job.ID, job.LeaseID, "malformed payload"))
+
+	_, err := mgr.Enqueue("dlqmetric", []byte("job"), nil, 5, 0, RetryPolicy{MaxRetries: 1}, "")
+	require.NoError(t, err)
+	_, err = mgr.Lease("dlqmetric", 1, 10)
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	mgr.checkLeaseTimeouts()
+
+	_, err = mgr.Enqueue("dlqmetric", []byte("job"), map[string]string{"tenant": "bad"}, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	moved, err := mgr.MoveToDLQ("dlqmetric", HeaderFilter{"tenant": "bad"})
+	require.NoError(t, err)
+	require.Equal(t, 1, moved)
+
+	// Free-text nack reasons are bucketed by how the job reached the DLQ
+	assert.Equal(t, 1.0, count("retries_exhausted"))
+	assert.Equal(t, 1.0, count("nack_rule"))
+	assert.Equal(t, 1.0, count("permanent"))
+	assert.Equal(t, 1.0, count("lease_expired"))
+	assert.Equal(t, 1.0, count(DLQReasonManual))
+}
+
+func TestWALOpenForRead(t *testing.T) {
+	dir := t.TempDir()
+
+	// Small segments so the records span several of them
+	walInst, err := wal.New(wal.Config{Dir: dir + "/wal", SegmentSize: 512, Fsync: false})
+	require.NoError(t, err)
+	storeInst, err := store.New(dir + "/store")
+	require.NoError(t, err)
+	mgr := NewManager(storeInst, walInst)
+	require.NoError(t, mgr.Start())
+
+	var jobIDs []string
+	for i := 0; i < 20; i++ {
+		jobID, err := mgr.Enqueue("test", []byte(fmt.Sprintf("job-%d", i)), nil, 5, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+		jobIDs = append(jobIDs, jobID)
+	}
+	jobs, err := mgr.Lease("test", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	require.NoError(t, mgr.Ack(jobs[0].ID, jobs[0].LeaseID))
+
+	mgr.Stop()
+	require.NoError(t, walInst.Close())
+	require.NoError(t, storeInst.Close())
+
+	// The WAL is read without a manager, in the order it was written
+	reader, err := wal.OpenForRead(dir + "/wal")
+	require.NoError(t, err)
+	defer reader.Close()
+
+	var records []*wal.Record
+	segments := make(map[uint64]bool)
+	for reader.Next() {
+		records = append(records, reader.Record())
+		segments[reader.Segment()] = true
+	}
+	require.NoError(t, reader.Err())
+
+	require.Len(t, records, len(jobIDs)+2)
+	for i, jobID := range jobIDs {
+		assert.Equal(t, wal.RecordTypeEnqueue, records[i].Type)
+		assert.Equal(t, jobID, records[i].JobID)
+		assert.Equal(t, fmt.Sprintf("job-%d", i), string(records[i].Payload))
+	}
+	lease := records[len(jobIDs)]
+	assert.Equal(t, wal.RecordTypeLease, lease.Type)
+	assert.Equal(t, jobs[0].LeaseID, lease.LeaseID)
+	assert.Equal(t, jobs[0].LeaseDeadline.UnixMilli(), lease.ETA.UnixMilli())
+	assert.Equal(t, "lease", lease.Type.String())
+	ack := records[len(jobIDs)+1]
+	assert.Equal(t, wal.RecordTypeAck, ack.Type)
+	assert.Equal(t, jobs[0].ID, ack.JobID)
+	assert.Equal(t, "ack", ack.Type.String())
+	assert.Greater(t, len(segments), 1)
+}
+
+func TestDefaultHeaders(t *testing.T) {
+	mgr := newTestManager(t)
+	require.NoError(t, mgr.SetDefaultHeaders("test", map[string]string{"source": "api", "schema": "v1"}))
+
+	_, err := mgr.Enqueue("test", []byte("plain"), nil, 9, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	producerHeaders := map[string]string{"schema": "v2", "trace": "abc"}
+	_, err = mgr.Enqueue("test", []byte("explicit"), producerHeaders, 1, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	jobs, err := mgr.Lease("test", 2, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 2)
+
+	// A job without headers gets the defaults
+	assert.Equal(t, map[string]string{"source": "api", "schema": "v1"}, jobs[0].Headers)
+	// Producer headers win over the defaults, without being modified
+	assert.Equal(t, map[string]string{"source": "api", "schema": "v2", "trace": "abc"}, jobs[1].Headers)
+	assert.Equal(t, map[string]string{"schema": "v2", "trace": "abc"}, producerHeaders)
+
+	cfg, err := mgr.GetQueueConfig("test")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"source": "api", "schema": "v1"}, cfg.DefaultHeaders)
+}
+
+func TestDefaultHeadersSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	walCfg := wal.Config{Dir: dir + "/wal", SegmentSize: 1 << 20, Fsync: false}
+
+	walInst, err := wal.New(walCfg)
+	require.NoError(t, err)
+	storeInst, err := store.New(dir + "/store")
+	require.NoError(t, err)
+	mgr := NewManager(storeInst, walInst)
+	require.NoError(t, mgr.Start())
+
+	require.NoError(t, mgr.SetDefaultHeaders("tagged", map[string]string{"source": "api"}))
+	require.NoError(t, mgr.SetQueueMode("fifo", QueueModeFIFO))
+	cfg, err := mgr.GetQueueConfig("fifo")
+	require.NoError(t, err)
+	cfg.DefaultHeaders = map[string]string{"schema": "v1"}
+	mgr.SetQueueConfig("fifo", cfg)
+	require.NoError(t, mgr.SetDefaultHeaders("cleared", map[string]string{"x": "y"}))
+	require.NoError(t, mgr.SetDefaultHeaders("cleared", nil))
+
+	mgr.Stop()
+	walInst.Close()
+	storeInst.Close()
+
+	walInst2, err := wal.New(walCfg)
+	require.NoError(t, err)
+	defer walInst2.Close()
+	storeInst2, err := store.New(dir + "/store")
+	require.NoError(t, err)
+	defer storeInst2.Close()
+	mgr2 := NewManager(storeInst2, walInst2)
+	require.NoError(t, mgr2.Start())
+	defer mgr2.Stop()
+
+	// Defaults set either way are restored, alongside a persisted mode
+	cfg, err = mgr2.GetQueueConfig("tagged")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"source": "api"}, cfg.DefaultHeaders)
+	cfg, err = mgr2.GetQueueConfig("fifo")
+	require.NoError(t, err)
+	assert.Equal(t, QueueModeFIFO, cfg.Mode)
+	assert.Equal(t, map[string]string{"schema": "v1"}, cfg.DefaultHeaders)
+
+	_, err = mgr2.Enqueue("tagged", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	jobs := leaseEventually(t, mgr2, "tagged")
+	assert.Equal(t, map[string]string{"source": "api"}, jobs[0].Headers)
+
+	// Removed defaults stay removed
+	_, err = mgr2.GetQueueConfig("cleared")
+	assert.ErrorIs(t, err, ErrQueueNotFound)
+
+	// Deleting the queue forgets them
+	require.NoError(t, mgr2.DeleteQueue("tagged", true))
+	data, err := storeInst2.Get(defaultHeadersKey("tagged"))
+	require.NoError(t, err)
+	assert.Nil(t, data)
+}
+
+func TestQueueTransforms(t *testing.T) {
+	mgr := newTestManager(t)
+	require.NoError(t, mgr.SetQueueTransforms("test", []Transform{
+		{Type: TransformStampReceivedAt},
+		{Type: TransformAddHeader, Header: "source", Value: "gateway"},
+		{Type: TransformCopyHeaderToPriority, Header: "urgency"},
+	}))
+
+	before := time.Now().Add(-time.Millisecond)
+	_, err := mgr.Enqueue("test", []byte("plain"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	_, err = mgr.Enqueue("test", []byte("urgent"), map[string]string{"urgency": "9", "source": "client"}, 1, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	_, err = mgr.EnqueueBatch("test", []EnqueueSpec{{Payload: []byte("batched"), Priority: 3}})
+	require.NoError(t, err)
+
+	jobs, err := mgr.Lease("test", 3, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 3)
+
+	// Every job is stamped when received
+	for _, job := range jobs {
+		stamp, err := time.Parse(time.RFC3339Nano, job.Headers[DefaultReceivedAtHeader])
+		require.NoError(t, err, job.Headers)
+		assert.False(t, stamp.Before(before), stamp)
+		assert.False(t, stamp.After(time.Now()), stamp)
+		assert.Equal(t, "gateway", job.Headers["source"])
+	}
+
+	// The header derived priority moved the urgent job first
+	assert.Equal(t, "urgent", string(jobs[0].Payload))
+	assert.Equal(t, uint8(9), jobs[0].Priority)
+	assert.Equal(t, uint8(5), jobs[1].Priority)
+	assert.Equal(t, uint8(3), jobs[2].Priority)
+
+	// A retried enqueue with the same job ID is not a collision because of
+	// its received-at stamp
+	id, err := mgr.EnqueueWithOptions("test", []byte("order"), EnqueueOptions{Priority: 5, RetryPolicy: DefaultRetryPolicy(), JobID: "order-1"})
+	require.NoError(t, err)
+	time.Sleep(2 * time.Millisecond)
+	again, err := mgr.EnqueueWithOptions("test", []byte("order"), EnqueueOptions{Priority: 5, RetryPolicy: DefaultRetryPolicy(), JobID: "order-1"})
+	require.NoError(t, err)
+	assert.Equal(t, id, again)
+
+	assert.Error(t, mgr.SetQueueTransforms("test", []Transform{{Type: "run_script"}}))
+	assert.Error(t, mgr.SetQueueTransforms("test", []Transform{{Type: TransformAddHeader}}))
+
+	// Removing the transforms leaves later jobs untouched
+	require.NoError(t, mgr.SetQueueTransforms("test", nil))
+	bare, err := mgr.Enqueue("test", []byte("bare"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	job, err := mgr.GetJob("test", bare)
+	require.NoError(t, err)
+	assert.Empty(t, job.Headers)
+}
+
+// failingIdempotencyStore fails every idempotency key read and write
+type failingIdempotencyStore struct{}
+
+func (failingIdempotencyStore) GetIdempotencyEntry(string) (string, string, error) {
+	return "", "", errors.New("disk I/O error")
+}
+
+func (failingIdempotencyStore) SetIdempotencyEntry(string, string, string, time.Duration) error {
+	return errors.New("disk I/O error")
+}
+
+func TestIdempotencyStoreFailure(t *testing.T) {
+	mgr := newTestManager(t)
+	mgr.idempotency = failingIdempotencyStore{}
+	assert.ErrorIs(t, mgr.CheckStore(), ErrStoreUnavailable)
+
+	// Failing closed rejects enqueues that need dedup
+	_, err := mgr.Enqueue("test", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "order-1")
+	assert.ErrorIs(t, err, ErrStoreUnavailable)
+
+	// Enqueues without a key don't touch the store
+	_, err = mgr.Enqueue("test", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	ready, _, _, err := mgr.Stats("test")
+	require.NoError(t, err)
+	assert.Equal(t, 1, ready)
+
+	// Failing open enqueues without dedup, so retries may duplicate
+	mgr.SetIdempotencyFailOpen(true)
+	first, err := mgr.Enqueue("test", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "order-1")
+	require.NoError(t, err)
+	second, err := mgr.Enqueue("test", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "order-1")
+	require.NoError(t, err)
+	assert.NotEqual(t, first, second)
+
+	// Once the store recovers, the check passes again
+	mgr.idempotency = mgr.store
+	assert.NoError(t, mgr.CheckStore())
+}
+
+func TestLeaseCheckJitter(t *testing.T) {
+	dir := t.TempDir()
+
+	walInst, err := wal.New(wal.Config{
+		Dir:         dir + "/wal",
+		SegmentSize: 1024,
+		Fsync:       false,
+	})
+	require.NoError(t, err)
+	defer walInst.Close()
+
+	storeInst, err := store.New(dir + "/store")
+	require.NoError(t, err)
+	defer storeInst.Close()
+
+	// Not started, so the test drives the lease checks itself
+	mgr := NewManager(storeInst, walInst)
+	mgr.SetLeaseCheckInterval(time.Second, 200*time.Millisecond)
+
+	names := make([]string, 20)
+	for i := range names {
+		names[i] = fmt.Sprintf("queue-%d", i)
+		_, err := mgr.Enqueue(names[i], []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+	}
+
+	// Every queue is due, so all are checked and rescheduled from the same
+	// instant, each with its own share of the jitter
+	now := time.Now().Add(2 * time.Second)
+	next := mgr.checkDueLeaseTimeouts(now)
+
+	checks := make(map[time.Time]bool)
+	earliest := now.Add(time.Hour)
+	for _, name := range names {
+		queue := mgr.getQueue(name)
+		queue.mu.RLock()
+		at := queue.nextLeaseCheck
+		queue.mu.RUnlock()
+
+		assert.False(t, at.Before(now.Add(time.Second)), "check scheduled before the interval")
+		assert.True(t, at.Before(now.Add(1200*time.Millisecond)), "check scheduled past the jitter")
+		checks[at] = true
+		if at.Before(earliest) {
+			earliest = at
+		}
+	}
+	assert.Greater(t, len(checks), 1, "lease checks should not align across queues")
+	assert.False(t, next.After(earliest), "worker should wake by the earliest check")
+
+	// Without jitter, checks made together stay aligned
+	mgr.SetLeaseCheckInterval(time.Second, 0)
+	now = now.Add(2 * time.Second)
+	next = mgr.checkDueLeaseTimeouts(now)
+	assert.Equal(t, now.Add(time.Second), next)
+	for _, name := range names {
+		queue := mgr.getQueue(name)
+		queue.mu.RLock()
+		assert.Equal(t, now.Add(time.Second), queue.nextLeaseCheck)
+		queue.mu.RUnlock()
+	}
+}
+
+func TestVerifyHeap(t *testing.T) {
+	mgr := newTestManager(t)
+
+	for i := 0; i < 10; i++ {
+		_, err := mgr.Enqueue("test", []byte(fmt.Sprintf("job-%d", i)), nil, uint8(i), 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+	}
+	_, err := mgr.Enqueue("test", []byte("delayed"), nil, 9, 60000, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	check, err := mgr.VerifyHeap("test")
+	require.NoError(t, err)
+	assert.Empty(t, check.Problem)
+	assert.False(t, check.Repaired)
+	assert.Equal(t, 11, check.Jobs)
+
+	// Corrupt an item's recorded index, as a bug mutating the heap in place might
+	queue := mgr.getQueue("test")
+	queue.mu.Lock()
+	queue.ready.heap[3].index = 7
+	queue.mu.Unlock()
+
+	check, err = mgr.VerifyHeap("test")
+	require.NoError(t, err)
+	assert.Contains(t, check.Problem, "records index 7")
+	assert.True(t, check.Repaired)
+	assert.Equal(t, 11, check.Jobs)
+
+	// Break the heap order too; the rebuild restores it
+	queue.mu.Lock()
+	queue.ready.heap[0].priority = 0
+	queue.mu.Unlock()
+
+	check, err = mgr.VerifyHeap("test")
+	require.NoError(t, err)
+	assert.NotEmpty(t, check.Problem)
+	assert.True(t, check.Repaired)
+
+	check, err = mgr.VerifyHeap("test")
+	require.NoError(t, err)
+	assert.Empty(t, check.Problem)
+
+	// Ready jobs still lease in priority order, and the delayed one stays delayed
+	for i := 9; i >= 0; i-- {
+		jobs, err := mgr.Lease("test", 1, 30000)
+		require.NoError(t, err)
+		require.Len(t, jobs, 1)
+		assert.Equal(t, fmt.Sprintf("job-%d", i), string(jobs[0].Payload))
+	}
+	jobs, err := mgr.Lease("test", 1, 30000)
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
+
+	_, err = mgr.VerifyHeap("missing")
+	assert.Error(t, err)
+}
+
+func TestIdempotencyStrict(t *testing.T) {
+	mgr := newTestManager(t)
+	mgr.SetIdempotencyStrict(true)
+
+	headers := map[string]string{"tenant": "a", "version": "2"}
+	first, err := mgr.Enqueue("test", []byte("payload"), headers, 5, 0, DefaultRetryPolicy(), "key-1")
+	require.NoError(t, err)
+
+	// The same request dedups as usual, whatever the header order or priority
+	same := map[string]string{"version": "2", "tenant": "a"}
+	second, err := mgr.Enqueue("test", []byte("payload"), same, 7, 0, DefaultRetryPolicy(), "key-1")
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+
+	// A different payload or headers conflicts, returning the existing job
+	existing, err := mgr.Enqueue("test", []byte("other-payload"), headers, 5, 0, DefaultRetryPolicy(), "key-1")
+	assert.ErrorIs(t, err, ErrIdempotencyConflict)
+	assert.Equal(t, first, existing)
+
+	existing, err = mgr.Enqueue("test", []byte("payload"), map[string]string{"tenant": "b", "version": "2"}, 5, 0, DefaultRetryPolicy(), "key-1")
+	assert.ErrorIs(t, err, ErrIdempotencyConflict)
+	assert.Equal(t, first, existing)
+
+	ready, _, _, err := mgr.Stats("test")
+	require.NoError(t, err)
+	assert.Equal(t, 1, ready)
+
+	// Keys stored without a hash predate strict mode and always match
+	require.NoError(t, mgr.store.SetIdempotencyKey("legacy", first, 0))
+	legacy, err := mgr.Enqueue("test", []byte("anything"), nil, 5, 0, DefaultRetryPolicy(), "legacy")
+	require.NoError(t, err)
+	assert.Equal(t, first, legacy)
+
+	// Without strict mode a differing request dedups silently
+	mgr.SetIdempotencyStrict(false)
+	lenient, err := mgr.Enqueue("test", []byte("other-payload"), nil, 5, 0, DefaultRetryPolicy(), "key-1")
+	require.NoError(t, err)
+	assert.Equal(t, first, lenient)
+}
+
+func TestBackoffDelayMetric(t *testing.T) {
+	mgr := newTestManager(t)
+	require.NoError(t, mgr.SetVisibilityLimits(VisibilityLimits{MinMs: 1}))
+
+	_, err := mgr.Enqueue("backoffmetric", []byte("job"), nil, 5, 0, RetryPolicy{MaxRetries: 10}, "")
+	require.NoError(t, err)
+
+	lease := func(visibilityMs int64) *Job {
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			jobs, err := mgr.Lease("backoffmetric", 1, visibilityMs)
+			require.NoError(t, err)
+			if len(jobs) == 1 {
+				return jobs[0]
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("job was not retried")
+		return nil
+	}
+
+	// Two nacks, then a lease expiry: the default backoff doubles from 100ms
+	// with 10% jitter, so each retry lands one bucket further out
+	job := lease(30000)
+	require.NoError(t, mgr.Nack(job.ID, job.LeaseID, "boom"))
+	job = lease(30000)
+	require.NoError(t, mgr.Nack(job.ID, job.LeaseID, "boom"))
+	lease(10)
+	time.Sleep(20 * time.Millisecond)
+	mgr.checkLeaseTimeouts()
+
+	var m dto.Metric
+	require.NoError(t, metrics.BackoffDelay.WithLabelValues("backoffmetric").(prometheus.Histogram).Write(&m))
+	hist := m.GetHistogram()
+	assert.Equal(t, uint64(3), hist.GetSampleCount())
+
+	cumulative := make(map[float64]uint64)
+	for _, bucket := range hist.GetBucket() {
+		cumulative[bucket.GetUpperBound()] = bucket.GetCumulativeCount()
+	}
+	assert.Equal(t, uint64(1), cumulative[0.125]) // ~100ms
+	assert.Equal(t, uint64(2), cumulative[0.25])  // ~200ms
+	assert.Equal(t, uint64(3), cumulative[0.5])   // ~400ms
+}
+
+func TestHeaderLimits(t *testing.T) {
+	mgr := newTestManager(t)
+	mgr.SetHeaderLimits(4, 20)
+
+	enqueue := func(headers map[string]string) error {
+		_, err := mgr.Enqueue("test", []byte("job"), headers, 5, 0, DefaultRetryPolicy(), "")
+		return err
+	}
+	headers := func(n int) map[string]string {
+		h := make(map[string]string, n)
+		for i := 0; i < n; i++ {
+			h[fmt.Sprintf("k%d", i)] = "v"
+		}
+		return h
+	}
+
+	// Count boundary: each header here is 3 bytes
+	assert.NoError(t, enqueue(headers(4)))
+	assert.ErrorIs(t, enqueue(headers(5)), ErrHeadersTooLarge)
+
+	// Size boundary: keys and values add up to 20, then 21 bytes
+	assert.NoError(t, enqueue(map[string]string{"key": strings.Repeat("v", 17)}))
+	assert.ErrorIs(t, enqueue(map[string]string{"key": strings.Repeat("v", 18)}), ErrHeadersTooLarge)
+
+	// Default headers count toward the limits
+	require.NoError(t, mgr.SetDefaultHeaders("test", map[string]string{"tenant": "a"}))
+	assert.ErrorIs(t, enqueue(headers(4)), ErrHeadersTooLarge)
+	require.NoError(t, mgr.SetDefaultHeaders("test", nil))
+
+	// Without limits, the WAL format's uint16 counts and lengths still apply
+	mgr.SetHeaderLimits(0, 0)
+	assert.NoError(t, enqueue(map[string]string{"key": strings.Repeat("v", math.MaxUint16)}))
+	assert.ErrorIs(t, enqueue(map[string]string{"key": strings.Repeat("v", math.MaxUint16+1)}), ErrHeadersTooLarge)
+	assert.ErrorIs(t, enqueue(headers(math.MaxUint16+1)), ErrHeadersTooLarge)
+
+	ready, _, _, err := mgr.Stats("test")
+	require.NoError(t, err)
+	assert.Equal(t, 3, ready)
+}
+
+func TestQuiesceQueue(t *testing.T) {
+	mgr := newTestManager(t)
+
+	for i := 0; i < 2; i++ {
+		_, err := mgr.Enqueue("test", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+	}
+	jobs, err := mgr.Lease("test", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	job := jobs[0]
+
+	// Quiescing waits for the inflight job, and nothing more is leased meanwhile
+	done := make(chan error, 1)
+	go func() {
+		done <- mgr.QuiesceQueue(context.Background(), "test", 5*time.Second)
+	}()
+
+	require.Eventually(t, func() bool { return mgr.QueuePaused("test") }, time.Second, 5*time.Millisecond)
+	jobs, err = mgr.Lease("test", 1, 30000)
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
+
+	select {
+	case err := <-done:
+		t.Fatalf("quiesce returned before the inflight job was acked: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, mgr.Ack(job.ID, job.LeaseID))
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("quiesce did not return after the queue drained")
+	}
+	assert.True(t, mgr.QueuePaused("test"))
+
+	// Resuming hands out the remaining job
+	require.NoError(t, mgr.ResumeQueue("test"))
+	jobs, err = mgr.Lease("test", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+
+	// A job that is never settled makes the quiesce time out, still paused
+	err = mgr.QuiesceQueue(context.Background(), "test", 50*time.Millisecond)
+	assert.ErrorIs(t, err, ErrNotDrained)
+	assert.True(t, mgr.QueuePaused("test"))
+
+	_, err = mgr.Enqueue("test", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	job, _, _, err = mgr.Reserve("test", 1000)
+	require.NoError(t, err)
+	assert.Nil(t, job)
+
+	assert.Error(t, mgr.QuiesceQueue(context.Background(), "missing", time.Second))
+}
+
+func TestSentinelErrors(t *testing.T) {
+	mgr := newTestManager(t)
+
+	_, err := mgr.Lease("missing", 1, 1000)
+	assert.ErrorIs(t, err, ErrQueueNotFound)
+	_, _, _, err = mgr.Stats("missing")
+	assert.ErrorIs(t, err, ErrQueueNotFound)
+	_, _, _, err = mgr.Reserve("missing", 0)
+	assert.ErrorIs(t, err, ErrQueueNotFound)
+
+	assert.ErrorIs(t, mgr.Ack("no-such-job", "lease"), ErrJobNotFound)
+	assert.ErrorIs(t, mgr.Nack("no-such-job", "lease", "failed"), ErrJobNotFound)
+
+	_, err = mgr.Enqueue("sentinels", []byte("a"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	jobs, err := mgr.Lease("sentinels", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.ErrorIs(t, mgr.Ack(jobs[0].ID, "wrong-lease"), ErrInvalidLease)
+	assert.ErrorIs(t, mgr.Nack(jobs[0].ID, "wrong-lease", "failed"), ErrInvalidLease)
+
+	mgr.SetRateLimit("limited", 1, 0.001)
+	_, err = mgr.Enqueue("limited", []byte("a"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	_, err = mgr.Enqueue("limited", []byte("b"), nil, 5, 0, DefaultRetryPolicy(), "")
+	assert.ErrorIs(t, err, ErrRateLimited)
+
+	// A stopped manager refuses new work
+	dir := t.TempDir()
+	walInst, err := wal.New(wal.Config{Dir: dir + "/wal", SegmentSize: 1024})
+	require.NoError(t, err)
+	defer walInst.Close()
+	storeInst, err := store.New(dir + "/store")
+	require.NoError(t, err)
+	defer storeInst.Close()
+
+	stopped := NewManager(storeInst, walInst)
+	require.NoError(t, stopped.Start())
+	_, err = stopped.Enqueue("sentinels", []byte("a"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	require.NoError(t, stopped.Stop())
+
+	_, err = stopped.Enqueue("sentinels", []byte("b"), nil, 5, 0, DefaultRetryPolicy(), "")
+	assert.ErrorIs(t, err, ErrManagerClosed)
+	_, err = stopped.Lease("sentinels", 1, 1000)
+	assert.ErrorIs(t, err, ErrManagerClosed)
+	assert.ErrorIs(t, stopped.Ack("job", "lease"), ErrManagerClosed)
+}
+
+func TestMemoryPressureShedding(t *testing.T) {
+	mgr := newTestManager(t)
+
+	var inUse atomic.Uint64
+	inUse.Store(500)
+	mgr.mu.Lock()
+	mgr.memoryUsage = inUse.Load
+	mgr.mu.Unlock()
+
+	cfg := DefaultQueueConfig()
+	cfg.DLQEnabled = false
+	mgr.SetQueueConfig("shed-nodlq", cfg)
+
+	enqueue := func(queueName string, priority uint8) string {
+		id, err := mgr.Enqueue(queueName, []byte("job"), nil, priority, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+		time.Sleep(time.Millisecond) // Distinct enqueue times
+		return id
+	}
+	lowA := enqueue("shed-a", 1)
+	highA := enqueue("shed-a", 9)
+	midA := enqueue("shed-a", 2)
+	lowB := enqueue("shed-b", 1)
+	enqueue("shed-nodlq", 0)
+
+	dlqReasons := func(queueName string) map[string]string {
+		q := mgr.getQueue(queueName)
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		reasons := make(map[string]string)
+		for id, job := range q.dlq {
+			reasons[id] = job.DLQReason
+		}
+		return reasons
+	}
+	shedCount := func(queueName string, policy ShedPolicy) float64 {
+		var m dto.Metric
+		require.NoError(t, metrics.MemoryPressureShedTotal.WithLabelValues(queueName, string(policy)).(prometheus.Counter).Write(&m))
+		return m.GetCounter().GetValue()
+	}
+
+	shedA, shedB := shedCount("shed-a", ShedLowestPriority), shedCount("shed-b", ShedLowestPriority)
+	shedOldest := shedCount("shed-a", ShedOldest)
+
+	// Disabled, then below the ceiling: nothing is shed
+	assert.Equal(t, 0, mgr.checkMemoryPressure())
+	require.NoError(t, mgr.SetMemoryPressure(MemoryPressure{Ceiling: 1000, BatchSize: 2}))
+	assert.Equal(t, 0, mgr.checkMemoryPressure())
+
+	// At the ceiling the lowest priority jobs go first, skipping queues
+	// without a DLQ
+	inUse.Store(1000)
+	assert.Equal(t, 2, mgr.checkMemoryPressure())
+	assert.Equal(t, map[string]string{lowA: DLQReasonMemoryPressure}, dlqReasons("shed-a"))
+	assert.Equal(t, map[string]string{lowB: DLQReasonMemoryPressure}, dlqReasons("shed-b"))
+	assert.Empty(t, dlqReasons("shed-nodlq"))
+	assert.Equal(t, shedA+1, shedCount("shed-a", ShedLowestPriority))
+	assert.Equal(t, shedB+1, shedCount("shed-b", ShedLowestPriority))
+
+	ready, _, dlq, err := mgr.Stats("shed-a")
+	require.NoError(t, err)
+	assert.Equal(t, 2, ready)
+	assert.Equal(t, 1, dlq)
+
+	// Shed payloads are kept in the store, not in memory, and read back
+	// wherever the job is exposed
+	q := mgr.getQueue("shed-a")
+	q.mu.Lock()
+	assert.Nil(t, q.dlq[lowA].Payload)
+	q.mu.Unlock()
+	dead, err := mgr.GetDLQJob("shed-a", lowA)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("job"), dead.Payload)
+	got, err := mgr.GetJob("shed-a", lowA)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("job"), got.Payload)
+	listed, _, err := mgr.ListJobs("shed-a", JobStatusDLQ, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+	assert.Equal(t, []byte("job"), listed[0].Payload)
+
+	// A requeued job takes its payload back
+	require.NoError(t, mgr.RequeueDLQ("shed-b", lowB))
+	leased, err := mgr.Lease("shed-b", 1, 1000)
+	require.NoError(t, err)
+	require.Len(t, leased, 1)
+	assert.Equal(t, []byte("job"), leased[0].Payload)
+	value, err := mgr.store.Get(dlqPayloadKey("shed-b", lowB))
+	require.NoError(t, err)
+	assert.Nil(t, value)
+
+	// The oldest policy ignores priority
+	require.NoError(t, mgr.SetMemoryPressure(MemoryPressure{Ceiling: 1000, Policy: ShedOldest, BatchSize: 1}))
+	assert.Equal(t, 1, mgr.checkMemoryPressure())
+	assert.Equal(t, DLQReasonMemoryPressure, dlqReasons("shed-a")[highA])
+	assert.NotContains(t, dlqReasons("shed-a"), midA)
+	assert.Equal(t, shedOldest+1, shedCount("shed-a", ShedOldest))
+
+	assert.Error(t, mgr.SetMemoryPressure(MemoryPressure{Policy: "random"}))
+}
+
+func TestShedHeap(t *testing.T) {
+	// The heap keeps the same batch as sorting every candidate would
+	rng := rand.New(rand.NewSource(1))
+	base := time.Now()
+	var all []shedCandidate
+	for i := 0; i < 500; i++ {
+		all = append(all, shedCandidate{
+			priority:   uint8(rng.Intn(10)),
+			enqueuedAt: base.Add(time.Duration(rng.Intn(1000)) * time.Millisecond),
+		})
+	}
+
+	for _, policy := range []ShedPolicy{ShedLowestPriority, ShedOldest} {
+		victims := &shedHeap{policy: policy}
+		for _, c := range all {
+			victims.offer(c, 20)
+		}
+		require.Len(t, victims.candidates, 20)
+
+		sorted := append([]shedCandidate(nil), all...)
+		sort.SliceStable(sorted, func(i, j int) bool { return victims.shedsBefore(sorted[i], sorted[j]) })
+		worst := sorted[19]
+		for _, c := range victims.candidates {
+			assert.False(t, victims.shedsBefore(worst, c), "policy %s kept a candidate shed after the batch", policy)
+		}
+		for _, c := range sorted[20:] {
+			assert.False(t, victims.shedsBefore(c, worst), "policy %s dropped a candidate in the batch", policy)
+		}
+	}
+}
+
+func TestDumpJobsPages(t *testing.T) {
+	mgr := newTestManager(t)
+
+	specs := make([]EnqueueSpec, 2*DumpPageSize+1)
+	for i := range specs {
+		specs[i] = EnqueueSpec{Payload: []byte("job"), RetryPolicy: DefaultRetryPolicy()}
+	}
+	_, err := mgr.EnqueueBatch("dump", specs)
+	require.NoError(t, err)
+
+	// Pages are handed over without the queue locked, from a snapshot: jobs
+	// leased meanwhile are still dumped as ready
+	var pages []int
+	err = mgr.DumpJobs("dump", []JobStatus{JobStatusReady}, func(page []Job) error {
+		pages = append(pages, len(page))
+		for _, job := range page {
+			assert.Equal(t, JobStatusReady, job.Status)
+		}
+		if len(pages) == 1 {
+			jobs, err := mgr.Lease("dump", len(specs), 30000)
+			require.NoError(t, err)
+			require.Len(t, jobs, len(specs))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []int{DumpPageSize, DumpPageSize, 1}, pages)
+
+	// All states
+	jobs, err := mgr.SnapshotJobs("dump")
+	require.NoError(t, err)
+	assert.Len(t, jobs, len(specs))
+	for _, job := range jobs {
+		assert.Equal(t, JobStatusInflight, job.Status)
+	}
+
+	// An error from fn ends the dump
+	stop := errors.New("stop")
+	calls := 0
+	err = mgr.DumpJobs("dump", nil, func([]Job) error {
+		calls++
+		return stop
+	})
+	assert.ErrorIs(t, err, stop)
+	assert.Equal(t, 1, calls)
+
+	assert.ErrorIs(t, mgr.DumpJobs("missing", nil, func([]Job) error { return nil }), ErrQueueNotFound)
+}
+
+func TestDumpJobsSpilledSnapshot(t *testing.T) {
+	mgr := newTestManager(t)
+
+	cfg := DefaultQueueConfig()
+	cfg.MaxReadyInMemory = 3
+	mgr.SetQueueConfig("spill", cfg)
+
+	specs := make([]EnqueueSpec, DumpPageSize+10)
+	for i := range specs {
+		specs[i] = EnqueueSpec{Payload: []byte(fmt.Sprintf("job-%d", i)), RetryPolicy: DefaultRetryPolicy()}
+	}
+	_, err := mgr.EnqueueBatch("spill", specs)
+	require.NoError(t, err)
+
+	// Spilled jobs leased, and so deleted from the store, after the dump
+	// started are still read from its snapshot
+	var dumped []Job
+	err = mgr.DumpJobs("spill", []JobStatus{JobStatusReady}, func(page []Job) error {
+		if len(dumped) == 0 {
+			jobs, err := mgr.Lease("spill", len(specs), 30000)
+			require.NoError(t, err)
+			require.Len(t, jobs, len(specs))
+		}
+		dumped = append(dumped, page...)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, dumped, len(specs))
+	for _, job := range dumped {
+		assert.Equal(t, JobStatusReady, job.Status)
+		assert.Contains(t, string(job.Payload), "job-")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	mgr := newTestManager(t)
+	require.NoError(t, mgr.SetVisibilityLimits(VisibilityLimits{MinMs: 1}))
+
+	_, err := mgr.Enqueue("heartbeat", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	jobs, err := mgr.Lease("heartbeat", 1, 50)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	job := jobs[0]
+
+	// Renewed past its original deadline, the job is not redelivered
+	deadline, err := mgr.Heartbeat(job.ID, job.LeaseID, 30000)
+	require.NoError(t, err)
+	assert.True(t, deadline.After(time.Now().Add(20*time.Second)))
+	time.Sleep(60 * time.Millisecond)
+	mgr.checkLeaseTimeouts()
+	_, inflight, _, err := mgr.Stats("heartbeat")
+	require.NoError(t, err)
+	assert.Equal(t, 1, inflight)
+	require.NoError(t, mgr.Ack(job.ID, job.LeaseID))
+
+	_, err = mgr.Heartbeat(job.ID, job.LeaseID, 30000)
+	assert.ErrorIs(t, err, ErrJobNotFound)
+
+	// Once the lease expired it cannot be renewed
+	_, err = mgr.Enqueue("heartbeat", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	jobs, err = mgr.Lease("heartbeat", 1, 10)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	jobID, leaseID := jobs[0].ID, jobs[0].LeaseID
+	time.Sleep(20 * time.Millisecond)
+	mgr.checkLeaseTimeouts()
+	_, err = mgr.Heartbeat(jobID, leaseID, 30000)
+	assert.ErrorIs(t, err, ErrLeaseExpired)
+}
+
+func TestExtendLease(t *testing.T) {
+	mgr := newTestManager(t)
+	require.NoError(t, mgr.SetVisibilityLimits(VisibilityLimits{MinMs: 1, MaxMs: 60000}))
+
+	_, err := mgr.Enqueue("extend", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	jobs, err := mgr.Lease("extend", 1, 50)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	job := jobs[0]
+
+	assert.ErrorIs(t, mgr.ExtendLease(job.ID, job.LeaseID, 0), ErrVisibilityOutOfRange)
+	assert.ErrorIs(t, mgr.ExtendLease(job.ID, "other-lease", 1000), ErrInvalidLease)
+
+	// Extended past its original deadline, the job is not redelivered
+	require.NoError(t, mgr.ExtendLease(job.ID, job.LeaseID, 30000))
+	time.Sleep(60 * time.Millisecond)
+	mgr.checkLeaseTimeouts()
+	_, inflight, _, err := mgr.Stats("extend")
+	require.NoError(t, err)
+	assert.Equal(t, 1, inflight)
+
+	found, err := mgr.GetJob("extend", job.ID)
+	require.NoError(t, err)
+	assert.Equal(t, job.Tries, found.Tries, "extending does not count as a try")
+
+	// The time left is capped at the maximum visibility
+	require.NoError(t, mgr.ExtendLease(job.ID, job.LeaseID, 120000))
+	found, err = mgr.GetJob("extend", job.ID)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), found.LeaseDeadline, time.Second)
+	require.NoError(t, mgr.Ack(job.ID, job.LeaseID))
+
+	// Once the lease expired and the job was requeued it cannot be extended
+	_, err = mgr.Enqueue("extend", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	jobs, err = mgr.Lease("extend", 1, 10)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	jobID, leaseID := jobs[0].ID, jobs[0].LeaseID
+	time.Sleep(20 * time.Millisecond)
+	mgr.checkLeaseTimeouts()
+	assert.ErrorIs(t, mgr.ExtendLease(jobID, leaseID, 30000), ErrLeaseExpired)
+
+	// Nor once it is past its deadline, before it is requeued
+	jobs, err = mgr.LeaseWithOptions(context.Background(), "extend", 1, 10, LeaseOptions{Wait: 2 * time.Second})
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	time.Sleep(20 * time.Millisecond)
+	assert.ErrorIs(t, mgr.ExtendLease(jobs[0].ID, jobs[0].LeaseID, 30000), ErrLeaseExpired)
+}
+
+func TestNamespaces(t *testing.T) {
+	dir := t.TempDir()
+
+	open := func() (*Manager, func()) {
+		walInst, err := wal.New(wal.Config{Dir: dir + "/wal", SegmentSize: 1024, Fsync: false})
+		require.NoError(t, err)
+		storeInst, err := store.New(dir + "/store")
+		require.NoError(t, err)
+
+		mgr := NewManager(storeInst, walInst)
+		require.NoError(t, mgr.Start())
+		return mgr, func() {
+			mgr.Stop()
+			walInst.Close()
+			storeInst.Close()
+		}
+	}
+
+	mgr, closeMgr := open()
+
+	acme, err := NamespacedQueue("acme", "emails")
+	require.NoError(t, err)
+	globex, err := NamespacedQueue("globex", "emails")
+	require.NoError(t, err)
+	namespace, name := SplitQueueName(acme)
+	assert.Equal(t, "acme", namespace)
+	assert.Equal(t, "emails", name)
+	_, err = NamespacedQueue("a:b", "emails")
+	assert.ErrorIs(t, err, ErrInvalidNamespace)
+
+	// Identically named queues, and the same idempotency key, don't collide
+	acmeID, err := mgr.Enqueue(acme, []byte("acme"), nil, 5, 0, DefaultRetryPolicy(), "welcome")
+	require.NoError(t, err)
+	globexID, err := mgr.Enqueue(globex, []byte("globex"), nil, 5, 0, DefaultRetryPolicy(), "welcome")
+	require.NoError(t, err)
+	assert.NotEqual(t, acmeID, globexID)
+	_, err = mgr.Enqueue(acme, []byte("acme"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	_, err = mgr.Enqueue("emails", []byte("shared"), nil, 5, 0, DefaultRetryPolicy(), "welcome")
+	require.NoError(t, err)
+
+	jobs, err := mgr.Lease(acme, 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, "acme", string(jobs[0].Payload))
+	jobs, err = mgr.Lease(globex, 10, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, globexID, jobs[0].ID)
+
+	// Purging one tenant leaves the other, and queues outside namespaces, intact
+	purged, err := mgr.PurgeNamespace("acme")
+	require.NoError(t, err)
+	assert.Equal(t, 2, purged)
+
+	_, _, _, err = mgr.Stats(acme)
+	assert.ErrorIs(t, err, ErrQueueNotFound)
+	_, inflight, _, err := mgr.Stats(globex)
+	require.NoError(t, err)
+	assert.Equal(t, 1, inflight)
+	ready, _, _, err := mgr.Stats("emails")
+	require.NoError(t, err)
+	assert.Equal(t, 1, ready)
+
+	// The purged tenant's idempotency keys are released, the others' are not
+	id, err := mgr.Enqueue(acme, []byte("acme"), nil, 5, 0, DefaultRetryPolicy(), "welcome")
+	require.NoError(t, err)
+	assert.NotEqual(t, acmeID, id)
+	id, err = mgr.Enqueue(globex, []byte("globex"), nil, 5, 0, DefaultRetryPolicy(), "welcome")
+	require.NoError(t, err)
+	assert.Equal(t, globexID, id)
+
+	_, err = mgr.PurgeNamespace("")
+	assert.ErrorIs(t, err, ErrInvalidNamespace)
+
+	// Purged jobs stay purged after a restart
+	closeMgr()
+	mgr, closeMgr = open()
+	defer closeMgr()
+
+	ready, _, _, err = mgr.Stats(acme)
+	require.NoError(t, err)
+	assert.Equal(t, 1, ready)
+	_, inflight, _, err = mgr.Stats(globex)
+	require.NoError(t, err)
+	assert.Equal(t, 1, inflight)
+}
+
+func TestRequestIDsAcrossNamespaces(t *testing.T) {
+	mgr := newTestManager(t)
+
+	// Queue "a:b" with request "c" and queue "a" with request "b:c" differ
+	namespacedID, err := mgr.EnqueueWithOptions("a:b", []byte("namespaced"), EnqueueOptions{Priority: 5, RetryPolicy: DefaultRetryPolicy(), RequestID: "c"})
+	require.NoError(t, err)
+	plainID, err := mgr.EnqueueWithOptions("a", []byte("plain"), EnqueueOptions{Priority: 5, RetryPolicy: DefaultRetryPolicy(), RequestID: "b:c"})
+	require.NoError(t, err)
+	assert.NotEqual(t, namespacedID, plainID)
+
+	// Purging namespace "a" forgets only its own queues' request IDs
+	_, err = mgr.PurgeNamespace("a")
+	require.NoError(t, err)
+	id, err := mgr.EnqueueWithOptions("a", []byte("plain"), EnqueueOptions{Priority: 5, RetryPolicy: DefaultRetryPolicy(), RequestID: "b:c"})
+	require.NoError(t, err)
+	assert.Equal(t, plainID, id)
+	id, err = mgr.EnqueueWithOptions("a:b", []byte("namespaced"), EnqueueOptions{Priority: 5, RetryPolicy: DefaultRetryPolicy(), RequestID: "c"})
+	require.NoError(t, err)
+	assert.NotEqual(t, namespacedID, id)
+}
+
+func TestListJobs(t *testing.T) {
+	mgr := newTestManager(t)
+
+	var ids []string
+	for _, priority := range []uint8{1, 9, 5, 9, 5} {
+		id, err := mgr.Enqueue("test", []byte("job"), nil, priority, 0, RetryPolicy{MaxRetries: 1}, "")
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	delayedID, err := mgr.Enqueue("test", []byte("later"), nil, 9, 60000, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	listIDs := func(state JobStatus, offset, limit int) ([]string, int) {
+		jobs, total, err := mgr.ListJobs("test", state, offset, limit)
+		require.NoError(t, err)
+		var got []string
+		for _, job := range jobs {
+			assert.Equal(t, state, job.Status)
+			got = append(got, job.ID)
+		}
+		return got, total
+	}
+
+	// Ready jobs page by priority, then ETA, then enqueue order
+	byPriority := []string{ids[1], ids[3], delayedID, ids[2], ids[4], ids[0]}
+	page, total := listIDs(JobStatusReady, 0, 4)
+	assert.Equal(t, byPriority[:4], page)
+	assert.Equal(t, 6, total)
+	page, total = listIDs(JobStatusReady, 4, 4)
+	assert.Equal(t, byPriority[4:], page)
+	assert.Equal(t, 6, total)
+	page, total = listIDs(JobStatusReady, 10, 4)
+	assert.Empty(t, page)
+	assert.Equal(t, 6, total)
+
+	// Listing leaves the queue untouched, and copies the jobs
+	jobs, _, err := mgr.ListJobs("test", JobStatusReady, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, jobs, 6)
+	jobs[0].Priority = 0
+	leased, err := mgr.Lease("test", 2, 30000)
+	require.NoError(t, err)
+	require.Len(t, leased, 2)
+	assert.Equal(t, ids[1], leased[0].ID)
+	assert.Equal(t, ids[3], leased[1].ID)
+	require.NoError(t, mgr.NackPermanent(leased[1].ID, leased[1].LeaseID, "bad"))
+
+	// Other states page in enqueue order
+	page, total = listIDs(JobStatusInflight, 0, 10)
+	assert.Equal(t, []string{ids[1]}, page)
+	assert.Equal(t, 1, total)
+	page, total = listIDs(JobStatusDLQ, 0, 10)
+	assert.Equal(t, []string{ids[3]}, page)
+	assert.Equal(t, 1, total)
+
+	// FIFO queues list ready jobs in enqueue order
+	require.NoError(t, mgr.SetQueueMode("test", QueueModeFIFO))
+	page, _ = listIDs(JobStatusReady, 0, 10)
+	assert.Equal(t, []string{ids[0], ids[2], ids[4], delayedID}, page)
+
+	_, _, err = mgr.ListJobs("test", "consumed", 0, 10)
+	assert.ErrorIs(t, err, ErrInvalidJobState)
+	_, _, err = mgr.ListJobs("missing", JobStatusReady, 0, 10)
+	assert.ErrorIs(t, err, ErrQueueNotFound)
+
+	// Ready jobs are listed by their priority after demotion, as leased
+	cfg := DefaultQueueConfig()
+	cfg.PriorityDemotionStep = 5
+	mgr.SetQueueConfig("demoted", cfg)
+	failingID, err := mgr.Enqueue("demoted", []byte("failing"), nil, 9, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	failing := leaseEventually(t, mgr, "demoted")
+	require.NoError(t, mgr.Nack(failingID, failing[0].LeaseID, "boom"))
+	freshID, err := mgr.Enqueue("demoted", []byte("fresh"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	jobs, _, err = mgr.ListJobs("demoted", JobStatusReady, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, jobs, 2)
+	assert.Equal(t, freshID, jobs[0].ID)
+	assert.Equal(t, failingID, jobs[1].ID)
+}
+
+func TestSubscribe(t *testing.T) {
+	mgr := newTestManager(t)
+	mgr.SetMaxSubscribers(2)
+
+	_, err := mgr.Subscribe("test")
+	assert.ErrorIs(t, err, ErrQueueNotFound)
+	mgr.CreateQueue("test", DefaultQueueConfig())
+
+	first, err := mgr.Subscribe("test")
+	require.NoError(t, err)
+	second, err := mgr.Subscribe("test")
+	require.NoError(t, err)
+	_, err = mgr.Subscribe("test")
+	assert.ErrorIs(t, err, ErrTooManySubscribers)
+	assert.Equal(t, 2, mgr.Subscribers("test"))
+
+	// Releasing twice frees one slot only
+	first()
+	first()
+	assert.Equal(t, 1, mgr.Subscribers("test"))
+	third, err := mgr.Subscribe("test")
+	require.NoError(t, err)
+	_, err = mgr.Subscribe("test")
+	assert.ErrorIs(t, err, ErrTooManySubscribers)
+
+	// A full queue turns waiting leases away, but not those that need not wait
+	_, err = mgr.LeaseWithOptions(context.Background(), "test", 1, 30000, LeaseOptions{Wait: time.Second})
+	assert.ErrorIs(t, err, ErrTooManySubscribers)
+	jobs, err := mgr.LeaseWithOptions(context.Background(), "test", 1, 30000, LeaseOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
+
+	second()
+	third()
+	assert.Equal(t, 0, mgr.Subscribers("test"))
+
+	// A wait that ends, however it ends, unregisters
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = mgr.LeaseWithOptions(ctx, "test", 1, 30000, LeaseOptions{Wait: time.Second})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 0, mgr.Subscribers("test"))
+
+	// Releasing after the queue is deleted is harmless
+	release, err := mgr.Subscribe("test")
+	require.NoError(t, err)
+	require.NoError(t, mgr.DeleteQueue("test", false))
+	release()
+	assert.Equal(t, 0, mgr.Subscribers("test"))
+}
+
+func TestDeleteQueue(t *testing.T) {
+	dir := t.TempDir()
+
+	open := func() (*Manager, func()) {
+		walInst, err := wal.New(wal.Config{Dir: dir + "/wal", SegmentSize: 1024, Fsync: false})
+		require.NoError(t, err)
+		storeInst, err := store.New(dir + "/store")
+		require.NoError(t, err)
+
+		mgr := NewManager(storeInst, walInst)
+		require.NoError(t, mgr.Start())
+		return mgr, func() {
+			mgr.Stop()
+			walInst.Close()
+			storeInst.Close()
+		}
+	}
+
+	mgr, closeMgr := open()
+
+	for i := 0; i < 3; i++ {
+		_, err := mgr.Enqueue("doomed", []byte("job"), nil, 5, 0, RetryPolicy{MaxRetries: 1}, "")
+		require.NoError(t, err)
+	}
+	keptID, err := mgr.Enqueue("kept", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	jobs, err := mgr.Lease("doomed", 2, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 2)
+	require.NoError(t, mgr.NackPermanent(jobs[0].ID, jobs[0].LeaseID, "bad"))
+	leased := jobs[1]
+
+	// A leased job keeps the queue from being deleted unless forced
+	assert.ErrorIs(t, mgr.DeleteQueue("doomed", false), ErrQueueBusy)
+	require.NoError(t, mgr.DeleteQueue("doomed", true))
+	assert.ErrorIs(t, mgr.DeleteQueue("doomed", true), ErrQueueNotFound)
+	assert.Equal(t, []string{"kept"}, mgr.ListQueues())
+
+	_, _, _, err = mgr.Stats("doomed")
+	assert.ErrorIs(t, err, ErrQueueNotFound)
+	_, err = mgr.Lease("doomed", 1, 30000)
+	assert.ErrorIs(t, err, ErrQueueNotFound)
+	assert.ErrorIs(t, mgr.Ack(leased.ID, leased.LeaseID), ErrJobNotFound)
+
+	// An idle queue needs no force
+	_, err = mgr.Enqueue("idle", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	require.NoError(t, mgr.DeleteQueue("idle", false))
+
+	// Enqueuing again creates the queue anew
+	recreatedID, err := mgr.Enqueue("doomed", []byte("again"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	// Deleting a queue forgets its request IDs, not those of the queues in
+	// the namespace of the same name
+	tenantID, err := mgr.EnqueueWithOptions("idle:jobs", []byte("job"), EnqueueOptions{Priority: 5, RetryPolicy: DefaultRetryPolicy(), RequestID: "req"})
+	require.NoError(t, err)
+	_, err = mgr.EnqueueWithOptions("idle", []byte("job"), EnqueueOptions{Priority: 5, RetryPolicy: DefaultRetryPolicy(), RequestID: "req"})
+	require.NoError(t, err)
+	require.NoError(t, mgr.DeleteQueue("idle", false))
+	id, err := mgr.EnqueueWithOptions("idle:jobs", []byte("job"), EnqueueOptions{Priority: 5, RetryPolicy: DefaultRetryPolicy(), RequestID: "req"})
+	require.NoError(t, err)
+	assert.Equal(t, tenantID, id)
+	require.NoError(t, mgr.DeleteQueue("idle:jobs", false))
+
+	// Deleted queues stay deleted after a restart, and only the job enqueued
+	// since comes back in the recreated one
+	closeMgr()
+	mgr, closeMgr = open()
+	defer closeMgr()
+
+	assert.ElementsMatch(t, []string{"doomed", "kept"}, mgr.ListQueues())
+	ready, inflight, dlq, err := mgr.Stats("doomed")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 0, 0}, []int{ready, inflight, dlq})
+	job, err := mgr.GetJob("doomed", recreatedID)
+	require.NoError(t, err)
+	assert.Equal(t, "again", string(job.Payload))
+	_, err = mgr.GetJob("kept", keptID)
+	require.NoError(t, err)
+}
+
+func TestDeleteQueueConcurrentEnqueue(t *testing.T) {
+	mgr := newTestManager(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_, err := mgr.Enqueue("churn", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+				assert.NoError(t, err)
+				_, err = mgr.Enqueue("other", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if err := mgr.DeleteQueue("churn", true); err != nil {
+			assert.ErrorIs(t, err, ErrQueueNotFound)
+		}
+	}
+	wg.Wait()
+
+	ready, _, _, err := mgr.Stats("other")
+	require.NoError(t, err)
+	assert.Equal(t, 200, ready)
+}
+
+func TestReconcile(t *testing.T) {
+	mgr := newTestManager(t)
+
+	enqueueAndNack := func() *Job {
+		_, err := mgr.Enqueue("reconcile", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+		jobs, err := mgr.Lease("reconcile", 1, 30000)
+		require.NoError(t, err)
+		require.Len(t, jobs, 1)
+		require.NoError(t, mgr.Nack(jobs[0].ID, jobs[0].LeaseID, "boom"))
+		return jobs[0]
+	}
+
+	// A nacked job gets history, but none of its state: the first pass
+	// fills it in and the next finds nothing to do
+	stale := enqueueAndNack()
+	report, err := mgr.Reconcile()
+	require.NoError(t, err)
+	assert.Equal(t, ReconcileReport{Checked: 1, Stale: 1}, report)
+	report, err = mgr.Reconcile()
+	require.NoError(t, err)
+	assert.Zero(t, report.Discrepancies())
+
+	// Introduce drift: metadata of a job that is gone, metadata out of date,
+	// and a retried job whose metadata was lost
+	require.NoError(t, mgr.store.SetJob("gone", &store.JobMetadata{JobID: "gone", Queue: "reconcile", Status: "inflight"}))
+	meta, err := mgr.store.GetJob(stale.ID)
+	require.NoError(t, err)
+	meta.Status, meta.Tries = "dlq", 7
+	require.NoError(t, mgr.store.SetJob(stale.ID, meta))
+	missing := enqueueAndNack()
+	require.NoError(t, mgr.store.DeleteJob(missing.ID))
+
+	var before dto.Metric
+	require.NoError(t, metrics.ReconcileDiscrepancies.WithLabelValues("orphaned").(prometheus.Counter).Write(&before))
+
+	report, err = mgr.Reconcile()
+	require.NoError(t, err)
+	assert.Equal(t, ReconcileReport{Checked: 2, Orphaned: 1, Stale: 1, Missing: 1}, report)
+
+	var after dto.Metric
+	require.NoError(t, metrics.ReconcileDiscrepancies.WithLabelValues("orphaned").(prometheus.Counter).Write(&after))
+	assert.Equal(t, before.GetCounter().GetValue()+1, after.GetCounter().GetValue())
+
+	gone, err := mgr.store.GetJob("gone")
+	require.NoError(t, err)
+	assert.Nil(t, gone)
+
+	meta, err = mgr.store.GetJob(stale.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "ready", meta.Status)
+	assert.Equal(t, uint32(1), meta.Tries)
+	assert.Len(t, meta.History, 1) // History survives the rewrite
+
+	meta, err = mgr.store.GetJob(missing.ID)
+	require.NoError(t, err)
+	require.NotNil(t, meta)
+	assert.Equal(t, "reconcile", meta.Queue)
+	assert.Equal(t, uint32(1), meta.Tries)
+
+	report, err = mgr.Reconcile()
+	require.NoError(t, err)
+	assert.Zero(t, report.Discrepancies())
+}
+
+func TestReconcileDuringNack(t *testing.T) {
+	mgr := newTestManager(t)
+
+	_, err := mgr.Enqueue("reconcile", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	jobs, err := mgr.Lease("reconcile", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+
+	// The job is nacked for the first time after the pass took its snapshot
+	defer func(orig func()) { reconcileSnapshotTaken = orig }(reconcileSnapshotTaken)
+	reconcileSnapshotTaken = func() {
+		require.NoError(t, mgr.Nack(jobs[0].ID, jobs[0].LeaseID, "boom"))
+	}
+
+	report, err := mgr.Reconcile()
+	require.NoError(t, err)
+	assert.Zero(t, report.Orphaned)
+
+	meta, err := mgr.store.GetJob(jobs[0].ID)
+	require.NoError(t, err)
+	require.NotNil(t, meta, "history of a live job must survive the pass")
+	assert.Equal(t, uint32(1), meta.Tries)
+	assert.Len(t, meta.History, 1)
+}
+
+func TestGetJob(t *testing.T) {
+	mgr := newTestManager(t)
+
+	readyID, err := mgr.Enqueue("inspect", []byte("ready"), map[string]string{"kind": "ready"}, 3, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	delayedID, err := mgr.Enqueue("inspect", []byte("delayed"), nil, 5, 60000, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	job, err := mgr.GetJob("inspect", readyID)
+	require.NoError(t, err)
+	assert.Equal(t, JobStatusReady, job.Status)
+	assert.Equal(t, uint8(3), job.Priority)
+	assert.Equal(t, []byte("ready"), job.Payload)
+	assert.False(t, job.EnqueuedAt.IsZero())
+
+	job, err = mgr.GetJob("inspect", delayedID)
+	require.NoError(t, err)
+	assert.Equal(t, JobStatusReady, job.Status)
+	assert.True(t, job.ETA.After(time.Now()))
+
+	// The returned job is a copy: changing it leaves the queued job alone
+	job, err = mgr.GetJob("inspect", readyID)
+	require.NoError(t, err)
+	job.Payload[0] = 'X'
+	job.Headers["kind"] = "changed"
+	job.Priority = 9
+
+	leased, err := mgr.Lease("inspect", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, leased, 1)
+	assert.Equal(t, readyID, leased[0].ID)
+	assert.Equal(t, []byte("ready"), leased[0].Payload)
+	assert.Equal(t, "ready", leased[0].Headers["kind"])
+
+	job, err = mgr.GetJob("inspect", readyID)
+	require.NoError(t, err)
+	assert.Equal(t, JobStatusInflight, job.Status)
+	assert.Equal(t, uint32(0), job.Tries)
+	assert.False(t, job.LeaseDeadline.IsZero())
+
+	badID, err := mgr.Enqueue("inspect", []byte("bad"), map[string]string{"version": "bad"}, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	moved, err := mgr.MoveToDLQ("inspect", HeaderFilter{"version": "bad"})
+	require.NoError(t, err)
+	require.Equal(t, 1, moved)
+	job, err = mgr.GetJob("inspect", badID)
+	require.NoError(t, err)
+	assert.Equal(t, JobStatusDLQ, job.Status)
+
+	// Acked jobs are gone
+	require.NoError(t, mgr.Ack(leased[0].ID, leased[0].LeaseID))
+	_, err = mgr.GetJob("inspect", readyID)
+	assert.ErrorIs(t, err, ErrJobNotFound)
+
+	_, err = mgr.GetJob("missing", readyID)
+	assert.ErrorIs(t, err, ErrQueueNotFound)
+}
+
+func TestPurgeDLQ(t *testing.T) {
+	dir := t.TempDir()
+
+	open := func() (*Manager, func()) {
+		walInst, err := wal.New(wal.Config{Dir: dir + "/wal", SegmentSize: 1024 * 1024, Fsync: false})
+		require.NoError(t, err)
+		storeInst, err := store.New(dir + "/store")
+		require.NoError(t, err)
+
+		mgr := NewManager(storeInst, walInst)
+		require.NoError(t, mgr.Start())
+		return mgr, func() {
+			mgr.Stop()
+			walInst.Close()
+			storeInst.Close()
+		}
+	}
+
+	mgr, closeMgr := open()
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := mgr.Enqueue("purge", []byte("bad"), map[string]string{"version": "bad"}, 5, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	_, err := mgr.Enqueue("purge", []byte("good"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	moved, err := mgr.MoveToDLQ("purge", HeaderFilter{"version": "bad"})
+	require.NoError(t, err)
+	require.Equal(t, 3, moved)
+
+	// Only jobs dead-lettered before the cutoff are purged
+	q := mgr.getQueue("purge")
+	q.mu.Lock()
+	q.dlq[ids[0]].DLQAt = time.Now().Add(-time.Hour)
+	q.mu.Unlock()
+
+	purged, err := mgr.PurgeDLQ("purge", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	_, err = mgr.GetJob("purge", ids[0])
+	assert.ErrorIs(t, err, ErrJobNotFound)
+
+	purged, err = mgr.PurgeDLQ("purge", 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, purged)
+
+	purged, err = mgr.PurgeDLQ("purge", 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, purged)
+
+	_, err = mgr.PurgeDLQ("missing", 0)
+	assert.ErrorIs(t, err, ErrQueueNotFound)
+
+	check := func(mgr *Manager) {
+		ready, inflight, dlq, err := mgr.Stats("purge")
+		require.NoError(t, err)
+		assert.Equal(t, 1, ready)
+		assert.Equal(t, 0, inflight)
+		assert.Equal(t, 0, dlq)
+	}
+	check(mgr)
+	closeMgr()
+
+	// Purged jobs stay purged across a restart
+	mgr, closeMgr = open()
+	defer closeMgr()
+	check(mgr)
+}
+
+func TestRequeueDLQ(t *testing.T) {
+	dir := t.TempDir()
+
+	open := func() (*Manager, func()) {
+		walInst, err := wal.New(wal.Config{Dir: dir + "/wal", SegmentSize: 1024 * 1024, Fsync: false})
+		require.NoError(t, err)
+		storeInst, err := store.New(dir + "/store")
+		require.NoError(t, err)
+
+		mgr := NewManager(storeInst, walInst)
+		require.NoError(t, mgr.Start())
+		return mgr, func() {
+			mgr.Stop()
+			walInst.Close()
+			storeInst.Close()
+		}
+	}
+
+	mgr, closeMgr := open()
+
+	nacked, err := mgr.Enqueue("replay", []byte("nacked"), nil, 5, 0, RetryPolicy{MaxRetries: 2}, "")
+	require.NoError(t, err)
+	jobs, err := mgr.Lease("replay", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	require.NoError(t, mgr.NackPermanent(nacked, jobs[0].LeaseID, "downstream down"))
+
+	var moved []string
+	for i := 0; i < 2; i++ {
+		id, err := mgr.Enqueue("replay", []byte("moved"), map[string]string{"version": "bad"}, 5, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+		moved = append(moved, id)
+	}
+	_, err = mgr.MoveToDLQ("replay", HeaderFilter{"version": "bad"})
+	require.NoError(t, err)
+
+	_, _, dlq, err := mgr.Stats("replay")
+	require.NoError(t, err)
+	require.Equal(t, 3, dlq)
+
+	require.NoError(t, mgr.RequeueDLQ("replay", nacked))
+	job, err := mgr.GetJob("replay", nacked)
+	require.NoError(t, err)
+	assert.Equal(t, JobStatusReady, job.Status)
+	assert.Equal(t, uint32(0), job.Tries)
+	assert.Empty(t, job.DLQReason)
+	assert.False(t, job.ETA.After(time.Now()))
+
+	// Only DLQ jobs can be requeued
+	err = mgr.RequeueDLQ("replay", nacked)
+	assert.ErrorIs(t, err, ErrJobNotFound)
+	err = mgr.RequeueDLQ("missing", nacked)
+	assert.ErrorIs(t, err, ErrQueueNotFound)
+
+	requeued, err := mgr.RequeueAllDLQ("replay")
+	require.NoError(t, err)
+	assert.Equal(t, 2, requeued)
+
+	check := func(mgr *Manager) {
+		ready, inflight, dlq, err := mgr.Stats("replay")
+		require.NoError(t, err)
+		assert.Equal(t, 3, ready)
+		assert.Equal(t, 0, inflight)
+		assert.Equal(t, 0, dlq)
+
+		job, err := mgr.GetJob("replay", nacked)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(0), job.Tries)
+	}
+	check(mgr)
+	closeMgr()
+
+	// Replay reflects the requeue, not the DLQ
+	mgr, closeMgr = open()
+	defer closeMgr()
+	check(mgr)
+
+	// With its tries reset, the job gets its retry again
+	jobs, err = mgr.LeaseWithOptions(context.Background(), "replay", 3, 30000, LeaseOptions{Ordering: OrderingFIFO})
+	require.NoError(t, err)
+	require.Len(t, jobs, 3)
+	for _, job := range jobs {
+		if job.ID == nacked {
+			require.NoError(t, mgr.Nack(job.ID, job.LeaseID, "again"))
+		}
+	}
+	job, err = mgr.GetJob("replay", nacked)
+	require.NoError(t, err)
+	assert.Equal(t, JobStatusReady, job.Status)
+}
+
+func TestMaxInflightBytes(t *testing.T) {
+	mgr := newTestManager(t)
+
+	cfg := DefaultQueueConfig()
+	cfg.MaxInflightBytes = 250
+	mgr.SetQueueConfig("big", cfg)
+
+	payload := bytes.Repeat([]byte("x"), 100)
+	for i := 0; i < 4; i++ {
+		_, err := mgr.Enqueue("big", payload, nil, 5, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+	}
+
+	// Two 100-byte jobs fit under the cap, a third would not
+	jobs, err := mgr.Lease("big", 4, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 2)
+	jobs2, err := mgr.Lease("big", 1, 30000)
+	require.NoError(t, err)
+	assert.Empty(t, jobs2)
+
+	// Settling a job makes room for another
+	require.NoError(t, mgr.Ack(jobs[0].ID, jobs[0].LeaseID))
+	jobs2, err = mgr.Lease("big", 4, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs2, 1)
+
+	require.NoError(t, mgr.Nack(jobs[1].ID, jobs[1].LeaseID, "boom"))
+	require.NoError(t, mgr.Ack(jobs2[0].ID, jobs2[0].LeaseID))
+	q := mgr.getQueue("big")
+	q.mu.RLock()
+	assert.Equal(t, int64(0), q.inflightBytes)
+	q.mu.RUnlock()
+
+	// A job larger than the cap is still leased when nothing else is inflight
+	_, err = mgr.Enqueue("huge", bytes.Repeat([]byte("x"), 500), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	cfg.MaxInflightBytes = 100
+	mgr.SetQueueConfig("huge", cfg)
+	jobs, err = mgr.Lease("huge", 1, 30000)
+	require.NoError(t, err)
+	assert.Len(t, jobs, 1)
+}
+
+func TestJobRetryPolicyBackoff(t *testing.T) {
+	dir := t.TempDir()
+
+	open := func() (*Manager, func()) {
+		walInst, err := wal.New(wal.Config{Dir: dir + "/wal", SegmentSize: 1024 * 1024, Fsync: false})
+		require.NoError(t, err)
+		storeInst, err := store.New(dir + "/store")
+		require.NoError(t, err)
+
+		mgr := NewManager(storeInst, walInst)
+		require.NoError(t, mgr.Start())
+		return mgr, func() {
+			mgr.Stop()
+			walInst.Close()
+			storeInst.Close()
+		}
+	}
+
+	// Delays are checked against jitter of up to 10%
+	within := func(t *testing.T, want time.Duration, eta time.Time) {
+		delay := time.Until(eta)
+		assert.InDelta(t, want.Seconds(), delay.Seconds(), want.Seconds()*0.1+0.5, "delay %s", delay)
+	}
+
+	nackNow := func(mgr *Manager, jobID string) *Job {
+		queue := mgr.getQueue("policy")
+		queue.mu.Lock()
+		job := queue.ready.Remove(jobID)
+		job.ETA = time.Now()
+		queue.ready.Push(job)
+		queue.mu.Unlock()
+
+		jobs, err := mgr.Lease("policy", 1, 30000)
+		require.NoError(t, err)
+		require.Len(t, jobs, 1)
+		require.NoError(t, mgr.Nack(jobID, jobs[0].LeaseID, "boom"))
+
+		job, err = mgr.GetJob("policy", jobID)
+		require.NoError(t, err)
+		return job
+	}
+
+	mgr, closeMgr := open()
+
+	policy := RetryPolicy{MaxRetries: 5, BaseDelay: 5 * time.Second, MaxDelay: time.Minute, Multiplier: 3}
+	jobID, err := mgr.Enqueue("policy", []byte("job"), nil, 5, 0, policy, "")
+	require.NoError(t, err)
+
+	job := nackNow(mgr, jobID)
+	within(t, 5*time.Second, job.ETA)
+	job = nackNow(mgr, jobID)
+	within(t, 15*time.Second, job.ETA)
+	closeMgr()
+
+	// The policy survives a restart
+	mgr, closeMgr = open()
+	defer closeMgr()
+
+	job, err = mgr.GetJob("policy", jobID)
+	require.NoError(t, err)
+	assert.Equal(t, policy.BaseDelay, job.BaseDelay)
+	assert.Equal(t, policy.MaxDelay, job.MaxDelay)
+	assert.Equal(t, policy.Multiplier, job.Multiplier)
+
+	for i := 0; i < 3; i++ {
+		job = nackNow(mgr, jobID)
+		want := time.Duration(float64(policy.BaseDelay) * math.Pow(policy.Multiplier, float64(job.Tries-1)))
+		if want > policy.MaxDelay {
+			want = policy.MaxDelay
+		}
+		within(t, want, job.ETA)
+	}
+}
+
+func TestProvidedJobID(t *testing.T) {
+	mgr := newTestManager(t)
+
+	enqueue := func(queueName, jobID, payload string) (string, error) {
+		return mgr.EnqueueWithOptions(queueName, []byte(payload), EnqueueOptions{Priority: 5, RetryPolicy: DefaultRetryPolicy(), JobID: jobID})
+	}
+
+	jobID, err := enqueue("orders", "order-1", "a")
+	require.NoError(t, err)
+	assert.Equal(t, "order-1", jobID)
+
+	// Enqueuing the same job again returns it
+	jobID, err = enqueue("orders", "order-1", "a")
+	require.NoError(t, err)
+	assert.Equal(t, "order-1", jobID)
+	ready, _, _, err := mgr.Stats("orders")
+	require.NoError(t, err)
+	assert.Equal(t, 1, ready)
+
+	// A different job under the same ID is a collision, in any queue
+	_, err = enqueue("orders", "order-1", "b")
+	assert.ErrorIs(t, err, ErrJobIDCollision)
+	_, err = enqueue("invoices", "order-1", "a")
+	assert.ErrorIs(t, err, ErrJobIDCollision)
+
+	// Also while the job is leased
+	jobs, err := mgr.Lease("orders", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	_, err = enqueue("orders", "order-1", "b")
+	assert.ErrorIs(t, err, ErrJobIDCollision)
+
+	// Once acked, the ID is free again
+	require.NoError(t, mgr.Ack(jobs[0].ID, jobs[0].LeaseID))
+	jobID, err = enqueue("orders", "order-1", "b")
+	require.NoError(t, err)
+	assert.Equal(t, "order-1", jobID)
+
+	_, err = enqueue("orders", strings.Repeat("x", MaxJobIDLength+1), "a")
+	assert.ErrorIs(t, err, ErrInvalidJobID)
+}
+
+func TestQueueModeFIFO(t *testing.T) {
+	dir := t.TempDir()
+
+	open := func() (*Manager, func()) {
+		walInst, err := wal.New(wal.Config{Dir: dir + "/wal", SegmentSize: 1024 * 1024, Fsync: false})
+		require.NoError(t, err)
+		storeInst, err := store.New(dir + "/store")
+		require.NoError(t, err)
+
+		mgr := NewManager(storeInst, walInst)
+		require.NoError(t, mgr.Start())
+		return mgr, func() {
+			mgr.Stop()
+			walInst.Close()
+			storeInst.Close()
+		}
+	}
+
+	mgr, closeMgr := open()
+
+	_, err := ParseQueueMode("lifo")
+	require.Error(t, err)
+	require.NoError(t, mgr.SetQueueMode("fifo", QueueModeFIFO))
+
+	var ids []string
+	for _, priority := range []uint8{1, 9, 5, 9} {
+		id, err := mgr.Enqueue("fifo", []byte("job"), nil, priority, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	// Jobs are leased in enqueue order, whatever their priority
+	jobs, err := mgr.Lease("fifo", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, ids[0], jobs[0].ID)
+	job, _, _, err := mgr.Reserve("fifo", 30000)
+	require.NoError(t, err)
+	require.NotNil(t, job)
+	assert.Equal(t, ids[1], job.ID)
+	closeMgr()
+
+	// The mode survives a restart, and replayed jobs keep their order. The
+	// leased job stays leased, the reserved one is ready again.
+	mgr, closeMgr = open()
+	defer closeMgr()
+
+	cfg, err := mgr.GetQueueConfig("fifo")
+	require.NoError(t, err)
+	assert.Equal(t, QueueModeFIFO, cfg.Mode)
+
+	jobs, err = mgr.Lease("fifo", 4, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 3)
+	for i, job := range jobs {
+		assert.Equal(t, ids[i+1], job.ID)
+	}
+
+	// Back in priority mode the highest priority job goes first
+	for _, job := range jobs {
+		require.NoError(t, mgr.Nack(job.ID, job.LeaseID, "retry"))
+	}
+	require.NoError(t, mgr.SetQueueMode("fifo", QueueModePriority))
+	q := mgr.getQueue("fifo")
+	q.mu.Lock()
+	for _, job := range q.ready.Jobs() {
+		job.ETA = time.Now()
+	}
+	q.ready.Rebuild()
+	q.mu.Unlock()
+
+	jobs, err = mgr.Lease("fifo", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, uint8(9), jobs[0].Priority)
+}
+
+func TestEnqueueBatch(t *testing.T) {
+	mgr := newTestManager(t)
+
+	existing, err := mgr.Enqueue("batch", []byte("old"), nil, 5, 0, DefaultRetryPolicy(), "key-old")
+	require.NoError(t, err)
+
+	specs := []EnqueueSpec{
+		{Payload: []byte("a"), Priority: 1, RetryPolicy: DefaultRetryPolicy()},
+		{Payload: []byte("b"), Priority: 9, RetryPolicy: DefaultRetryPolicy(), IdempotencyKey: "key-b"},
+		{Payload: []byte("b"), Priority: 9, RetryPolicy: DefaultRetryPolicy(), IdempotencyKey: "key-b"},
+		{Payload: []byte("old"), RetryPolicy: DefaultRetryPolicy(), IdempotencyKey: "key-old"},
+		{JobID: "batch-1", Payload: []byte("c"), DelayMs: 60000, RetryPolicy: DefaultRetryPolicy()},
+	}
+	ids, err := mgr.EnqueueBatch("batch", specs)
+	require.NoError(t, err)
+	require.Len(t, ids, len(specs))
+	assert.Equal(t, ids[1], ids[2])
+	assert.Equal(t, existing, ids[3])
+	assert.Equal(t, "batch-1", ids[4])
+
+	ready, _, _, err := mgr.Stats("batch")
+	require.NoError(t, err)
+	assert.Equal(t, 4, ready)
+
+	jobs, err := mgr.Lease("batch", 10, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 3)
+	assert.Equal(t, ids[1], jobs[0].ID)
+
+	// An invalid job fails the whole batch and is named by its index
+	_, err = mgr.EnqueueBatch("batch", []EnqueueSpec{
+		{Payload: []byte("d")},
+		{Payload: []byte("e"), DelayMs: -1},
+	})
+	var batchErr *BatchError
+	require.ErrorAs(t, err, &batchErr)
+	assert.Equal(t, 1, batchErr.Index)
+	assert.ErrorIs(t, err, ErrDelayOutOfRange)
+
+	_, err = mgr.EnqueueBatch("batch", []EnqueueSpec{
+		{JobID: "batch-2", Payload: []byte("d")},
+		{JobID: "batch-2", Payload: []byte("e")},
+	})
+	require.ErrorAs(t, err, &batchErr)
+	assert.Equal(t, 1, batchErr.Index)
+	assert.ErrorIs(t, err, ErrJobIDCollision)
+
+	ready, _, _, err = mgr.Stats("batch")
+	require.NoError(t, err)
+	assert.Equal(t, 1, ready)
+
+	// The rate limit takes a token per job, all or none
+	mgr.SetRateLimit("limited", 2, 0.001)
+	_, err = mgr.EnqueueBatch("limited", make([]EnqueueSpec, 3))
+	assert.ErrorIs(t, err, ErrRateLimited)
+	ids, err = mgr.EnqueueBatch("limited", make([]EnqueueSpec, 2))
+	require.NoError(t, err)
+	assert.Len(t, ids, 2)
+}
+
+func TestEnqueueSequenceOrder(t *testing.T) {
+	dir := t.TempDir()
+
+	open := func() (*Manager, func()) {
+		walInst, err := wal.New(wal.Config{Dir: dir + "/wal", SegmentSize: 1024 * 1024, Fsync: false})
+		require.NoError(t, err)
+		storeInst, err := store.New(dir + "/store")
+		require.NoError(t, err)
+
+		mgr := NewManager(storeInst, walInst)
+		require.NoError(t, mgr.Start())
+		return mgr, func() {
+			mgr.Stop()
+			walInst.Close()
+			storeInst.Close()
+		}
+	}
+
+	mgr, closeMgr := open()
+
+	// Same priority and ETA, so only the sequence tells the jobs apart
+	const n = 200
+	eta := time.Now().Add(-time.Second)
+	var ids []string
+	for i := 0; i < n; i++ {
+		id, err := mgr.Enqueue("seq", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	q := mgr.getQueue("seq")
+	q.mu.Lock()
+	for _, job := range q.ready.Jobs() {
+		job.ETA = eta
+		job.EnqueuedAt = eta
+	}
+	q.ready.Rebuild()
+	q.mu.Unlock()
+
+	leaseAll := func(mgr *Manager) []string {
+		var leased []string
+		for len(leased) < n {
+			jobs, err := mgr.Lease("seq", 7, 30000)
+			require.NoError(t, err)
+			require.NotEmpty(t, jobs)
+			for _, job := range jobs {
+				leased = append(leased, job.ID)
+			}
+		}
+		return leased
+	}
+	// Reservations are not logged, so the jobs are still ready after a restart
+	var reserved []string
+	for len(reserved) < n {
+		job, _, _, err := mgr.Reserve("seq", 30000)
+		require.NoError(t, err)
+		require.NotNil(t, job)
+		reserved = append(reserved, job.ID)
+	}
+	assert.Equal(t, ids, reserved)
+	closeMgr()
+
+	// Replay logs the jobs with millisecond ETAs that tie; the order holds
+	mgr, closeMgr = open()
+	assert.Equal(t, ids, leaseAll(mgr))
+
+	// Jobs enqueued after the replay come after the replayed ones
+	id, err := mgr.Enqueue("seq", []byte("job"), nil, 5, 0, DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	job, err := mgr.GetJob("seq", id)
+	require.NoError(t, err)
+	assert.Greater(t, job.Seq, uint64(n))
+	closeMgr()
+}
+
+func TestInMemoryManager(t *testing.T) {
+	// Anything written to disk would land in the working directory
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	mgr, err := NewInMemoryManager()
+	require.NoError(t, err)
+	require.NoError(t, mgr.Start())
+
+	// Enqueue, lease and ack
+	doneID, err := mgr.Enqueue("test", []byte("done"), map[string]string{"k": "v"}, 5, 0, RetryPolicy{}, "key")
+	require.NoError(t, err)
+	again, err := mgr.Enqueue("test", []byte("done"), map[string]string{"k": "v"}, 5, 0, RetryPolicy{}, "key")
+	require.NoError(t, err)
+	assert.Equal(t, doneID, again, "idempotency keys are kept in the in-memory store")
+
+	jobs, err := mgr.Lease("test", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, doneID, jobs[0].ID)
+	require.NoError(t, mgr.Ack(jobs[0].ID, jobs[0].LeaseID))
+
+	// Nack, retry and ack
+	retryID, err := mgr.Enqueue("test", []byte("retry"), nil, 5, 0, RetryPolicy{MaxRetries: 2, BaseDelay: 10 * time.Millisecond, MaxDelay: time.Second}, "")
+	require.NoError(t, err)
+	jobs = leaseEventually(t, mgr, "test")
+	require.Equal(t, retryID, jobs[0].ID)
+	require.NoError(t, mgr.Nack(jobs[0].ID, jobs[0].LeaseID, "transient"))
+
+	jobs = leaseEventually(t, mgr, "test")
+	require.Equal(t, retryID, jobs[0].ID)
+	require.NoError(t, mgr.Ack(jobs[0].ID, jobs[0].LeaseID))
+
+	// Nack without retries dead-letters the job
+	deadID, err := mgr.Enqueue("test", []byte("dead"), nil, 5, 0, RetryPolicy{}, "")
+	require.NoError(t, err)
+	jobs = leaseEventually(t, mgr, "test")
+	require.Equal(t, deadID, jobs[0].ID)
+	require.NoError(t, mgr.Nack(jobs[0].ID, jobs[0].LeaseID, "fatal"))
+
+	ready, inflight, dlq, err := mgr.Stats("test")
+	require.NoError(t, err)
+	assert.Equal(t, 0, ready)
+	assert.Equal(t, 0, inflight)
+	assert.Equal(t, 1, dlq)
+
+	dead, err := mgr.GetDLQJob("test", deadID)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("dead"), dead.Payload)
+
+	_, err = mgr.VerifyReplay()
+	assert.Error(t, err)
+
+	require.NoError(t, mgr.Stop())
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestLeaseWait(t *testing.T) {
+	mgr := newTestManager(t)
+	_, err := mgr.Enqueue("test", []byte("first"), nil, 5, 0, RetryPolicy{}, "")
+	require.NoError(t, err)
+	jobs, err := mgr.Lease("test", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+
+	lease := func(ctx context.Context, wait time.Duration) ([]*Job, error) {
+		return mgr.LeaseWithOptions(ctx, "test", 1, 30000, LeaseOptions{Wait: wait})
+	}
+
+	t.Run("times_out", func(t *testing.T) {
+		start := time.Now()
+		jobs, err := lease(context.Background(), 50*time.Millisecond)
+		require.NoError(t, err)
+		assert.Empty(t, jobs)
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	})
+
+	t.Run("woken_by_enqueue", func(t *testing.T) {
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			mgr.Enqueue("test", []byte("second"), nil, 5, 0, RetryPolicy{}, "")
+		}()
+
+		start := time.Now()
+		jobs, err := lease(context.Background(), 5*time.Second)
+		require.NoError(t, err)
+		require.Len(t, jobs, 1)
+		assert.Equal(t, []byte("second"), jobs[0].Payload)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("woken_by_nack", func(t *testing.T) {
+		_, err := mgr.Enqueue("test", []byte("third"), nil, 5, 0, RetryPolicy{MaxRetries: 3, BaseDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond}, "")
+		require.NoError(t, err)
+		jobs, err := mgr.Lease("test", 1, 30000)
+		require.NoError(t, err)
+		require.Len(t, jobs, 1)
+
+		// The nacked job is requeued with a delay, which the wait sleeps out
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			mgr.Nack(jobs[0].ID, jobs[0].LeaseID, "retry")
+		}()
+
+		start := time.Now()
+		leased, err := lease(context.Background(), 5*time.Second)
+		require.NoError(t, err)
+		require.Len(t, leased, 1)
+		assert.Equal(t, jobs[0].ID, leased[0].ID)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("context_canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			cancel()
+		}()
+
+		jobs, err := lease(ctx, 5*time.Second)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Empty(t, jobs)
+	})
+
+	t.Run("clamped", func(t *testing.T) {
+		mgr.SetMaxLeaseWait(50 * time.Millisecond)
+		defer mgr.SetMaxLeaseWait(DefaultMaxLeaseWait)
+
+		start := time.Now()
+		jobs, err := lease(context.Background(), time.Minute)
+		require.NoError(t, err)
+		assert.Empty(t, jobs)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+}
+
+func TestLeaseWaitEndsOnPauseAndDelete(t *testing.T) {
+	mgr := newTestManager(t)
+	_, err := mgr.Enqueue("acme:jobs", []byte("job"), nil, 5, 0, RetryPolicy{}, "")
+	require.NoError(t, err)
+	_, err = mgr.Lease("acme:jobs", 1, 30000)
+	require.NoError(t, err)
+
+	type result struct {
+		jobs    []*Job
+		err     error
+		elapsed time.Duration
+	}
+	wait := func() <-chan result {
+		done := make(chan result, 1)
+		go func() {
+			start := time.Now()
+			jobs, err := mgr.LeaseWithOptions(context.Background(), "acme:jobs", 1, 30000, LeaseOptions{Wait: 10 * time.Second})
+			done <- result{jobs, err, time.Since(start)}
+		}()
+		// Let the lease start waiting
+		time.Sleep(20 * time.Millisecond)
+		return done
+	}
+	await := func(done <-chan result) result {
+		select {
+		case r := <-done:
+			return r
+		case <-time.After(2 * time.Second):
+			t.Fatal("waiting lease was not woken")
+			return result{}
+		}
+	}
+
+	// Pausing the queue unblocks the waiting lease, which gets no jobs
+	done := wait()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	mgr.QuiesceQueue(ctx, "acme:jobs", 0)
+	r := await(done)
+	require.NoError(t, r.err)
+	assert.Empty(t, r.jobs)
+	assert.Less(t, r.elapsed, time.Second)
+
+	// While paused, leases do not wait at all
+	r = await(wait())
+	require.NoError(t, r.err)
+	assert.Empty(t, r.jobs)
+	assert.Less(t, r.elapsed, time.Second)
+
+	// Deleting the queue ends the wait with an error
+	require.NoError(t, mgr.ResumeQueue("acme:jobs"))
+	done = wait()
+	_, err = mgr.PurgeNamespace("acme")
+	require.NoError(t, err)
+	r = await(done)
+	assert.ErrorIs(t, r.err, ErrQueueNotFound)
+	assert.Less(t, r.elapsed, time.Second)
+}
+
+func TestMinRetryDelay(t *testing.T) {
+	mgr := newTestManager(t)
+	require.NoError(t, mgr.SetVisibilityLimits(VisibilityLimits{MinMs: 1}))
+	mgr.SetMinRetryDelay(300 * time.Millisecond)
+
+	policy := RetryPolicy{MaxRetries: 5, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	jobID, err := mgr.Enqueue("floor", []byte("job"), nil, 5, 0, policy, "")
+	require.NoError(t, err)
+
+	// A nack waits out the floor rather than the 1ms backoff
+	jobs, err := mgr.Lease("floor", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	nackedAt := time.Now()
+	require.NoError(t, mgr.Nack(jobID, jobs[0].LeaseID, "downstream down"))
+
+	job, err := mgr.GetJob("floor", jobID)
+	require.NoError(t, err)
+	assert.False(t, job.ETA.Before(nackedAt.Add(300*time.Millisecond)), "retry at %v, nacked at %v", job.ETA, nackedAt)
+
+	jobs, err = mgr.Lease("floor", 1, 30000)
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
+
+	// So does an expired lease
+	jobs, err = mgr.LeaseWithOptions(context.Background(), "floor", 1, 10, LeaseOptions{Wait: 2 * time.Second})
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	time.Sleep(20 * time.Millisecond)
+	expiredAt := time.Now()
+	mgr.checkLeaseTimeouts()
+
+	job, err = mgr.GetJob("floor", jobID)
+	require.NoError(t, err)
+	assert.Equal(t, JobStatusReady, job.Status)
+	assert.False(t, job.ETA.Before(expiredAt.Add(300*time.Millisecond)), "retry at %v, expired at %v", job.ETA, expiredAt)
+}
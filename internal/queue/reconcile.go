@@ -0,0 +1,235 @@
+package queue
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rivetq/rivetq/internal/logging"
+	"github.com/rivetq/rivetq/internal/metrics"
+	"github.com/rivetq/rivetq/internal/store"
+)
+
+// Job metadata in the store is written lazily, when a job is nacked, and
+// removed when it is acked, so it can drift from the in-memory queues: a
+// crash between the WAL write and the store write, or a job that leaves
+// through a path that does not clean up, leaves metadata behind or out of
+// date. The reconciler walks the live jobs and brings the store in line.
+
+// Discrepancy labels of rivetq_reconcile_discrepancies_total
+const (
+	reconcileOrphaned = "orphaned" // Metadata of a job that is no longer live
+	reconcileStale    = "stale"    // Metadata disagreeing with the live job
+	reconcileMissing  = "missing"  // A retried live job without metadata
+)
+
+// ReconcileReport counts what a reconciliation pass found and fixed
+type ReconcileReport struct {
+	Checked  int `json:"checked"`  // Live jobs compared against the store
+	Orphaned int `json:"orphaned"` // Metadata deleted because its job is gone
+	Stale    int `json:"stale"`    // Metadata rewritten to match its job
+	Missing  int `json:"missing"`  // Metadata created for retried jobs
+}
+
+// Discrepancies returns how many store entries the pass fixed
+func (r ReconcileReport) Discrepancies() int {
+	return r.Orphaned + r.Stale + r.Missing
+}
+
+// SetReconcileInterval sets how often the reconciler runs. Zero, the
+// default, disables it. Must be called before Start.
+func (m *Manager) SetReconcileInterval(interval time.Duration) {
+	if interval < 0 {
+		interval = 0
+	}
+	m.reconcileInterval = interval
+}
+
+// reconcileWorker runs Reconcile every reconcileInterval
+func (m *Manager) reconcileWorker() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stopCh:
+			return
+		case <-ticker.C:
+			report, err := m.Reconcile()
+			if err != nil {
+				logging.With(logging.Fields{}).Error().Err(err).Msg("failed to reconcile job metadata")
+				continue
+			}
+			if report.Discrepancies() > 0 {
+				logging.With(logging.Fields{}).Warn().
+					Int("orphaned", report.Orphaned).
+					Int("stale", report.Stale).
+					Int("missing", report.Missing).
+					Msg("job metadata drifted from queue state, corrected")
+			}
+		}
+	}
+}
+
+// reconcileSnapshotTaken runs after Reconcile snapshots the live jobs. Tests
+// replace it to change jobs during a pass.
+var reconcileSnapshotTaken = func() {}
+
+// Reconcile makes the store's job metadata match the live jobs: metadata of
+// jobs no longer live is deleted, metadata disagreeing with its job is
+// rewritten, keeping its history, and retried jobs without metadata get it.
+// Each entry is judged against its job as it is when the entry is fixed, so
+// jobs that change while the pass runs are not mistaken for drift.
+func (m *Manager) Reconcile() (ReconcileReport, error) {
+	var report ReconcileReport
+
+	// Live retried jobs, to find those without metadata
+	live := make(map[string]string) // jobID -> queue
+	for _, queue := range m.allQueues() {
+		queue.mu.Lock()
+		jobs := queue.readyJobs()
+		for _, job := range queue.inflight {
+			jobs = append(jobs, job)
+		}
+		for _, r := range queue.reserved {
+			jobs = append(jobs, r.job)
+		}
+		for _, job := range queue.dlq {
+			jobs = append(jobs, job)
+		}
+		for _, job := range jobs {
+			if job.Tries > 0 {
+				live[job.ID] = job.Queue
+			}
+		}
+		report.Checked += len(jobs)
+		queue.mu.Unlock()
+	}
+	reconcileSnapshotTaken()
+
+	// Collect the stored entries first: the store cannot be written during a
+	// scan
+	type entry struct{ jobID, queue string }
+	var stored []entry
+	err := m.store.ScanJobs(func(meta *store.JobMetadata) error {
+		stored = append(stored, entry{jobID: meta.JobID, queue: meta.Queue})
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to scan job metadata: %w", err)
+	}
+
+	for _, e := range stored {
+		delete(live, e.jobID)
+		kind, err := m.reconcileJob(e.queue, e.jobID, false)
+		if err != nil {
+			return report, fmt.Errorf("failed to reconcile job %s: %w", e.jobID, err)
+		}
+		countReconcile(&report, kind)
+	}
+
+	for jobID, queueName := range live {
+		kind, err := m.reconcileJob(queueName, jobID, true)
+		if err != nil {
+			return report, fmt.Errorf("failed to reconcile job %s: %w", jobID, err)
+		}
+		countReconcile(&report, kind)
+	}
+
+	return report, nil
+}
+
+// reconcileJob brings a job's metadata in line with the job and returns the
+// discrepancy fixed, if any. The job is looked up under its queue's lock,
+// held until the store is updated, so a job nacked or acked during the pass
+// is judged by its current state. With onlyMissing, existing metadata is
+// left alone.
+func (m *Manager) reconcileJob(queueName, jobID string, onlyMissing bool) (string, error) {
+	var want *store.JobMetadata
+	if queue := m.getQueue(queueName); queue != nil {
+		queue.mu.RLock()
+		defer queue.mu.RUnlock()
+
+		job, _, err := queue.findJob(jobID)
+		if err != nil {
+			return "", err
+		}
+		if job != nil {
+			meta := jobMetadata(job)
+			want = &meta
+		}
+	}
+
+	kind := ""
+	err := m.store.UpdateJob(jobID, func(meta *store.JobMetadata) *store.JobMetadata {
+		switch {
+		case onlyMissing:
+			if meta != nil || want == nil || want.Tries == 0 {
+				return meta // Written, or no longer needed, since the snapshot
+			}
+			kind = reconcileMissing
+			return want
+		case meta == nil:
+			return nil
+		case want == nil:
+			kind = reconcileOrphaned
+			return nil
+		case !sameMetadata(meta, want):
+			kind = reconcileStale
+			want.History = meta.History
+			return want
+		default:
+			return meta
+		}
+	})
+	return kind, err
+}
+
+// countReconcile counts a fixed discrepancy of kind, if any
+func countReconcile(report *ReconcileReport, kind string) {
+	switch kind {
+	case reconcileOrphaned:
+		report.Orphaned++
+	case reconcileStale:
+		report.Stale++
+	case reconcileMissing:
+		report.Missing++
+	default:
+		return
+	}
+	metrics.ReconcileDiscrepancies.WithLabelValues(kind).Inc()
+}
+
+// jobMetadata returns the metadata describing a live job, without history.
+// Must be called with the job's queue lock held.
+func jobMetadata(job *Job) store.JobMetadata {
+	meta := store.JobMetadata{
+		JobID:      job.ID,
+		Queue:      job.Queue,
+		Priority:   job.Priority,
+		Tries:      job.Tries,
+		MaxRetries: job.MaxRetries,
+		ETA:        job.ETA.UnixMilli(),
+		LeaseID:    job.LeaseID,
+		Status:     string(job.Status),
+	}
+	if !job.LeaseDeadline.IsZero() {
+		meta.LeaseUntil = job.LeaseDeadline.UnixMilli()
+	}
+	return meta
+}
+
+// sameMetadata reports whether stored metadata matches a live job's, leaving
+// out the history only the store has
+func sameMetadata(stored, live *store.JobMetadata) bool {
+	return stored.JobID == live.JobID &&
+		stored.Queue == live.Queue &&
+		stored.Priority == live.Priority &&
+		stored.Tries == live.Tries &&
+		stored.MaxRetries == live.MaxRetries &&
+		stored.ETA == live.ETA &&
+		stored.LeaseID == live.LeaseID &&
+		stored.LeaseUntil == live.LeaseUntil &&
+		stored.Status == live.Status
+}
@@ -0,0 +1,205 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rivetq/rivetq/internal/logging"
+	"github.com/rivetq/rivetq/internal/metrics"
+)
+
+// ErrReservationNotFound is returned by Claim and Release when the job is not
+// reserved under the given token, usually because the reservation timed out
+var ErrReservationNotFound = errors.New("reservation not found")
+
+const (
+	// DefaultReservationWindow is used when Reserve is called without a window
+	DefaultReservationWindow = 5 * time.Second
+
+	// DefaultMaxReservation is the longest window Reserve grants by default
+	DefaultMaxReservation = 30 * time.Second
+)
+
+// reservation holds a job out of the ready heap while a consumer decides
+// whether to take it. Reservations are not written to the WAL: they are
+// short-lived and a reserved job simply comes back as ready after a restart.
+type reservation struct {
+	job      *Job
+	token    string
+	deadline time.Time
+}
+
+// SetMaxReservation sets the longest window Reserve will grant
+func (m *Manager) SetMaxReservation(max time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxReservation = max
+}
+
+// Reserve takes the next ready job out of circulation for windowMs without
+// leasing it, returning the job and a reservation token. The job must then be
+// claimed or released; if neither happens before the window ends it returns
+// to ready. Tries are not incremented. Returns a nil job if none is ready.
+func (m *Manager) Reserve(queueName string, windowMs int64) (*Job, string, time.Time, error) {
+	queue := m.getQueue(queueName)
+	if queue == nil {
+		return nil, "", time.Time{}, fmt.Errorf("%w: %s", ErrQueueNotFound, queueName)
+	}
+
+	m.mu.RLock()
+	max := m.maxReservation
+	maintenance := m.maintenance.Enabled
+	m.mu.RUnlock()
+
+	if maintenance {
+		return nil, "", time.Time{}, nil
+	}
+
+	window := time.Duration(windowMs) * time.Millisecond
+	if window <= 0 {
+		window = DefaultReservationWindow
+	}
+	if max > 0 && window > max {
+		window = max
+	}
+
+	now := time.Now()
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if queue.paused || (queue.config.SingleActiveConsumer && queue.hasActiveConsumer()) {
+		return nil, "", time.Time{}, nil
+	}
+
+	pop := queue.popReady
+	if queue.isFIFO() {
+		pop = queue.popOldestReady
+	}
+	job := pop(now)
+	if job == nil {
+		return nil, "", time.Time{}, nil
+	}
+
+	job.Status = JobStatusReserved
+
+	r := &reservation{
+		job:      job,
+		token:    uuid.New().String(),
+		deadline: now.Add(window),
+	}
+	queue.reserved[job.ID] = r
+	queue.updateGauges()
+
+	logging.With(logging.Fields{Queue: queueName, JobID: job.ID}).Debug().Msg("job reserved")
+
+	return job, r.token, r.deadline, nil
+}
+
+// Claim converts a reservation into a normal lease with the given visibility
+// timeout, subject to the same limits as Lease
+func (m *Manager) Claim(queueName, jobID, token string, visibilityMs int64) (*Job, error) {
+	queue := m.getQueue(queueName)
+	if queue == nil {
+		return nil, fmt.Errorf("%w: %s", ErrQueueNotFound, queueName)
+	}
+
+	m.mu.RLock()
+	limits := m.visibility
+	m.mu.RUnlock()
+
+	visibilityMs, err := limits.apply(visibilityMs)
+	if err != nil {
+		return nil, err
+	}
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	r, err := queue.takeReservation(jobID, token)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	job := r.job
+	job.LeaseID = uuid.New().String()
+	job.LeaseDeadline = now.Add(time.Duration(visibilityMs) * time.Millisecond)
+	job.Status = JobStatusInflight
+	if queue.config.SingleActiveConsumer {
+		job.FencingToken = queue.nextFencingToken(now)
+	}
+
+	if queue.config.DeliveryMode == DeliveryAtMostOnce {
+		err = m.consume([]*Job{job})
+	} else {
+		err = m.logLease(job)
+	}
+	if err != nil {
+		job.LeaseID = ""
+		job.LeaseDeadline = time.Time{}
+		job.FencingToken = 0
+		job.Status = JobStatusReserved
+		queue.reserved[job.ID] = r
+		return nil, err
+	}
+
+	job.markLeased(now)
+	job.startLease(now, 0)
+	queue.addInflight(job)
+	metrics.JobsLeasedTotal.WithLabelValues(queueName).Inc()
+
+	logging.With(logging.Fields{Queue: queueName, JobID: job.ID, LeaseID: job.LeaseID}).Debug().Msg("reservation claimed")
+
+	return job, nil
+}
+
+// Release returns a reserved job to ready without incrementing tries
+func (m *Manager) Release(queueName, jobID, token string) error {
+	queue := m.getQueue(queueName)
+	if queue == nil {
+		return fmt.Errorf("%w: %s", ErrQueueNotFound, queueName)
+	}
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	r, err := queue.takeReservation(jobID, token)
+	if err != nil {
+		return err
+	}
+	r.job.Status = JobStatusReady
+	queue.pushReady(r.job)
+	queue.updateGauges()
+
+	logging.With(logging.Fields{Queue: queueName, JobID: jobID}).Debug().Msg("reservation released")
+
+	return nil
+}
+
+// takeReservation removes and returns a live reservation matching token.
+// Must be called with q.mu held.
+func (q *Queue) takeReservation(jobID, token string) (*reservation, error) {
+	r, exists := q.reserved[jobID]
+	if !exists || r.token != token {
+		return nil, fmt.Errorf("%w: job %s", ErrReservationNotFound, jobID)
+	}
+	delete(q.reserved, jobID)
+	return r, nil
+}
+
+// expireReservations returns reservations past their deadline to ready.
+// Must be called with q.mu held.
+func expireReservations(q *Queue, now time.Time) {
+	for jobID, r := range q.reserved {
+		if now.After(r.deadline) {
+			delete(q.reserved, jobID)
+			r.job.Status = JobStatusReady
+			q.pushReady(r.job)
+
+			logging.With(logging.Fields{Queue: q.name, JobID: jobID}).Debug().Msg("reservation expired")
+		}
+	}
+}
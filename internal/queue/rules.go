@@ -0,0 +1,88 @@
+package queue
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MaxNackRules bounds the number of nack rules per queue
+const MaxNackRules = 32
+
+// NackAction is the behavior a matching nack rule selects
+type NackAction string
+
+const (
+	// NackActionRetry retries normally, optionally with a scaled backoff
+	NackActionRetry NackAction = "retry"
+	// NackActionDLQ skips remaining retries and dead-letters the job
+	NackActionDLQ NackAction = "dlq"
+)
+
+// NackRule maps nack reasons to a behavior, letting consumers signal intent
+// through the reason string (e.g. "validation: bad field" -> DLQ)
+type NackRule struct {
+	Prefix   string     `json:"prefix,omitempty"`   // Matches reasons starting with Prefix
+	Contains string     `json:"contains,omitempty"` // Matches reasons containing Contains
+	Action   NackAction `json:"action"`
+
+	// BackoffMultiplier scales the computed backoff for retry rules (e.g. 10
+	// for throttling errors). Zero or one leaves the backoff unchanged.
+	BackoffMultiplier float64 `json:"backoff_multiplier,omitempty"`
+}
+
+// matches reports whether the rule applies to a nack reason
+func (r NackRule) matches(reason string) bool {
+	if r.Prefix != "" && !strings.HasPrefix(reason, r.Prefix) {
+		return false
+	}
+	if r.Contains != "" && !strings.Contains(reason, r.Contains) {
+		return false
+	}
+	return r.Prefix != "" || r.Contains != ""
+}
+
+// validateNackRules checks rule count and actions
+func validateNackRules(rules []NackRule) error {
+	if len(rules) > MaxNackRules {
+		return fmt.Errorf("too many nack rules: %d (max %d)", len(rules), MaxNackRules)
+	}
+
+	for i, rule := range rules {
+		if rule.Prefix == "" && rule.Contains == "" {
+			return fmt.Errorf("nack rule %d: prefix or contains is required", i)
+		}
+		if rule.Action != NackActionRetry && rule.Action != NackActionDLQ {
+			return fmt.Errorf("nack rule %d: unknown action %q", i, rule.Action)
+		}
+		if rule.BackoffMultiplier < 0 {
+			return fmt.Errorf("nack rule %d: backoff multiplier must not be negative", i)
+		}
+	}
+
+	return nil
+}
+
+// matchNackRule returns the first rule matching the reason, or nil
+func matchNackRule(rules []NackRule, reason string) *NackRule {
+	for i := range rules {
+		if rules[i].matches(reason) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// applyNackRule returns the adjusted backoff and whether the job may retry
+func applyNackRule(rule *NackRule, delay time.Duration) (time.Duration, bool) {
+	if rule == nil {
+		return delay, true
+	}
+	if rule.Action == NackActionDLQ {
+		return delay, false
+	}
+	if rule.BackoffMultiplier > 1 {
+		delay = time.Duration(float64(delay) * rule.BackoffMultiplier)
+	}
+	return delay, true
+}
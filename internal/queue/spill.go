@@ -0,0 +1,455 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/rivetq/rivetq/internal/logging"
+)
+
+// spillPageSize is the most spilled jobs paged back into memory per store scan
+const spillPageSize = 256
+
+// errStopScan ends a store scan early
+var errStopScan = errors.New("stop scan")
+
+// Ready jobs beyond a queue's MaxReadyInMemory are spilled to the store under
+// keys that sort in lease order, so the store acts as a disk-backed extension
+// of the ready heap. The next job is whichever of the heap top and the first
+// spilled job sorts first; spilled jobs are paged back into the heap as it
+// drains. Only a jobID -> key index is kept in memory for spilled jobs.
+//
+// Like the heap, spilled jobs whose ETA has not passed are kept apart, under
+// keys that sort by ETA, and re-keyed into lease order once due. Otherwise a
+// delayed high-priority job would sort first and hide due jobs behind it.
+//
+// Spilled jobs are not written durably: the WAL remains the source of truth
+// and the spill area is cleared and rebuilt on startup.
+
+// Spill key spaces within a queue's spill prefix
+const (
+	spillReady   byte = 'r'
+	spillDelayed byte = 'd'
+)
+
+// spillPrefix returns the store prefix of a queue's spilled jobs
+func spillPrefix(queueName string) []byte {
+	return []byte("spill:" + queueName + "\x00")
+}
+
+// spillSpacePrefix returns the store prefix of one of a queue's spill key
+// spaces
+func spillSpacePrefix(queueName string, space byte) []byte {
+	return append(spillPrefix(queueName), space)
+}
+
+// spillKey encodes a job's position so keys sort like jobHeap.Less:
+// effective priority (DESC), ETA (ASC), enqueued time (ASC)
+func spillKey(queueName string, job *Job, priority uint8) []byte {
+	key := spillSpacePrefix(queueName, spillReady)
+	key = append(key, 255-priority)
+	key = binary.BigEndian.AppendUint64(key, orderedTime(job.ETA))
+	key = binary.BigEndian.AppendUint64(key, job.Seq)
+	return append(key, job.ID...)
+}
+
+// spillDelayedKey encodes a delayed job's position so keys sort like
+// etaHeap.Less: ETA (ASC), enqueued time (ASC)
+func spillDelayedKey(queueName string, job *Job) []byte {
+	key := spillSpacePrefix(queueName, spillDelayed)
+	key = binary.BigEndian.AppendUint64(key, orderedTime(job.ETA))
+	key = binary.BigEndian.AppendUint64(key, job.Seq)
+	return append(key, job.ID...)
+}
+
+// isDelayedSpillKey reports whether a spill key is in the delayed key space
+func isDelayedSpillKey(queueName string, key []byte) bool {
+	return bytes.HasPrefix(key, spillSpacePrefix(queueName, spillDelayed))
+}
+
+// orderedTime maps t to an integer whose byte order matches time order, with
+// the zero time first
+func orderedTime(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano()) ^ (1 << 63)
+}
+
+// spillEnabled reports whether the queue keeps ready jobs beyond its cap in
+// the store. Must be called with q.mu held.
+func (q *Queue) spillEnabled() bool {
+	return q.config.MaxReadyInMemory > 0 && q.store != nil
+}
+
+// pushReady adds a job to the ready set, spilling it to the store if the heap
+// is at capacity. Must be called with q.mu held.
+func (q *Queue) pushReady(job *Job) {
+	q.notifyReady()
+	if q.spillEnabled() && q.ready.Len() >= q.config.MaxReadyInMemory {
+		err := q.spill(job)
+		if err == nil {
+			return
+		}
+		logging.With(logging.Fields{Queue: q.name, JobID: job.ID}).Warn().Err(err).Msg("failed to spill job, keeping it in memory")
+	}
+	q.ready.Push(job)
+}
+
+// spill writes a ready job to the store. Must be called with q.mu held.
+func (q *Queue) spill(job *Job) error {
+	return q.spillAt(job, time.Now())
+}
+
+// spillAt writes a ready job to the store, in the delayed key space if it is
+// not due by now. Must be called with q.mu held.
+func (q *Queue) spillAt(job *Job, now time.Time) error {
+	if _, exists := q.spilled[job.ID]; exists {
+		return nil
+	}
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	if !dueBy(job, now) {
+		key := spillDelayedKey(q.name, job)
+		if err := q.store.SetNoSync(key, data); err != nil {
+			return err
+		}
+		q.spilled[job.ID] = key
+		if q.spillDelayed == 0 || job.ETA.Before(q.spillNextDue) {
+			q.spillNextDue = job.ETA
+		}
+		q.spillDelayed++
+		return nil
+	}
+
+	key := spillKey(q.name, job, q.ready.effectivePriority(job))
+	if err := q.store.SetNoSync(key, data); err != nil {
+		return err
+	}
+	q.spilled[job.ID] = key
+
+	// Keep the cached head current; if it is not loaded it is found lazily
+	if len(q.spilled)-q.spillDelayed == 1 || (q.spillHead != nil && bytes.Compare(key, q.spillHeadKey) < 0) {
+		q.spillHead, q.spillHeadKey = job, key
+	}
+	return nil
+}
+
+// unspill removes a spilled job from the store. Must be called with q.mu held.
+func (q *Queue) unspill(jobID string, key []byte) {
+	if err := q.store.DeleteNoSync(key); err != nil {
+		logging.With(logging.Fields{Queue: q.name, JobID: jobID}).Warn().Err(err).Msg("failed to delete spilled job")
+	}
+	delete(q.spilled, jobID)
+	if isDelayedSpillKey(q.name, key) {
+		q.spillDelayed-- // spillNextDue stays a lower bound
+	}
+	if bytes.Equal(key, q.spillHeadKey) {
+		q.spillHead, q.spillHeadKey = nil, nil
+	}
+}
+
+// scanSpilled calls fn for the spilled jobs under prefix in key order until
+// fn returns false. Must be called with q.mu held.
+func (q *Queue) scanSpilled(prefix []byte, fn func(key []byte, job *Job) bool) error {
+	if len(q.spilled) == 0 {
+		return nil
+	}
+
+	err := q.store.Scan(prefix, func(key, value []byte) error {
+		var job Job
+		if err := json.Unmarshal(value, &job); err != nil {
+			return err
+		}
+		if !fn(key, &job) {
+			return errStopScan
+		}
+		return nil
+	})
+	if err == errStopScan {
+		return nil
+	}
+	return err
+}
+
+// loadSpilled reads a spilled job from the store, or returns nil if the job
+// is not spilled. Must be called with q.mu held.
+func (q *Queue) loadSpilled(jobID string) (*Job, error) {
+	key, exists := q.spilled[jobID]
+	if !exists {
+		return nil, nil
+	}
+	value, err := q.store.Get(key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var job Job
+	if err := json.Unmarshal(value, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// spilledHead returns the first spilled job due by now and its key, loading
+// it from the store if needed. Must be called with q.mu held.
+func (q *Queue) spilledHead() (*Job, []byte) {
+	if q.spillHead == nil && len(q.spilled) > q.spillDelayed {
+		err := q.scanSpilled(spillSpacePrefix(q.name, spillReady), func(key []byte, job *Job) bool {
+			q.spillHead, q.spillHeadKey = job, key
+			return false
+		})
+		if err != nil {
+			logging.With(logging.Fields{Queue: q.name}).Error().Err(err).Msg("failed to load spilled jobs")
+		}
+	}
+	return q.spillHead, q.spillHeadKey
+}
+
+// nextReady returns the job that sorts first across the heap and the spill
+// area, after promoting jobs due by now. Must be called with q.mu held.
+func (q *Queue) nextReady(now time.Time) (job *Job, key []byte) {
+	q.ready.promote(now)
+	q.promoteSpilled(now)
+
+	head, headKey := q.spilledHead()
+	if q.ready.heap.Len() == 0 || head == nil {
+		if head != nil {
+			return head, headKey
+		}
+		return q.ready.Peek(), nil
+	}
+
+	top := q.ready.heap[0]
+	if bytes.Compare(spillKeyFor(q.name, top), headKey) <= 0 {
+		return top.job, nil
+	}
+	return head, headKey
+}
+
+// promoteSpilled re-keys delayed spilled jobs whose ETA has passed into lease
+// order, a page at a time. Must be called with q.mu held.
+func (q *Queue) promoteSpilled(now time.Time) {
+	for q.spillDelayed > 0 && !q.spillNextDue.After(now) {
+		var due []*Job
+		var keys [][]byte
+		next := time.Time{}
+		err := q.scanSpilled(spillSpacePrefix(q.name, spillDelayed), func(key []byte, job *Job) bool {
+			if !dueBy(job, now) {
+				next = job.ETA
+				return false
+			}
+			due = append(due, job)
+			keys = append(keys, key)
+			return len(due) < spillPageSize
+		})
+		if err != nil {
+			logging.With(logging.Fields{Queue: q.name}).Error().Err(err).Msg("failed to promote spilled jobs")
+			return
+		}
+
+		for i, job := range due {
+			q.unspill(job.ID, keys[i])
+			if err := q.spillAt(job, now); err != nil {
+				logging.With(logging.Fields{Queue: q.name, JobID: job.ID}).Warn().Err(err).Msg("failed to spill job, keeping it in memory")
+				q.ready.Push(job)
+			}
+		}
+		if len(due) < spillPageSize {
+			q.spillNextDue = next
+			return
+		}
+	}
+}
+
+// spillKeyFor returns the spill key a heap item would have
+func spillKeyFor(queueName string, item *jobHeapItem) []byte {
+	return spillKey(queueName, item.job, item.priority)
+}
+
+// peekReady returns the next job if its ETA has passed, without removing it.
+// Must be called with q.mu held.
+func (q *Queue) peekReady(now time.Time) *Job {
+	job, _ := q.nextReady(now)
+	if job == nil || !job.IsReady(now) {
+		return nil
+	}
+	return job
+}
+
+// popReady removes and returns the next job if its ETA has passed, then pages
+// spilled jobs into the freed heap capacity. Must be called with q.mu held.
+func (q *Queue) popReady(now time.Time) *Job {
+	job, key := q.nextReady(now)
+	if job == nil || !job.IsReady(now) {
+		return nil
+	}
+
+	if key != nil {
+		q.unspill(job.ID, key)
+	} else {
+		q.ready.Pop()
+	}
+
+	q.refill()
+	return job
+}
+
+// peekOldestReady returns the earliest enqueued ready job, ignoring
+// priority, without removing it. Spilled jobs are only considered once they
+// are paged back into memory. Must be called with q.mu held.
+func (q *Queue) peekOldestReady(now time.Time) *Job {
+	if job := q.ready.PeekOldestReady(now); job != nil {
+		return job
+	}
+	return q.peekReady(now)
+}
+
+// popOldestReady removes and returns the earliest enqueued ready job,
+// ignoring priority. Must be called with q.mu held.
+func (q *Queue) popOldestReady(now time.Time) *Job {
+	job := q.ready.PopOldestReady(now)
+	if job == nil {
+		return q.popReady(now)
+	}
+	q.refill()
+	return job
+}
+
+// refill pages spilled jobs into the heap while it is below capacity. Must be
+// called with q.mu held.
+func (q *Queue) refill() {
+	for len(q.spilled) > 0 {
+		room := len(q.spilled)
+		if q.spillEnabled() {
+			room = min(room, q.config.MaxReadyInMemory-q.ready.Len())
+		}
+		if room <= 0 {
+			return
+		}
+
+		type paged struct {
+			key []byte
+			job *Job
+		}
+		page := make([]paged, 0, min(room, spillPageSize))
+		collect := func(key []byte, job *Job) bool {
+			page = append(page, paged{key: key, job: job})
+			return len(page) < cap(page)
+		}
+		// Due jobs first, then delayed ones, which the heap keeps apart
+		err := q.scanSpilled(spillSpacePrefix(q.name, spillReady), collect)
+		if err == nil && len(page) < cap(page) {
+			err = q.scanSpilled(spillSpacePrefix(q.name, spillDelayed), collect)
+		}
+		if err != nil {
+			logging.With(logging.Fields{Queue: q.name}).Error().Err(err).Msg("failed to page in spilled jobs")
+			return
+		}
+		if len(page) == 0 {
+			return
+		}
+
+		for _, p := range page {
+			q.unspill(p.job.ID, p.key)
+			q.ready.Push(p.job)
+		}
+	}
+}
+
+// respill re-keys spilled jobs after their effective priorities changed.
+// Must be called with q.mu held.
+func (q *Queue) respill() {
+	var jobs []*Job
+	var keys [][]byte
+	err := q.scanSpilled(spillPrefix(q.name), func(key []byte, job *Job) bool {
+		jobs = append(jobs, job)
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		logging.With(logging.Fields{Queue: q.name}).Error().Err(err).Msg("failed to re-key spilled jobs")
+		return
+	}
+
+	for i, job := range jobs {
+		q.unspill(job.ID, keys[i])
+		if err := q.spill(job); err != nil {
+			logging.With(logging.Fields{Queue: q.name, JobID: job.ID}).Warn().Err(err).Msg("failed to spill job, keeping it in memory")
+			q.ready.Push(job)
+		}
+	}
+	q.spillHead, q.spillHeadKey = nil, nil
+}
+
+// removeReady removes a job from the ready set, in memory or spilled. Must be
+// called with q.mu held.
+func (q *Queue) removeReady(jobID string) {
+	if q.ready.Remove(jobID) != nil {
+		return
+	}
+	if key, exists := q.spilled[jobID]; exists {
+		q.unspill(jobID, key)
+	}
+}
+
+// takeReady removes a job from the ready set and returns it, or nil if it is
+// not ready. Must be called with q.mu held.
+func (q *Queue) takeReady(jobID string) *Job {
+	if job := q.ready.Remove(jobID); job != nil {
+		return job
+	}
+
+	key, exists := q.spilled[jobID]
+	if !exists {
+		return nil
+	}
+	data, err := q.store.Get(key)
+	if err != nil {
+		logging.With(logging.Fields{Queue: q.name, JobID: jobID}).Error().Err(err).Msg("failed to load spilled job")
+		return nil
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		logging.With(logging.Fields{Queue: q.name, JobID: jobID}).Error().Err(err).Msg("failed to load spilled job")
+		return nil
+	}
+	q.unspill(jobID, key)
+	return &job
+}
+
+// containsReady reports whether a job is ready, in memory or spilled. Must
+// be called with q.mu held.
+func (q *Queue) containsReady(jobID string) bool {
+	if q.ready.Contains(jobID) {
+		return true
+	}
+	_, exists := q.spilled[jobID]
+	return exists
+}
+
+// readyLen returns the number of ready jobs, in memory or spilled. Must be
+// called with q.mu held.
+func (q *Queue) readyLen() int {
+	return q.ready.Len() + len(q.spilled)
+}
+
+// readyJobs returns every ready job, reading spilled ones from the store.
+// Must be called with q.mu held.
+func (q *Queue) readyJobs() []*Job {
+	jobs := q.ready.Jobs()
+	err := q.scanSpilled(spillPrefix(q.name), func(key []byte, job *Job) bool {
+		jobs = append(jobs, job)
+		return true
+	})
+	if err != nil {
+		logging.With(logging.Fields{Queue: q.name}).Error().Err(err).Msg("failed to read spilled jobs")
+	}
+	return jobs
+}
@@ -0,0 +1,88 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/rivetq/rivetq/internal/metrics"
+)
+
+// Subscribers are clients that hold a goroutine and a channel on a queue for
+// as long as they stay connected, such as leases waiting for jobs. Each is
+// registered with Subscribe for its whole life, so a flood of them is bounded
+// per queue and shows up in the rivetq_subscribers_active gauge.
+
+// DefaultMaxSubscribers is the most subscribers a queue may have at once by
+// default
+const DefaultMaxSubscribers = 1000
+
+// ErrTooManySubscribers is returned when a queue already has as many
+// subscribers as SetMaxSubscribers allows
+var ErrTooManySubscribers = errors.New("too many subscribers")
+
+// SetMaxSubscribers sets the most subscribers each queue may have at once.
+// Subscribers already registered are kept. Zero removes the limit.
+func (m *Manager) SetMaxSubscribers(max int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxSubscribers = max
+}
+
+// Subscribe registers a subscriber on a queue, or returns
+// ErrTooManySubscribers if the queue is full. The returned release must be
+// called once the subscriber is gone, however it ends, typically deferred;
+// calling it again does nothing.
+func (m *Manager) Subscribe(queueName string) (release func(), err error) {
+	queue := m.getQueue(queueName)
+	if queue == nil {
+		return nil, fmt.Errorf("%w: %s", ErrQueueNotFound, queueName)
+	}
+
+	m.mu.RLock()
+	max := m.maxSubscribers
+	m.mu.RUnlock()
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if queue.deleted {
+		return nil, fmt.Errorf("%w: %s", ErrQueueNotFound, queueName)
+	}
+	if max > 0 && queue.subscribers >= max {
+		return nil, fmt.Errorf("%w: queue %s has %d", ErrTooManySubscribers, queueName, queue.subscribers)
+	}
+	queue.subscribers++
+	queue.updateSubscriberGauge()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			queue.mu.Lock()
+			queue.subscribers--
+			queue.updateSubscriberGauge()
+			queue.mu.Unlock()
+		})
+	}, nil
+}
+
+// Subscribers returns how many subscribers a queue has
+func (m *Manager) Subscribers(queueName string) int {
+	queue := m.getQueue(queueName)
+	if queue == nil {
+		return 0
+	}
+
+	queue.mu.RLock()
+	defer queue.mu.RUnlock()
+	return queue.subscribers
+}
+
+// updateSubscriberGauge reports the queue's subscriber count. Must be called
+// with q.mu held.
+func (q *Queue) updateSubscriberGauge() {
+	if q.deleted {
+		return
+	}
+	metrics.SubscribersActive.WithLabelValues(q.name).Set(float64(q.subscribers))
+}
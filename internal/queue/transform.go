@@ -0,0 +1,144 @@
+package queue
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// TransformType names a built-in enqueue transform. Transforms are a fixed
+// set of safe operations on a job's headers and priority, not arbitrary
+// code, so producers need not all implement the same enrichment.
+type TransformType string
+
+const (
+	// TransformAddHeader sets Header to Value, overriding the producer
+	TransformAddHeader TransformType = "add_header"
+	// TransformCopyHeaderToPriority sets the job's priority from Header,
+	// which must hold an integer from 0 to 9. Jobs without the header, or
+	// with another value, keep the priority they were enqueued with.
+	TransformCopyHeaderToPriority TransformType = "copy_header_to_priority"
+	// TransformStampReceivedAt sets Header (DefaultReceivedAtHeader if
+	// empty) to the time the server received the job, in RFC 3339 with
+	// milliseconds
+	TransformStampReceivedAt TransformType = "stamp_received_at"
+)
+
+const (
+	// MaxTransforms caps the number of transforms per queue
+	MaxTransforms = 16
+
+	// DefaultReceivedAtHeader is the header stamp_received_at sets by default
+	DefaultReceivedAtHeader = "received_at"
+)
+
+// receivedAtLayout formats stamp_received_at times
+const receivedAtLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// Transform is one step applied to jobs enqueued to a queue
+type Transform struct {
+	Type   TransformType `json:"type"`
+	Header string        `json:"header,omitempty"`
+	Value  string        `json:"value,omitempty"` // For add_header
+}
+
+// validateTransforms checks transform count, types and arguments
+func validateTransforms(transforms []Transform) error {
+	if len(transforms) > MaxTransforms {
+		return fmt.Errorf("too many transforms: %d (max %d)", len(transforms), MaxTransforms)
+	}
+
+	for i, t := range transforms {
+		switch t.Type {
+		case TransformAddHeader, TransformCopyHeaderToPriority:
+			if t.Header == "" {
+				return fmt.Errorf("transform %d: %s requires a header", i, t.Type)
+			}
+		case TransformStampReceivedAt:
+		default:
+			return fmt.Errorf("transform %d: unknown type %q", i, t.Type)
+		}
+	}
+
+	return nil
+}
+
+// applyTransforms runs transforms in order over a job's headers and
+// priority, and returns the results. The headers passed in are not modified.
+func applyTransforms(transforms []Transform, headers map[string]string, priority uint8, now time.Time) (map[string]string, uint8) {
+	if len(transforms) == 0 {
+		return headers, priority
+	}
+
+	out := make(map[string]string, len(headers)+len(transforms))
+	for k, v := range headers {
+		out[k] = v
+	}
+
+	for _, t := range transforms {
+		switch t.Type {
+		case TransformAddHeader:
+			out[t.Header] = t.Value
+		case TransformCopyHeaderToPriority:
+			if p, err := strconv.ParseUint(out[t.Header], 10, 8); err == nil && p <= 9 {
+				priority = uint8(p)
+			}
+		case TransformStampReceivedAt:
+			out[receivedAtHeader(t)] = now.UTC().Format(receivedAtLayout)
+		}
+	}
+
+	return out, priority
+}
+
+// receivedAtHeader returns the header a stamp_received_at transform sets
+func receivedAtHeader(t Transform) string {
+	if t.Header == "" {
+		return DefaultReceivedAtHeader
+	}
+	return t.Header
+}
+
+// unstamped returns headers without those set by stamp_received_at
+// transforms, which differ between two enqueues of the same job
+func unstamped(transforms []Transform, headers map[string]string) map[string]string {
+	var out map[string]string
+	for _, t := range transforms {
+		if t.Type != TransformStampReceivedAt {
+			continue
+		}
+		if out == nil {
+			out = make(map[string]string, len(headers))
+			for k, v := range headers {
+				out[k] = v
+			}
+		}
+		delete(out, receivedAtHeader(t))
+	}
+	if out == nil {
+		return headers
+	}
+	return out
+}
+
+// SetQueueTransforms sets the transforms applied, in order, to every job
+// enqueued to a queue from now on, after its default headers are merged and
+// before it is written to the WAL. Jobs already enqueued are unchanged. A
+// nil or empty list removes them.
+func (m *Manager) SetQueueTransforms(queueName string, transforms []Transform) error {
+	if err := validateTransforms(transforms); err != nil {
+		return err
+	}
+
+	queue := m.getOrCreateQueue(queueName)
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if len(transforms) == 0 {
+		queue.config.Transforms = nil
+		return nil
+	}
+	queue.config.Transforms = append([]Transform(nil), transforms...)
+	return nil
+}
@@ -13,6 +13,7 @@ type TokenBucket struct {
 	refillRate   float64 // tokens per second
 	lastRefill   time.Time
 	enabled      bool
+	window       window // Recent decisions, for Stats
 }
 
 // NewTokenBucket creates a new token bucket rate limiter
@@ -44,12 +45,13 @@ func (tb *TokenBucket) AllowN(n float64) bool {
 
 	tb.refill()
 
-	if tb.tokens >= n {
+	allowed := tb.tokens >= n
+	if allowed {
 		tb.tokens -= n
-		return true
 	}
+	tb.window.record(tb.lastRefill, allowed) // refill just set lastRefill to now
 
-	return false
+	return allowed
 }
 
 // refill adds tokens based on elapsed time
@@ -98,6 +100,37 @@ func (tb *TokenBucket) Tokens() float64 {
 	return tb.tokens
 }
 
+// Stats returns how many operations were allowed and rejected over the last
+// StatsWindow. Operations are only counted while the limit is enabled.
+func (tb *TokenBucket) Stats() WindowStats {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return tb.window.stats(time.Now())
+}
+
+// Status describes how close a bucket is to its limit
+type Status struct {
+	Limit     float64       // bucket capacity
+	Remaining float64       // tokens currently available
+	Reset     time.Duration // time until the bucket is full again
+}
+
+// Status returns the bucket's current headroom
+func (tb *TokenBucket) Status() Status {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill()
+
+	status := Status{
+		Limit:     tb.capacity,
+		Remaining: tb.tokens,
+	}
+	if tb.refillRate > 0 && tb.tokens < tb.capacity {
+		status.Reset = time.Duration((tb.capacity - tb.tokens) / tb.refillRate * float64(time.Second))
+	}
+	return status
+}
+
 // Limiter manages rate limiters for multiple queues
 type Limiter struct {
 	mu      sync.RWMutex
@@ -113,6 +146,12 @@ func NewLimiter() *Limiter {
 
 // Allow checks if operation is allowed for a queue
 func (l *Limiter) Allow(queue string) bool {
+	return l.AllowN(queue, 1)
+}
+
+// AllowN checks if N operations are allowed for a queue, taking all N tokens
+// or none
+func (l *Limiter) AllowN(queue string, n float64) bool {
 	l.mu.RLock()
 	bucket, exists := l.buckets[queue]
 	l.mu.RUnlock()
@@ -121,7 +160,7 @@ func (l *Limiter) Allow(queue string) bool {
 		return true // No limit set
 	}
 
-	return bucket.Allow()
+	return bucket.AllowN(n)
 }
 
 // SetRate sets rate limit for a queue
@@ -138,6 +177,13 @@ func (l *Limiter) SetRate(queue string, capacity, refillRate float64) {
 	}
 }
 
+// Remove drops a queue's rate limit
+func (l *Limiter) Remove(queue string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.buckets, queue)
+}
+
 // GetRate gets rate limit for a queue
 func (l *Limiter) GetRate(queue string) (capacity, refillRate float64, exists bool) {
 	l.mu.RLock()
@@ -164,3 +210,36 @@ func (l *Limiter) Tokens(queue string) float64 {
 
 	return bucket.Tokens()
 }
+
+// Status returns the headroom for a queue, or false if it has no limit
+func (l *Limiter) Status(queue string) (Status, bool) {
+	l.mu.RLock()
+	bucket, exists := l.buckets[queue]
+	l.mu.RUnlock()
+
+	if !exists {
+		return Status{}, false
+	}
+
+	bucket.mu.Lock()
+	enabled := bucket.enabled
+	bucket.mu.Unlock()
+	if !enabled {
+		return Status{}, false
+	}
+
+	return bucket.Status(), true
+}
+
+// Stats returns the recent allow/reject counts for a queue, or false if it
+// has no limit
+func (l *Limiter) Stats(queue string) (WindowStats, bool) {
+	l.mu.RLock()
+	bucket, exists := l.buckets[queue]
+	l.mu.RUnlock()
+
+	if !exists {
+		return WindowStats{}, false
+	}
+	return bucket.Stats(), true
+}
@@ -66,3 +66,50 @@ func TestLimiter(t *testing.T) {
 	// Other queues should not be affected
 	assert.True(t, limiter.Allow("queue2"))
 }
+
+func TestLimiterStats(t *testing.T) {
+	limiter := NewLimiter()
+
+	_, ok := limiter.Stats("queue1")
+	assert.False(t, ok)
+
+	limiter.SetRate("queue1", 15, 0.001)
+	for i := 0; i < 20; i++ {
+		limiter.Allow("queue1")
+	}
+
+	stats, ok := limiter.Stats("queue1")
+	assert.True(t, ok)
+	assert.Equal(t, StatsWindow, stats.Window)
+	assert.Equal(t, uint64(15), stats.Allowed)
+	assert.Equal(t, uint64(5), stats.Rejected)
+	assert.InDelta(t, 0.25, stats.RejectRatio, 1e-9)
+}
+
+func TestWindowSlides(t *testing.T) {
+	var w window
+	start := time.Unix(1000, 0)
+	slot := StatsWindow / statsSlots
+
+	for i := 0; i < 4; i++ {
+		w.record(start, true)
+	}
+	w.record(start.Add(StatsWindow/2), false)
+
+	stats := w.stats(start.Add(StatsWindow / 2))
+	assert.Equal(t, uint64(4), stats.Allowed)
+	assert.Equal(t, uint64(1), stats.Rejected)
+	assert.InDelta(t, 0.2, stats.RejectRatio, 1e-9)
+
+	// The first slot ages out once a full window has passed
+	stats = w.stats(start.Add(StatsWindow + slot))
+	assert.Equal(t, uint64(0), stats.Allowed)
+	assert.Equal(t, uint64(1), stats.Rejected)
+	assert.Equal(t, 1.0, stats.RejectRatio)
+
+	// An old slot is reset when reused
+	w.record(start.Add(2*StatsWindow), true)
+	stats = w.stats(start.Add(2 * StatsWindow))
+	assert.Equal(t, uint64(1), stats.Allowed)
+	assert.Equal(t, uint64(0), stats.Rejected)
+}
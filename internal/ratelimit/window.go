@@ -0,0 +1,66 @@
+package ratelimit
+
+import "time"
+
+// StatsWindow is how far back rate limiter statistics reach
+const StatsWindow = time.Minute
+
+// statsSlots is the number of slots StatsWindow is divided into. The window
+// slides one slot at a time, so counts age out in StatsWindow/statsSlots steps.
+const statsSlots = 60
+
+// WindowStats counts a bucket's decisions over the last Window
+type WindowStats struct {
+	Window      time.Duration
+	Allowed     uint64
+	Rejected    uint64
+	RejectRatio float64 // Rejected / (Allowed + Rejected), 0 without traffic
+}
+
+// windowSlot counts decisions made during one slot
+type windowSlot struct {
+	index    int64 // Which slot since the Unix epoch the counts belong to
+	allowed  uint64
+	rejected uint64
+}
+
+// window is a ring of slots covering StatsWindow
+type window struct {
+	slots [statsSlots]windowSlot
+}
+
+// slotIndex returns the slot now falls in
+func slotIndex(now time.Time) int64 {
+	return now.UnixNano() / int64(StatsWindow/statsSlots)
+}
+
+// record counts one decision
+func (w *window) record(now time.Time, allowed bool) {
+	index := slotIndex(now)
+	slot := &w.slots[index%statsSlots]
+	if slot.index != index {
+		*slot = windowSlot{index: index} // Reuse a slot that has aged out
+	}
+	if allowed {
+		slot.allowed++
+	} else {
+		slot.rejected++
+	}
+}
+
+// stats sums the slots still inside the window
+func (w *window) stats(now time.Time) WindowStats {
+	index := slotIndex(now)
+	stats := WindowStats{Window: StatsWindow}
+	for _, slot := range w.slots {
+		if slot.index > index || index-slot.index >= statsSlots {
+			continue
+		}
+		stats.Allowed += slot.allowed
+		stats.Rejected += slot.rejected
+	}
+	if total := stats.Allowed + stats.Rejected; total > 0 {
+		stats.RejectRatio = float64(stats.Rejected) / float64(total)
+	}
+	return stats
+}
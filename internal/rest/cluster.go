@@ -2,13 +2,18 @@ package rest
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/rivetq/rivetq/internal/cluster"
 	"github.com/rs/zerolog/log"
 )
 
+// clusterApplyTimeout bounds how long a replicated change waits to commit
+const clusterApplyTimeout = 5 * time.Second
+
 // ClusterServer provides cluster management REST API
 type ClusterServer struct {
 	node       *cluster.Node
@@ -34,9 +39,14 @@ func (cs *ClusterServer) RegisterRoutes(r chi.Router) {
 		r.Get("/members", cs.listMembers)
 		r.Get("/stats", cs.getStats)
 		r.Get("/sharding", cs.getSharding)
+		r.Get("/raft/config", cs.getRaftConfig)
+		r.Get("/ring", cs.getRing)
+		r.Get("/owner", cs.getOwner)
 		r.Post("/join", cs.joinNode)
 		r.Post("/leave", cs.leaveNode)
 		r.Post("/announce", cs.announceNode)
+		r.Post("/transfer_leadership", cs.transferLeadership)
+		r.Put("/queues/{queue}/default_headers", cs.setDefaultHeaders)
 	})
 }
 
@@ -67,13 +77,76 @@ func (cs *ClusterServer) getSharding(w http.ResponseWriter, r *http.Request) {
 		Replication int      `json:"replication"`
 		Nodes       []string `json:"nodes"`
 	}{
-		NodeCount: cs.sharding.hashRing.NodeCount(),
-		Nodes:     cs.sharding.hashRing.Nodes(),
+		NodeCount:   cs.sharding.NodeCount(),
+		Replication: cs.sharding.Replication(),
+		Nodes:       cs.sharding.Nodes(),
 	}
 
 	respondJSON(w, http.StatusOK, info)
 }
 
+// getRing returns a summary of the consistent hash ring
+func (cs *ClusterServer) getRing(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, cs.sharding.RingInfo())
+}
+
+// QueueOwnerResponse identifies the node that owns a queue
+type QueueOwnerResponse struct {
+	Queue   string `json:"queue"`
+	NodeID  string `json:"node_id"`
+	Addr    string `json:"addr,omitempty"`
+	IsLocal bool   `json:"is_local"`
+}
+
+// getOwner returns the primary owner of a queue per the hash ring, so
+// clients can route to it directly. With an empty ring (a single node that
+// has not formed a cluster) the local node owns every queue.
+func (cs *ClusterServer) getOwner(w http.ResponseWriter, r *http.Request) {
+	queueName := r.URL.Query().Get("queue")
+	if queueName == "" {
+		respondError(w, http.StatusBadRequest, "queue is required")
+		return
+	}
+
+	nodeID := cs.sharding.LocalNodeID()
+	if cs.sharding.NodeCount() > 0 {
+		owner, err := cs.sharding.GetQueueNode(queueName)
+		if err != nil {
+			log.Error().Err(err).Str("queue", queueName).Msg("failed to find queue owner")
+			respondError(w, http.StatusInternalServerError, clientError(err))
+			return
+		}
+		nodeID = owner
+	}
+
+	resp := QueueOwnerResponse{
+		Queue:   queueName,
+		NodeID:  nodeID,
+		IsLocal: nodeID == cs.sharding.LocalNodeID(),
+	}
+	if member, err := cs.membership.GetMember(nodeID); err == nil {
+		resp.Addr = member.Addr
+	} else if resp.IsLocal {
+		resp.Addr = r.Host // The caller already reached us here
+	}
+
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// getRaftConfig returns the Raft configuration (voters and non-voters)
+func (cs *ClusterServer) getRaftConfig(w http.ResponseWriter, r *http.Request) {
+	servers, err := cs.node.Configuration()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to get raft configuration")
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"servers": servers,
+	})
+}
+
 // JoinRequest represents a node join request
 type JoinRequest struct {
 	NodeID   string `json:"node_id"`
@@ -97,7 +170,7 @@ func (cs *ClusterServer) joinNode(w http.ResponseWriter, r *http.Request) {
 	// Add to Raft cluster
 	if err := cs.node.Join(req.NodeID, req.RaftAddr); err != nil {
 		log.Error().Err(err).Msg("failed to join node to cluster")
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondError(w, http.StatusInternalServerError, clientError(err))
 		return
 	}
 
@@ -140,7 +213,7 @@ func (cs *ClusterServer) leaveNode(w http.ResponseWriter, r *http.Request) {
 	// Remove from Raft cluster
 	if err := cs.node.Remove(req.NodeID); err != nil {
 		log.Error().Err(err).Msg("failed to remove node from cluster")
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondError(w, http.StatusInternalServerError, clientError(err))
 		return
 	}
 
@@ -195,3 +268,60 @@ func (cs *ClusterServer) announceNode(w http.ResponseWriter, r *http.Request) {
 		"status": "acknowledged",
 	})
 }
+
+// TransferLeadershipRequest represents a leadership transfer request
+type TransferLeadershipRequest struct {
+	TargetNodeID string `json:"target_node_id"`
+}
+
+// transferLeadership moves leadership to another voter
+func (cs *ClusterServer) transferLeadership(w http.ResponseWriter, r *http.Request) {
+	if !cs.node.IsLeader() {
+		respondError(w, http.StatusServiceUnavailable, "not the leader")
+		return
+	}
+
+	var req TransferLeadershipRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TargetNodeID == "" {
+		respondError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if err := cs.node.TransferLeadership(req.TargetNodeID); err != nil {
+		log.Error().Err(err).Str("target", req.TargetNodeID).Msg("failed to transfer leadership")
+		status := http.StatusInternalServerError
+		if errors.Is(err, cluster.ErrTargetNotVoter) {
+			status = http.StatusBadRequest
+		}
+		respondError(w, status, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{
+		"status": "transferred",
+		"target": req.TargetNodeID,
+	})
+}
+
+// setDefaultHeaders replicates a queue's default headers to every node
+func (cs *ClusterServer) setDefaultHeaders(w http.ResponseWriter, r *http.Request) {
+	if !cs.node.IsLeader() {
+		respondError(w, http.StatusServiceUnavailable, "not the leader")
+		return
+	}
+
+	queueName := chi.URLParam(r, "queue")
+	var req DefaultHeadersRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if err := cs.node.SetDefaultHeaders(queueName, req.Headers, clusterApplyTimeout); err != nil {
+		log.Error().Err(err).Str("queue", queueName).Msg("failed to replicate default headers")
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
+	}
+
+	respondJSON(w, http.StatusOK, DefaultHeadersResponse{Headers: req.Headers})
+}
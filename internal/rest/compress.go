@@ -0,0 +1,163 @@
+package rest
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultCompressionMinBytes is the smallest response body gzipped when
+// compression is enabled; smaller ones gain little and cost CPU
+const DefaultCompressionMinBytes = 1024
+
+// gzipWriters recycles gzip writers, which are costly to allocate
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// SetCompression chooses whether lease and dump responses of at least
+// minBytes are gzipped for clients sending Accept-Encoding: gzip. It is on
+// by default; minBytes of zero or less uses DefaultCompressionMinBytes. Must
+// be called before serving.
+func (s *Server) SetCompression(enabled bool, minBytes int) {
+	if minBytes <= 0 {
+		minBytes = DefaultCompressionMinBytes
+	}
+	s.compressionDisabled = !enabled
+	s.compressionMinBytes = minBytes
+}
+
+// compress gzips the response if the client accepts it and the body reaches
+// the compression threshold. The body is held back until it does, so small
+// responses are sent as they are.
+func (s *Server) compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if s.compressionDisabled || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		minBytes := s.compressionMinBytes
+		if minBytes <= 0 {
+			minBytes = DefaultCompressionMinBytes
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, minBytes: minBytes}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		// gzip;q=0 explicitly refuses it
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			weight, err := strconv.ParseFloat(q, 64)
+			return err == nil && weight > 0
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter buffers the start of a response until it is known to
+// reach minBytes, then switches to gzip
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minBytes int
+
+	status int    // Status to send, zero until WriteHeader
+	buf    []byte // Body held back while under minBytes
+	gz     *gzip.Writer
+	sent   bool // Headers sent
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	if w.sent {
+		return w.ResponseWriter.Write(p)
+	}
+
+	w.buf = append(w.buf, p...)
+	if len(w.buf) < w.minBytes {
+		return len(p), nil
+	}
+
+	// Compressing an already encoded body would corrupt it
+	if w.Header().Get("Content-Encoding") != "" {
+		w.sendHeader()
+		return len(p), w.flushBuffer(w.ResponseWriter)
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	w.sendHeader()
+	w.gz = gzipWriters.Get().(*gzip.Writer)
+	w.gz.Reset(w.ResponseWriter)
+	return len(p), w.flushBuffer(w.gz)
+}
+
+// Flush sends what was written so far, compressing it once past minBytes.
+// A body still under minBytes is held back, since flushing it would commit
+// to sending it uncompressed.
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if w.gz != nil || w.sent {
+		if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+}
+
+// sendHeader sends the status and headers
+func (w *gzipResponseWriter) sendHeader() {
+	w.sent = true
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+// flushBuffer writes the held back body to dst
+func (w *gzipResponseWriter) flushBuffer(dst io.Writer) error {
+	buf := w.buf
+	w.buf = nil
+	_, err := dst.Write(buf)
+	return err
+}
+
+// close ends the response: a body that stayed under minBytes is sent as it
+// is, a compressed one is terminated
+func (w *gzipResponseWriter) close() {
+	if w.gz != nil {
+		w.gz.Close()
+		gzipWriters.Put(w.gz)
+		w.gz = nil
+		return
+	}
+	if w.sent || w.status == 0 {
+		return
+	}
+	w.sendHeader()
+	if len(w.buf) > 0 {
+		w.flushBuffer(w.ResponseWriter)
+	}
+}
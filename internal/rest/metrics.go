@@ -0,0 +1,29 @@
+package rest
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// SetMetrics chooses whether Prometheus metrics are served on GET /metrics.
+// They are by default. Must be called before serving.
+func (s *Server) SetMetrics(enabled bool) {
+	s.metricsDisabled = !enabled
+}
+
+// setupMetrics serves /metrics on the root router, ahead of the API's
+// middleware: scrapes are not logged as API requests and the exposition is
+// sent as promhttp writes it, without CORS headers. Every other path goes to
+// the API router.
+func (s *Server) setupMetrics() {
+	metrics := promhttp.Handler()
+	s.root.Get("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if s.metricsDisabled {
+			s.router.ServeHTTP(w, r)
+			return
+		}
+		metrics.ServeHTTP(w, r)
+	})
+	s.root.Mount("/", s.router)
+}
@@ -1,30 +1,61 @@
 package rest
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"runtime"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rivetq/rivetq/internal/cluster"
+	"github.com/rivetq/rivetq/internal/logging"
 	"github.com/rivetq/rivetq/internal/queue"
-	"github.com/rs/zerolog/log"
+	"github.com/rivetq/rivetq/internal/selfcheck"
+	"github.com/rivetq/rivetq/internal/store"
+	"github.com/rs/zerolog"
 )
 
 // Server provides REST API
 type Server struct {
-	manager *queue.Manager
-	router  *chi.Mux
+	manager    *queue.Manager
+	root       *chi.Mux // Serves /metrics and mounts router
+	router     *chi.Mux
+	writeGuard func() error
+	adminToken string
+	selfCheck  *selfcheck.Report
+
+	// Respond to empty leases with 200 and an empty jobs array instead of 204
+	legacyEmptyLease bool
+
+	// Gzip lease and dump responses of at least compressionMinBytes for
+	// clients accepting it, see SetCompression
+	compressionDisabled bool
+	compressionMinBytes int
+
+	// Recent log events served by /v1/admin/logs, nil when disabled
+	logBuffer *logging.RingBuffer
+
+	// Don't serve Prometheus metrics on /metrics, see SetMetrics
+	metricsDisabled bool
 }
 
 // NewServer creates a new REST server
 func NewServer(manager *queue.Manager) *Server {
 	s := &Server{
 		manager: manager,
+		root:    chi.NewRouter(),
 		router:  chi.NewRouter(),
 	}
 
 	s.setupRoutes()
+	s.setupMetrics()
 	return s
 }
 
@@ -40,43 +71,202 @@ func (s *Server) setupRoutes() {
 		r.Get("/", s.listQueues)
 		
 		r.Route("/{queue}", func(r chi.Router) {
-			r.Post("/enqueue", s.enqueue)
-			r.Post("/lease", s.lease)
+			r.With(s.requireWritable).Post("/enqueue", s.enqueue)
+			r.With(s.requireWritable).Post("/enqueue_batch", s.enqueueBatch)
+			r.With(s.requireWritable, s.compress).Post("/lease", s.lease)
+			r.With(s.requireWritable).Post("/reserve", s.reserve)
+			r.With(s.requireWritable).Post("/claim", s.claim)
+			r.With(s.requireWritable).Post("/release", s.release)
+			r.With(s.requireWritable, s.requireAdmin).Delete("/", s.deleteQueue)
 			r.Get("/stats", s.stats)
-			r.Post("/rate_limit", s.setRateLimit)
+			r.With(s.compress).Get("/dump", s.dump)
+			r.Get("/jobs", s.listJobs)
+			r.Get("/jobs/{job_id}", s.getJob)
+			r.With(s.requireWritable, s.requireAdmin).Post("/config", s.setQueueConfig)
+			r.With(s.requireWritable, s.requireAdmin).Put("/default_headers", s.setDefaultHeaders)
+			r.With(s.requireWritable).Post("/rate_limit", s.setRateLimit)
 			r.Get("/rate_limit", s.getRateLimit)
+			r.With(s.requireWritable, s.requireAdmin).Delete("/idempotency/{key}", s.clearIdempotencyKey)
+			r.With(s.requireWritable, s.requireAdmin).Post("/move_to_dlq", s.moveToDLQ)
+			r.With(s.requireWritable, s.requireAdmin).Delete("/dlq", s.purgeDLQ)
+			r.With(s.requireWritable, s.requireAdmin).Post("/dlq/requeue", s.requeueDLQ)
+			r.Get("/dlq/{job_id}", s.getDLQJob)
+			r.With(s.requireWritable, s.requireAdmin).Post("/quiesce", s.quiesceQueue)
+			r.With(s.requireWritable, s.requireAdmin).Post("/resume", s.resumeQueue)
 		})
 	})
 
-	s.router.Post("/v1/ack", s.ack)
-	s.router.Post("/v1/nack", s.nack)
+	s.router.With(s.requireWritable).Post("/v1/ack", s.ack)
+	s.router.With(s.requireWritable).Post("/v1/nack", s.nack)
+	s.router.With(s.requireWritable).Post("/v1/ack/batch", s.ackBatch)
+	s.router.With(s.requireWritable).Post("/v1/ack_and_lease", s.ackAndLease)
+	s.router.With(s.requireWritable).Post("/v1/lease/extend", s.extendLease)
+	s.router.Get("/v1/jobs/{job_id}/history", s.jobHistory)
+
+	// Admin
+	s.router.With(s.requireAdmin).Post("/v1/admin/verify_replay", s.verifyReplay)
+	s.router.With(s.requireAdmin).Post("/v1/admin/queues/{queue}/verify_heap", s.verifyHeap)
+	s.router.With(s.requireAdmin).Get("/v1/admin/node_stats", s.nodeStats)
+	s.router.With(s.requireAdmin).Get("/v1/admin/idempotency/stats", s.idempotencyStats)
+	s.router.With(s.requireAdmin).Get("/v1/admin/maintenance", s.getMaintenance)
+	s.router.With(s.requireAdmin).Post("/v1/admin/maintenance", s.setMaintenance)
+	s.router.With(s.requireAdmin).Get("/v1/admin/logs", s.recentLogs)
+	s.router.With(s.requireWritable, s.requireAdmin).Delete("/v1/admin/namespaces/{namespace}", s.purgeNamespace)
 
 	// Health check
 	s.router.Get("/healthz", s.health)
+	s.router.Get("/readyz", s.ready)
+}
+
+// SetLegacyEmptyLease makes leases that find no jobs respond 200 with an
+// empty jobs array, as before, instead of 204 No Content, for clients that
+// treat any status but 200 as a failure. Must be called before serving.
+func (s *Server) SetLegacyEmptyLease(legacy bool) {
+	s.legacyEmptyLease = legacy
+}
+
+// SetLogBuffer serves the events kept by buffer on /v1/admin/logs. The
+// buffer must also be installed as a writer of the global logger. Must be
+// called before serving.
+func (s *Server) SetLogBuffer(buffer *logging.RingBuffer) {
+	s.logBuffer = buffer
+}
+
+// SetWriteGuard installs a check run before every mutating request. If it
+// returns an error the request fails immediately with 503; in cluster mode
+// this is Node.CheckQuorum so writes don't hang while quorum is lost.
+// Must be called before serving.
+func (s *Server) SetWriteGuard(guard func() error) {
+	s.writeGuard = guard
+}
+
+// requireWritable rejects mutating requests while the write guard fails
+func (s *Server) requireWritable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.writeGuard != nil {
+			if err := s.writeGuard(); err != nil {
+				if errors.Is(err, cluster.ErrNoQuorum) {
+					respondError(w, http.StatusServiceUnavailable, "no_quorum")
+				} else {
+					respondError(w, http.StatusServiceUnavailable, err.Error())
+				}
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SetAdminToken requires admin endpoints to be called with
+// "Authorization: Bearer <token>". With no token set they are open, like the
+// rest of the API. Must be called before serving.
+func (s *Server) SetAdminToken(token string) {
+	s.adminToken = token
+}
+
+// requireAdmin rejects requests to admin endpoints without the admin token
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+				respondError(w, http.StatusForbidden, "admin token required")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 // Handler returns the HTTP handler
 func (s *Server) Handler() http.Handler {
-	return s.router
+	return s.root
 }
 
 // Request/Response types
 type EnqueueRequest struct {
+	// JobID is the job's ID, generated if empty. Enqueuing the same job
+	// again under its ID returns it; a different job gets 409.
+	JobID          string            `json:"job_id,omitempty"`
 	Payload        json.RawMessage   `json:"payload"`
 	Headers        map[string]string `json:"headers,omitempty"`
 	Priority       uint8             `json:"priority,omitempty"`
 	DelayMs        int64             `json:"delay_ms,omitempty"`
 	MaxRetries     uint32            `json:"max_retries,omitempty"`
 	IdempotencyKey string            `json:"idempotency_key,omitempty"`
+	AckMode        string            `json:"ack_mode,omitempty"` // durable (default) or buffered
+	IncludeStats   bool              `json:"include_stats,omitempty"`
+
+	// Mode is the queue's mode, "priority" or "fifo", if the enqueue
+	// creates it. An existing queue in another mode gets 409.
+	Mode string `json:"mode,omitempty"`
 }
 
 type EnqueueResponse struct {
 	JobID string `json:"job_id"`
+
+	// Stats is the queue's depth right after the enqueue, if include_stats
+	// was set
+	Stats *StatsResponse `json:"stats,omitempty"`
+}
+
+// maxBatchEnqueueJobs bounds the jobs enqueued by one batch request
+const maxBatchEnqueueJobs = 1000
+
+// EnqueueBatchRequest enqueues jobs to one queue in a single WAL write
+type EnqueueBatchRequest struct {
+	Jobs []EnqueueBatchJob `json:"jobs"`
+}
+
+// EnqueueBatchJob is one job of a batch enqueue, with the fields of a single
+// enqueue
+type EnqueueBatchJob struct {
+	JobID          string            `json:"job_id,omitempty"`
+	Payload        json.RawMessage   `json:"payload"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	Priority       uint8             `json:"priority,omitempty"`
+	DelayMs        int64             `json:"delay_ms,omitempty"`
+	MaxRetries     uint32            `json:"max_retries,omitempty"`
+	IdempotencyKey string            `json:"idempotency_key,omitempty"`
+}
+
+// EnqueueBatchResponse holds the jobs' IDs in request order. A job deduped
+// by its idempotency key or job ID gets the existing job's ID.
+type EnqueueBatchResponse struct {
+	JobIDs []string `json:"job_ids"`
+}
+
+// BatchErrorResponse is returned when a job of a batch conflicts with an
+// existing one, naming its index. Nothing in the batch is enqueued.
+type BatchErrorResponse struct {
+	Error string `json:"error"`
+	Index int    `json:"index"`
+}
+
+// IdempotencyConflictResponse is returned with 409 when strict idempotency
+// rejects a reused key, naming the job the key already maps to
+type IdempotencyConflictResponse struct {
+	Error string `json:"error"`
+	JobID string `json:"job_id"`
 }
 
 type LeaseRequest struct {
 	MaxJobs      int   `json:"max_jobs,omitempty"`
 	VisibilityMs int64 `json:"visibility_ms,omitempty"`
+	MaxBytes     int64 `json:"max_bytes,omitempty"` // Payload size budget for the batch
+
+	// Ordering is "priority" (default) or "fifo" to lease the oldest jobs
+	// first regardless of priority. It applies to this call only.
+	Ordering string `json:"ordering,omitempty"`
+
+	// ExpectedMs is how long the consumer expects to process each job. Jobs
+	// held longer are flagged overdue in the inflight dump. Without
+	// visibility_ms, the visibility timeout is derived from it.
+	ExpectedMs int64 `json:"expected_ms,omitempty"`
+
+	// WaitMs is how long to wait for a job if none is ready, rather than
+	// returning no jobs straight away. It is capped at queue.max_lease_wait.
+	WaitMs int64 `json:"wait_ms,omitempty"`
 }
 
 type LeaseResponse struct {
@@ -91,6 +281,34 @@ type JobResponse struct {
 	Priority uint8             `json:"priority"`
 	Tries    uint32            `json:"tries"`
 	LeaseID  string            `json:"lease_id"`
+
+	// FencingToken increases with every lease from a single-active-consumer queue
+	FencingToken uint64 `json:"fencing_token,omitempty"`
+}
+
+type ReserveRequest struct {
+	WindowMs int64 `json:"window_ms,omitempty"`
+}
+
+type ReserveResponse struct {
+	Job              *JobResponse `json:"job"` // Null if no job is ready
+	ReservationToken string       `json:"reservation_token,omitempty"`
+	ExpiresAt        *time.Time   `json:"expires_at,omitempty"`
+}
+
+type ClaimRequest struct {
+	JobID            string `json:"job_id"`
+	ReservationToken string `json:"reservation_token"`
+	VisibilityMs     int64  `json:"visibility_ms,omitempty"`
+}
+
+type ReleaseRequest struct {
+	JobID            string `json:"job_id"`
+	ReservationToken string `json:"reservation_token"`
+}
+
+type ReleaseResponse struct {
+	Success bool `json:"success"`
 }
 
 type AckRequest struct {
@@ -102,22 +320,253 @@ type AckResponse struct {
 	Success bool `json:"success"`
 }
 
+// AckAndLeaseRequest acks a job and leases the next one from Queue
+type AckAndLeaseRequest struct {
+	JobID        string `json:"job_id"`
+	LeaseID      string `json:"lease_id"`
+	Queue        string `json:"queue"`
+	VisibilityMs int64  `json:"visibility_ms,omitempty"`
+}
+
+// AckAndLeaseResponse holds the next job, or none if no job is ready
+type AckAndLeaseResponse struct {
+	Success bool         `json:"success"`
+	Job     *JobResponse `json:"job,omitempty"`
+}
+
 type NackRequest struct {
 	JobID   string `json:"job_id"`
 	LeaseID string `json:"lease_id"`
 	Reason  string `json:"reason,omitempty"`
+
+	// Permanent dead-letters the job without retrying it
+	Permanent bool `json:"permanent,omitempty"`
 }
 
 type NackResponse struct {
 	Success bool `json:"success"`
 }
 
+// ExtendLeaseRequest pushes a lease's deadline AdditionalMs further out
+type ExtendLeaseRequest struct {
+	JobID        string `json:"job_id"`
+	LeaseID      string `json:"lease_id"`
+	AdditionalMs int64  `json:"additional_ms"`
+}
+
+type ExtendLeaseResponse struct {
+	Success bool `json:"success"`
+}
+
+// maxBatchAckItems bounds the jobs settled by one batch ack request
+const maxBatchAckItems = 1000
+
+// BatchAckItem settles one job: an ack, or a nack if Nack is set. A
+// Permanent nack dead-letters the job without retrying it.
+type BatchAckItem struct {
+	JobID     string `json:"job_id"`
+	LeaseID   string `json:"lease_id"`
+	Nack      bool   `json:"nack,omitempty"`
+	Permanent bool   `json:"permanent,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+type BatchAckRequest struct {
+	Items []BatchAckItem `json:"items"`
+}
+
+// BatchAckResult is the outcome for one item, in request order. Error is
+// "lease_expired" when the lease timed out, like the single ack endpoint.
+type BatchAckResult struct {
+	JobID   string `json:"job_id"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+type BatchAckResponse struct {
+	Results []BatchAckResult `json:"results"`
+}
+
 type StatsResponse struct {
 	Ready    int `json:"ready"`
 	Inflight int `json:"inflight"`
 	DLQ      int `json:"dlq"`
 }
 
+// Payload encodings of a DumpRecord
+const (
+	// PayloadEncodingJSON embeds a payload that is valid JSON as is
+	PayloadEncodingJSON = "json"
+	// PayloadEncodingBase64 carries any other payload as a base64 string
+	PayloadEncodingBase64 = "base64"
+)
+
+// DumpRecord is one line of a queue dump
+type DumpRecord struct {
+	ID            string            `json:"id"`
+	Queue         string            `json:"queue"`
+	State         string            `json:"state"`
+	Payload       json.RawMessage   `json:"payload"`
+	Encoding      string            `json:"encoding"` // How Payload encodes the job's payload, see PayloadEncodingJSON
+	Headers       map[string]string `json:"headers,omitempty"`
+	Priority      uint8             `json:"priority"`
+	Tries         uint32            `json:"tries"`
+	MaxRetries    uint32            `json:"max_retries"`
+	ETA           time.Time         `json:"eta"`
+	EnqueuedAt    time.Time         `json:"enqueued_at"`
+	LeaseID       string            `json:"lease_id,omitempty"`
+	LeaseDeadline *time.Time        `json:"lease_deadline,omitempty"`
+	DLQReason     string            `json:"dlq_reason,omitempty"`
+	ExpectedMs    int64             `json:"expected_ms,omitempty"`
+	Overdue       bool              `json:"overdue,omitempty"` // Held longer than expected_ms
+}
+
+// ListedJob is a job in a listing. Its Payload and Encoding take the place of
+// the DumpRecord's, so that they can be left out of listings without payloads.
+type ListedJob struct {
+	DumpRecord
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Encoding string          `json:"encoding,omitempty"`
+}
+
+// ListJobsResponse is one page of a queue's jobs in one state, with the
+// number of jobs in that state in all
+type ListJobsResponse struct {
+	Jobs   []ListedJob `json:"jobs"`
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+}
+
+// JobInfoResponse describes one job and the state it is in: ready
+// (including delayed), reserved, inflight or dlq
+type JobInfoResponse struct {
+	ID            string            `json:"id"`
+	Queue         string            `json:"queue"`
+	Status        string            `json:"status"`
+	Payload       json.RawMessage   `json:"payload"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Priority      uint8             `json:"priority"`
+	Tries         uint32            `json:"tries"`
+	MaxRetries    uint32            `json:"max_retries"`
+	ETA           time.Time         `json:"eta"`
+	EnqueuedAt    time.Time         `json:"enqueued_at"`
+	LeaseDeadline *time.Time        `json:"lease_deadline,omitempty"`
+	DLQReason     string            `json:"dlq_reason,omitempty"`
+}
+
+// DLQJobResponse is a dead-lettered job with the context of its failure
+type DLQJobResponse struct {
+	JobInfoResponse
+	DLQAt   time.Time             `json:"dlq_at"`
+	History []store.JobTransition `json:"history"` // Failed attempts, oldest first
+}
+
+// MoveToDLQRequest selects the ready jobs to dead-letter. At least one header
+// is required so an empty body cannot dead-letter a whole queue.
+type MoveToDLQRequest struct {
+	Headers map[string]string `json:"headers"`
+}
+
+// LogsResponse holds recent log events, oldest first, as logged
+type LogsResponse struct {
+	Logs []json.RawMessage `json:"logs"`
+}
+
+// QuiesceRequest bounds how long a quiesce waits for inflight jobs to drain
+type QuiesceRequest struct {
+	TimeoutMs int64 `json:"timeout_ms,omitempty"` // Default 30000
+}
+
+// QuiesceResponse reports whether the queue drained. It stays paused either
+// way until resumed.
+type QuiesceResponse struct {
+	Drained bool   `json:"drained"`
+	Error   string `json:"error,omitempty"`
+}
+
+// PurgeNamespaceResponse counts the jobs a namespace purge deleted
+type PurgeNamespaceResponse struct {
+	Purged int `json:"purged"`
+}
+
+type MoveToDLQResponse struct {
+	Moved int `json:"moved"`
+}
+
+// RequeueDLQRequest selects the DLQ job to requeue. Without a job ID the
+// whole DLQ is requeued.
+type RequeueDLQRequest struct {
+	JobID string `json:"job_id,omitempty"`
+}
+
+// RequeueDLQResponse counts the jobs moved out of the DLQ
+type RequeueDLQResponse struct {
+	Requeued int `json:"requeued"`
+}
+
+// QueueConfigRequest changes a queue's settings
+type QueueConfigRequest struct {
+	Mode string `json:"mode"` // "priority" or "fifo"
+}
+
+// QueueConfigResponse holds a queue's settings
+type QueueConfigResponse struct {
+	Mode string `json:"mode"`
+}
+
+// DefaultHeadersRequest replaces the headers merged into every job enqueued
+// to a queue. Empty headers remove them.
+type DefaultHeadersRequest struct {
+	Headers map[string]string `json:"headers"`
+}
+
+// DefaultHeadersResponse holds a queue's default headers
+type DefaultHeadersResponse struct {
+	Headers map[string]string `json:"headers"`
+}
+
+// PurgeDLQResponse counts the jobs a DLQ purge deleted
+type PurgeDLQResponse struct {
+	Purged int `json:"purged"`
+}
+
+type VerifyReplayResponse struct {
+	OK          bool                     `json:"ok"`
+	Divergences []queue.ReplayDivergence `json:"divergences"`
+}
+
+// MaintenanceRequest enables or disables node-wide maintenance mode
+type MaintenanceRequest struct {
+	Enabled        bool `json:"enabled"`
+	RejectEnqueues bool `json:"reject_enqueues,omitempty"` // Also reject enqueues with 503
+}
+
+// IdempotencyStatsResponse reports stored idempotency keys. The totals count
+// from when the node's store was opened.
+type IdempotencyStatsResponse struct {
+	Keys         int64  `json:"keys"`
+	AddedTotal   uint64 `json:"added_total"`
+	ExpiredTotal uint64 `json:"expired_total"`
+	ClearedTotal uint64 `json:"cleared_total"`
+	TTLMs        int64  `json:"ttl_ms"` // 0 means keys are kept until cleared
+}
+
+// NodeStatsResponse is a point-in-time snapshot of node resource usage
+type NodeStatsResponse struct {
+	Goroutines     int     `json:"goroutines"`
+	HeapAllocBytes uint64  `json:"heap_alloc_bytes"`
+	HeapSysBytes   uint64  `json:"heap_sys_bytes"`
+	NumGC          uint32  `json:"num_gc"`
+	LastGCPauseMs  float64 `json:"last_gc_pause_ms"`
+	TotalGCPauseMs float64 `json:"total_gc_pause_ms"`
+	QueueCount     int     `json:"queue_count"`
+	WALSegments    int     `json:"wal_segments"`
+	WALSizeBytes   int64   `json:"wal_size_bytes"`
+	WALWriteP99Ms  float64 `json:"wal_write_p99_ms"`
+	StoreSizeBytes uint64  `json:"store_size_bytes"`
+}
+
 type RateLimitRequest struct {
 	Capacity   float64 `json:"capacity"`
 	RefillRate float64 `json:"refill_rate"`
@@ -127,6 +576,17 @@ type RateLimitResponse struct {
 	Capacity   float64 `json:"capacity"`
 	RefillRate float64 `json:"refill_rate"`
 	Exists     bool    `json:"exists"`
+
+	// Stats counts enqueues the limit allowed and rejected recently
+	Stats *RateLimitStats `json:"stats,omitempty"`
+}
+
+// RateLimitStats are a rate limit's decisions over the last window_ms
+type RateLimitStats struct {
+	WindowMs    int64   `json:"window_ms"`
+	Allowed     uint64  `json:"allowed"`
+	Rejected    uint64  `json:"rejected"`
+	RejectRatio float64 `json:"reject_ratio"`
 }
 
 // Handlers
@@ -134,32 +594,179 @@ func (s *Server) enqueue(w http.ResponseWriter, r *http.Request) {
 	queueName := chi.URLParam(r, "queue")
 
 	var req EnqueueRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid request body")
+	if verr := decodeJSON(r.Body, &req); verr != nil {
+		respondJSON(w, http.StatusBadRequest, verr)
+		return
+	}
+	if fields := validateEnqueueRequest(&req); len(fields) > 0 {
+		respondValidationError(w, fields)
 		return
 	}
 
+	ackMode, _ := queue.ParseAckMode(req.AckMode) // Validated above
+
+	if req.Mode != "" {
+		mode, _ := queue.ParseQueueMode(req.Mode) // Validated above
+		cfg := s.manager.DefaultQueueConfig()
+		cfg.Mode = mode
+		if !s.manager.CreateQueue(queueName, cfg) {
+			existing, err := s.manager.GetQueueConfig(queueName)
+			if err == nil {
+				if current, _ := queue.ParseQueueMode(string(existing.Mode)); current != mode {
+					respondError(w, http.StatusConflict, "queue_mode_conflict")
+					return
+				}
+			}
+		}
+	}
+
 	retryPolicy := queue.DefaultRetryPolicy()
 	if req.MaxRetries > 0 {
 		retryPolicy.MaxRetries = req.MaxRetries
 	}
 
-	jobID, err := s.manager.Enqueue(
-		queueName,
-		[]byte(req.Payload),
-		req.Headers,
-		req.Priority,
-		req.DelayMs,
-		retryPolicy,
-		req.IdempotencyKey,
-	)
+	var depth *queue.QueueDepth
+	if req.IncludeStats {
+		depth = &queue.QueueDepth{}
+	}
+
+	jobID, err := s.manager.EnqueueWithOptions(queueName, []byte(req.Payload), queue.EnqueueOptions{
+		Headers:        req.Headers,
+		Priority:       req.Priority,
+		DelayMs:        req.DelayMs,
+		RetryPolicy:    retryPolicy,
+		IdempotencyKey: req.IdempotencyKey,
+		RequestID:      r.Header.Get("X-Request-ID"),
+		JobID:          req.JobID,
+		AckMode:        ackMode,
+		Depth:          depth,
+	})
+	s.setRateLimitHeaders(w, queueName)
+	if err != nil {
+		if errors.Is(err, queue.ErrDelayOutOfRange) {
+			respondValidationError(w, []FieldError{{Field: "delay_ms", Message: err.Error()}})
+			return
+		}
+		if errors.Is(err, queue.ErrHeadersTooLarge) {
+			respondValidationError(w, []FieldError{{Field: "headers", Message: err.Error()}})
+			return
+		}
+		if errors.Is(err, queue.ErrMaintenance) {
+			respondError(w, http.StatusServiceUnavailable, "maintenance")
+			return
+		}
+		if errors.Is(err, queue.ErrStoreUnavailable) {
+			logging.FromRequest(r, logging.Fields{Queue: queueName}).Error().Err(err).Msg("failed to enqueue job")
+			respondError(w, http.StatusServiceUnavailable, "store_unavailable")
+			return
+		}
+		if errors.Is(err, queue.ErrIdempotencyConflict) {
+			respondJSON(w, http.StatusConflict, IdempotencyConflictResponse{Error: "idempotency_conflict", JobID: jobID})
+			return
+		}
+		// The message names the queue holding the other job, which may
+		// belong to another tenant
+		if errors.Is(err, queue.ErrJobIDCollision) {
+			respondError(w, http.StatusConflict, "job_id_collision")
+			return
+		}
+		if status := managerErrorStatus(err); status != 0 {
+			respondError(w, status, err.Error())
+			return
+		}
+		logging.FromRequest(r, logging.Fields{Queue: queueName}).Error().Err(err).Msg("failed to enqueue job")
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
+	}
+
+	resp := EnqueueResponse{JobID: jobID}
+	if depth != nil {
+		resp.Stats = &StatsResponse{
+			Ready:    depth.Ready,
+			Inflight: depth.Inflight,
+			DLQ:      depth.DLQ,
+		}
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// enqueueBatch enqueues all jobs of the request, or none if one of them is
+// invalid or conflicts
+func (s *Server) enqueueBatch(w http.ResponseWriter, r *http.Request) {
+	queueName := chi.URLParam(r, "queue")
+
+	var req EnqueueBatchRequest
+	if verr := decodeJSON(r.Body, &req); verr != nil {
+		respondJSON(w, http.StatusBadRequest, verr)
+		return
+	}
+	if fields := validateEnqueueBatchRequest(&req); len(fields) > 0 {
+		respondValidationError(w, fields)
+		return
+	}
+
+	specs := make([]queue.EnqueueSpec, len(req.Jobs))
+	for i, job := range req.Jobs {
+		retryPolicy := queue.DefaultRetryPolicy()
+		if job.MaxRetries > 0 {
+			retryPolicy.MaxRetries = job.MaxRetries
+		}
+		specs[i] = queue.EnqueueSpec{
+			JobID:          job.JobID,
+			Payload:        []byte(job.Payload),
+			Headers:        job.Headers,
+			Priority:       job.Priority,
+			DelayMs:        job.DelayMs,
+			RetryPolicy:    retryPolicy,
+			IdempotencyKey: job.IdempotencyKey,
+		}
+	}
+
+	ids, err := s.manager.EnqueueBatch(queueName, specs)
+	s.setRateLimitHeaders(w, queueName)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to enqueue job")
-		respondError(w, http.StatusInternalServerError, err.Error())
+		var batchErr *queue.BatchError
+		if errors.As(err, &batchErr) {
+			field := func(name string) []FieldError {
+				return []FieldError{{Field: fmt.Sprintf("jobs[%d].%s", batchErr.Index, name), Message: batchErr.Err.Error()}}
+			}
+			switch {
+			case errors.Is(err, queue.ErrDelayOutOfRange):
+				respondValidationError(w, field("delay_ms"))
+				return
+			case errors.Is(err, queue.ErrHeadersTooLarge):
+				respondValidationError(w, field("headers"))
+				return
+			case errors.Is(err, queue.ErrInvalidJobID):
+				respondValidationError(w, field("job_id"))
+				return
+			case errors.Is(err, queue.ErrIdempotencyConflict):
+				respondJSON(w, http.StatusConflict, BatchErrorResponse{Error: "idempotency_conflict", Index: batchErr.Index})
+				return
+			case errors.Is(err, queue.ErrJobIDCollision):
+				respondJSON(w, http.StatusConflict, BatchErrorResponse{Error: "job_id_collision", Index: batchErr.Index})
+				return
+			}
+		}
+		if errors.Is(err, queue.ErrMaintenance) {
+			respondError(w, http.StatusServiceUnavailable, "maintenance")
+			return
+		}
+		if errors.Is(err, queue.ErrStoreUnavailable) {
+			logging.FromRequest(r, logging.Fields{Queue: queueName}).Error().Err(err).Msg("failed to enqueue job batch")
+			respondError(w, http.StatusServiceUnavailable, "store_unavailable")
+			return
+		}
+		if status := managerErrorStatus(err); status != 0 {
+			respondError(w, status, err.Error())
+			return
+		}
+		logging.FromRequest(r, logging.Fields{Queue: queueName}).Error().Err(err).Msg("failed to enqueue job batch")
+		respondError(w, http.StatusInternalServerError, clientError(err))
 		return
 	}
 
-	respondJSON(w, http.StatusOK, EnqueueResponse{JobID: jobID})
+	respondJSON(w, http.StatusOK, EnqueueBatchResponse{JobIDs: ids})
 }
 
 func (s *Server) lease(w http.ResponseWriter, r *http.Request) {
@@ -174,118 +781,1099 @@ func (s *Server) lease(w http.ResponseWriter, r *http.Request) {
 	if req.MaxJobs == 0 {
 		req.MaxJobs = 1
 	}
-	if req.VisibilityMs == 0 {
+	if req.ExpectedMs < 0 {
+		respondValidationError(w, []FieldError{{Field: "expected_ms", Message: "must not be negative"}})
+		return
+	}
+	if req.WaitMs < 0 {
+		respondValidationError(w, []FieldError{{Field: "wait_ms", Message: "must not be negative"}})
+		return
+	}
+	if req.VisibilityMs == 0 && req.ExpectedMs == 0 {
 		req.VisibilityMs = 30000
 	}
 
-	jobs, err := s.manager.Lease(queueName, req.MaxJobs, req.VisibilityMs)
+	ordering, err := queue.ParseLeaseOrdering(req.Ordering)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to lease jobs")
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondValidationError(w, []FieldError{{Field: "ordering", Message: err.Error()}})
 		return
 	}
 
-	jobResponses := make([]JobResponse, len(jobs))
-	for i, job := range jobs {
-		jobResponses[i] = JobResponse{
-			ID:       job.ID,
-			Queue:    job.Queue,
-			Payload:  json.RawMessage(job.Payload),
-			Headers:  job.Headers,
-			Priority: job.Priority,
-			Tries:    job.Tries,
-			LeaseID:  job.LeaseID,
+	jobs, err := s.manager.LeaseWithOptions(r.Context(), queueName, req.MaxJobs, req.VisibilityMs, queue.LeaseOptions{
+		MaxBytes:   req.MaxBytes,
+		Ordering:   ordering,
+		ExpectedMs: req.ExpectedMs,
+		Wait:       time.Duration(req.WaitMs) * time.Millisecond,
+	})
+	if err != nil {
+		// The client went away while waiting, there is no one to answer
+		if r.Context().Err() != nil {
+			return
+		}
+		if errors.Is(err, queue.ErrVisibilityOutOfRange) {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
 		}
+		if status := managerErrorStatus(err); status != 0 {
+			respondError(w, status, err.Error())
+			return
+		}
+		logging.FromRequest(r, logging.Fields{Queue: queueName}).Error().Err(err).Msg("failed to lease jobs")
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
 	}
 
-	respondJSON(w, http.StatusOK, LeaseResponse{Jobs: jobResponses})
-}
-
-func (s *Server) ack(w http.ResponseWriter, r *http.Request) {
-	var req AckRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid request body")
+	// No jobs is 204 so clients can tell an empty queue from the status alone
+	if len(jobs) == 0 && !s.legacyEmptyLease {
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	err := s.manager.Ack(req.JobID, req.LeaseID)
-	if err != nil {
-		log.Error().Err(err).Msg("failed to ack job")
-		respondError(w, http.StatusInternalServerError, err.Error())
-		return
+	jobResponses := make([]JobResponse, len(jobs))
+	for i, job := range jobs {
+		jobResponses[i] = newJobResponse(job)
 	}
 
-	respondJSON(w, http.StatusOK, AckResponse{Success: true})
+	respondJSON(w, http.StatusOK, LeaseResponse{Jobs: jobResponses})
 }
 
-func (s *Server) nack(w http.ResponseWriter, r *http.Request) {
-	var req NackRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid request body")
-		return
-	}
+// newJobResponse converts a job for a lease-style response
+func newJobResponse(job *queue.Job) JobResponse {
+	return JobResponse{
+		ID:       job.ID,
+		Queue:    job.Queue,
+		Payload:  json.RawMessage(job.Payload),
+		Headers:  job.Headers,
+		Priority: job.Priority,
+		Tries:    job.Tries,
+		LeaseID:  job.LeaseID,
 
-	err := s.manager.Nack(req.JobID, req.LeaseID, req.Reason)
-	if err != nil {
-		log.Error().Err(err).Msg("failed to nack job")
-		respondError(w, http.StatusInternalServerError, err.Error())
-		return
+		FencingToken: job.FencingToken,
 	}
-
-	respondJSON(w, http.StatusOK, NackResponse{Success: true})
 }
 
-func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+// reserve holds the next ready job for a short window without leasing it
+func (s *Server) reserve(w http.ResponseWriter, r *http.Request) {
 	queueName := chi.URLParam(r, "queue")
 
-	ready, inflight, dlq, err := s.manager.Stats(queueName)
+	var req ReserveRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+	}
+
+	job, token, expiresAt, err := s.manager.Reserve(queueName, req.WindowMs)
 	if err != nil {
-		respondError(w, http.StatusNotFound, err.Error())
+		if status := managerErrorStatus(err); status != 0 {
+			respondError(w, status, err.Error())
+			return
+		}
+		logging.FromRequest(r, logging.Fields{Queue: queueName}).Error().Err(err).Msg("failed to reserve job")
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
+	}
+	if job == nil {
+		respondJSON(w, http.StatusOK, ReserveResponse{})
 		return
 	}
 
-	respondJSON(w, http.StatusOK, StatsResponse{
-		Ready:    ready,
-		Inflight: inflight,
-		DLQ:      dlq,
-	})
-}
-
-func (s *Server) listQueues(w http.ResponseWriter, r *http.Request) {
-	queues := s.manager.ListQueues()
-	respondJSON(w, http.StatusOK, map[string]interface{}{
-		"queues": queues,
+	resp := newJobResponse(job)
+	respondJSON(w, http.StatusOK, ReserveResponse{
+		Job:              &resp,
+		ReservationToken: token,
+		ExpiresAt:        &expiresAt,
 	})
 }
 
-func (s *Server) setRateLimit(w http.ResponseWriter, r *http.Request) {
+// claim turns a reservation into a normal lease
+func (s *Server) claim(w http.ResponseWriter, r *http.Request) {
 	queueName := chi.URLParam(r, "queue")
 
-	var req RateLimitRequest
+	var req ClaimRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		respondError(w, http.StatusBadRequest, "invalid request body")
 		return
 	}
+	if req.VisibilityMs == 0 {
+		req.VisibilityMs = 30000
+	}
 
-	s.manager.SetRateLimit(queueName, req.Capacity, req.RefillRate)
-	respondJSON(w, http.StatusOK, map[string]bool{"success": true})
+	job, err := s.manager.Claim(queueName, req.JobID, req.ReservationToken, req.VisibilityMs)
+	if err != nil {
+		switch {
+		case errors.Is(err, queue.ErrReservationNotFound):
+			respondError(w, http.StatusNotFound, err.Error())
+		case errors.Is(err, queue.ErrVisibilityOutOfRange):
+			respondError(w, http.StatusBadRequest, err.Error())
+		case managerErrorStatus(err) != 0:
+			respondError(w, managerErrorStatus(err), err.Error())
+		default:
+			logging.FromRequest(r, logging.Fields{Queue: queueName, JobID: req.JobID}).Error().Err(err).Msg("failed to claim job")
+			respondError(w, http.StatusInternalServerError, clientError(err))
+		}
+		return
+	}
+
+	respondJSON(w, http.StatusOK, newJobResponse(job))
 }
 
-func (s *Server) getRateLimit(w http.ResponseWriter, r *http.Request) {
+// release hands a reserved job back to the queue without counting a try
+func (s *Server) release(w http.ResponseWriter, r *http.Request) {
 	queueName := chi.URLParam(r, "queue")
 
-	capacity, refillRate, exists := s.manager.GetRateLimit(queueName)
-	respondJSON(w, http.StatusOK, RateLimitResponse{
-		Capacity:   capacity,
+	var req ReleaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if err := s.manager.Release(queueName, req.JobID, req.ReservationToken); err != nil {
+		if errors.Is(err, queue.ErrReservationNotFound) {
+			respondError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if status := managerErrorStatus(err); status != 0 {
+			respondError(w, status, err.Error())
+			return
+		}
+		logging.FromRequest(r, logging.Fields{Queue: queueName, JobID: req.JobID}).Error().Err(err).Msg("failed to release job")
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
+	}
+
+	respondJSON(w, http.StatusOK, ReleaseResponse{Success: true})
+}
+
+func (s *Server) ack(w http.ResponseWriter, r *http.Request) {
+	var req AckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	err := s.manager.Ack(req.JobID, req.LeaseID)
+	if err != nil {
+		logging.FromRequest(r, logging.Fields{JobID: req.JobID, LeaseID: req.LeaseID}).Error().Err(err).Msg("failed to ack job")
+		if errors.Is(err, queue.ErrLeaseExpired) {
+			respondError(w, http.StatusConflict, "lease_expired")
+			return
+		}
+		if status := managerErrorStatus(err); status != 0 {
+			respondError(w, status, err.Error())
+			return
+		}
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
+	}
+
+	respondJSON(w, http.StatusOK, AckResponse{Success: true})
+}
+
+// ackAndLease acks a job, then leases the next job from the given queue
+func (s *Server) ackAndLease(w http.ResponseWriter, r *http.Request) {
+	var req AckAndLeaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if req.Queue == "" {
+		respondValidationError(w, []FieldError{{Field: "queue", Message: "is required"}})
+		return
+	}
+	if req.VisibilityMs == 0 {
+		req.VisibilityMs = 30000
+	}
+
+	job, err := s.manager.AckAndLease(req.JobID, req.LeaseID, req.Queue, req.VisibilityMs)
+	if err != nil {
+		logging.FromRequest(r, logging.Fields{Queue: req.Queue, JobID: req.JobID, LeaseID: req.LeaseID}).Error().Err(err).Msg("failed to ack and lease")
+		switch {
+		case errors.Is(err, queue.ErrLeaseExpired):
+			respondError(w, http.StatusConflict, "lease_expired")
+		case errors.Is(err, queue.ErrVisibilityOutOfRange):
+			respondError(w, http.StatusBadRequest, err.Error())
+		case managerErrorStatus(err) != 0:
+			respondError(w, managerErrorStatus(err), err.Error())
+		default:
+			respondError(w, http.StatusInternalServerError, clientError(err))
+		}
+		return
+	}
+
+	resp := AckAndLeaseResponse{Success: true}
+	if job != nil {
+		jobResponse := newJobResponse(job)
+		resp.Job = &jobResponse
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) nack(w http.ResponseWriter, r *http.Request) {
+	var req NackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	nack := s.manager.Nack
+	if req.Permanent {
+		nack = s.manager.NackPermanent
+	}
+	err := nack(req.JobID, req.LeaseID, req.Reason)
+	if err != nil {
+		logging.FromRequest(r, logging.Fields{JobID: req.JobID, LeaseID: req.LeaseID}).Error().Err(err).Msg("failed to nack job")
+		if errors.Is(err, queue.ErrLeaseExpired) {
+			respondError(w, http.StatusConflict, "lease_expired")
+			return
+		}
+		if status := managerErrorStatus(err); status != 0 {
+			respondError(w, status, err.Error())
+			return
+		}
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
+	}
+
+	respondJSON(w, http.StatusOK, NackResponse{Success: true})
+}
+
+// extendLease gives a consumer more time to finish an inflight job
+func (s *Server) extendLease(w http.ResponseWriter, r *http.Request) {
+	var req ExtendLeaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if req.AdditionalMs <= 0 {
+		respondValidationError(w, []FieldError{{Field: "additional_ms", Message: "must be positive"}})
+		return
+	}
+
+	err := s.manager.ExtendLease(req.JobID, req.LeaseID, req.AdditionalMs)
+	if err != nil {
+		logging.FromRequest(r, logging.Fields{JobID: req.JobID, LeaseID: req.LeaseID}).Error().Err(err).Msg("failed to extend lease")
+		if errors.Is(err, queue.ErrLeaseExpired) {
+			respondError(w, http.StatusConflict, "lease_expired")
+			return
+		}
+		if errors.Is(err, queue.ErrVisibilityOutOfRange) {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if status := managerErrorStatus(err); status != 0 {
+			respondError(w, status, err.Error())
+			return
+		}
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
+	}
+
+	respondJSON(w, http.StatusOK, ExtendLeaseResponse{Success: true})
+}
+
+// ackBatch acks and nacks several jobs in one request. Items are settled in
+// order and independently: one failing does not stop the rest.
+func (s *Server) ackBatch(w http.ResponseWriter, r *http.Request) {
+	var req BatchAckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if len(req.Items) > maxBatchAckItems {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("too many items: %d (max %d)", len(req.Items), maxBatchAckItems))
+		return
+	}
+
+	results := make([]BatchAckResult, len(req.Items))
+	for i, item := range req.Items {
+		var err error
+		if item.Nack && item.Permanent {
+			err = s.manager.NackPermanent(item.JobID, item.LeaseID, item.Reason)
+		} else if item.Nack {
+			err = s.manager.Nack(item.JobID, item.LeaseID, item.Reason)
+		} else {
+			err = s.manager.Ack(item.JobID, item.LeaseID)
+		}
+
+		results[i] = BatchAckResult{JobID: item.JobID, Success: err == nil}
+		switch {
+		case err == nil:
+		case errors.Is(err, queue.ErrLeaseExpired):
+			results[i].Error = "lease_expired"
+		default:
+			logging.FromRequest(r, logging.Fields{JobID: item.JobID, LeaseID: item.LeaseID}).Error().Err(err).Bool("nack", item.Nack).Msg("failed to settle job in batch")
+			results[i].Error = clientError(err)
+		}
+	}
+
+	respondJSON(w, http.StatusOK, BatchAckResponse{Results: results})
+}
+
+type JobHistoryResponse struct {
+	JobID   string                `json:"job_id"`
+	History []store.JobTransition `json:"history"`
+}
+
+// jobHistory returns a job's retry timeline
+func (s *Server) jobHistory(w http.ResponseWriter, r *http.Request) {
+	jobID := chi.URLParam(r, "job_id")
+
+	history, err := s.manager.JobHistory(jobID)
+	if err != nil {
+		logging.FromRequest(r, logging.Fields{JobID: jobID}).Error().Err(err).Msg("failed to get job history")
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
+	}
+	if history == nil {
+		respondError(w, http.StatusNotFound, "no history for job: "+jobID)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, JobHistoryResponse{JobID: jobID, History: history})
+}
+
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	queueName := chi.URLParam(r, "queue")
+
+	ready, inflight, dlq, err := s.manager.Stats(queueName)
+	if err != nil {
+		respondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, StatsResponse{
+		Ready:    ready,
+		Inflight: inflight,
+		DLQ:      dlq,
+	})
+}
+
+// dumpJobsPerSecond bounds how fast a dump streams a queue, so that dumping
+// a large queue does not take over the node's disk and network. Pages are
+// flushed as they are written.
+const dumpJobsPerSecond = 20000
+
+// dump streams a consistent snapshot of a queue's jobs as newline-delimited
+// JSON, a page at a time, see queue.Manager.DumpJobs
+func (s *Server) dump(w http.ResponseWriter, r *http.Request) {
+	queueName := chi.URLParam(r, "queue")
+
+	var states []queue.JobStatus
+	switch state := r.URL.Query().Get("state"); state {
+	case "", "all":
+	case string(queue.JobStatusReady), string(queue.JobStatusReserved), string(queue.JobStatusInflight), string(queue.JobStatusDLQ):
+		states = append(states, queue.JobStatus(state))
+	default:
+		respondError(w, http.StatusBadRequest, "state must be one of ready, inflight, dlq, all")
+		return
+	}
+
+	// The response starts with the first page, so a missing queue still
+	// gets a 404
+	started := false
+	start := func() {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+	}
+
+	pause := time.Duration(queue.DumpPageSize) * time.Second / dumpJobsPerSecond
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	err := s.manager.DumpJobs(queueName, states, func(jobs []queue.Job) error {
+		if started {
+			select {
+			case <-r.Context().Done():
+				return r.Context().Err() // Client went away
+			case <-time.After(pause):
+			}
+		}
+		start()
+
+		for i := range jobs {
+			if err := enc.Encode(newDumpRecord(&jobs[i])); err != nil {
+				return err
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	switch {
+	case err == nil:
+		start()
+	case !started && errors.Is(err, queue.ErrQueueNotFound):
+		respondError(w, http.StatusNotFound, err.Error())
+	case !started:
+		logging.FromRequest(r, logging.Fields{Queue: queueName}).Error().Err(err).Msg("failed to dump queue")
+		respondError(w, http.StatusInternalServerError, clientError(err))
+	case r.Context().Err() == nil:
+		logging.FromRequest(r, logging.Fields{Queue: queueName}).Error().Err(err).Msg("failed to write dump")
+	}
+}
+
+// listJobs returns a page of the queue's jobs in one state: ?state= ready
+// (the default), reserved, inflight or dlq, from ?offset= (default 0), at
+// most ?limit= of them. Payloads are left out with ?include_payload=false.
+func (s *Server) listJobs(w http.ResponseWriter, r *http.Request) {
+	queueName := chi.URLParam(r, "queue")
+	query := r.URL.Query()
+
+	var fieldErrors []FieldError
+	state := queue.JobStatusReady
+	if v := query.Get("state"); v != "" {
+		state = queue.JobStatus(v)
+	}
+	switch state {
+	case queue.JobStatusReady, queue.JobStatusReserved, queue.JobStatusInflight, queue.JobStatusDLQ:
+	default:
+		fieldErrors = append(fieldErrors, FieldError{Field: "state", Message: "must be one of ready, reserved, inflight, dlq"})
+	}
+	offset := 0
+	if v := query.Get("offset"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 0 {
+			fieldErrors = append(fieldErrors, FieldError{Field: "offset", Message: "must be a non-negative integer"})
+		}
+		offset = parsed
+	}
+	limit := queue.DefaultListJobsLimit
+	if v := query.Get("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 || parsed > queue.MaxListJobsLimit {
+			fieldErrors = append(fieldErrors, FieldError{Field: "limit", Message: fmt.Sprintf("must be an integer from 1 to %d", queue.MaxListJobsLimit)})
+		}
+		limit = parsed
+	}
+	includePayload := true
+	if v := query.Get("include_payload"); v != "" {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			fieldErrors = append(fieldErrors, FieldError{Field: "include_payload", Message: "must be true or false"})
+		}
+		includePayload = parsed
+	}
+	if len(fieldErrors) > 0 {
+		respondValidationError(w, fieldErrors)
+		return
+	}
+
+	jobs, total, err := s.manager.ListJobs(queueName, state, offset, limit)
+	if err != nil {
+		if status := managerErrorStatus(err); status != 0 {
+			respondError(w, status, err.Error())
+			return
+		}
+		logging.FromRequest(r, logging.Fields{Queue: queueName}).Error().Err(err).Msg("failed to list jobs")
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
+	}
+
+	resp := ListJobsResponse{
+		Jobs:   make([]ListedJob, len(jobs)),
+		Total:  total,
+		Offset: offset,
+		Limit:  limit,
+	}
+	for i, job := range jobs {
+		resp.Jobs[i] = ListedJob{DumpRecord: newDumpRecord(job)}
+		if includePayload {
+			resp.Jobs[i].Payload = resp.Jobs[i].DumpRecord.Payload
+			resp.Jobs[i].Encoding = resp.Jobs[i].DumpRecord.Encoding
+		}
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// newDumpRecord converts a job snapshot to its dump representation.
+// Payloads that are not valid JSON are emitted as base64 strings, and
+// Encoding tells the two apart.
+func newDumpRecord(job *queue.Job) DumpRecord {
+	payload, encoding := json.RawMessage(job.Payload), PayloadEncodingJSON
+	if !json.Valid(job.Payload) {
+		payload, _ = json.Marshal(job.Payload)
+		encoding = PayloadEncodingBase64
+	}
+
+	rec := DumpRecord{
+		ID:         job.ID,
+		Queue:      job.Queue,
+		State:      string(job.Status),
+		Payload:    payload,
+		Encoding:   encoding,
+		Headers:    job.Headers,
+		Priority:   job.Priority,
+		Tries:      job.Tries,
+		MaxRetries: job.MaxRetries,
+		ETA:        job.ETA,
+		EnqueuedAt: job.EnqueuedAt,
+		LeaseID:    job.LeaseID,
+		DLQReason:  job.DLQReason,
+	}
+	if job.Status == queue.JobStatusInflight {
+		rec.ExpectedMs = job.ExpectedMs
+		rec.Overdue = job.Overdue(time.Now())
+	}
+	if !job.LeaseDeadline.IsZero() {
+		deadline := job.LeaseDeadline
+		rec.LeaseDeadline = &deadline
+	}
+	return rec
+}
+
+// getJob returns a job without leasing it, for inspecting stuck queues
+func (s *Server) getJob(w http.ResponseWriter, r *http.Request) {
+	queueName := chi.URLParam(r, "queue")
+	jobID := chi.URLParam(r, "job_id")
+
+	job, err := s.manager.GetJob(queueName, jobID)
+	if err != nil {
+		if status := managerErrorStatus(err); status != 0 {
+			respondError(w, status, err.Error())
+			return
+		}
+		logging.FromRequest(r, logging.Fields{Queue: queueName, JobID: jobID}).Error().Err(err).Msg("failed to get job")
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
+	}
+
+	respondJSON(w, http.StatusOK, newJobInfoResponse(job))
+}
+
+// newJobInfoResponse describes a job snapshot. The lease ID is left out: it
+// would let anyone inspecting the queue ack the job.
+func newJobInfoResponse(job *queue.Job) JobInfoResponse {
+	rec := newDumpRecord(job)
+	return JobInfoResponse{
+		ID:            rec.ID,
+		Queue:         rec.Queue,
+		Status:        rec.State,
+		Payload:       rec.Payload,
+		Headers:       rec.Headers,
+		Priority:      rec.Priority,
+		Tries:         rec.Tries,
+		MaxRetries:    rec.MaxRetries,
+		ETA:           rec.ETA,
+		EnqueuedAt:    rec.EnqueuedAt,
+		LeaseDeadline: rec.LeaseDeadline,
+		DLQReason:     rec.DLQReason,
+	}
+}
+
+// getDLQJob returns a dead-lettered job with its payload, when and why it
+// was dead-lettered and the reasons of its failed attempts
+func (s *Server) getDLQJob(w http.ResponseWriter, r *http.Request) {
+	queueName := chi.URLParam(r, "queue")
+	jobID := chi.URLParam(r, "job_id")
+
+	job, err := s.manager.GetDLQJob(queueName, jobID)
+	if err != nil {
+		if status := managerErrorStatus(err); status != 0 {
+			respondError(w, status, err.Error())
+			return
+		}
+		logging.FromRequest(r, logging.Fields{Queue: queueName, JobID: jobID}).Error().Err(err).Msg("failed to get DLQ job")
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
+	}
+
+	history := job.History
+	if history == nil {
+		history = []store.JobTransition{}
+	}
+	respondJSON(w, http.StatusOK, DLQJobResponse{
+		JobInfoResponse: newJobInfoResponse(job.Job),
+		DLQAt:           job.DLQAt,
+		History:         history,
+	})
+}
+
+func (s *Server) listQueues(w http.ResponseWriter, r *http.Request) {
+	queues := s.manager.ListQueues()
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"queues": queues,
+	})
+}
+
+func (s *Server) setRateLimit(w http.ResponseWriter, r *http.Request) {
+	queueName := chi.URLParam(r, "queue")
+
+	var req RateLimitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	s.manager.SetRateLimit(queueName, req.Capacity, req.RefillRate)
+	respondJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+func (s *Server) getRateLimit(w http.ResponseWriter, r *http.Request) {
+	queueName := chi.URLParam(r, "queue")
+
+	capacity, refillRate, exists := s.manager.GetRateLimit(queueName)
+	resp := RateLimitResponse{
+		Capacity:   capacity,
 		RefillRate: refillRate,
 		Exists:     exists,
+	}
+	if stats, ok := s.manager.RateLimitStats(queueName); ok {
+		resp.Stats = &RateLimitStats{
+			WindowMs:    stats.Window.Milliseconds(),
+			Allowed:     stats.Allowed,
+			Rejected:    stats.Rejected,
+			RejectRatio: stats.RejectRatio,
+		}
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// verifyReplay checks that replaying the WAL reproduces the live state
+func (s *Server) verifyReplay(w http.ResponseWriter, r *http.Request) {
+	divergences, err := s.manager.VerifyReplay()
+	if err != nil {
+		logging.FromRequest(r, logging.Fields{}).Error().Err(err).Msg("failed to verify replay")
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
+	}
+
+	if len(divergences) > 0 {
+		logging.FromRequest(r, logging.Fields{}).Warn().Int("divergences", len(divergences)).Msg("WAL replay diverges from live state")
+	} else {
+		divergences = []queue.ReplayDivergence{}
+	}
+
+	respondJSON(w, http.StatusOK, VerifyReplayResponse{
+		OK:          len(divergences) == 0,
+		Divergences: divergences,
 	})
 }
 
+// verifyHeap checks a queue's ready heap and repairs it if corrupt
+func (s *Server) verifyHeap(w http.ResponseWriter, r *http.Request) {
+	queueName := chi.URLParam(r, "queue")
+
+	check, err := s.manager.VerifyHeap(queueName)
+	if err != nil {
+		respondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, check)
+}
+
+// purgeNamespace deletes every queue in a tenant namespace with its jobs
+func (s *Server) purgeNamespace(w http.ResponseWriter, r *http.Request) {
+	namespace := chi.URLParam(r, "namespace")
+
+	purged, err := s.manager.PurgeNamespace(namespace)
+	if err != nil {
+		if errors.Is(err, queue.ErrInvalidNamespace) {
+			respondValidationError(w, []FieldError{{Field: "namespace", Message: err.Error()}})
+			return
+		}
+		logging.FromRequest(r, logging.Fields{}).Error().Err(err).Str("namespace", namespace).Msg("failed to purge namespace")
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
+	}
+
+	respondJSON(w, http.StatusOK, PurgeNamespaceResponse{Purged: purged})
+}
+
+// defaultLogsLimit is how many log events /v1/admin/logs returns by default
+const defaultLogsLimit = 100
+
+// recentLogs returns the most recent buffered log events, optionally only
+// those at ?level= or above, at most ?limit= of them
+func (s *Server) recentLogs(w http.ResponseWriter, r *http.Request) {
+	if s.logBuffer == nil {
+		respondError(w, http.StatusNotFound, "log buffer is disabled, set logging.buffer_size")
+		return
+	}
+
+	level := zerolog.TraceLevel
+	if v := r.URL.Query().Get("level"); v != "" {
+		parsed, err := zerolog.ParseLevel(v)
+		if err != nil || parsed == zerolog.NoLevel {
+			respondValidationError(w, []FieldError{{Field: "level", Message: fmt.Sprintf("unknown level %q", v)}})
+			return
+		}
+		level = parsed
+	}
+
+	limit := defaultLogsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 {
+			respondValidationError(w, []FieldError{{Field: "limit", Message: "must be a positive integer"}})
+			return
+		}
+		limit = parsed
+	}
+
+	logs := s.logBuffer.Recent(level, limit)
+	if logs == nil {
+		logs = []json.RawMessage{}
+	}
+	respondJSON(w, http.StatusOK, LogsResponse{Logs: logs})
+}
+
+// nodeStats reports runtime and storage metrics for this node
+func (s *Server) nodeStats(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	var lastPause uint64
+	if mem.NumGC > 0 {
+		lastPause = mem.PauseNs[(mem.NumGC+255)%256]
+	}
+
+	storage := s.manager.StorageStats()
+
+	respondJSON(w, http.StatusOK, NodeStatsResponse{
+		Goroutines:     runtime.NumGoroutine(),
+		HeapAllocBytes: mem.HeapAlloc,
+		HeapSysBytes:   mem.HeapSys,
+		NumGC:          mem.NumGC,
+		LastGCPauseMs:  float64(lastPause) / float64(time.Millisecond),
+		TotalGCPauseMs: float64(mem.PauseTotalNs) / float64(time.Millisecond),
+		QueueCount:     storage.Queues,
+		WALSegments:    storage.WALSegments,
+		WALSizeBytes:   storage.WALSizeBytes,
+		WALWriteP99Ms:  float64(storage.WALWriteP99) / float64(time.Millisecond),
+		StoreSizeBytes: storage.StoreSizeBytes,
+	})
+}
+
+// idempotencyStats reports how many idempotency keys are stored
+func (s *Server) idempotencyStats(w http.ResponseWriter, r *http.Request) {
+	stats := s.manager.IdempotencyStats()
+
+	respondJSON(w, http.StatusOK, IdempotencyStatsResponse{
+		Keys:         stats.Keys,
+		AddedTotal:   stats.AddedTotal,
+		ExpiredTotal: stats.ExpiredTotal,
+		ClearedTotal: stats.ClearedTotal,
+		TTLMs:        s.manager.IdempotencyTTL().Milliseconds(),
+	})
+}
+
+// getMaintenance reports the node's maintenance mode
+func (s *Server) getMaintenance(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, s.manager.Maintenance())
+}
+
+// setMaintenance enables or disables node-wide maintenance mode
+func (s *Server) setMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req MaintenanceRequest
+	if verr := decodeJSON(r.Body, &req); verr != nil {
+		respondJSON(w, http.StatusBadRequest, verr)
+		return
+	}
+
+	err := s.manager.SetMaintenance(queue.MaintenanceMode{
+		Enabled:        req.Enabled,
+		RejectEnqueues: req.RejectEnqueues,
+	})
+	if err != nil {
+		logging.FromRequest(r, logging.Fields{}).Error().Err(err).Msg("failed to set maintenance mode")
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
+	}
+
+	respondJSON(w, http.StatusOK, s.manager.Maintenance())
+}
+
+// moveToDLQ dead-letters the queue's ready jobs matching a header filter
+func (s *Server) moveToDLQ(w http.ResponseWriter, r *http.Request) {
+	queueName := chi.URLParam(r, "queue")
+
+	var req MoveToDLQRequest
+	if verr := decodeJSON(r.Body, &req); verr != nil {
+		respondJSON(w, http.StatusBadRequest, verr)
+		return
+	}
+	if len(req.Headers) == 0 {
+		respondValidationError(w, []FieldError{{Field: "headers", Message: "at least one header is required"}})
+		return
+	}
+
+	if _, err := s.manager.GetQueueConfig(queueName); err != nil {
+		respondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	moved, err := s.manager.MoveToDLQ(queueName, queue.HeaderFilter(req.Headers))
+	if err != nil {
+		if errors.Is(err, queue.ErrDLQDisabled) {
+			respondError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if status := managerErrorStatus(err); status != 0 {
+			respondError(w, status, err.Error())
+			return
+		}
+		logging.FromRequest(r, logging.Fields{Queue: queueName}).Error().Err(err).Msg("failed to move jobs to DLQ")
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
+	}
+
+	respondJSON(w, http.StatusOK, MoveToDLQResponse{Moved: moved})
+}
+
+// deleteQueue deletes the queue and its jobs. It is refused while jobs are
+// leased or reserved unless ?force=true.
+func (s *Server) deleteQueue(w http.ResponseWriter, r *http.Request) {
+	queueName := chi.URLParam(r, "queue")
+
+	force := false
+	if v := r.URL.Query().Get("force"); v != "" {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			respondValidationError(w, []FieldError{{Field: "force", Message: "must be true or false"}})
+			return
+		}
+		force = parsed
+	}
+
+	if err := s.manager.DeleteQueue(queueName, force); err != nil {
+		if errors.Is(err, queue.ErrQueueBusy) {
+			respondError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if status := managerErrorStatus(err); status != 0 {
+			respondError(w, status, err.Error())
+			return
+		}
+		logging.FromRequest(r, logging.Fields{Queue: queueName}).Error().Err(err).Msg("failed to delete queue")
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// purgeDLQ deletes the queue's dead-lettered jobs, optionally only those
+// that entered the DLQ more than older_than_ms ago
+func (s *Server) purgeDLQ(w http.ResponseWriter, r *http.Request) {
+	queueName := chi.URLParam(r, "queue")
+
+	var olderThan time.Duration
+	if v := r.URL.Query().Get("older_than_ms"); v != "" {
+		parsed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || parsed <= 0 {
+			respondValidationError(w, []FieldError{{Field: "older_than_ms", Message: "must be a positive integer"}})
+			return
+		}
+		olderThan = time.Duration(parsed) * time.Millisecond
+	}
+
+	purged, err := s.manager.PurgeDLQ(queueName, olderThan)
+	if err != nil {
+		if status := managerErrorStatus(err); status != 0 {
+			respondError(w, status, err.Error())
+			return
+		}
+		logging.FromRequest(r, logging.Fields{Queue: queueName}).Error().Err(err).Msg("failed to purge DLQ")
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
+	}
+
+	respondJSON(w, http.StatusOK, PurgeDLQResponse{Purged: purged})
+}
+
+// requeueDLQ moves one job, or every job, out of the queue's DLQ back to
+// its ready jobs with their tries reset
+func (s *Server) requeueDLQ(w http.ResponseWriter, r *http.Request) {
+	queueName := chi.URLParam(r, "queue")
+
+	var req RequeueDLQRequest
+	if r.ContentLength != 0 {
+		if verr := decodeJSON(r.Body, &req); verr != nil {
+			respondJSON(w, http.StatusBadRequest, verr)
+			return
+		}
+	}
+
+	requeued := 1
+	var err error
+	if req.JobID != "" {
+		err = s.manager.RequeueDLQ(queueName, req.JobID)
+	} else {
+		requeued, err = s.manager.RequeueAllDLQ(queueName)
+	}
+	if err != nil {
+		if status := managerErrorStatus(err); status != 0 {
+			respondError(w, status, err.Error())
+			return
+		}
+		logging.FromRequest(r, logging.Fields{Queue: queueName, JobID: req.JobID}).Error().Err(err).Msg("failed to requeue DLQ jobs")
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
+	}
+
+	respondJSON(w, http.StatusOK, RequeueDLQResponse{Requeued: requeued})
+}
+
+// setQueueConfig changes a queue's mode, creating the queue if needed
+func (s *Server) setQueueConfig(w http.ResponseWriter, r *http.Request) {
+	queueName := chi.URLParam(r, "queue")
+
+	var req QueueConfigRequest
+	if verr := decodeJSON(r.Body, &req); verr != nil {
+		respondJSON(w, http.StatusBadRequest, verr)
+		return
+	}
+	mode, err := queue.ParseQueueMode(req.Mode)
+	if err != nil {
+		respondValidationError(w, []FieldError{{Field: "mode", Message: err.Error()}})
+		return
+	}
+
+	if err := s.manager.SetQueueMode(queueName, mode); err != nil {
+		logging.FromRequest(r, logging.Fields{Queue: queueName}).Error().Err(err).Msg("failed to set queue mode")
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
+	}
+
+	respondJSON(w, http.StatusOK, QueueConfigResponse{Mode: string(mode)})
+}
+
+// setDefaultHeaders replaces a queue's default headers, creating the queue
+// if needed
+func (s *Server) setDefaultHeaders(w http.ResponseWriter, r *http.Request) {
+	queueName := chi.URLParam(r, "queue")
+
+	var req DefaultHeadersRequest
+	if verr := decodeJSON(r.Body, &req); verr != nil {
+		respondJSON(w, http.StatusBadRequest, verr)
+		return
+	}
+
+	if err := s.manager.SetDefaultHeaders(queueName, req.Headers); err != nil {
+		if errors.Is(err, queue.ErrHeadersTooLarge) {
+			respondValidationError(w, []FieldError{{Field: "headers", Message: err.Error()}})
+			return
+		}
+		logging.FromRequest(r, logging.Fields{Queue: queueName}).Error().Err(err).Msg("failed to set default headers")
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
+	}
+
+	respondJSON(w, http.StatusOK, DefaultHeadersResponse{Headers: req.Headers})
+}
+
+// quiesceQueue pauses leasing from a queue and waits for its inflight jobs
+// to drain
+func (s *Server) quiesceQueue(w http.ResponseWriter, r *http.Request) {
+	queueName := chi.URLParam(r, "queue")
+
+	var req QuiesceRequest
+	if r.ContentLength != 0 {
+		if verr := decodeJSON(r.Body, &req); verr != nil {
+			respondJSON(w, http.StatusBadRequest, verr)
+			return
+		}
+	}
+	if req.TimeoutMs < 0 {
+		respondValidationError(w, []FieldError{{Field: "timeout_ms", Message: "must not be negative"}})
+		return
+	}
+	timeout := queue.DefaultQuiesceTimeout
+	if req.TimeoutMs > 0 {
+		timeout = time.Duration(req.TimeoutMs) * time.Millisecond
+	}
+
+	if _, err := s.manager.GetQueueConfig(queueName); err != nil {
+		respondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	err := s.manager.QuiesceQueue(r.Context(), queueName, timeout)
+	switch {
+	case err == nil:
+		respondJSON(w, http.StatusOK, QuiesceResponse{Drained: true})
+	case errors.Is(err, queue.ErrNotDrained):
+		respondJSON(w, http.StatusOK, QuiesceResponse{Drained: false, Error: err.Error()})
+	case r.Context().Err() != nil:
+		// The client went away; the queue stays paused
+	default:
+		logging.FromRequest(r, logging.Fields{Queue: queueName}).Error().Err(err).Msg("failed to quiesce queue")
+		respondError(w, http.StatusInternalServerError, clientError(err))
+	}
+}
+
+// resumeQueue lets a quiesced queue be leased from again
+func (s *Server) resumeQueue(w http.ResponseWriter, r *http.Request) {
+	queueName := chi.URLParam(r, "queue")
+
+	if err := s.manager.ResumeQueue(queueName); err != nil {
+		respondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// clearIdempotencyKey releases an idempotency key for reuse
+func (s *Server) clearIdempotencyKey(w http.ResponseWriter, r *http.Request) {
+	queueName := chi.URLParam(r, "queue")
+	key := chi.URLParam(r, "key")
+
+	if err := s.manager.ClearIdempotencyKey(queueName, key); err != nil {
+		if errors.Is(err, queue.ErrIdempotencyKeyNotFound) {
+			respondError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		logging.FromRequest(r, logging.Fields{Queue: queueName}).Error().Err(err).Msg("failed to clear idempotency key")
+		respondError(w, http.StatusInternalServerError, clientError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (s *Server) health(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusOK, map[string]string{"status": "healthy"})
 }
 
+// SetSelfCheck records the startup self-check result reported by /readyz.
+// Without one the server reports not ready. Must be called before serving.
+func (s *Server) SetSelfCheck(report *selfcheck.Report) {
+	s.selfCheck = report
+}
+
+// ReadyResponse is returned by /readyz
+type ReadyResponse struct {
+	Status    string            `json:"status"` // "ready", "not_ready", "maintenance" or "store_unavailable"
+	SelfCheck *selfcheck.Report `json:"self_check,omitempty"`
+}
+
+// ready reports whether the startup self-check passed, the node is not in
+// maintenance mode and its store is readable, so load balancers drain a node
+// being quiesced or whose store is failing
+func (s *Server) ready(w http.ResponseWriter, r *http.Request) {
+	report := s.selfCheck
+	if report == nil || !report.OK {
+		respondJSON(w, http.StatusServiceUnavailable, ReadyResponse{Status: "not_ready", SelfCheck: report})
+		return
+	}
+	if s.manager.Maintenance().Enabled {
+		respondJSON(w, http.StatusServiceUnavailable, ReadyResponse{Status: "maintenance", SelfCheck: report})
+		return
+	}
+	if err := s.manager.CheckStore(); err != nil {
+		logging.FromRequest(r, logging.Fields{}).Error().Err(err).Msg("store check failed")
+		respondJSON(w, http.StatusServiceUnavailable, ReadyResponse{Status: "store_unavailable", SelfCheck: report})
+		return
+	}
+	respondJSON(w, http.StatusOK, ReadyResponse{Status: "ready", SelfCheck: report})
+}
+
 // Helper functions
 func respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
@@ -293,15 +1881,55 @@ func respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	json.NewEncoder(w).Encode(data)
 }
 
+// setRateLimitHeaders advertises the queue's rate-limit headroom so clients
+// can self-throttle. Reset is the number of seconds until the bucket is full.
+func (s *Server) setRateLimitHeaders(w http.ResponseWriter, queueName string) {
+	status, limited := s.manager.RateLimitStatus(queueName)
+	if !limited {
+		return
+	}
+
+	w.Header().Set("X-RateLimit-Limit", strconv.FormatInt(int64(status.Limit), 10))
+	w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(int64(math.Floor(status.Remaining)), 10))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(status.Reset.Seconds())), 10))
+}
+
+// managerErrorStatus maps the manager's sentinel errors to the HTTP status
+// they are reported with, or returns 0 for errors that are internal
+func managerErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, queue.ErrQueueNotFound), errors.Is(err, queue.ErrJobNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, queue.ErrInvalidLease):
+		return http.StatusConflict
+	case errors.Is(err, queue.ErrRateLimited), errors.Is(err, queue.ErrTooManySubscribers):
+		return http.StatusTooManyRequests
+	case errors.Is(err, queue.ErrManagerClosed):
+		return http.StatusServiceUnavailable
+	default:
+		return 0
+	}
+}
+
 func respondError(w http.ResponseWriter, status int, message string) {
 	respondJSON(w, status, map[string]string{"error": message})
 }
 
+// clientError returns the message reported to clients for an internal error.
+// With redaction enabled the details, which may quote job data, stay in the
+// server log.
+func clientError(err error) string {
+	if logging.Redacting() {
+		return "internal error"
+	}
+	return err.Error()
+}
+
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Request-ID")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -0,0 +1,1544 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rivetq/rivetq/internal/cluster"
+	"github.com/rivetq/rivetq/internal/logging"
+	"github.com/rivetq/rivetq/internal/queue"
+	"github.com/rivetq/rivetq/internal/selfcheck"
+	"github.com/rivetq/rivetq/internal/store"
+	"github.com/rivetq/rivetq/internal/wal"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T) (*Server, *queue.Manager) {
+	dir := t.TempDir()
+
+	walInst, err := wal.New(wal.Config{Dir: dir + "/wal", SegmentSize: 1024 * 1024})
+	require.NoError(t, err)
+	t.Cleanup(func() { walInst.Close() })
+
+	storeInst, err := store.New(dir + "/store")
+	require.NoError(t, err)
+	t.Cleanup(func() { storeInst.Close() })
+
+	mgr := queue.NewManager(storeInst, walInst)
+	require.NoError(t, mgr.Start())
+	t.Cleanup(func() { mgr.Stop() })
+
+	return NewServer(mgr), mgr
+}
+
+// do sends a request to the server and returns the recorded response
+func do(t *testing.T, s *Server, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestEnqueueRateLimitHeaders(t *testing.T) {
+	s, mgr := newTestServer(t)
+
+	// No limit, no headers
+	rec := do(t, s, http.MethodPost, "/v1/queues/free/enqueue", `{"payload":{}}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("X-RateLimit-Limit"))
+
+	mgr.SetRateLimit("limited", 5, 0.001)
+
+	var remaining []int
+	for i := 0; i < 3; i++ {
+		rec := do(t, s, http.MethodPost, "/v1/queues/limited/enqueue", `{"payload":{}}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "5", rec.Header().Get("X-RateLimit-Limit"))
+
+		n, err := strconv.Atoi(rec.Header().Get("X-RateLimit-Remaining"))
+		require.NoError(t, err)
+		remaining = append(remaining, n)
+
+		reset, err := strconv.Atoi(rec.Header().Get("X-RateLimit-Reset"))
+		require.NoError(t, err)
+		assert.Greater(t, reset, 0)
+	}
+
+	assert.Equal(t, []int{4, 3, 2}, remaining)
+}
+
+func TestRateLimitStats(t *testing.T) {
+	s, mgr := newTestServer(t)
+	mgr.SetRateLimit("limited", 3, 0.001)
+
+	for i := 0; i < 4; i++ {
+		do(t, s, http.MethodPost, "/v1/queues/limited/enqueue", `{"payload":{}}`)
+	}
+
+	rec := do(t, s, http.MethodGet, "/v1/queues/limited/rate_limit", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp RateLimitResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.NotNil(t, resp.Stats)
+	assert.Equal(t, RateLimitStats{WindowMs: 60000, Allowed: 3, Rejected: 1, RejectRatio: 0.25}, *resp.Stats)
+
+	// Queues without a limit have no stats
+	rec = do(t, s, http.MethodGet, "/v1/queues/free/rate_limit", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	resp = RateLimitResponse{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Nil(t, resp.Stats)
+}
+
+func TestDumpQueue(t *testing.T) {
+	s, mgr := newTestServer(t)
+
+	// More jobs than fit a page
+	const n = 2*queue.DumpPageSize + 50
+	for i := 0; i < n; i++ {
+		_, err := mgr.Enqueue("dump", []byte(fmt.Sprintf(`{"n":%d}`, i)), map[string]string{"k": "v"}, 5, 0, queue.DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+	}
+	leased, err := mgr.Lease("dump", 10, 30000)
+	require.NoError(t, err)
+	require.Len(t, leased, 10)
+
+	rec := do(t, s, http.MethodGet, "/v1/queues/dump/dump", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+
+	states := map[string]int{}
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var line DumpRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		assert.Equal(t, "dump", line.Queue)
+		assert.Equal(t, map[string]string{"k": "v"}, line.Headers)
+		assert.Contains(t, string(line.Payload), `"n":`)
+		assert.Equal(t, PayloadEncodingJSON, line.Encoding)
+		states[line.State]++
+		seen[line.ID] = true
+	}
+	require.NoError(t, scanner.Err())
+	assert.Len(t, seen, n)
+	assert.Equal(t, map[string]int{"ready": n - 10, "inflight": 10}, states)
+
+	// Filtered by state
+	rec = do(t, s, http.MethodGet, "/v1/queues/dump/dump?state=inflight", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 10, strings.Count(rec.Body.String(), "\n"))
+
+	rec = do(t, s, http.MethodGet, "/v1/queues/dump/dump?state=bogus", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// Payloads that are not JSON say they are base64
+	_, err = mgr.Enqueue("binary", []byte{0xff, 0x00}, nil, 5, 0, queue.DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	rec = do(t, s, http.MethodGet, "/v1/queues/binary/dump", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var line DumpRecord
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &line))
+	assert.Equal(t, PayloadEncodingBase64, line.Encoding)
+	assert.Equal(t, `"/wA="`, string(line.Payload))
+
+	// Empty payloads are dumped like any other
+	_, err = mgr.Enqueue("empty", nil, nil, 5, 0, queue.DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	rec = do(t, s, http.MethodGet, "/v1/queues/empty/dump", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"payload":`)
+
+	rec = do(t, s, http.MethodGet, "/v1/queues/missing/dump", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestEnqueueRequestIDDedup(t *testing.T) {
+	s, mgr := newTestServer(t)
+
+	enqueue := func(queueName, requestID string) string {
+		req := httptest.NewRequest(http.MethodPost, "/v1/queues/"+queueName+"/enqueue", bytes.NewBufferString(`{"payload":{"to":"a@b.c"}}`))
+		req.Header.Set("X-Request-ID", requestID)
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var resp EnqueueResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp.JobID
+	}
+
+	first := enqueue("emails", "req-1")
+	retry := enqueue("emails", "req-1")
+	assert.Equal(t, first, retry)
+
+	ready, _, _, err := mgr.Stats("emails")
+	require.NoError(t, err)
+	assert.Equal(t, 1, ready)
+
+	// A new request ID, or the same ID on another queue, enqueues again
+	assert.NotEqual(t, first, enqueue("emails", "req-2"))
+	assert.NotEqual(t, first, enqueue("other", "req-1"))
+}
+
+func TestEnqueueIncludeStats(t *testing.T) {
+	s, mgr := newTestServer(t)
+
+	enqueue := func(body string) EnqueueResponse {
+		rec := do(t, s, http.MethodPost, "/v1/queues/emails/enqueue", body)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var resp EnqueueResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp
+	}
+
+	// Stats are only computed on request
+	assert.Nil(t, enqueue(`{"payload":{}}`).Stats)
+
+	resp := enqueue(`{"payload":{}, "include_stats": true}`)
+	require.NotNil(t, resp.Stats)
+	assert.Equal(t, StatsResponse{Ready: 2}, *resp.Stats)
+
+	_, err := mgr.Lease("emails", 1, 30000)
+	require.NoError(t, err)
+
+	resp = enqueue(`{"payload":{}, "include_stats": true}`)
+	require.NotNil(t, resp.Stats)
+	assert.Equal(t, StatsResponse{Ready: 2, Inflight: 1}, *resp.Stats)
+
+	// A duplicate reports the current depth without adding a job
+	first := enqueue(`{"payload":{}, "idempotency_key": "k", "include_stats": true}`)
+	dup := enqueue(`{"payload":{}, "idempotency_key": "k", "include_stats": true}`)
+	assert.Equal(t, first.JobID, dup.JobID)
+	assert.Equal(t, StatsResponse{Ready: 3, Inflight: 1}, *dup.Stats)
+}
+
+func TestWritesFailFastWithoutQuorum(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.SetWriteGuard(func() error { return cluster.ErrNoQuorum })
+
+	start := time.Now()
+	rec := do(t, s, http.MethodPost, "/v1/queues/emails/enqueue", `{"payload":{}}`)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), "no_quorum")
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+	rec = do(t, s, http.MethodPost, "/v1/ack", `{"job_id":"x","lease_id":"y"}`)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	rec = do(t, s, http.MethodDelete, "/v1/queues/emails/idempotency/k", "")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	rec = do(t, s, http.MethodPost, "/v1/queues/emails/quiesce", "")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	rec = do(t, s, http.MethodPost, "/v1/queues/emails/resume", "")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	// Reads are still served
+	rec = do(t, s, http.MethodGet, "/v1/queues/", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestJobHistory(t *testing.T) {
+	s, mgr := newTestServer(t)
+
+	jobID, err := mgr.Enqueue("flaky", []byte(`{}`), nil, 5, 0, queue.DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	// Nack three times, waiting out the backoff between attempts
+	nacks := 3
+	for i := 1; i <= nacks; i++ {
+		var leaseID string
+		require.Eventually(t, func() bool {
+			jobs, err := mgr.Lease("flaky", 1, 30000)
+			require.NoError(t, err)
+			if len(jobs) == 0 {
+				return false
+			}
+			leaseID = jobs[0].LeaseID
+			return true
+		}, 2*time.Second, 10*time.Millisecond)
+
+		require.NoError(t, mgr.Nack(jobID, leaseID, fmt.Sprintf("attempt %d", i)))
+	}
+
+	w := do(t, s, "GET", "/v1/jobs/"+jobID+"/history", "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp JobHistoryResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, jobID, resp.JobID)
+
+	require.Len(t, resp.History, nacks)
+	for i, entry := range resp.History {
+		assert.Equal(t, uint32(i+1), entry.Tries)
+		assert.Equal(t, fmt.Sprintf("attempt %d", i+1), entry.Reason)
+		if i > 0 {
+			assert.GreaterOrEqual(t, entry.At, resp.History[i-1].RetryAt)
+		}
+	}
+
+	// The third nack exhausted retries, so the job was not rescheduled
+	assert.Greater(t, resp.History[0].RetryAt, resp.History[0].At)
+	assert.Zero(t, resp.History[nacks-1].RetryAt)
+
+	w = do(t, s, "GET", "/v1/jobs/unknown/history", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestClearIdempotencyKey(t *testing.T) {
+	s, mgr := newTestServer(t)
+	s.SetAdminToken("secret")
+
+	enqueue := func() string {
+		w := do(t, s, "POST", "/v1/queues/orders/enqueue", `{"payload":{},"idempotency_key":"order-42"}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp EnqueueResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.JobID
+	}
+
+	first := enqueue()
+	assert.Equal(t, first, enqueue())
+
+	// Admin only
+	w := do(t, s, "DELETE", "/v1/queues/orders/idempotency/order-42", "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	req := httptest.NewRequest("DELETE", "/v1/queues/orders/idempotency/order-42", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	second := enqueue()
+	assert.NotEqual(t, first, second)
+
+	ready, _, _, err := mgr.Stats("orders")
+	require.NoError(t, err)
+	assert.Equal(t, 2, ready)
+
+	// Unknown keys are reported as not found
+	assert.ErrorIs(t, mgr.ClearIdempotencyKey("orders", "missing"), queue.ErrIdempotencyKeyNotFound)
+}
+
+func TestNodeStats(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	for _, q := range []string{"emails", "reports"} {
+		w := do(t, s, "POST", "/v1/queues/"+q+"/enqueue", `{"payload":{"n":1}}`)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	w := do(t, s, "GET", "/v1/admin/node_stats", "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var stats NodeStatsResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Greater(t, stats.Goroutines, 0)
+	assert.Greater(t, stats.HeapAllocBytes, uint64(0))
+	assert.GreaterOrEqual(t, stats.HeapSysBytes, stats.HeapAllocBytes)
+	assert.GreaterOrEqual(t, stats.TotalGCPauseMs, stats.LastGCPauseMs)
+	assert.Equal(t, 2, stats.QueueCount)
+	assert.Equal(t, 1, stats.WALSegments)
+	assert.Greater(t, stats.WALSizeBytes, int64(0))
+	assert.Greater(t, stats.WALWriteP99Ms, 0.0)
+	assert.Less(t, stats.WALWriteP99Ms, 10000.0)
+	assert.Greater(t, stats.StoreSizeBytes, uint64(0))
+}
+
+func TestIdempotencyStats(t *testing.T) {
+	s, mgr := newTestServer(t)
+	mgr.SetIdempotencyTTL(time.Hour)
+
+	for _, key := range []string{"a", "b", "a"} {
+		w := do(t, s, "POST", "/v1/queues/emails/enqueue", `{"payload":{"n":1},"idempotency_key":"`+key+`"}`)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	w := do(t, s, "DELETE", "/v1/queues/emails/idempotency/b", "")
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	w = do(t, s, "GET", "/v1/admin/idempotency/stats", "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var stats IdempotencyStatsResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, IdempotencyStatsResponse{
+		Keys:         1,
+		AddedTotal:   2,
+		ClearedTotal: 1,
+		TTLMs:        time.Hour.Milliseconds(),
+	}, stats)
+}
+
+func TestQueueOwner(t *testing.T) {
+	sharding := cluster.NewSharding("node1", 2)
+	membership := cluster.NewMembership(nil, "node1")
+	router := chi.NewRouter()
+	NewClusterServer(nil, membership, sharding, nil).RegisterRoutes(router)
+
+	owner := func(queueName string) QueueOwnerResponse {
+		req := httptest.NewRequest("GET", "/v1/cluster/owner?queue="+queueName, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var resp QueueOwnerResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp
+	}
+
+	// Before a cluster forms the local node owns everything
+	resp := owner("emails")
+	assert.Equal(t, "node1", resp.NodeID)
+	assert.True(t, resp.IsLocal)
+	assert.Equal(t, "example.com", resp.Addr)
+
+	for i := 1; i <= 3; i++ {
+		id := fmt.Sprintf("node%d", i)
+		sharding.AddNode(id)
+		require.NoError(t, membership.AddMember(&cluster.Member{ID: id, Addr: fmt.Sprintf("10.0.0.%d:8080", i)}))
+	}
+
+	for _, queueName := range []string{"emails", "reports", "billing", "webhooks", "thumbnails"} {
+		expected, err := sharding.GetQueueNode(queueName)
+		require.NoError(t, err)
+
+		resp := owner(queueName)
+		assert.Equal(t, queueName, resp.Queue)
+		assert.Equal(t, expected, resp.NodeID)
+		assert.Equal(t, "10.0.0."+strings.TrimPrefix(expected, "node")+":8080", resp.Addr)
+		assert.Equal(t, expected == "node1", resp.IsLocal)
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/cluster/owner", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestEnqueueValidationErrors(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	tests := []struct {
+		name    string
+		body    string
+		message string
+		fields  []FieldError
+	}{
+		{
+			name:    "malformed JSON",
+			body:    `{"payload": {}, "priority": }`,
+			message: "malformed JSON at offset",
+		},
+		{
+			name:    "empty body",
+			body:    ``,
+			message: "request body is empty",
+		},
+		{
+			name:    "string priority",
+			body:    `{"payload": {}, "priority": "high"}`,
+			message: "invalid request body",
+			fields:  []FieldError{{Field: "priority", Message: "expected non-negative integer, got string"}},
+		},
+		{
+			name:    "negative delay",
+			body:    `{"payload": {}, "delay_ms": -5}`,
+			message: "invalid request body",
+			fields:  []FieldError{{Field: "delay_ms", Message: "must not be negative, got -5"}},
+		},
+		{
+			name:    "delay beyond horizon",
+			body:    `{"payload": {}, "delay_ms": 1000000000000}`,
+			message: "invalid request body",
+			fields:  []FieldError{{Field: "delay_ms", Message: "delay out of range: 1000000000000ms exceeds the maximum of 31536000000ms"}},
+		},
+		{
+			name:    "several invalid fields",
+			body:    `{"payload": {}, "priority": 12, "delay_ms": -1, "ack_mode": "eventually"}`,
+			message: "invalid request body",
+			fields: []FieldError{
+				{Field: "priority", Message: "must be between 0 and 9, got 12"},
+				{Field: "delay_ms", Message: "must not be negative, got -1"},
+				{Field: "ack_mode", Message: `unknown ack mode "eventually" (want "durable" or "buffered")`},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := do(t, s, "POST", "/v1/queues/emails/enqueue", tt.body)
+			require.Equal(t, http.StatusBadRequest, w.Code)
+
+			var resp ValidationErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Contains(t, resp.Error, tt.message)
+			assert.Equal(t, tt.fields, resp.Fields)
+		})
+	}
+
+	// A valid request still succeeds
+	w := do(t, s, "POST", "/v1/queues/emails/enqueue", `{"payload": {}, "priority": 9, "delay_ms": 0}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestMoveToDLQ(t *testing.T) {
+	s, mgr := newTestServer(t)
+
+	rec := do(t, s, http.MethodPost, "/v1/queues/deploys/move_to_dlq", `{"headers": {"version": "bad"}}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	for _, version := range []string{"bad", "bad", "good"} {
+		rec := do(t, s, http.MethodPost, "/v1/queues/deploys/enqueue", `{"payload": {}, "headers": {"version": "`+version+`"}}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	// An empty filter would match everything
+	rec = do(t, s, http.MethodPost, "/v1/queues/deploys/move_to_dlq", `{}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = do(t, s, http.MethodPost, "/v1/queues/deploys/move_to_dlq", `{"headers": {"version": "bad"}}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var resp MoveToDLQResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, 2, resp.Moved)
+
+	ready, _, dlq, err := mgr.Stats("deploys")
+	require.NoError(t, err)
+	assert.Equal(t, 1, ready)
+	assert.Equal(t, 2, dlq)
+}
+
+func TestLeaseOrdering(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	for _, priority := range []string{"1", "9"} {
+		rec := do(t, s, http.MethodPost, "/v1/queues/backlog/enqueue", `{"payload": {}, "priority": `+priority+`}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	rec := do(t, s, http.MethodPost, "/v1/queues/backlog/lease", `{"ordering": "lifo"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	var verr ValidationErrorResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &verr))
+	require.Len(t, verr.Fields, 1)
+	assert.Equal(t, "ordering", verr.Fields[0].Field)
+
+	rec = do(t, s, http.MethodPost, "/v1/queues/backlog/lease", `{"ordering": "fifo"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp LeaseResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Len(t, resp.Jobs, 1)
+	assert.Equal(t, uint8(1), resp.Jobs[0].Priority)
+}
+
+// leaseNames leases up to maxJobs jobs and returns the "name" of each job's
+// payload in lease order
+func leaseNames(t *testing.T, s *Server, queueName string, maxJobs int) ([]string, []JobResponse) {
+	t.Helper()
+	rec := do(t, s, http.MethodPost, "/v1/queues/"+queueName+"/lease", fmt.Sprintf(`{"max_jobs": %d}`, maxJobs))
+	if rec.Code == http.StatusNoContent {
+		return nil, nil
+	}
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var resp LeaseResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	names := make([]string, len(resp.Jobs))
+	for i, job := range resp.Jobs {
+		var payload struct {
+			Name string `json:"name"`
+		}
+		require.NoError(t, json.Unmarshal(job.Payload, &payload))
+		names[i] = payload.Name
+	}
+	return names, resp.Jobs
+}
+
+// TestLeasePriorityOrder pins the lease order consumers rely on: highest
+// priority first, then the job that became ready first, then enqueue order
+func TestLeasePriorityOrder(t *testing.T) {
+	enqueue := func(t *testing.T, s *Server, queueName, name string, priority int) {
+		rec := do(t, s, http.MethodPost, "/v1/queues/"+queueName+"/enqueue", fmt.Sprintf(`{"payload": {"name": %q}, "priority": %d}`, name, priority))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	jobs := []struct {
+		name     string
+		priority int
+	}{
+		{"a", 5}, {"b", 9}, {"c", 5}, {"d", 1}, {"e", 9}, {"f", 5}, {"g", 0},
+	}
+	want := []string{"b", "e", "a", "c", "f", "d", "g"}
+
+	t.Run("batch", func(t *testing.T) {
+		s, _ := newTestServer(t)
+		for _, job := range jobs {
+			enqueue(t, s, "orders", job.name, job.priority)
+		}
+
+		names, _ := leaseNames(t, s, "orders", len(jobs))
+		assert.Equal(t, want, names)
+	})
+
+	t.Run("one_at_a_time", func(t *testing.T) {
+		s, _ := newTestServer(t)
+		for _, job := range jobs {
+			enqueue(t, s, "orders", job.name, job.priority)
+		}
+
+		var names []string
+		for range jobs {
+			leased, _ := leaseNames(t, s, "orders", 1)
+			require.Len(t, leased, 1)
+			names = append(names, leased...)
+		}
+		assert.Equal(t, want, names)
+	})
+
+	t.Run("after_nack", func(t *testing.T) {
+		s, _ := newTestServer(t)
+		enqueue(t, s, "orders", "x", 5)
+		enqueue(t, s, "orders", "y", 5)
+
+		names, leased := leaseNames(t, s, "orders", 1)
+		require.Equal(t, []string{"x"}, names)
+		rec := do(t, s, http.MethodPost, "/v1/nack", fmt.Sprintf(`{"job_id": %q, "lease_id": %q}`, leased[0].ID, leased[0].LeaseID))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		// x is older but its retry is not due: jobs ready before then go first,
+		// a higher priority one ahead of them
+		enqueue(t, s, "orders", "z", 5)
+		enqueue(t, s, "orders", "h", 9)
+		names, _ = leaseNames(t, s, "orders", 3)
+		assert.Equal(t, []string{"h", "y", "z"}, names)
+
+		// Once due, x goes ahead of jobs enqueued after its retry time
+		time.Sleep(500 * time.Millisecond)
+		enqueue(t, s, "orders", "w", 5)
+		names, _ = leaseNames(t, s, "orders", 2)
+		assert.Equal(t, []string{"x", "w"}, names)
+	})
+}
+
+func TestLeaseExpectedOverdue(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	for i := 0; i < 2; i++ {
+		rec := do(t, s, http.MethodPost, "/v1/queues/slow/enqueue", `{"payload": {}}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	rec := do(t, s, http.MethodPost, "/v1/queues/slow/lease", `{"expected_ms": -1}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = do(t, s, http.MethodPost, "/v1/queues/slow/lease", `{"expected_ms": 10, "visibility_ms": 30000}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var overdue LeaseResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &overdue))
+	require.Len(t, overdue.Jobs, 1)
+
+	rec = do(t, s, http.MethodPost, "/v1/queues/slow/lease", `{"expected_ms": 60000}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	time.Sleep(30 * time.Millisecond)
+
+	rec = do(t, s, http.MethodGet, "/v1/queues/slow/dump?state=inflight", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	flagged := map[string]bool{}
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var line DumpRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		require.NotNil(t, line.LeaseDeadline)
+		assert.True(t, line.LeaseDeadline.After(time.Now()))
+		flagged[line.ID] = line.Overdue
+	}
+	require.NoError(t, scanner.Err())
+	require.Len(t, flagged, 2)
+	for id, isOverdue := range flagged {
+		assert.Equal(t, id == overdue.Jobs[0].ID, isOverdue, id)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	s, mgr := newTestServer(t)
+	report, err := selfcheck.Run(selfcheck.Config{Dirs: []selfcheck.Dir{{Name: "wal", Path: t.TempDir()}}})
+	require.NoError(t, err)
+	s.SetSelfCheck(report)
+
+	_, err = mgr.Enqueue("emails", []byte(`{}`), nil, 5, 0, queue.DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	rec := do(t, s, http.MethodPost, "/v1/admin/maintenance", `{"enabled": true, "reject_enqueues": true}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var mode queue.MaintenanceMode
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &mode))
+	assert.True(t, mode.Enabled)
+	assert.True(t, mode.RejectEnqueues)
+
+	rec = do(t, s, http.MethodGet, "/readyz", "")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"maintenance"`)
+
+	rec = do(t, s, http.MethodPost, "/v1/queues/emails/enqueue", `{"payload":{}}`)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	rec = do(t, s, http.MethodPost, "/v1/queues/emails/lease", `{}`)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	var lease LeaseResponse
+
+	rec = do(t, s, http.MethodPost, "/v1/admin/maintenance", `{"enabled": false}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = do(t, s, http.MethodGet, "/readyz", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = do(t, s, http.MethodPost, "/v1/queues/emails/lease", `{}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &lease))
+	assert.Len(t, lease.Jobs, 1)
+}
+
+func TestReadyz(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	// Not ready until the self-check has run
+	rec := do(t, s, http.MethodGet, "/readyz", "")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	dir := t.TempDir()
+	report, err := selfcheck.Run(selfcheck.Config{Dirs: []selfcheck.Dir{{Name: "wal", Path: dir}}})
+	require.NoError(t, err)
+	s.SetSelfCheck(report)
+
+	rec = do(t, s, http.MethodGet, "/readyz", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp ReadyResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "ready", resp.Status)
+	require.NotNil(t, resp.SelfCheck)
+	assert.Equal(t, dir, resp.SelfCheck.Dirs[0].Path)
+
+	report, err = selfcheck.Run(selfcheck.Config{Dirs: []selfcheck.Dir{{Name: "wal", Path: dir}}, MinFreeBytes: math.MaxUint64})
+	require.Error(t, err)
+	s.SetSelfCheck(report)
+
+	rec = do(t, s, http.MethodGet, "/readyz", "")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestAckBatch(t *testing.T) {
+	s, mgr := newTestServer(t)
+
+	for i := 0; i < 3; i++ {
+		_, err := mgr.Enqueue("batch", []byte(`{}`), nil, 5, 0, queue.DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+	}
+	jobs, err := mgr.Lease("batch", 3, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 3)
+
+	body, err := json.Marshal(BatchAckRequest{Items: []BatchAckItem{
+		{JobID: jobs[0].ID, LeaseID: jobs[0].LeaseID},
+		{JobID: jobs[1].ID, LeaseID: "wrong-lease"},
+		{JobID: jobs[2].ID, LeaseID: jobs[2].LeaseID, Nack: true, Reason: "try later"},
+	}})
+	require.NoError(t, err)
+
+	rec := do(t, s, http.MethodPost, "/v1/ack/batch", string(body))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var resp BatchAckResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Len(t, resp.Results, 3)
+	assert.True(t, resp.Results[0].Success)
+	assert.False(t, resp.Results[1].Success)
+	assert.NotEmpty(t, resp.Results[1].Error)
+	assert.True(t, resp.Results[2].Success)
+
+	// One acked, one still leased, one requeued
+	ready, inflight, _, err := mgr.Stats("batch")
+	require.NoError(t, err)
+	assert.Equal(t, 1, ready)
+	assert.Equal(t, 1, inflight)
+}
+
+func TestExtendLease(t *testing.T) {
+	s, mgr := newTestServer(t)
+	require.NoError(t, mgr.SetVisibilityLimits(queue.VisibilityLimits{MinMs: 1}))
+	_, err := mgr.Enqueue("reports", []byte(`{}`), nil, 5, 0, queue.DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	jobs, err := mgr.Lease("reports", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	job := jobs[0]
+
+	rec := do(t, s, http.MethodPost, "/v1/lease/extend", fmt.Sprintf(`{"job_id": %q, "lease_id": %q}`, job.ID, job.LeaseID))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "additional_ms")
+
+	rec = do(t, s, http.MethodPost, "/v1/lease/extend", fmt.Sprintf(`{"job_id": %q, "lease_id": %q, "additional_ms": 60000}`, job.ID, job.LeaseID))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"success": true}`, rec.Body.String())
+	found, err := mgr.GetJob("reports", job.ID)
+	require.NoError(t, err)
+	assert.True(t, found.LeaseDeadline.After(time.Now().Add(80*time.Second)))
+
+	rec = do(t, s, http.MethodPost, "/v1/lease/extend", fmt.Sprintf(`{"job_id": %q, "lease_id": "other", "additional_ms": 60000}`, job.ID))
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	// An expired lease tells the worker to stop
+	require.NoError(t, mgr.Ack(job.ID, job.LeaseID))
+	_, err = mgr.Enqueue("reports", []byte(`{}`), nil, 5, 0, queue.DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	jobs, err = mgr.Lease("reports", 1, 10)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	time.Sleep(20 * time.Millisecond)
+
+	rec = do(t, s, http.MethodPost, "/v1/lease/extend", fmt.Sprintf(`{"job_id": %q, "lease_id": %q, "additional_ms": 60000}`, jobs[0].ID, jobs[0].LeaseID))
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.JSONEq(t, `{"error": "lease_expired"}`, rec.Body.String())
+}
+
+func TestAckAndLease(t *testing.T) {
+	s, mgr := newTestServer(t)
+
+	var jobIDs []string
+	for i := 0; i < 2; i++ {
+		jobID, err := mgr.Enqueue("serial", []byte(`{}`), nil, 5, 0, queue.DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+		jobIDs = append(jobIDs, jobID)
+	}
+
+	jobs, err := mgr.Lease("serial", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	require.Equal(t, jobIDs[0], jobs[0].ID)
+
+	// An unknown queue is rejected before the ack
+	body := fmt.Sprintf(`{"job_id": %q, "lease_id": %q, "queue": "missing"}`, jobs[0].ID, jobs[0].LeaseID)
+	rec := do(t, s, http.MethodPost, "/v1/ack_and_lease", body)
+	assert.NotEqual(t, http.StatusOK, rec.Code)
+	_, inflight, _, err := mgr.Stats("serial")
+	require.NoError(t, err)
+	assert.Equal(t, 1, inflight)
+
+	// The first job is acked and the second one leased in one request
+	body = fmt.Sprintf(`{"job_id": %q, "lease_id": %q, "queue": "serial"}`, jobs[0].ID, jobs[0].LeaseID)
+	rec = do(t, s, http.MethodPost, "/v1/ack_and_lease", body)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var resp AckAndLeaseResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.True(t, resp.Success)
+	require.NotNil(t, resp.Job)
+	assert.Equal(t, jobIDs[1], resp.Job.ID)
+	assert.NotEmpty(t, resp.Job.LeaseID)
+
+	ready, inflight, _, err := mgr.Stats("serial")
+	require.NoError(t, err)
+	assert.Equal(t, 0, ready)
+	assert.Equal(t, 1, inflight)
+
+	// Acking the last job leases nothing
+	body = fmt.Sprintf(`{"job_id": %q, "lease_id": %q, "queue": "serial"}`, resp.Job.ID, resp.Job.LeaseID)
+	rec = do(t, s, http.MethodPost, "/v1/ack_and_lease", body)
+	require.Equal(t, http.StatusOK, rec.Code)
+	resp = AckAndLeaseResponse{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Nil(t, resp.Job)
+}
+
+func TestEnqueueIdempotencyConflict(t *testing.T) {
+	s, mgr := newTestServer(t)
+	mgr.SetIdempotencyStrict(true)
+
+	w := do(t, s, "POST", "/v1/queues/orders/enqueue", `{"payload":{"amount":10},"idempotency_key":"order-42"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var first EnqueueResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &first))
+
+	// Same payload dedups
+	w = do(t, s, "POST", "/v1/queues/orders/enqueue", `{"payload":{"amount":10},"idempotency_key":"order-42"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var dup EnqueueResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &dup))
+	assert.Equal(t, first.JobID, dup.JobID)
+
+	// Different payload conflicts, naming the existing job
+	w = do(t, s, "POST", "/v1/queues/orders/enqueue", `{"payload":{"amount":99},"idempotency_key":"order-42"}`)
+	require.Equal(t, http.StatusConflict, w.Code)
+	var conflict IdempotencyConflictResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &conflict))
+	assert.Equal(t, "idempotency_conflict", conflict.Error)
+	assert.Equal(t, first.JobID, conflict.JobID)
+}
+
+func TestEmptyLease(t *testing.T) {
+	s, mgr := newTestServer(t)
+	_, err := mgr.Enqueue("emails", []byte(`{}`), nil, 5, 0, queue.DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	// A populated lease is 200 with the jobs
+	rec := do(t, s, http.MethodPost, "/v1/queues/emails/lease", `{}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var lease LeaseResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &lease))
+	assert.Len(t, lease.Jobs, 1)
+
+	// An empty one is 204 with no body
+	rec = do(t, s, http.MethodPost, "/v1/queues/emails/lease", `{}`)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, rec.Body.Bytes())
+
+	// In legacy mode it is 200 with an empty array
+	s.SetLegacyEmptyLease(true)
+	rec = do(t, s, http.MethodPost, "/v1/queues/emails/lease", `{}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"jobs": []}`, rec.Body.String())
+
+	_, err = mgr.Enqueue("emails", []byte(`{}`), nil, 5, 0, queue.DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	rec = do(t, s, http.MethodPost, "/v1/queues/emails/lease", `{}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &lease))
+	assert.Len(t, lease.Jobs, 1)
+}
+
+func TestLeaseWait(t *testing.T) {
+	s, mgr := newTestServer(t)
+	_, err := mgr.Enqueue("emails", []byte(`{}`), nil, 5, 0, queue.DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	rec := do(t, s, http.MethodPost, "/v1/queues/emails/lease", `{}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = do(t, s, http.MethodPost, "/v1/queues/emails/lease", `{"wait_ms": -1}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "wait_ms")
+
+	// A job enqueued while the lease waits is handed to it
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		mgr.Enqueue("emails", []byte(`{"n":2}`), nil, 5, 0, queue.DefaultRetryPolicy(), "")
+	}()
+	rec = do(t, s, http.MethodPost, "/v1/queues/emails/lease", `{"wait_ms": 5000}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var lease LeaseResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &lease))
+	require.Len(t, lease.Jobs, 1)
+	assert.JSONEq(t, `{"n":2}`, string(lease.Jobs[0].Payload))
+
+	// Nothing arrives before the wait ends
+	rec = do(t, s, http.MethodPost, "/v1/queues/emails/lease", `{"wait_ms": 20}`)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+}
+
+func TestLeaseWaitSubscribers(t *testing.T) {
+	s, mgr := newTestServer(t)
+	mgr.CreateQueue("emails", queue.DefaultQueueConfig())
+	const max = 25
+	mgr.SetMaxSubscribers(max)
+
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+
+	baseline := runtime.NumGoroutine()
+
+	// Waiting leases are subscribers; clients that hang up are all
+	// unregistered, round after round
+	for round := 0; round < 3; round++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+		for i := 0; i < max; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req, _ := http.NewRequestWithContext(ctx, http.MethodPost, server.URL+"/v1/queues/emails/lease", strings.NewReader(`{"wait_ms": 30000}`))
+				if resp, err := client.Do(req); err == nil {
+					resp.Body.Close()
+				}
+			}()
+		}
+		require.Eventually(t, func() bool { return mgr.Subscribers("emails") == max }, 5*time.Second, 5*time.Millisecond)
+
+		// The queue is full
+		rec := do(t, s, http.MethodPost, "/v1/queues/emails/lease", `{"wait_ms": 1000}`)
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+
+		cancel()
+		wg.Wait()
+		require.Eventually(t, func() bool { return mgr.Subscribers("emails") == 0 }, 5*time.Second, 5*time.Millisecond)
+	}
+
+	transport.CloseIdleConnections()
+	assert.Eventually(t, func() bool { return runtime.NumGoroutine() <= baseline+5 }, 5*time.Second, 10*time.Millisecond,
+		"goroutines: %d, %d before", runtime.NumGoroutine(), baseline)
+}
+
+func TestEnqueueHeadersTooLarge(t *testing.T) {
+	s, mgr := newTestServer(t)
+	mgr.SetHeaderLimits(2, 0)
+
+	rec := do(t, s, http.MethodPost, "/v1/queues/emails/enqueue", `{"payload":{},"headers":{"a":"1","b":"2"}}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = do(t, s, http.MethodPost, "/v1/queues/emails/enqueue", `{"payload":{},"headers":{"a":"1","b":"2","c":"3"}}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	var resp ValidationErrorResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Len(t, resp.Fields, 1)
+	assert.Equal(t, "headers", resp.Fields[0].Field)
+}
+
+func TestSetDefaultHeaders(t *testing.T) {
+	s, mgr := newTestServer(t)
+	mgr.SetHeaderLimits(2, 0)
+
+	rec := do(t, s, http.MethodPut, "/v1/queues/emails/default_headers", `{"headers":{"source":"api"}}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp DefaultHeadersResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, map[string]string{"source": "api"}, resp.Headers)
+	cfg, err := mgr.GetQueueConfig("emails")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"source": "api"}, cfg.DefaultHeaders)
+
+	rec = do(t, s, http.MethodPut, "/v1/queues/emails/default_headers", `{"headers":{"a":"1","b":"2","c":"3"}}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = do(t, s, http.MethodPut, "/v1/queues/emails/default_headers", `{"headers":{}}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	cfg, err = mgr.GetQueueConfig("emails")
+	require.NoError(t, err)
+	assert.Empty(t, cfg.DefaultHeaders)
+}
+
+func TestRecentLogs(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.SetAdminToken("secret")
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Disabled until a buffer is set
+	assert.Equal(t, http.StatusNotFound, get("/v1/admin/logs").Code)
+
+	buffer := logging.NewRingBuffer(4)
+	s.SetLogBuffer(buffer)
+	orig := log.Logger
+	log.Logger = zerolog.New(buffer).Level(zerolog.DebugLevel)
+	defer func() { log.Logger = orig }()
+
+	logging.With(logging.Fields{Queue: "emails"}).Info().Msg("first")
+	logging.With(logging.Fields{Queue: "emails"}).Warn().Msg("second")
+	logging.With(logging.Fields{Queue: "emails"}).Debug().Msg("third")
+	logging.With(logging.Fields{Queue: "emails"}).Error().Msg("fourth")
+	logging.With(logging.Fields{Queue: "emails"}).Info().Msg("fifth")
+
+	messages := func(rec *httptest.ResponseRecorder) []string {
+		require.Equal(t, http.StatusOK, rec.Code)
+		var resp struct {
+			Logs []struct {
+				Level   string `json:"level"`
+				Queue   string `json:"queue"`
+				Message string `json:"message"`
+			} `json:"logs"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		var msgs []string
+		for _, entry := range resp.Logs {
+			assert.Equal(t, "emails", entry.Queue)
+			msgs = append(msgs, entry.Level+":"+entry.Message)
+		}
+		return msgs
+	}
+
+	// The buffer keeps the last 4 events, oldest first
+	assert.Equal(t, []string{"warn:second", "debug:third", "error:fourth", "info:fifth"}, messages(get("/v1/admin/logs")))
+	assert.Equal(t, []string{"warn:second", "error:fourth"}, messages(get("/v1/admin/logs?level=warn")))
+	assert.Equal(t, []string{"error:fourth", "info:fifth"}, messages(get("/v1/admin/logs?level=info&limit=2")))
+
+	assert.Equal(t, http.StatusBadRequest, get("/v1/admin/logs?level=loud").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/v1/admin/logs?limit=0").Code)
+
+	// Admin only
+	assert.Equal(t, http.StatusForbidden, do(t, s, http.MethodGet, "/v1/admin/logs", "").Code)
+}
+
+func TestManagerErrorStatus(t *testing.T) {
+	s, mgr := newTestServer(t)
+
+	rec := do(t, s, http.MethodPost, "/v1/queues/missing/lease", `{"max_jobs":1}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = do(t, s, http.MethodPost, "/v1/ack", `{"job_id":"x","lease_id":"y"}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	_, err := mgr.Enqueue("emails", []byte(`{}`), nil, 5, 0, queue.DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	jobs, err := mgr.Lease("emails", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	rec = do(t, s, http.MethodPost, "/v1/nack", `{"job_id":"`+jobs[0].ID+`","lease_id":"wrong"}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	mgr.SetRateLimit("limited", 1, 0.001)
+	rec = do(t, s, http.MethodPost, "/v1/queues/limited/enqueue", `{"payload":{}}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = do(t, s, http.MethodPost, "/v1/queues/limited/enqueue", `{"payload":{}}`)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+}
+
+func TestPurgeNamespace(t *testing.T) {
+	s, mgr := newTestServer(t)
+
+	rec := do(t, s, http.MethodPost, "/v1/queues/acme:emails/enqueue", `{"payload":{}}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = do(t, s, http.MethodPost, "/v1/queues/globex:emails/enqueue", `{"payload":{}}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = do(t, s, http.MethodDelete, "/v1/admin/namespaces/acme", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp PurgeNamespaceResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, 1, resp.Purged)
+
+	assert.Equal(t, []string{"globex:emails"}, mgr.ListQueues())
+
+	rec = do(t, s, http.MethodDelete, "/v1/admin/namespaces/a:b", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestListJobs(t *testing.T) {
+	s, mgr := newTestServer(t)
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		id, err := mgr.Enqueue("emails", []byte(fmt.Sprintf(`{"n":%d}`, i)), nil, 5, 0, queue.DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	list := func(query string) ListJobsResponse {
+		rec := do(t, s, http.MethodGet, "/v1/queues/emails/jobs"+query, "")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var resp ListJobsResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp
+	}
+
+	// Ready jobs by default, a page at a time
+	resp := list("?offset=2&limit=2")
+	assert.Equal(t, 5, resp.Total)
+	assert.Equal(t, 2, resp.Offset)
+	assert.Equal(t, 2, resp.Limit)
+	require.Len(t, resp.Jobs, 2)
+	assert.Equal(t, ids[2], resp.Jobs[0].ID)
+	assert.Equal(t, ids[3], resp.Jobs[1].ID)
+	assert.Equal(t, "ready", resp.Jobs[0].State)
+	assert.JSONEq(t, `{"n":2}`, string(resp.Jobs[0].Payload))
+
+	resp = list("?include_payload=false")
+	assert.Equal(t, queue.DefaultListJobsLimit, resp.Limit)
+	require.Len(t, resp.Jobs, 5)
+	assert.Nil(t, resp.Jobs[0].Payload)
+	rec := do(t, s, http.MethodGet, "/v1/queues/emails/jobs?include_payload=false", "")
+	assert.NotContains(t, rec.Body.String(), "payload")
+	assert.NotContains(t, rec.Body.String(), "encoding")
+
+	jobs, err := mgr.Lease("emails", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	resp = list("?state=inflight")
+	assert.Equal(t, 1, resp.Total)
+	require.Len(t, resp.Jobs, 1)
+	assert.Equal(t, jobs[0].LeaseID, resp.Jobs[0].LeaseID)
+	assert.Empty(t, list("?state=dlq").Jobs)
+
+	for _, query := range []string{"?state=consumed", "?offset=-1", "?limit=0", "?limit=100000", "?include_payload=maybe"} {
+		rec := do(t, s, http.MethodGet, "/v1/queues/emails/jobs"+query, "")
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+	rec = do(t, s, http.MethodGet, "/v1/queues/missing/jobs", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestDeleteQueue(t *testing.T) {
+	s, mgr := newTestServer(t)
+
+	_, err := mgr.Enqueue("emails", []byte("{}"), nil, 5, 0, queue.DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	_, err = mgr.Enqueue("emails", []byte("{}"), nil, 5, 0, queue.DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+	jobs, err := mgr.Lease("emails", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+
+	// A leased job keeps the queue from being deleted unless forced
+	rec := do(t, s, http.MethodDelete, "/v1/queues/emails", "")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = do(t, s, http.MethodDelete, "/v1/queues/emails?force=maybe", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = do(t, s, http.MethodDelete, "/v1/queues/emails?force=true", "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, mgr.ListQueues())
+
+	rec = do(t, s, http.MethodGet, "/v1/queues/emails/stats", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = do(t, s, http.MethodDelete, "/v1/queues/emails", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestGetJob(t *testing.T) {
+	s, mgr := newTestServer(t)
+
+	jobID, err := mgr.Enqueue("emails", []byte(`{"to":"a@example.com"}`), map[string]string{"tenant": "acme"}, 7, 0, queue.DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	rec := do(t, s, http.MethodGet, "/v1/queues/emails/jobs/"+jobID, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp JobInfoResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, jobID, resp.ID)
+	assert.Equal(t, "ready", resp.Status)
+	assert.Equal(t, uint8(7), resp.Priority)
+	assert.JSONEq(t, `{"to":"a@example.com"}`, string(resp.Payload))
+	assert.Nil(t, resp.LeaseDeadline)
+
+	// Inspecting does not lease the job
+	jobs, err := mgr.Lease("emails", 1, 30000)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+
+	rec = do(t, s, http.MethodGet, "/v1/queues/emails/jobs/"+jobID, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "inflight", resp.Status)
+	assert.Equal(t, uint32(0), resp.Tries)
+	assert.NotNil(t, resp.LeaseDeadline)
+	assert.NotContains(t, rec.Body.String(), jobs[0].LeaseID)
+
+	rec = do(t, s, http.MethodGet, "/v1/queues/emails/jobs/unknown", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = do(t, s, http.MethodGet, "/v1/queues/missing/jobs/"+jobID, "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestPurgeDLQ(t *testing.T) {
+	s, mgr := newTestServer(t)
+
+	for i := 0; i < 2; i++ {
+		_, err := mgr.Enqueue("emails", []byte(`{}`), map[string]string{"version": "bad"}, 5, 0, queue.DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+	}
+	_, err := mgr.MoveToDLQ("emails", queue.HeaderFilter{"version": "bad"})
+	require.NoError(t, err)
+
+	// Nothing has been in the DLQ for an hour yet
+	rec := do(t, s, http.MethodDelete, "/v1/queues/emails/dlq?older_than_ms=3600000", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp PurgeDLQResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, 0, resp.Purged)
+
+	rec = do(t, s, http.MethodDelete, "/v1/queues/emails/dlq", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, 2, resp.Purged)
+
+	rec = do(t, s, http.MethodDelete, "/v1/queues/emails/dlq?older_than_ms=soon", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(t, s, http.MethodDelete, "/v1/queues/missing/dlq", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestRequeueDLQ(t *testing.T) {
+	s, mgr := newTestServer(t)
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := mgr.Enqueue("emails", []byte(`{}`), map[string]string{"version": "bad"}, 5, 0, queue.DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	_, err := mgr.MoveToDLQ("emails", queue.HeaderFilter{"version": "bad"})
+	require.NoError(t, err)
+
+	rec := do(t, s, http.MethodPost, "/v1/queues/emails/dlq/requeue", `{"job_id":"`+ids[0]+`"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp RequeueDLQResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, 1, resp.Requeued)
+
+	rec = do(t, s, http.MethodPost, "/v1/queues/emails/dlq/requeue", `{"job_id":"`+ids[0]+`"}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = do(t, s, http.MethodPost, "/v1/queues/emails/dlq/requeue", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, 2, resp.Requeued)
+
+	ready, _, dlq, err := mgr.Stats("emails")
+	require.NoError(t, err)
+	assert.Equal(t, 3, ready)
+	assert.Equal(t, 0, dlq)
+}
+
+func TestGetDLQJob(t *testing.T) {
+	s, mgr := newTestServer(t)
+
+	policy := queue.RetryPolicy{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Multiplier: 1}
+	jobID, err := mgr.Enqueue("payments", []byte(`{"amount":42}`), map[string]string{"customer": "c-1"}, 7, 0, policy, "")
+	require.NoError(t, err)
+
+	// Fail the job until it is dead-lettered
+	reasons := []string{"card declined", "gateway timeout"}
+	for _, reason := range reasons {
+		var leaseID string
+		require.Eventually(t, func() bool {
+			jobs, err := mgr.Lease("payments", 1, 30000)
+			require.NoError(t, err)
+			if len(jobs) == 0 {
+				return false
+			}
+			leaseID = jobs[0].LeaseID
+			return true
+		}, 2*time.Second, 5*time.Millisecond)
+		require.NoError(t, mgr.Nack(jobID, leaseID, reason))
+	}
+
+	rec := do(t, s, http.MethodGet, "/v1/queues/payments/dlq/"+jobID, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp DLQJobResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+
+	assert.Equal(t, jobID, resp.ID)
+	assert.Equal(t, "dlq", resp.Status)
+	assert.JSONEq(t, `{"amount":42}`, string(resp.Payload))
+	assert.Equal(t, "c-1", resp.Headers["customer"])
+	assert.Equal(t, uint8(7), resp.Priority)
+	assert.Equal(t, uint32(2), resp.Tries)
+	assert.Equal(t, "gateway timeout", resp.DLQReason)
+	assert.WithinDuration(t, time.Now(), resp.DLQAt, time.Minute)
+
+	require.Len(t, resp.History, len(reasons))
+	for i, attempt := range resp.History {
+		assert.Equal(t, uint32(i+1), attempt.Tries)
+		assert.Equal(t, reasons[i], attempt.Reason)
+		assert.NotZero(t, attempt.At)
+	}
+	assert.NotZero(t, resp.History[0].RetryAt)
+	assert.Zero(t, resp.History[1].RetryAt)
+
+	// Only dead-lettered jobs are served
+	other, err := mgr.Enqueue("payments", []byte(`{}`), nil, 5, 0, policy, "")
+	require.NoError(t, err)
+	rec = do(t, s, http.MethodGet, "/v1/queues/payments/dlq/"+other, "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = do(t, s, http.MethodGet, "/v1/queues/missing/dlq/"+jobID, "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestEnqueueWithJobID(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	rec := do(t, s, http.MethodPost, "/v1/queues/orders/enqueue", `{"job_id":"order-1","payload":{"n":1}}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp EnqueueResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "order-1", resp.JobID)
+
+	rec = do(t, s, http.MethodPost, "/v1/queues/orders/enqueue", `{"job_id":"order-1","payload":{"n":1}}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = do(t, s, http.MethodPost, "/v1/queues/orders/enqueue", `{"job_id":"order-1","payload":{"n":2}}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), "job_id_collision")
+
+	rec = do(t, s, http.MethodPost, "/v1/queues/orders/enqueue", `{"job_id":"`+strings.Repeat("x", queue.MaxJobIDLength+1)+`","payload":{}}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestQueueMode(t *testing.T) {
+	s, mgr := newTestServer(t)
+
+	// An enqueue can create a FIFO queue
+	rec := do(t, s, http.MethodPost, "/v1/queues/tasks/enqueue", `{"payload":{"n":1},"priority":1,"mode":"fifo"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = do(t, s, http.MethodPost, "/v1/queues/tasks/enqueue", `{"payload":{"n":2},"priority":9}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = do(t, s, http.MethodPost, "/v1/queues/tasks/enqueue", `{"payload":{"n":3},"mode":"priority"}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), "queue_mode_conflict")
+	rec = do(t, s, http.MethodPost, "/v1/queues/tasks/enqueue", `{"payload":{"n":3},"mode":"lifo"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = do(t, s, http.MethodPost, "/v1/queues/tasks/lease", `{"max_jobs":1}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var lease LeaseResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &lease))
+	require.Len(t, lease.Jobs, 1)
+	assert.JSONEq(t, `{"n":1}`, string(lease.Jobs[0].Payload))
+
+	// The mode of an existing queue can be changed
+	rec = do(t, s, http.MethodPost, "/v1/queues/tasks/config", `{"mode":"priority"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp QueueConfigResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "priority", resp.Mode)
+	cfg, err := mgr.GetQueueConfig("tasks")
+	require.NoError(t, err)
+	assert.Equal(t, queue.QueueModePriority, cfg.Mode)
+
+	rec = do(t, s, http.MethodPost, "/v1/queues/tasks/config", `{"mode":"lifo"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestEnqueueBatch(t *testing.T) {
+	s, mgr := newTestServer(t)
+
+	rec := do(t, s, http.MethodPost, "/v1/queues/bulk/enqueue_batch", `{"jobs":[
+		{"payload":{"n":1},"priority":3},
+		{"payload":{"n":2},"idempotency_key":"k"},
+		{"payload":{"n":2},"idempotency_key":"k"},
+		{"job_id":"bulk-1","payload":{"n":3}}
+	]}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp EnqueueBatchResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Len(t, resp.JobIDs, 4)
+	assert.Equal(t, resp.JobIDs[1], resp.JobIDs[2])
+	assert.Equal(t, "bulk-1", resp.JobIDs[3])
+
+	ready, _, _, err := mgr.Stats("bulk")
+	require.NoError(t, err)
+	assert.Equal(t, 3, ready)
+
+	// The failing job is named by its index and nothing is enqueued
+	rec = do(t, s, http.MethodPost, "/v1/queues/bulk/enqueue_batch", `{"jobs":[{"payload":{}},{"payload":{},"priority":12}]}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "jobs[1].priority")
+
+	rec = do(t, s, http.MethodPost, "/v1/queues/bulk/enqueue_batch", `{"jobs":[{"payload":{}},{"job_id":"bulk-1","payload":{"n":4}}]}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	var conflict BatchErrorResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &conflict))
+	assert.Equal(t, BatchErrorResponse{Error: "job_id_collision", Index: 1}, conflict)
+
+	rec = do(t, s, http.MethodPost, "/v1/queues/bulk/enqueue_batch", `{"jobs":[]}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	ready, _, _, err = mgr.Stats("bulk")
+	require.NoError(t, err)
+	assert.Equal(t, 3, ready)
+}
+
+func TestLeaseCompression(t *testing.T) {
+	s, mgr := newTestServer(t)
+
+	payload := []byte(`"` + strings.Repeat("compressible ", 200) + `"`)
+	for i := 0; i < 5; i++ {
+		_, err := mgr.Enqueue("big", payload, nil, 5, 0, queue.DefaultRetryPolicy(), "")
+		require.NoError(t, err)
+	}
+
+	lease := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/queues/big/lease", strings.NewReader(`{"max_jobs":1}`))
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec
+	}
+	decode := func(body io.Reader) LeaseResponse {
+		var resp LeaseResponse
+		require.NoError(t, json.NewDecoder(body).Decode(&resp))
+		require.Len(t, resp.Jobs, 1)
+		return resp
+	}
+
+	// A large response is gzipped for clients that accept it
+	rec := lease("gzip, deflate")
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Less(t, rec.Body.Len(), len(payload))
+	gz, err := gzip.NewReader(rec.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(payload), string(decode(gz).Jobs[0].Payload))
+
+	// and sent verbatim to the others
+	for _, accept := range []string{"", "gzip;q=0"} {
+		rec = lease(accept)
+		assert.Empty(t, rec.Header().Get("Content-Encoding"))
+		assert.JSONEq(t, string(payload), string(decode(rec.Body).Jobs[0].Payload))
+	}
+
+	// Small responses are not worth compressing
+	s.SetCompression(true, 1<<20)
+	rec = lease("gzip")
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	decode(rec.Body)
+
+	s.SetCompression(false, 0)
+	rec = lease("gzip")
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	decode(rec.Body)
+
+	// An empty lease still answers 204
+	req := httptest.NewRequest(http.MethodPost, "/v1/queues/big/lease", strings.NewReader(`{}`))
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	s.SetCompression(true, 0)
+	s.Handler().ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	s, mgr := newTestServer(t)
+	_, err := mgr.Enqueue("scraped", []byte(`{}`), nil, 5, 0, queue.DefaultRetryPolicy(), "")
+	require.NoError(t, err)
+
+	rec := do(t, s, http.MethodGet, "/metrics", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "rivetq_")
+	assert.Contains(t, rec.Body.String(), `rivetq_jobs_enqueued_total{queue="scraped"} 1`)
+	// Served outside the API middleware
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+
+	// The API is still routed
+	rec = do(t, s, http.MethodGet, "/v1/queues/", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	s.SetMetrics(false)
+	rec = do(t, s, http.MethodGet, "/metrics", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
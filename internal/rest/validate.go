@@ -0,0 +1,137 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+
+	"github.com/rivetq/rivetq/internal/queue"
+)
+
+// maxPriority is the highest job priority
+const maxPriority = 9
+
+// FieldError describes a problem with one field of a request body
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrorResponse is returned for a request body that is not valid
+// JSON or fails validation. Fields is empty for JSON syntax errors.
+type ValidationErrorResponse struct {
+	Error  string       `json:"error"`
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// decodeJSON decodes a request body, describing what went wrong on failure:
+// a syntax error with its offset, or the field whose value has the wrong type
+func decodeJSON(r io.Reader, v interface{}) *ValidationErrorResponse {
+	err := json.NewDecoder(r).Decode(v)
+	if err == nil {
+		return nil
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		return &ValidationErrorResponse{Error: "request body is empty"}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &ValidationErrorResponse{Error: "malformed JSON: unexpected end of input"}
+	case errors.As(err, &syntaxErr):
+		return &ValidationErrorResponse{Error: fmt.Sprintf("malformed JSON at offset %d: %s", syntaxErr.Offset, syntaxErr.Error())}
+	case errors.As(err, &typeErr):
+		return &ValidationErrorResponse{
+			Error: "invalid request body",
+			Fields: []FieldError{{
+				Field:   typeErr.Field,
+				Message: fmt.Sprintf("expected %s, got %s", jsonTypeName(typeErr.Type), typeErr.Value),
+			}},
+		}
+	default:
+		return &ValidationErrorResponse{Error: "invalid request body"}
+	}
+}
+
+// jsonTypeName describes a Go type in JSON terms
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "integer"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "non-negative integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	default:
+		return t.String()
+	}
+}
+
+// validateEnqueueRequest checks a decoded enqueue request's values
+func validateEnqueueRequest(req *EnqueueRequest) []FieldError {
+	var errs []FieldError
+	if req.Priority > maxPriority {
+		errs = append(errs, FieldError{Field: "priority", Message: fmt.Sprintf("must be between 0 and %d, got %d", maxPriority, req.Priority)})
+	}
+	if req.DelayMs < 0 {
+		errs = append(errs, FieldError{Field: "delay_ms", Message: fmt.Sprintf("must not be negative, got %d", req.DelayMs)})
+	}
+	if _, err := queue.ParseAckMode(req.AckMode); err != nil {
+		errs = append(errs, FieldError{Field: "ack_mode", Message: err.Error()})
+	}
+	if _, err := queue.ParseQueueMode(req.Mode); err != nil {
+		errs = append(errs, FieldError{Field: "mode", Message: err.Error()})
+	}
+	if len(req.JobID) > queue.MaxJobIDLength {
+		errs = append(errs, FieldError{Field: "job_id", Message: fmt.Sprintf("must be at most %d bytes", queue.MaxJobIDLength)})
+	}
+	return errs
+}
+
+// validateEnqueueBatchRequest checks a decoded batch enqueue request's
+// values, naming each invalid field by its job's index
+func validateEnqueueBatchRequest(req *EnqueueBatchRequest) []FieldError {
+	if len(req.Jobs) == 0 {
+		return []FieldError{{Field: "jobs", Message: "must not be empty"}}
+	}
+	if len(req.Jobs) > maxBatchEnqueueJobs {
+		return []FieldError{{Field: "jobs", Message: fmt.Sprintf("must hold at most %d jobs, got %d", maxBatchEnqueueJobs, len(req.Jobs))}}
+	}
+
+	var errs []FieldError
+	for i, job := range req.Jobs {
+		field := func(name string) string {
+			return fmt.Sprintf("jobs[%d].%s", i, name)
+		}
+		if job.Priority > maxPriority {
+			errs = append(errs, FieldError{Field: field("priority"), Message: fmt.Sprintf("must be between 0 and %d, got %d", maxPriority, job.Priority)})
+		}
+		if job.DelayMs < 0 {
+			errs = append(errs, FieldError{Field: field("delay_ms"), Message: fmt.Sprintf("must not be negative, got %d", job.DelayMs)})
+		}
+		if len(job.JobID) > queue.MaxJobIDLength {
+			errs = append(errs, FieldError{Field: field("job_id"), Message: fmt.Sprintf("must be at most %d bytes", queue.MaxJobIDLength)})
+		}
+	}
+	return errs
+}
+
+// respondValidationError reports field-level validation failures
+func respondValidationError(w http.ResponseWriter, fields []FieldError) {
+	respondJSON(w, http.StatusBadRequest, ValidationErrorResponse{
+		Error:  "invalid request body",
+		Fields: fields,
+	})
+}
@@ -0,0 +1,150 @@
+// Package selfcheck verifies the data directories before the server starts
+// taking traffic, so a read-only, full or misplaced data directory fails
+// startup with a clear error instead of a WAL or store failure later.
+package selfcheck
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrSelfCheckFailed is returned by Run when a directory is unusable
+var ErrSelfCheckFailed = errors.New("startup self-check failed")
+
+const (
+	// DefaultMinFreeBytes is the free space below which startup is aborted
+	DefaultMinFreeBytes = 256 * 1024 * 1024 // 256MB
+
+	// DefaultWarnFreeBytes is the free space below which a warning is logged
+	DefaultWarnFreeBytes = 1024 * 1024 * 1024 // 1GB
+)
+
+// Dir is a data directory to check
+type Dir struct {
+	Name string // e.g. "wal", used in messages
+	Path string
+}
+
+// Config controls the self-check. Thresholds of zero disable that check.
+type Config struct {
+	Dirs          []Dir
+	MinFreeBytes  uint64
+	WarnFreeBytes uint64
+}
+
+// DirStatus is the outcome of checking one directory
+type DirStatus struct {
+	Name       string `json:"name"`
+	Path       string `json:"path"`
+	Writable   bool   `json:"writable"`
+	FreeBytes  uint64 `json:"free_bytes"`
+	TotalBytes uint64 `json:"total_bytes"`
+	Device     uint64 `json:"device"` // Filesystem device ID, to spot a directory on an unexpected disk
+	Warning    string `json:"warning,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Report is the outcome of a self-check
+type Report struct {
+	OK        bool        `json:"ok"`
+	Dirs      []DirStatus `json:"dirs"`
+	CheckedAt time.Time   `json:"checked_at"`
+}
+
+// Run checks that each directory exists (creating it if needed), is
+// writable and has enough free space. It returns the report along with an
+// error wrapping ErrSelfCheckFailed if any directory is unusable.
+func Run(cfg Config) (*Report, error) {
+	report := &Report{
+		OK:        true,
+		Dirs:      make([]DirStatus, 0, len(cfg.Dirs)),
+		CheckedAt: time.Now(),
+	}
+
+	var errs []error
+	for _, dir := range cfg.Dirs {
+		status, err := checkDir(dir, cfg)
+		if err != nil {
+			status.Error = err.Error()
+			report.OK = false
+			errs = append(errs, err)
+		}
+		report.Dirs = append(report.Dirs, status)
+
+		event := log.Info()
+		if status.Warning != "" {
+			event = log.Warn().Str("warning", status.Warning)
+		}
+		if err != nil {
+			event = log.Error().Err(err)
+		}
+		event.Str("dir", dir.Name).Str("path", dir.Path).Uint64("free_bytes", status.FreeBytes).Uint64("device", status.Device).Msg("data directory self-check")
+	}
+
+	if len(errs) > 0 {
+		return report, fmt.Errorf("%w: %w", ErrSelfCheckFailed, errors.Join(errs...))
+	}
+	return report, nil
+}
+
+// checkDir checks a single directory
+func checkDir(dir Dir, cfg Config) (DirStatus, error) {
+	status := DirStatus{Name: dir.Name, Path: dir.Path}
+
+	if err := os.MkdirAll(dir.Path, 0755); err != nil {
+		return status, fmt.Errorf("%s directory %s cannot be created: %w", dir.Name, dir.Path, err)
+	}
+	if err := probeWrite(dir.Path); err != nil {
+		return status, fmt.Errorf("%s directory %s is not writable: %w", dir.Name, dir.Path, err)
+	}
+	status.Writable = true
+
+	space, err := diskSpace(dir.Path)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return status, nil // Writability is all we can check here
+	}
+	if err != nil {
+		return status, fmt.Errorf("failed to read free space of %s directory %s: %w", dir.Name, dir.Path, err)
+	}
+	status.FreeBytes = space.free
+	status.TotalBytes = space.total
+	status.Device = space.device
+
+	if cfg.MinFreeBytes > 0 && space.free < cfg.MinFreeBytes {
+		return status, fmt.Errorf("%s directory %s has %d bytes free, below the minimum of %d", dir.Name, dir.Path, space.free, cfg.MinFreeBytes)
+	}
+	if cfg.WarnFreeBytes > 0 && space.free < cfg.WarnFreeBytes {
+		status.Warning = fmt.Sprintf("only %d bytes free, below the warning threshold of %d", space.free, cfg.WarnFreeBytes)
+	}
+	return status, nil
+}
+
+// probeWrite creates, syncs and removes a file in dir
+func probeWrite(dir string) error {
+	f, err := os.CreateTemp(dir, ".selfcheck-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write([]byte("ok")); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// space describes the filesystem holding a directory
+type space struct {
+	free   uint64 // Available to unprivileged users
+	total  uint64
+	device uint64
+}
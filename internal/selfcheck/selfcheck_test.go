@@ -0,0 +1,77 @@
+package selfcheck
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunHealthyDirs(t *testing.T) {
+	dir := t.TempDir()
+
+	report, err := Run(Config{Dirs: []Dir{
+		{Name: "wal", Path: filepath.Join(dir, "wal")},
+		{Name: "store", Path: filepath.Join(dir, "store")},
+	}})
+	require.NoError(t, err)
+	assert.True(t, report.OK)
+	require.Len(t, report.Dirs, 2)
+
+	for _, status := range report.Dirs {
+		assert.True(t, status.Writable)
+		assert.Empty(t, status.Error)
+		assert.DirExists(t, status.Path)
+
+		// The probe file is cleaned up
+		entries, err := os.ReadDir(status.Path)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	}
+}
+
+func TestRunReadOnlyDir(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+
+	dir := filepath.Join(t.TempDir(), "wal")
+	require.NoError(t, os.Mkdir(dir, 0555))
+	t.Cleanup(func() { os.Chmod(dir, 0755) })
+
+	report, err := Run(Config{Dirs: []Dir{{Name: "wal", Path: dir}}})
+	require.ErrorIs(t, err, ErrSelfCheckFailed)
+	assert.Contains(t, err.Error(), "wal directory "+dir+" is not writable")
+	assert.False(t, report.OK)
+	assert.False(t, report.Dirs[0].Writable)
+}
+
+func TestRunUnusableDir(t *testing.T) {
+	// A file where the directory should be, which also stops root
+	file := filepath.Join(t.TempDir(), "data")
+	require.NoError(t, os.WriteFile(file, nil, 0644))
+
+	report, err := Run(Config{Dirs: []Dir{{Name: "store", Path: filepath.Join(file, "store")}}})
+	require.ErrorIs(t, err, ErrSelfCheckFailed)
+	assert.Contains(t, err.Error(), "store directory "+filepath.Join(file, "store")+" cannot be created")
+	assert.False(t, report.OK)
+	assert.NotEmpty(t, report.Dirs[0].Error)
+}
+
+func TestRunFreeSpaceThresholds(t *testing.T) {
+	dir := t.TempDir()
+
+	report, err := Run(Config{Dirs: []Dir{{Name: "wal", Path: dir}}, WarnFreeBytes: math.MaxUint64})
+	require.NoError(t, err)
+	assert.True(t, report.OK)
+	assert.NotEmpty(t, report.Dirs[0].Warning)
+
+	report, err = Run(Config{Dirs: []Dir{{Name: "wal", Path: dir}}, MinFreeBytes: math.MaxUint64})
+	require.ErrorIs(t, err, ErrSelfCheckFailed)
+	assert.Contains(t, err.Error(), "below the minimum")
+	assert.False(t, report.OK)
+	assert.True(t, report.Dirs[0].Writable)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package selfcheck
+
+import "errors"
+
+// diskSpace is not implemented on this platform
+func diskSpace(path string) (space, error) {
+	return space{}, errors.ErrUnsupported
+}
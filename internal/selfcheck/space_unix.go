@@ -0,0 +1,24 @@
+//go:build linux || darwin
+
+package selfcheck
+
+import "syscall"
+
+// diskSpace reads the free space and device of the filesystem holding path
+func diskSpace(path string) (space, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return space{}, err
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return space{}, err
+	}
+
+	return space{
+		free:   uint64(fs.Bavail) * uint64(fs.Bsize),
+		total:  uint64(fs.Blocks) * uint64(fs.Bsize),
+		device: uint64(st.Dev),
+	}, nil
+}
@@ -3,27 +3,63 @@ package store
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
 )
 
 // Store provides KV storage using Pebble
 type Store struct {
 	db *pebble.DB
 	mu sync.RWMutex
+
+	// Idempotency key count, kept incrementally, and counters since open
+	idemKeys    atomic.Int64
+	idemAdded   atomic.Uint64
+	idemExpired atomic.Uint64
+	idemCleared atomic.Uint64
 }
 
 // New creates a new Store instance
 func New(path string) (*Store, error) {
-	db, err := pebble.Open(path, &pebble.Options{})
+	return open(path, &pebble.Options{})
+}
+
+// NewInMemory creates a Store held entirely in memory, which is lost when it
+// is closed
+func NewInMemory() (*Store, error) {
+	return open("", &pebble.Options{FS: vfs.NewMem()})
+}
+
+// open opens the pebble database at path and loads the store's counters
+func open(path string, opts *pebble.Options) (*Store, error) {
+	db, err := pebble.Open(path, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open pebble db: %w", err)
 	}
 
-	return &Store{
+	s := &Store{
 		db: db,
-	}, nil
+	}
+
+	// Count existing idempotency keys once; the count is maintained from here
+	var keys int64
+	err = s.Scan([]byte(idempotencyPrefix), func(key, value []byte) error {
+		keys++
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to count idempotency keys: %w", err)
+	}
+	s.idemKeys.Store(keys)
+
+	return s, nil
 }
 
 // Set stores a key-value pair
@@ -48,6 +84,39 @@ func (s *Store) Get(key []byte) ([]byte, error) {
 	return result, nil
 }
 
+// Snapshot is a read-only view of the store as it was when taken. It must
+// be closed.
+type Snapshot struct {
+	snap *pebble.Snapshot
+}
+
+// Snapshot returns a view of the store as it is now, unaffected by later
+// writes
+func (s *Store) Snapshot() *Snapshot {
+	return &Snapshot{snap: s.db.NewSnapshot()}
+}
+
+// Get retrieves a value by key as of the snapshot
+func (sn *Snapshot) Get(key []byte) ([]byte, error) {
+	value, closer, err := sn.snap.Get(key)
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer closer.Close()
+
+	result := make([]byte, len(value))
+	copy(result, value)
+	return result, nil
+}
+
+// Close releases the snapshot
+func (sn *Snapshot) Close() error {
+	return sn.snap.Close()
+}
+
 // Delete removes a key
 func (s *Store) Delete(key []byte) error {
 	return s.db.Delete(key, pebble.Sync)
@@ -79,6 +148,27 @@ func (s *Store) Scan(prefix []byte, callback func(key, value []byte) error) erro
 	return iter.Error()
 }
 
+// SetNoSync stores a key-value pair without waiting for fsync, for data that
+// is rebuilt from the WAL after a crash
+func (s *Store) SetNoSync(key, value []byte) error {
+	return s.db.Set(key, value, pebble.NoSync)
+}
+
+// DeleteNoSync removes a key without waiting for fsync
+func (s *Store) DeleteNoSync(key []byte) error {
+	return s.db.Delete(key, pebble.NoSync)
+}
+
+// DeletePrefix removes every key with a prefix
+func (s *Store) DeletePrefix(prefix []byte) error {
+	return s.db.DeleteRange(prefix, prefixUpperBound(prefix), pebble.Sync)
+}
+
+// Size returns the store's approximate disk usage in bytes
+func (s *Store) Size() uint64 {
+	return s.db.Metrics().DiskSpaceUsage()
+}
+
 // Close closes the store
 func (s *Store) Close() error {
 	return s.db.Close()
@@ -110,6 +200,35 @@ type JobMetadata struct {
 	LeaseID    string            `json:"lease_id,omitempty"`
 	LeaseUntil int64             `json:"lease_until,omitempty"` // Unix milliseconds
 	Status     string            `json:"status"`                // ready, inflight, dlq
+	History    []JobTransition   `json:"history,omitempty"`     // Oldest first, capped
+}
+
+// JobTransition is one entry in a job's retry history
+type JobTransition struct {
+	At      int64  `json:"at"` // Unix milliseconds
+	Tries   uint32 `json:"tries"`
+	Reason  string `json:"reason,omitempty"`
+	RetryAt int64  `json:"retry_at,omitempty"` // Unix milliseconds, 0 if not retried
+}
+
+// transitionOverhead approximates the encoded size of a transition without
+// its reason, for the history byte cap
+const transitionOverhead = 64
+
+// size approximates the encoded size of t
+func (t JobTransition) size() int {
+	return transitionOverhead + len(t.Reason)
+}
+
+// truncateReason cuts reason to at most n bytes without splitting a rune
+func truncateReason(reason string, n int) string {
+	if len(reason) <= n {
+		return reason
+	}
+	for n > 0 && !utf8.RuneStart(reason[n]) {
+		n--
+	}
+	return reason[:n]
 }
 
 // SetJob stores job metadata
@@ -140,12 +259,72 @@ func (s *Store) GetJob(jobID string) (*JobMetadata, error) {
 	return &meta, nil
 }
 
+// AppendJobHistory appends a transition to a job's history, creating the
+// metadata if needed. The oldest entries are dropped to keep at most
+// maxEntries and roughly maxBytes; the newest entry is always kept, with its
+// reason truncated if it alone exceeds maxBytes.
+func (s *Store) AppendJobHistory(jobID, queue string, t JobTransition, maxEntries, maxBytes int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, err := s.GetJob(jobID)
+	if err != nil {
+		return err
+	}
+	if meta == nil {
+		meta = &JobMetadata{JobID: jobID, Queue: queue}
+	}
+	meta.Tries = t.Tries
+
+	if maxBytes > 0 && t.size() > maxBytes {
+		t.Reason = truncateReason(t.Reason, max(0, maxBytes-transitionOverhead))
+	}
+	history := append(meta.History, t)
+
+	total := 0
+	for _, entry := range history {
+		total += entry.size()
+	}
+	for len(history) > 1 && ((maxEntries > 0 && len(history) > maxEntries) || (maxBytes > 0 && total > maxBytes)) {
+		total -= history[0].size()
+		history = history[1:]
+	}
+	meta.History = history
+
+	return s.SetJob(jobID, meta)
+}
+
+// UpdateJob replaces a job's metadata with what update returns for the
+// current metadata, nil if there is none, or deletes it if update returns
+// nil. It is serialized with AppendJobHistory, so no history is lost.
+func (s *Store) UpdateJob(jobID string, update func(meta *JobMetadata) *JobMetadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, err := s.GetJob(jobID)
+	if err != nil {
+		return err
+	}
+	meta = update(meta)
+	if meta == nil {
+		return s.DeleteJob(jobID)
+	}
+	return s.SetJob(jobID, meta)
+}
+
 // DeleteJob removes job metadata
 func (s *Store) DeleteJob(jobID string) error {
 	key := []byte(fmt.Sprintf("job:%s", jobID))
 	return s.Delete(key)
 }
 
+// DeleteJobNoSync deletes job metadata without waiting for fsync, for callers
+// holding a queue lock
+func (s *Store) DeleteJobNoSync(jobID string) error {
+	key := []byte(fmt.Sprintf("job:%s", jobID))
+	return s.DeleteNoSync(key)
+}
+
 // ScanJobs scans all jobs
 func (s *Store) ScanJobs(callback func(*JobMetadata) error) error {
 	prefix := []byte("job:")
@@ -158,16 +337,215 @@ func (s *Store) ScanJobs(callback func(*JobMetadata) error) error {
 	})
 }
 
-// SetIdempotencyKey stores the result for an idempotency key
-func (s *Store) SetIdempotencyKey(key, jobID string) error {
-	k := []byte(fmt.Sprintf("idempotency:%s", key))
+// idempotencyPrefix is the key prefix of idempotency key mappings
+const idempotencyPrefix = "idempotency:"
+
+// idempotencyEntry is the stored value for an idempotency key with a TTL or
+// a request hash. Other keys store the bare job ID, which never starts with "{".
+type idempotencyEntry struct {
+	JobID     string `json:"job_id"`
+	ExpiresAt int64  `json:"expires_at"`     // Unix milliseconds, 0 for none
+	Hash      string `json:"hash,omitempty"` // Of the request that created the job
+}
+
+// IdempotencyStats describes the stored idempotency keys. The totals count
+// from when the store was opened.
+type IdempotencyStats struct {
+	Keys         int64  `json:"keys"`
+	AddedTotal   uint64 `json:"added_total"`
+	ExpiredTotal uint64 `json:"expired_total"`
+	ClearedTotal uint64 `json:"cleared_total"`
+}
+
+// SetIdempotencyKey stores the result for an idempotency key. A zero ttl
+// keeps it until it is cleared.
+func (s *Store) SetIdempotencyKey(key, jobID string, ttl time.Duration) error {
+	return s.SetIdempotencyEntry(key, jobID, "", ttl)
+}
+
+// SetIdempotencyEntry is SetIdempotencyKey that also stores a hash of the
+// request that created the job, so a later request reusing the key can be
+// compared with it
+func (s *Store) SetIdempotencyEntry(key, jobID, hash string, ttl time.Duration) error {
+	k := []byte(idempotencyPrefix + key)
 	v := []byte(jobID)
-	return s.Set(k, v)
+	if ttl > 0 || hash != "" {
+		entry := idempotencyEntry{JobID: jobID, Hash: hash}
+		if ttl > 0 {
+			entry.ExpiresAt = time.Now().Add(ttl).UnixMilli()
+		}
+		var err error
+		v, err = json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	existing, err := s.Get(k)
+	if err != nil {
+		return err
+	}
+	if err := s.Set(k, v); err != nil {
+		return err
+	}
+	if existing == nil {
+		s.idemKeys.Add(1)
+		s.idemAdded.Add(1)
+	}
+	return nil
 }
 
-// GetIdempotencyKey retrieves the job ID for an idempotency key
+// GetIdempotencyKey retrieves the job ID for an idempotency key, or "" if the
+// key is unknown or has expired
 func (s *Store) GetIdempotencyKey(key string) (string, error) {
-	k := []byte(fmt.Sprintf("idempotency:%s", key))
+	jobID, _, err := s.GetIdempotencyEntry(key)
+	return jobID, err
+}
+
+// GetIdempotencyEntry is GetIdempotencyKey that also returns the stored
+// request hash, "" if none was stored with the key
+func (s *Store) GetIdempotencyEntry(key string) (string, string, error) {
+	k := []byte(idempotencyPrefix + key)
+	v, err := s.Get(k)
+	if err != nil {
+		return "", "", err
+	}
+	if v == nil {
+		return "", "", nil
+	}
+
+	entry, err := decodeIdempotencyValue(v)
+	if err != nil {
+		return "", "", err
+	}
+	if entry.ExpiresAt != 0 && time.Now().UnixMilli() >= entry.ExpiresAt {
+		return "", "", nil
+	}
+	return entry.JobID, entry.Hash, nil
+}
+
+// DeleteIdempotencyKey removes the mapping for an idempotency key
+func (s *Store) DeleteIdempotencyKey(key string) error {
+	k := []byte(idempotencyPrefix + key)
+	existing, err := s.Get(k)
+	if err != nil {
+		return err
+	}
+	if err := s.Delete(k); err != nil {
+		return err
+	}
+	if existing != nil {
+		s.idemKeys.Add(-1)
+		s.idemCleared.Add(1)
+	}
+	return nil
+}
+
+// PruneIdempotencyKeys deletes idempotency keys whose TTL has passed and
+// returns how many were removed
+func (s *Store) PruneIdempotencyKeys(now time.Time) (int, error) {
+	var expired [][]byte
+	err := s.Scan([]byte(idempotencyPrefix), func(key, value []byte) error {
+		entry, err := decodeIdempotencyValue(value)
+		if err != nil || (entry.ExpiresAt != 0 && now.UnixMilli() >= entry.ExpiresAt) {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, key := range expired {
+		if err := s.Delete(key); err != nil {
+			s.idemKeys.Add(-int64(i))
+			s.idemExpired.Add(uint64(i))
+			return i, err
+		}
+	}
+	s.idemKeys.Add(-int64(len(expired)))
+	s.idemExpired.Add(uint64(len(expired)))
+	return len(expired), nil
+}
+
+// DeleteIdempotencyKeys removes every idempotency key starting with prefix
+// and returns how many were removed
+func (s *Store) DeleteIdempotencyKeys(prefix string) (int, error) {
+	var keys [][]byte
+	err := s.Scan([]byte(idempotencyPrefix+prefix), func(key, value []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, key := range keys {
+		if err := s.Delete(key); err != nil {
+			s.idemKeys.Add(-int64(i))
+			s.idemCleared.Add(uint64(i))
+			return i, err
+		}
+	}
+	s.idemKeys.Add(-int64(len(keys)))
+	s.idemCleared.Add(uint64(len(keys)))
+	return len(keys), nil
+}
+
+// IdempotencyStats returns the number of stored idempotency keys and how
+// many have been added, expired and cleared
+func (s *Store) IdempotencyStats() IdempotencyStats {
+	return IdempotencyStats{
+		Keys:         s.idemKeys.Load(),
+		AddedTotal:   s.idemAdded.Load(),
+		ExpiredTotal: s.idemExpired.Load(),
+		ClearedTotal: s.idemCleared.Load(),
+	}
+}
+
+// decodeIdempotencyValue decodes a stored idempotency key, either a bare job
+// ID or an entry
+func decodeIdempotencyValue(v []byte) (idempotencyEntry, error) {
+	if !strings.HasPrefix(string(v), "{") {
+		return idempotencyEntry{JobID: string(v)}, nil
+	}
+	var entry idempotencyEntry
+	if err := json.Unmarshal(v, &entry); err != nil {
+		return idempotencyEntry{}, err
+	}
+	return entry, nil
+}
+
+// requestIDEntry is the stored value for a remembered client request ID
+type requestIDEntry struct {
+	JobID     string `json:"job_id"`
+	ExpiresAt int64  `json:"expires_at"` // Unix milliseconds
+}
+
+// requestIDPrefix returns the key prefix of a queue's request IDs. Queue names
+// contain ':' as the namespace separator, so the name is ended by a "\x00"
+// instead: queues "a" and "a:b" must not share keys or a prefix.
+func requestIDPrefix(queue string) string {
+	return "reqid:" + queue + "\x00"
+}
+
+// SetRequestID remembers the job created by a client request for ttl
+func (s *Store) SetRequestID(queue, requestID, jobID string, ttl time.Duration) error {
+	k := []byte(requestIDPrefix(queue) + requestID)
+	v, err := json.Marshal(requestIDEntry{
+		JobID:     jobID,
+		ExpiresAt: time.Now().Add(ttl).UnixMilli(),
+	})
+	if err != nil {
+		return err
+	}
+	return s.Set(k, v)
+}
+
+// GetRequestID retrieves the job ID for a client request, or "" if the
+// request is unknown or its window has passed
+func (s *Store) GetRequestID(queue, requestID string) (string, error) {
+	k := []byte(requestIDPrefix(queue) + requestID)
 	v, err := s.Get(k)
 	if err != nil {
 		return "", err
@@ -175,5 +553,41 @@ func (s *Store) GetIdempotencyKey(key string) (string, error) {
 	if v == nil {
 		return "", nil
 	}
-	return string(v), nil
+
+	var entry requestIDEntry
+	if err := json.Unmarshal(v, &entry); err != nil {
+		return "", err
+	}
+	if time.Now().UnixMilli() >= entry.ExpiresAt {
+		return "", nil
+	}
+	return entry.JobID, nil
+}
+
+// DeleteRequestIDs forgets every request ID remembered for a queue
+func (s *Store) DeleteRequestIDs(queue string) error {
+	return s.DeletePrefix([]byte(requestIDPrefix(queue)))
+}
+
+// PruneRequestIDs deletes request IDs whose window has passed and returns
+// how many were removed
+func (s *Store) PruneRequestIDs(now time.Time) (int, error) {
+	var expired [][]byte
+	err := s.Scan([]byte("reqid:"), func(key, value []byte) error {
+		var entry requestIDEntry
+		if err := json.Unmarshal(value, &entry); err != nil || now.UnixMilli() >= entry.ExpiresAt {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range expired {
+		if err := s.Delete(key); err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
 }
@@ -0,0 +1,157 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultGroupCommitMaxRecords is how many durable writes may wait for a
+// group commit before it is started early
+const DefaultGroupCommitMaxRecords = 256
+
+// ErrClosed is returned for writes that wait on a WAL being closed
+var ErrClosed = errors.New("WAL closed")
+
+// groupCommit batches the fsyncs of durable writes. A writer appends its
+// record without fsync and waits; the commit loop fsyncs once for every
+// writer waiting, within interval of the first one or as soon as maxRecords
+// are waiting, then wakes them all.
+type groupCommit struct {
+	interval   time.Duration
+	maxRecords int
+
+	mu      sync.Mutex
+	waiters []groupWaiter
+	closed  bool
+
+	pending chan struct{} // Signalled when the first writer starts waiting
+	full    chan struct{} // Signalled when maxRecords writers are waiting
+}
+
+// groupWaiter is a durable write waiting for its segment to be fsynced
+type groupWaiter struct {
+	segment *Segment
+	done    chan error
+}
+
+func newGroupCommit(interval time.Duration, maxRecords int) *groupCommit {
+	if maxRecords <= 0 {
+		maxRecords = DefaultGroupCommitMaxRecords
+	}
+	return &groupCommit{
+		interval:   interval,
+		maxRecords: maxRecords,
+		pending:    make(chan struct{}, 1),
+		full:       make(chan struct{}, 1),
+	}
+}
+
+// add registers a write to segment and returns the channel its fsync result
+// is sent on
+func (g *groupCommit) add(segment *Segment) <-chan error {
+	done := make(chan error, 1)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		done <- ErrClosed
+		return done
+	}
+	g.waiters = append(g.waiters, groupWaiter{segment: segment, done: done})
+	switch len(g.waiters) {
+	case 1:
+		signal(g.pending)
+	case g.maxRecords:
+		signal(g.full)
+	}
+	return done
+}
+
+// commit fsyncs the segments written by the waiting writers, once each, and
+// wakes the writers. With closing set, later writers get ErrClosed.
+func (g *groupCommit) commit(closing bool) {
+	g.mu.Lock()
+	waiters := g.waiters
+	g.waiters = nil
+	if closing {
+		g.closed = true
+	}
+	g.mu.Unlock()
+
+	results := make(map[*Segment]error)
+	for _, waiter := range waiters {
+		err, synced := results[waiter.segment]
+		if !synced {
+			err = waiter.segment.Sync()
+			results[waiter.segment] = err
+		}
+		waiter.done <- err
+	}
+}
+
+// groupCommitLoop runs group commits until the WAL is closed, then commits
+// the writes still waiting
+func (w *WAL) groupCommitLoop() {
+	defer w.syncWg.Done()
+
+	for {
+		select {
+		case <-w.stopSync:
+			w.group.commit(true)
+			return
+		case <-w.group.pending:
+		}
+
+		// Give other writers until the interval ends to join the commit
+		timer := time.NewTimer(w.group.interval)
+		select {
+		case <-w.stopSync:
+			timer.Stop()
+			w.group.commit(true)
+			return
+		case <-timer.C:
+		case <-w.group.full:
+			timer.Stop()
+		}
+		w.group.commit(false)
+	}
+}
+
+// writeGrouped appends a record and waits for the next group commit to
+// make it durable
+func (w *WAL) writeGrouped(record *Record) error {
+	start := time.Now()
+
+	w.mu.Lock()
+	if err := w.rotateIfFull(); err != nil {
+		w.mu.Unlock()
+		return err
+	}
+	segment := w.activeSegment
+	if err := segment.WriteBuffered(record); err != nil {
+		w.mu.Unlock()
+		return fmt.Errorf("failed to write to segment: %w", err)
+	}
+	done := w.group.add(segment)
+	w.mu.Unlock()
+
+	if err := <-done; err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.writeLatencies.add(time.Since(start))
+	w.mu.Unlock()
+	return nil
+}
+
+// signal wakes the receiver of ch without blocking if it is already signalled
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,43 @@
+package wal
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// latencyWindow is how many recent write durations are kept
+const latencyWindow = 1024
+
+// latencyRing holds the most recent write durations. It is not safe for
+// concurrent use.
+type latencyRing struct {
+	samples [latencyWindow]time.Duration
+	next    int
+	count   int
+}
+
+// add records a duration, overwriting the oldest once the ring is full
+func (r *latencyRing) add(d time.Duration) {
+	r.samples[r.next] = d
+	r.next = (r.next + 1) % latencyWindow
+	if r.count < latencyWindow {
+		r.count++
+	}
+}
+
+// percentile returns the p-th percentile (0-100) of the recorded durations
+// using the nearest-rank method
+func (r *latencyRing) percentile(p float64) time.Duration {
+	if r.count == 0 {
+		return 0
+	}
+
+	sorted := make([]time.Duration, r.count)
+	copy(sorted, r.samples[:r.count])
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	rank := int(math.Ceil(p / 100 * float64(r.count)))
+	rank = min(max(rank, 1), r.count)
+	return sorted[rank-1]
+}
@@ -0,0 +1,144 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Reader iterates the records of a WAL directory in log order, across all
+// segments, without opening the WAL for writing. It is meant for offline
+// tools that inspect or audit a WAL; reading a WAL that a running node is
+// writing to may end on a partially written record, which reads as the end of
+// the WAL.
+//
+//	r, err := wal.OpenForRead(dir)
+//	...
+//	defer r.Close()
+//	for r.Next() {
+//		record := r.Record()
+//		...
+//	}
+//	if err := r.Err(); err != nil {
+//		...
+//	}
+type Reader struct {
+	dir     string
+	ids     []uint64
+	next    int // Index in ids of the next segment to open
+	segment uint64
+	current *SegmentReader
+	record  *Record
+	err     error
+}
+
+// OpenForRead opens the WAL in dir for reading
+func OpenForRead(dir string) (*Reader, error) {
+	ids, err := listSegmentIDs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list segments: %w", err)
+	}
+	return &Reader{dir: dir, ids: ids}, nil
+}
+
+// Next advances to the next record, returning false at the end of the WAL or
+// on an error, which Err reports. Like replay, a corrupted record skips the
+// rest of its segment.
+func (r *Reader) Next() bool {
+	r.record = nil
+	if r.err != nil {
+		return false
+	}
+
+	for {
+		if r.current == nil {
+			if r.next >= len(r.ids) {
+				return false
+			}
+			r.segment = r.ids[r.next]
+			r.next++
+
+			reader, err := NewSegmentReader(filepath.Join(r.dir, fmt.Sprintf(SegmentFilePattern, r.segment)))
+			if err != nil {
+				r.err = fmt.Errorf("failed to open segment %d: %w", r.segment, err)
+				return false
+			}
+			reader.tornTail = r.next == len(r.ids)
+			r.current = reader
+		}
+
+		record, err := r.current.Read()
+		switch {
+		case err == nil:
+			r.record = record
+			return true
+		case err == io.EOF || err == ErrCorruptedData:
+			r.current.Close()
+			r.current = nil
+		default:
+			r.err = fmt.Errorf("failed to read from segment %d: %w", r.segment, err)
+			return false
+		}
+	}
+}
+
+// Record returns the record Next advanced to
+func (r *Reader) Record() *Record {
+	return r.record
+}
+
+// Segment returns the ID of the segment holding the current record
+func (r *Reader) Segment() uint64 {
+	return r.segment
+}
+
+// Err returns the error that stopped iteration, if any
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// Close releases the open segment
+func (r *Reader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
+
+// listSegmentIDs returns the IDs of the segments in dir, in log order
+func listSegmentIDs(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segmentIDs := make([]uint64, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".wal") {
+			continue
+		}
+
+		// Parse segment ID from filename
+		name := strings.TrimSuffix(entry.Name(), ".wal")
+		id, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			log.Warn().Str("file", entry.Name()).Msg("invalid segment filename")
+			continue
+		}
+
+		segmentIDs = append(segmentIDs, id)
+	}
+
+	sort.Slice(segmentIDs, func(i, j int) bool {
+		return segmentIDs[i] < segmentIDs[j]
+	})
+	return segmentIDs, nil
+}
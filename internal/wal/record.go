@@ -3,6 +3,8 @@ package wal
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"math"
 	"time"
 )
 
@@ -15,11 +17,39 @@ const (
 	RecordTypeNack
 	RecordTypeRequeue
 	RecordTypeTombstone
+	RecordTypeDLQ // Moves a job straight to the DLQ from any state
+	RecordTypeLease // Leases a job to LeaseID until ETA, or renews its lease
+	RecordTypeDeleteQueue // Deletes Queue, after its jobs were tombstoned
 )
 
+// String returns the record type's name, e.g. for WAL inspection tools
+func (t RecordType) String() string {
+	switch t {
+	case RecordTypeEnqueue:
+		return "enqueue"
+	case RecordTypeAck:
+		return "ack"
+	case RecordTypeNack:
+		return "nack"
+	case RecordTypeRequeue:
+		return "requeue"
+	case RecordTypeTombstone:
+		return "tombstone"
+	case RecordTypeDLQ:
+		return "dlq"
+	case RecordTypeLease:
+		return "lease"
+	case RecordTypeDeleteQueue:
+		return "delete_queue"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(t))
+	}
+}
+
 var (
 	ErrInvalidRecord = errors.New("invalid record")
 	ErrCorruptedData = errors.New("corrupted data")
+	ErrTornRecord    = errors.New("record cut short by the end of the segment")
 )
 
 // Record represents a WAL entry
@@ -32,14 +62,29 @@ type Record struct {
 	Priority uint8
 	Tries    uint32
 	MaxRetries uint32
-	ETA      time.Time // Execute Time After - for delayed jobs
+	ETA      time.Time // Execute Time After - for delayed jobs; the lease deadline for Lease
 	LeaseID  string
 	Reason   string // For Nack
+	Expiries uint32 // Consecutive lease expirations, see Job.Expiries
+
+	// Backoff between retries of an enqueued job, zero for the defaults
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	Multiplier float64
+
+	// Seq is an enqueued job's position in its node's enqueue order
+	Seq uint64
+
+	// FencingToken is the token issued with a lease from a single-active-
+	// consumer queue, on its Lease record or, if consumed, its Ack
+	FencingToken uint64
 }
 
 // Marshal serializes a record to bytes
 // Format: [type:1][queue_len:2][queue][job_id_len:2][job_id][priority:1][tries:4][max_retries:4]
 //         [eta_unix_ms:8][payload_len:4][payload][headers_count:2][headers...][lease_id_len:2][lease_id][reason_len:2][reason]
+//         [expiries:4][base_delay_ms:8][max_delay_ms:8][multiplier:8][seq:8][fencing_token:8]
+// Fields after reason were added later and are optional when reading.
 func (r *Record) Marshal() ([]byte, error) {
 	// Estimate size
 	size := 1 + 2 + len(r.Queue) + 2 + len(r.JobID) + 1 + 4 + 4 + 8 + 4 + len(r.Payload) + 2
@@ -47,7 +92,7 @@ func (r *Record) Marshal() ([]byte, error) {
 	for k, v := range r.Headers {
 		size += 2 + len(k) + 2 + len(v)
 	}
-	size += 2 + len(r.LeaseID) + 2 + len(r.Reason)
+	size += 2 + len(r.LeaseID) + 2 + len(r.Reason) + 4 + 8 + 8 + 8 + 8 + 8
 
 	buf := make([]byte, size)
 	offset := 0
@@ -118,6 +163,26 @@ func (r *Record) Marshal() ([]byte, error) {
 	copy(buf[offset:], r.Reason)
 	offset += len(r.Reason)
 
+	// Expiries
+	binary.LittleEndian.PutUint32(buf[offset:], r.Expiries)
+	offset += 4
+
+	// Backoff
+	binary.LittleEndian.PutUint64(buf[offset:], uint64(r.BaseDelay.Milliseconds()))
+	offset += 8
+	binary.LittleEndian.PutUint64(buf[offset:], uint64(r.MaxDelay.Milliseconds()))
+	offset += 8
+	binary.LittleEndian.PutUint64(buf[offset:], math.Float64bits(r.Multiplier))
+	offset += 8
+
+	// Seq
+	binary.LittleEndian.PutUint64(buf[offset:], r.Seq)
+	offset += 8
+
+	// FencingToken
+	binary.LittleEndian.PutUint64(buf[offset:], r.FencingToken)
+	offset += 8
+
 	return buf[:offset], nil
 }
 
@@ -258,5 +323,35 @@ func (r *Record) Unmarshal(data []byte) error {
 	r.Reason = string(data[offset : offset+int(reasonLen)])
 	offset += int(reasonLen)
 
+	// Expiries (absent in records written by older versions)
+	r.Expiries = 0
+	if offset+4 <= len(data) {
+		r.Expiries = binary.LittleEndian.Uint32(data[offset:])
+		offset += 4
+	}
+
+	// Backoff (absent in records written by older versions)
+	r.BaseDelay, r.MaxDelay, r.Multiplier = 0, 0, 0
+	if offset+24 <= len(data) {
+		r.BaseDelay = time.Duration(binary.LittleEndian.Uint64(data[offset:])) * time.Millisecond
+		r.MaxDelay = time.Duration(binary.LittleEndian.Uint64(data[offset+8:])) * time.Millisecond
+		r.Multiplier = math.Float64frombits(binary.LittleEndian.Uint64(data[offset+16:]))
+		offset += 24
+	}
+
+	// Seq (absent in records written by older versions)
+	r.Seq = 0
+	if offset+8 <= len(data) {
+		r.Seq = binary.LittleEndian.Uint64(data[offset:])
+		offset += 8
+	}
+
+	// FencingToken (absent in records written by older versions)
+	r.FencingToken = 0
+	if offset+8 <= len(data) {
+		r.FencingToken = binary.LittleEndian.Uint64(data[offset:])
+		offset += 8
+	}
+
 	return nil
 }
@@ -0,0 +1,233 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// replayBatchSize is the number of raw frames handed to a decode worker at once
+const replayBatchSize = 256
+
+// replayBatch is a run of consecutive frames from one segment. The reader
+// fills frames, a worker fills records, and the applier consumes batches in
+// the order they were read.
+type replayBatch struct {
+	segmentID uint64
+	frames    [][]byte
+	crcs      []uint32
+
+	// Set by the worker before done is closed
+	records   []*Record
+	decodeErr error // error decoding records[len(records)]
+
+	// Set by the reader: reading stopped here for this segment
+	readErr error
+
+	done chan struct{}
+}
+
+// decode verifies and unmarshals frames until the first failure
+func (b *replayBatch) decode() {
+	defer close(b.done)
+
+	b.records = make([]*Record, 0, len(b.frames))
+	for i, data := range b.frames {
+		record, err := decodeFrame(data, b.crcs[i])
+		if err != nil {
+			b.decodeErr = err
+			return
+		}
+		b.records = append(b.records, record)
+	}
+}
+
+// replaySource is a segment opened for replay
+type replaySource struct {
+	segmentID uint64
+	reader    *SegmentReader
+}
+
+// openSources opens a reader on every segment, in log order. A reader sees
+// its segment as it was when opened, even if it is written to or removed
+// later. Must be called with w.mu held.
+func (w *WAL) openSources() ([]replaySource, error) {
+	sources := make([]replaySource, 0, len(w.segments))
+	for i, segment := range w.segments {
+		reader, err := w.segmentReader(i)
+		if err != nil {
+			closeSources(sources)
+			return nil, fmt.Errorf("failed to create reader for segment %d: %w", segment.ID(), err)
+		}
+		sources = append(sources, replaySource{segmentID: segment.ID(), reader: reader})
+	}
+	return sources, nil
+}
+
+// closeSources closes the readers of sources
+func closeSources(sources []replaySource) {
+	for _, source := range sources {
+		source.reader.Close()
+	}
+}
+
+// replayPipelined replays every segment, see replaySources. Must be called
+// with w.mu held.
+func (w *WAL) replayPipelined(callback func(*Record) error) error {
+	sources, err := w.openSources()
+	if err != nil {
+		return err
+	}
+	return replaySources(sources, callback)
+}
+
+// replaySources reads frames sequentially, verifies and decodes them in a
+// worker pool, and applies the records in their original order on the
+// calling goroutine. It matches replaySequential exactly, including skipping
+// the rest of a segment after a corrupted record. The sources are closed.
+func replaySources(sources []replaySource, callback func(*Record) error) error {
+	defer closeSources(sources)
+
+	workers := runtime.GOMAXPROCS(0)
+
+	work := make(chan *replayBatch, workers)
+	ordered := make(chan *replayBatch, workers*2)
+	stop := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range work {
+				batch.decode()
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(work)
+		defer close(ordered)
+		readBatches(sources, work, ordered, stop)
+	}()
+
+	err := applyBatches(ordered, callback)
+
+	close(stop)
+	wg.Wait()
+
+	return err
+}
+
+// readBatches reads every source into batches, sending each to the applier
+// in order and, if it has frames to decode, to the workers. It returns early
+// once stop is closed.
+func readBatches(sources []replaySource, work, ordered chan<- *replayBatch, stop <-chan struct{}) {
+	send := func(batch *replayBatch) bool {
+		select {
+		case ordered <- batch:
+		case <-stop:
+			return false
+		}
+		// The applier does not wait on batches without frames, so a worker
+		// must not touch them
+		if len(batch.frames) == 0 {
+			return true
+		}
+		select {
+		case work <- batch:
+		case <-stop:
+			return false
+		}
+		return true
+	}
+
+	newBatch := func(segmentID uint64) *replayBatch {
+		return &replayBatch{
+			segmentID: segmentID,
+			frames:    make([][]byte, 0, replayBatchSize),
+			crcs:      make([]uint32, 0, replayBatchSize),
+			done:      make(chan struct{}),
+		}
+	}
+
+	for _, source := range sources {
+		segmentID, reader := source.segmentID, source.reader
+		batch := newBatch(segmentID)
+
+		for {
+			data, crc, err := reader.readFrame()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				// The applier decides whether this matters: it is ignored if an
+				// earlier record in the segment was already corrupted.
+				batch.readErr = fmt.Errorf("failed to read from segment %d: %w", segmentID, err)
+				break
+			}
+
+			batch.frames = append(batch.frames, data)
+			batch.crcs = append(batch.crcs, crc)
+
+			if len(batch.frames) == replayBatchSize {
+				if !send(batch) {
+					return
+				}
+				batch = newBatch(segmentID)
+			}
+		}
+
+		if len(batch.frames) > 0 || batch.readErr != nil {
+			if !send(batch) {
+				return
+			}
+		}
+	}
+}
+
+// applyBatches applies decoded batches in order, stopping at the first error
+func applyBatches(ordered <-chan *replayBatch, callback func(*Record) error) error {
+	corruptedSegment := false
+	var lastSegment uint64
+
+	for batch := range ordered {
+		if batch.segmentID != lastSegment {
+			corruptedSegment = false
+			lastSegment = batch.segmentID
+		}
+		if corruptedSegment {
+			continue
+		}
+
+		// Batches without frames only carry a read error and are never decoded
+		if len(batch.frames) > 0 {
+			<-batch.done
+		}
+
+		for _, record := range batch.records {
+			if err := callback(record); err != nil {
+				return fmt.Errorf("callback failed: %w", err)
+			}
+		}
+
+		if batch.decodeErr == ErrCorruptedData {
+			log.Warn().Uint64("segment", batch.segmentID).Msg("corrupted record, skipping rest of segment")
+			corruptedSegment = true
+			continue
+		}
+		if batch.decodeErr != nil {
+			return fmt.Errorf("failed to read from segment %d: %w", batch.segmentID, batch.decodeErr)
+		}
+		if batch.readErr != nil {
+			return batch.readErr
+		}
+	}
+
+	return nil
+}
@@ -19,6 +19,9 @@ const (
 	SegmentFilePattern = "%06d.wal"
 )
 
+// syncFile fsyncs a segment file. Tests replace it to simulate slow disks.
+var syncFile = (*os.File).Sync
+
 // Segment represents a single WAL segment file
 type Segment struct {
 	mu       sync.RWMutex
@@ -30,6 +33,11 @@ type Segment struct {
 	maxSize  int64
 	fsync    bool
 	readOnly bool
+	dirty    bool   // Written without fsync since the last sync
+	writes   uint64 // Records written, tells Sync whether more came in while it ran
+
+	// syncMu serializes Sync and Close, which fsync outside mu
+	syncMu sync.Mutex
 }
 
 // NewSegment creates a new WAL segment
@@ -82,6 +90,17 @@ func OpenSegmentReadOnly(path string) (*Segment, error) {
 // Write writes a record to the segment
 // Format: [length:4][crc32:4][data...]
 func (s *Segment) Write(record *Record) error {
+	return s.write(record, s.fsync)
+}
+
+// WriteBuffered writes a record without waiting for fsync. The record reaches
+// the OS but may be lost on a machine crash until the next Sync.
+func (s *Segment) WriteBuffered(record *Record) error {
+	return s.write(record, false)
+}
+
+// write writes a record, fsyncing afterwards if sync is set
+func (s *Segment) write(record *Record, sync bool) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -121,13 +140,43 @@ func (s *Segment) Write(record *Record) error {
 		return fmt.Errorf("failed to flush: %w", err)
 	}
 
-	if s.fsync {
-		if err := s.file.Sync(); err != nil {
+	if sync {
+		if err := syncFile(s.file); err != nil {
 			return fmt.Errorf("failed to fsync: %w", err)
 		}
+		s.dirty = false
+	} else if s.fsync {
+		s.dirty = true
 	}
 
 	s.size += int64(8 + len(data))
+	s.writes++
+	return nil
+}
+
+// Sync fsyncs records written with WriteBuffered, if any. Writes are not
+// blocked while the fsync runs; the ones that land during it are left for
+// the next Sync.
+func (s *Segment) Sync() error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	s.mu.Lock()
+	dirty, writes := s.dirty, s.writes
+	s.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+
+	if err := syncFile(s.file); err != nil {
+		return fmt.Errorf("failed to fsync: %w", err)
+	}
+
+	s.mu.Lock()
+	if s.writes == writes {
+		s.dirty = false
+	}
+	s.mu.Unlock()
 	return nil
 }
 
@@ -152,6 +201,8 @@ func (s *Segment) ID() uint64 {
 
 // Close closes the segment
 func (s *Segment) Close() error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -160,6 +211,12 @@ func (s *Segment) Close() error {
 			return err
 		}
 	}
+	if s.dirty {
+		if err := syncFile(s.file); err != nil {
+			return err
+		}
+		s.dirty = false
+	}
 
 	if s.file != nil {
 		return s.file.Close()
@@ -168,16 +225,120 @@ func (s *Segment) Close() error {
 	return nil
 }
 
+// TruncateTail cuts a partial record left by a crash mid-write, or garbage,
+// off the end of the segment, so records appended afterwards follow valid
+// data and stay readable. It only cuts when no valid record follows the bad
+// bytes: corruption in the middle of the segment is returned as an error
+// rather than silently dropping the records after it. Returns the number of
+// bytes removed.
+func (s *Segment) TruncateTail() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return 0, fmt.Errorf("segment is read-only")
+	}
+	if err := s.writer.Flush(); err != nil {
+		return 0, fmt.Errorf("failed to flush: %w", err)
+	}
+
+	valid, err := s.validLength()
+	if err != nil {
+		return 0, err
+	}
+	if valid >= s.size {
+		return 0, nil
+	}
+
+	if err := s.file.Truncate(valid); err != nil {
+		return 0, fmt.Errorf("failed to truncate segment: %w", err)
+	}
+	if s.fsync {
+		if err := syncFile(s.file); err != nil {
+			return 0, fmt.Errorf("failed to fsync: %w", err)
+		}
+	}
+
+	removed := s.size - valid
+	s.size = valid
+	return removed, nil
+}
+
+// validLength returns the offset just past the last record with a valid
+// checksum, or an error if a valid record follows the first bad one. Must be
+// called with s.mu held.
+func (s *Segment) validLength() (int64, error) {
+	reader, err := s.Reader()
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	reader.tornTail = true
+
+	var valid int64
+	for {
+		valid = reader.offset
+		data, crc, err := reader.readFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !util.VerifyChecksum(data, crc) {
+			break
+		}
+	}
+	if valid >= s.size {
+		return valid, nil
+	}
+
+	// The bad bytes are a torn tail only if nothing valid comes after them.
+	// A corrupted length hides where the next record starts, so look for one
+	// at every offset.
+	rest := make([]byte, s.size-valid-1)
+	if _, err := s.file.ReadAt(rest, valid+1); err != nil {
+		return 0, fmt.Errorf("failed to read segment: %w", err)
+	}
+	if next := nextValidFrame(rest); next >= 0 {
+		return 0, fmt.Errorf("%w at offset %d, followed by a valid record at offset %d",
+			ErrCorruptedData, valid, valid+1+int64(next))
+	}
+	return valid, nil
+}
+
+// nextValidFrame returns the offset in buf of the first frame that verifies
+// and decodes, or -1 if there is none
+func nextValidFrame(buf []byte) int {
+	for i := 0; i+8 <= len(buf); i++ {
+		length := binary.LittleEndian.Uint32(buf[i:])
+		if length == 0 || uint64(i)+8+uint64(length) > uint64(len(buf)) {
+			continue
+		}
+		crc := binary.LittleEndian.Uint32(buf[i+4:])
+		if _, err := decodeFrame(buf[i+8:i+8+int(length)], crc); err == nil {
+			return i
+		}
+	}
+	return -1
+}
+
 // Reader returns a new reader for this segment
 func (s *Segment) Reader() (*SegmentReader, error) {
 	return NewSegmentReader(s.path)
 }
 
-// SegmentReader reads records from a segment
+// SegmentReader reads records from a segment. A record cut short at the end
+// of the file reads as ErrTornRecord, or as io.EOF if tornTail is set.
 type SegmentReader struct {
 	file   *os.File
 	reader *bufio.Reader
 	offset int64
+	size   int64 // File size when opened
+
+	// Set for the last segment of a WAL, the only one a crash mid-write can
+	// leave a partial record at the end of
+	tornTail bool
 }
 
 // NewSegmentReader creates a new segment reader
@@ -187,37 +348,86 @@ func NewSegmentReader(path string) (*SegmentReader, error) {
 		return nil, fmt.Errorf("failed to open segment: %w", err)
 	}
 
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat segment: %w", err)
+	}
+
 	return &SegmentReader{
 		file:   file,
 		reader: bufio.NewReader(file),
+		size:   stat.Size(),
 	}, nil
 }
 
 // Read reads the next record from segment
 func (sr *SegmentReader) Read() (*Record, error) {
+	data, crc, err := sr.readFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeFrame(data, crc)
+}
+
+// readFrame reads the next raw frame without verifying or decoding it. A
+// frame cut short by the end of the file is a torn record.
+func (sr *SegmentReader) readFrame() ([]byte, uint32, error) {
 	// Read length
 	lenBuf := make([]byte, 4)
 	if _, err := io.ReadFull(sr.reader, lenBuf); err != nil {
 		if err == io.EOF {
-			return nil, io.EOF
+			return nil, 0, io.EOF
 		}
-		return nil, fmt.Errorf("failed to read length: %w", err)
+		if err == io.ErrUnexpectedEOF {
+			return sr.torn()
+		}
+		return nil, 0, fmt.Errorf("failed to read length: %w", err)
 	}
 	length := binary.LittleEndian.Uint32(lenBuf)
 
+	// A length running past the end of the file is a partial write, or
+	// garbage that must not be allocated for
+	if sr.offset+8+int64(length) > sr.size {
+		return sr.torn()
+	}
+
 	// Read checksum
 	crcBuf := make([]byte, 4)
 	if _, err := io.ReadFull(sr.reader, crcBuf); err != nil {
-		return nil, fmt.Errorf("failed to read checksum: %w", err)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sr.torn()
+		}
+		return nil, 0, fmt.Errorf("failed to read checksum: %w", err)
 	}
 	expectedCRC := binary.LittleEndian.Uint32(crcBuf)
 
 	// Read data
 	data := make([]byte, length)
 	if _, err := io.ReadFull(sr.reader, data); err != nil {
-		return nil, fmt.Errorf("failed to read data: %w", err)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sr.torn()
+		}
+		return nil, 0, fmt.Errorf("failed to read data: %w", err)
+	}
+
+	sr.offset += int64(8 + length)
+	return data, expectedCRC, nil
+}
+
+// torn ends the segment at a frame cut short by the end of the file: cleanly
+// in the last segment, where a crash mid-write leaves one, and as an error
+// anywhere else
+func (sr *SegmentReader) torn() ([]byte, uint32, error) {
+	if sr.tornTail {
+		return nil, 0, io.EOF
 	}
+	return nil, 0, fmt.Errorf("%w at offset %d", ErrTornRecord, sr.offset)
+}
 
+// decodeFrame verifies a frame's checksum and unmarshals its record
+func decodeFrame(data []byte, expectedCRC uint32) (*Record, error) {
 	// Verify checksum
 	if !util.VerifyChecksum(data, expectedCRC) {
 		return nil, ErrCorruptedData
@@ -229,7 +439,6 @@ func (sr *SegmentReader) Read() (*Record, error) {
 		return nil, fmt.Errorf("failed to unmarshal record: %w", err)
 	}
 
-	sr.offset += int64(8 + length)
 	return record, nil
 }
 
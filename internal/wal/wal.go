@@ -4,12 +4,11 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
-	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/rivetq/rivetq/internal/metrics"
 	"github.com/rs/zerolog/log"
 )
 
@@ -22,13 +21,62 @@ type WAL struct {
 	nextSegmentID uint64
 	segmentSize   int64
 	fsync         bool
+	maxSegments   int
+	onMaxSegments func(count int)
+	hookRunning   atomic.Bool // An onMaxSegments call is in progress
+	truncateTail  bool
+
+	// Records are discarded rather than written, see NewInMemory
+	inMemory bool
+
+	// Background fsync of buffered writes
+	syncInterval time.Duration
+	stopSync     chan struct{}
+	stopOnce     sync.Once
+	syncWg       sync.WaitGroup
+
+	// Group commit of durable writes, nil when each write fsyncs itself
+	group *groupCommit
+
+	// Durations of recent writes, guarded by mu
+	writeLatencies latencyRing
 }
 
+// DefaultSyncInterval is how often buffered writes are fsynced by default
+const DefaultSyncInterval = 100 * time.Millisecond
+
 // Config for WAL
 type Config struct {
 	Dir         string
 	SegmentSize int64
 	Fsync       bool
+
+	// MaxSegments is a soft threshold on the number of segments (0 disables it).
+	// Exceeding it logs a warning and calls OnMaxSegments, if set.
+	MaxSegments int
+	// OnMaxSegments is invoked asynchronously with the current segment count
+	// whenever a rotation leaves the WAL above MaxSegments, e.g. to trigger compaction.
+	// Only one call runs at a time: rotations while it runs do not call it again.
+	OnMaxSegments func(count int)
+
+	// SyncInterval is how often records written with WriteBuffered are
+	// fsynced. Only used when Fsync is enabled.
+	SyncInterval time.Duration
+
+	// TruncateTail cuts a partial or corrupted record off the end of the
+	// last segment on open, as left by a crash mid-write, so it does not
+	// hide the records written after it. New fails instead if valid records
+	// follow the bad one, since that is corruption rather than a torn write.
+	TruncateTail bool
+
+	// GroupCommitInterval enables group commit when Fsync is enabled: Write
+	// still returns once its record is durable, but concurrent writes share
+	// one fsync made within this interval of the first of them. Zero fsyncs
+	// every write on its own.
+	GroupCommitInterval time.Duration
+	// GroupCommitMaxRecords starts a group commit early once this many
+	// writes are waiting (default DefaultGroupCommitMaxRecords)
+	GroupCommitMaxRecords int
 }
 
 // New creates a new WAL instance
@@ -36,6 +84,9 @@ func New(cfg Config) (*WAL, error) {
 	if cfg.SegmentSize == 0 {
 		cfg.SegmentSize = DefaultSegmentSize
 	}
+	if cfg.SyncInterval == 0 {
+		cfg.SyncInterval = DefaultSyncInterval
+	}
 
 	// Create directory if not exists
 	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
@@ -43,10 +94,15 @@ func New(cfg Config) (*WAL, error) {
 	}
 
 	wal := &WAL{
-		dir:         cfg.Dir,
-		segments:    make([]*Segment, 0),
-		segmentSize: cfg.SegmentSize,
-		fsync:       cfg.Fsync,
+		dir:           cfg.Dir,
+		segments:      make([]*Segment, 0),
+		segmentSize:   cfg.SegmentSize,
+		fsync:         cfg.Fsync,
+		maxSegments:   cfg.MaxSegments,
+		onMaxSegments: cfg.OnMaxSegments,
+		truncateTail:  cfg.TruncateTail,
+		syncInterval:  cfg.SyncInterval,
+		stopSync:      make(chan struct{}),
 	}
 
 	// Load existing segments
@@ -61,42 +117,45 @@ func New(cfg Config) (*WAL, error) {
 		}
 	}
 
+	if wal.fsync {
+		wal.syncWg.Add(1)
+		go wal.syncLoop()
+	}
+	if wal.fsync && cfg.GroupCommitInterval > 0 {
+		wal.group = newGroupCommit(cfg.GroupCommitInterval, cfg.GroupCommitMaxRecords)
+		wal.syncWg.Add(1)
+		go wal.groupCommitLoop()
+	}
+
 	return wal, nil
 }
 
+// NewInMemory creates a WAL that keeps nothing: writes succeed without
+// touching disk and replay finds no records. It is for managers embedded
+// in-process, whose jobs need not survive a restart.
+func NewInMemory() *WAL {
+	return &WAL{
+		inMemory: true,
+		stopSync: make(chan struct{}),
+	}
+}
+
+// InMemory reports whether the WAL was created by NewInMemory
+func (w *WAL) InMemory() bool {
+	return w.inMemory
+}
+
 // loadSegments loads existing segment files from disk
 func (w *WAL) loadSegments() error {
-	entries, err := os.ReadDir(w.dir)
+	segmentIDs, err := listSegmentIDs(w.dir)
 	if err != nil {
 		return err
 	}
 
-	segmentIDs := make([]uint64, 0)
-	for _, entry := range entries {
-		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".wal") {
-			continue
-		}
-
-		// Parse segment ID from filename
-		name := strings.TrimSuffix(entry.Name(), ".wal")
-		id, err := strconv.ParseUint(name, 10, 64)
-		if err != nil {
-			log.Warn().Str("file", entry.Name()).Msg("invalid segment filename")
-			continue
-		}
-
-		segmentIDs = append(segmentIDs, id)
-	}
-
 	if len(segmentIDs) == 0 {
 		return nil
 	}
 
-	// Sort by ID
-	sort.Slice(segmentIDs, func(i, j int) bool {
-		return segmentIDs[i] < segmentIDs[j]
-	})
-
 	// Open segments
 	for _, id := range segmentIDs {
 		segment, err := NewSegment(w.dir, id, w.segmentSize, w.fsync)
@@ -110,6 +169,20 @@ func (w *WAL) loadSegments() error {
 	w.activeSegment = w.segments[len(w.segments)-1]
 	w.nextSegmentID = segmentIDs[len(segmentIDs)-1] + 1
 
+	// Only the last segment was being written to when the process died
+	if w.truncateTail {
+		removed, err := w.activeSegment.TruncateTail()
+		if err != nil {
+			return fmt.Errorf("failed to truncate segment %d: %w", w.activeSegment.ID(), err)
+		}
+		if removed > 0 {
+			log.Warn().
+				Uint64("segment", w.activeSegment.ID()).
+				Int64("bytes", removed).
+				Msg("truncated partial record at the end of the WAL")
+		}
+	}
+
 	return nil
 }
 
@@ -127,32 +200,177 @@ func (w *WAL) createSegment() error {
 	return nil
 }
 
-// Write writes a record to the WAL
+// Write writes a record to the WAL, returning once it is durable. With
+// group commit enabled, it waits for the next group commit, so callers
+// holding a lock other writers need should use WriteBatch instead.
 func (w *WAL) Write(record *Record) error {
+	if w.group != nil {
+		return w.writeGrouped(record)
+	}
+	return w.write(record, false)
+}
+
+// WriteBuffered writes a record to the WAL without waiting for fsync. The
+// record is fsynced within SyncInterval; until then a machine crash (not a
+// process crash) can lose it. Records are still ordered with other writes.
+func (w *WAL) WriteBuffered(record *Record) error {
+	return w.write(record, true)
+}
+
+// write appends a record to the active segment, rotating first if it is full
+func (w *WAL) write(record *Record, buffered bool) error {
+	if w.inMemory {
+		return nil
+	}
+
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	// Check if we need to rotate segment
-	if w.activeSegment.IsFull() {
-		if err := w.createSegment(); err != nil {
-			return fmt.Errorf("failed to create new segment: %w", err)
-		}
+	if err := w.rotateIfFull(); err != nil {
+		return err
 	}
 
-	if err := w.activeSegment.Write(record); err != nil {
+	write := w.activeSegment.Write
+	if buffered {
+		write = w.activeSegment.WriteBuffered
+	}
+	start := time.Now()
+	if err := write(record); err != nil {
 		return fmt.Errorf("failed to write to segment: %w", err)
 	}
+	w.writeLatencies.add(time.Since(start))
 
 	return nil
 }
 
-// Replay reads all records from WAL and calls the callback for each
+// WriteBatch writes records in order and returns once they are all durable.
+// The batch is fsynced once rather than once per record, which makes bulk
+// writes such as mass lease expiry far cheaper. It fsyncs straight away,
+// without waiting for a group commit.
+func (w *WAL) WriteBatch(records []*Record) error {
+	if len(records) == 0 || w.inMemory {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	start := time.Now()
+	for _, record := range records {
+		if err := w.rotateIfFull(); err != nil {
+			return err
+		}
+		if err := w.activeSegment.WriteBuffered(record); err != nil {
+			return fmt.Errorf("failed to write to segment: %w", err)
+		}
+	}
+
+	if w.fsync {
+		if err := w.activeSegment.Sync(); err != nil {
+			return err
+		}
+	}
+	w.writeLatencies.add(time.Since(start))
+
+	return nil
+}
+
+// rotateIfFull starts a new segment if the active one is full. Must be
+// called with w.mu held.
+func (w *WAL) rotateIfFull() error {
+	if !w.activeSegment.IsFull() {
+		return nil
+	}
+
+	// Buffered writes in the old segment must not outlive it unsynced
+	if err := w.activeSegment.Sync(); err != nil {
+		return err
+	}
+	if err := w.createSegment(); err != nil {
+		return fmt.Errorf("failed to create new segment: %w", err)
+	}
+	w.checkSegmentThreshold()
+	return nil
+}
+
+// syncLoop periodically fsyncs buffered writes in the active segment
+func (w *WAL) syncLoop() {
+	defer w.syncWg.Done()
+
+	ticker := time.NewTicker(w.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stopSync:
+			return
+		case <-ticker.C:
+			w.mu.RLock()
+			segment := w.activeSegment
+			w.mu.RUnlock()
+
+			if err := segment.Sync(); err != nil {
+				log.Error().Err(err).Uint64("segment", segment.ID()).Msg("failed to sync buffered WAL writes")
+			}
+		}
+	}
+}
+
+// checkSegmentThreshold warns when the segment count exceeds MaxSegments.
+// Must be called with w.mu held.
+func (w *WAL) checkSegmentThreshold() {
+	if w.maxSegments <= 0 || len(w.segments) <= w.maxSegments {
+		return
+	}
+
+	count := len(w.segments)
+	log.Warn().
+		Int("segments", count).
+		Int("max_segments", w.maxSegments).
+		Msg("WAL segment count exceeds threshold, compaction may not be keeping up")
+	metrics.WALSegmentThresholdExceeded.Inc()
+
+	// Run the hook outside the lock so it can call back into the WAL (e.g.
+	// Compact), and only once at a time, so rotations while a slow hook runs
+	// don't pile up goroutines
+	if w.onMaxSegments != nil && w.hookRunning.CompareAndSwap(false, true) {
+		go func() {
+			defer w.hookRunning.Store(false)
+			w.onMaxSegments(count)
+		}()
+	}
+}
+
+// Replay reads all records from WAL and calls the callback for each.
+// Records are verified and decoded concurrently but the callback is always
+// invoked sequentially, in log order.
 func (w *WAL) Replay(callback func(*Record) error) error {
 	w.mu.RLock()
 	defer w.mu.RUnlock()
 
-	for _, segment := range w.segments {
-		reader, err := segment.Reader()
+	return w.replayPipelined(callback)
+}
+
+// ReplayLive replays the records written so far like Replay, without
+// holding up writes while it runs: the segments are opened under the lock
+// and read after it is released. Records written meanwhile are not
+// replayed, and segments compacted away meanwhile are still read in full.
+func (w *WAL) ReplayLive(callback func(*Record) error) error {
+	w.mu.RLock()
+	sources, err := w.openSources()
+	w.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	return replaySources(sources, callback)
+}
+
+// replaySequential reads, verifies and applies one record at a time.
+// Must be called with w.mu held.
+func (w *WAL) replaySequential(callback func(*Record) error) error {
+	for i, segment := range w.segments {
+		reader, err := w.segmentReader(i)
 		if err != nil {
 			return fmt.Errorf("failed to create reader for segment %d: %w", segment.ID(), err)
 		}
@@ -183,6 +401,18 @@ func (w *WAL) Replay(callback func(*Record) error) error {
 	return nil
 }
 
+// segmentReader opens a reader for w.segments[i]. Only the last segment may
+// end in a record torn by a crash; anywhere else that is an error. Must be
+// called with w.mu held.
+func (w *WAL) segmentReader(i int) (*SegmentReader, error) {
+	reader, err := w.segments[i].Reader()
+	if err != nil {
+		return nil, err
+	}
+	reader.tornTail = i == len(w.segments)-1
+	return reader, nil
+}
+
 // Compact removes old segments and compacts data
 func (w *WAL) Compact(activeJobIDs map[string]bool) error {
 	w.mu.Lock()
@@ -264,6 +494,9 @@ func (w *WAL) Compact(activeJobIDs map[string]bool) error {
 
 // Close closes all segments
 func (w *WAL) Close() error {
+	w.stopOnce.Do(func() { close(w.stopSync) })
+	w.syncWg.Wait()
+
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
@@ -294,3 +527,12 @@ func (w *WAL) TotalSize() int64 {
 	}
 	return total
 }
+
+// WriteLatency returns the given percentile (0-100) of recent write
+// durations, including fsync for durable writes, or zero if nothing has been
+// written yet
+func (w *WAL) WriteLatency(percentile float64) time.Duration {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.writeLatencies.percentile(percentile)
+}
@@ -1,8 +1,10 @@
 package wal
 
 import (
+	"fmt"
 	"os"
-	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -101,17 +103,23 @@ func TestWALSegmentRotation(t *testing.T) {
 
 func TestRecordMarshalUnmarshal(t *testing.T) {
 	rec := &Record{
-		Type:       RecordTypeEnqueue,
-		Queue:      "test-queue",
-		JobID:      "job-123",
-		Payload:    []byte("test payload"),
-		Headers:    map[string]string{"foo": "bar", "baz": "qux"},
-		Priority:   7,
-		Tries:      2,
-		MaxRetries: 5,
-		ETA:        time.Now().Truncate(time.Millisecond),
-		LeaseID:    "lease-456",
-		Reason:     "test reason",
+		Type:         RecordTypeEnqueue,
+		Queue:        "test-queue",
+		JobID:        "job-123",
+		Payload:      []byte("test payload"),
+		Headers:      map[string]string{"foo": "bar", "baz": "qux"},
+		Priority:     7,
+		Tries:        2,
+		MaxRetries:   5,
+		ETA:          time.Now().Truncate(time.Millisecond),
+		LeaseID:      "lease-456",
+		Reason:       "test reason",
+		Expiries:     3,
+		BaseDelay:    5 * time.Second,
+		MaxDelay:     time.Minute,
+		Multiplier:   1.5,
+		Seq:          42,
+		FencingToken: 7,
 	}
 
 	// Marshal
@@ -135,4 +143,594 @@ func TestRecordMarshalUnmarshal(t *testing.T) {
 	assert.Equal(t, rec.ETA.Unix(), rec2.ETA.Unix())
 	assert.Equal(t, rec.LeaseID, rec2.LeaseID)
 	assert.Equal(t, rec.Reason, rec2.Reason)
+	assert.Equal(t, rec.Expiries, rec2.Expiries)
+	assert.Equal(t, rec.BaseDelay, rec2.BaseDelay)
+	assert.Equal(t, rec.MaxDelay, rec2.MaxDelay)
+	assert.Equal(t, rec.Multiplier, rec2.Multiplier)
+	assert.Equal(t, rec.Seq, rec2.Seq)
+	assert.Equal(t, rec.FencingToken, rec2.FencingToken)
+
+	// Records written before FencingToken existed still decode
+	noToken := &Record{}
+	require.NoError(t, noToken.Unmarshal(data[:len(data)-8]))
+	assert.Equal(t, rec.Seq, noToken.Seq)
+	assert.Zero(t, noToken.FencingToken)
+
+	// Records written before Seq existed still decode
+	noSeq := &Record{}
+	require.NoError(t, noSeq.Unmarshal(data[:len(data)-8-8]))
+	assert.Equal(t, rec.Multiplier, noSeq.Multiplier)
+	assert.Zero(t, noSeq.Seq)
+
+	// Records written before the backoff fields existed still decode
+	noBackoff := &Record{}
+	require.NoError(t, noBackoff.Unmarshal(data[:len(data)-8-8-24]))
+	assert.Equal(t, rec.Expiries, noBackoff.Expiries)
+	assert.Zero(t, noBackoff.BaseDelay)
+	assert.Zero(t, noBackoff.MaxDelay)
+	assert.Zero(t, noBackoff.Multiplier)
+
+	// Records written before Expiries existed still decode
+	rec3 := &Record{}
+	require.NoError(t, rec3.Unmarshal(data[:len(data)-8-8-24-4]))
+	assert.Equal(t, rec.Reason, rec3.Reason)
+	assert.Equal(t, uint32(0), rec3.Expiries)
+}
+
+func TestWALSegmentThreshold(t *testing.T) {
+	dir := t.TempDir()
+
+	hookCh := make(chan int, 16)
+	wal, err := New(Config{
+		Dir:         dir,
+		SegmentSize: 100,
+		Fsync:       false,
+		MaxSegments: 2,
+		OnMaxSegments: func(count int) {
+			hookCh <- count
+		},
+	})
+	require.NoError(t, err)
+	defer wal.Close()
+
+	// Write enough to rotate past the threshold
+	for i := 0; i < 5; i++ {
+		err := wal.Write(&Record{
+			Type:    RecordTypeEnqueue,
+			Queue:   "test",
+			JobID:   "job",
+			Payload: make([]byte, 100),
+		})
+		require.NoError(t, err)
+	}
+
+	assert.Greater(t, wal.SegmentCount(), 2)
+
+	select {
+	case count := <-hookCh:
+		assert.Greater(t, count, 2)
+	case <-time.After(time.Second):
+		t.Fatal("expected segment threshold hook to fire")
+	}
+}
+
+func TestWALSegmentThresholdHookRunsOnce(t *testing.T) {
+	var calls, running, maxRunning atomic.Int32
+	release := make(chan struct{})
+	wal, err := New(Config{
+		Dir:         t.TempDir(),
+		SegmentSize: 100,
+		MaxSegments: 1,
+		OnMaxSegments: func(int) {
+			calls.Add(1)
+			if n := running.Add(1); n > maxRunning.Load() {
+				maxRunning.Store(n)
+			}
+			<-release
+			running.Add(-1)
+		},
+	})
+	require.NoError(t, err)
+	defer wal.Close()
+
+	write := func() {
+		require.NoError(t, wal.Write(&Record{Type: RecordTypeEnqueue, Queue: "test", JobID: "job", Payload: make([]byte, 100)}))
+	}
+
+	// Rotations while the hook is blocked don't start more calls
+	for i := 0; i < 10; i++ {
+		write()
+	}
+	require.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, 5*time.Millisecond)
+	write()
+	assert.Equal(t, int32(1), calls.Load())
+
+	// Once it returns, the next rotation calls it again
+	close(release)
+	require.Eventually(t, func() bool { return running.Load() == 0 }, time.Second, 5*time.Millisecond)
+	require.Eventually(t, func() bool {
+		write()
+		return calls.Load() > 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int32(1), maxRunning.Load())
+}
+
+func TestWriteBufferedSkipsFsync(t *testing.T) {
+	// Simulate a slow disk
+	const syncDelay = 200 * time.Millisecond
+	var syncs atomic.Int32
+	origSync := syncFile
+	syncFile = func(f *os.File) error {
+		time.Sleep(syncDelay)
+		syncs.Add(1)
+		return f.Sync()
+	}
+	t.Cleanup(func() { syncFile = origSync })
+
+	wal, err := New(Config{Dir: t.TempDir(), Fsync: true, SyncInterval: 50 * time.Millisecond})
+	require.NoError(t, err)
+	defer wal.Close()
+
+	record := &Record{Type: RecordTypeEnqueue, Queue: "test", JobID: "job"}
+
+	start := time.Now()
+	require.NoError(t, wal.Write(record))
+	assert.GreaterOrEqual(t, time.Since(start), syncDelay, "durable write should wait for fsync")
+
+	synced := syncs.Load()
+	start = time.Now()
+	require.NoError(t, wal.WriteBuffered(record))
+	assert.Less(t, time.Since(start), syncDelay, "buffered write should not wait for fsync")
+	assert.Equal(t, synced, syncs.Load())
+
+	// The background sync picks up the buffered write
+	require.Eventually(t, func() bool {
+		return syncs.Load() > synced
+	}, 2*time.Second, 10*time.Millisecond)
+
+	count := 0
+	require.NoError(t, wal.Replay(func(*Record) error {
+		count++
+		return nil
+	}))
+	assert.Equal(t, 2, count)
+}
+
+// writeTestWAL writes n enqueue records spread over segments of segmentSize
+func writeTestWAL(tb testing.TB, dir string, segmentSize int64, n int) {
+	w, err := New(Config{Dir: dir, SegmentSize: segmentSize, Fsync: false})
+	require.NoError(tb, err)
+	defer w.Close()
+
+	for i := 0; i < n; i++ {
+		rec := &Record{
+			Type:       RecordTypeEnqueue,
+			Queue:      "test",
+			JobID:      fmt.Sprintf("job-%d", i),
+			Payload:    make([]byte, 128),
+			Headers:    map[string]string{"n": fmt.Sprint(i)},
+			Priority:   uint8(i % 10),
+			MaxRetries: 3,
+			ETA:        time.UnixMilli(int64(i)),
+		}
+		require.NoError(tb, w.Write(rec))
+	}
+}
+
+func TestTruncatePartialTail(t *testing.T) {
+	tails := map[string][]byte{
+		"partial_length":   {0x10, 0x00},
+		"partial_checksum": {0x04, 0x00, 0x00, 0x00, 0xaa, 0xbb},
+		"partial_data":     {0x40, 0x00, 0x00, 0x00, 0xaa, 0xbb, 0xcc, 0xdd, 0x01, 0x02},
+		"bad_checksum":     {0x02, 0x00, 0x00, 0x00, 0xaa, 0xbb, 0xcc, 0xdd, 0x01, 0x02},
+		"huge_length":      {0xff, 0xff, 0xff, 0xff, 0xaa, 0xbb, 0xcc, 0xdd},
+	}
+
+	for name, tail := range tails {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			w, err := New(Config{Dir: dir})
+			require.NoError(t, err)
+			require.NoError(t, w.Write(&Record{Type: RecordTypeEnqueue, Queue: "test", JobID: "good", Payload: []byte("payload")}))
+			require.NoError(t, w.Close())
+
+			path := fmt.Sprintf("%s/"+SegmentFilePattern, dir, 0)
+			stat, err := os.Stat(path)
+			require.NoError(t, err)
+			validSize := stat.Size()
+
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+			require.NoError(t, err)
+			_, err = f.Write(tail)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+
+			replay := func(w *WAL) []string {
+				var ids []string
+				require.NoError(t, w.Replay(func(rec *Record) error {
+					ids = append(ids, rec.JobID)
+					return nil
+				}))
+				return ids
+			}
+
+			// Without truncation the tail ends replay cleanly
+			w, err = New(Config{Dir: dir})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"good"}, replay(w))
+			require.NoError(t, w.Close())
+
+			// With truncation the tail is removed and new records are readable
+			w, err = New(Config{Dir: dir, TruncateTail: true})
+			require.NoError(t, err)
+			defer w.Close()
+
+			stat, err = os.Stat(path)
+			require.NoError(t, err)
+			assert.Equal(t, validSize, stat.Size())
+
+			require.NoError(t, w.Write(&Record{Type: RecordTypeEnqueue, Queue: "test", JobID: "after"}))
+			assert.Equal(t, []string{"good", "after"}, replay(w))
+		})
+	}
+}
+
+func TestCorruptMiddleRecordNotTruncated(t *testing.T) {
+	corruptions := map[string]func(data []byte, offset int){
+		"bad_checksum": func(data []byte, offset int) { data[offset+8] ^= 0xff },
+		"huge_length":  func(data []byte, offset int) { data[offset+3] = 0x7f },
+	}
+
+	for name, corrupt := range corruptions {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			w, err := New(Config{Dir: dir})
+			require.NoError(t, err)
+			var offsets []int64
+			for i := 0; i < 10; i++ {
+				offsets = append(offsets, w.activeSegment.Size())
+				require.NoError(t, w.Write(&Record{Type: RecordTypeEnqueue, Queue: "test", JobID: fmt.Sprintf("job-%d", i)}))
+			}
+			require.NoError(t, w.Close())
+
+			path := fmt.Sprintf("%s/"+SegmentFilePattern, dir, 0)
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			corrupt(data, int(offsets[5]))
+			require.NoError(t, os.WriteFile(path, data, 0644))
+
+			// Valid records follow the bad one, so this is not a torn tail
+			_, err = New(Config{Dir: dir, TruncateTail: true})
+			require.ErrorIs(t, err, ErrCorruptedData)
+
+			stat, err := os.Stat(path)
+			require.NoError(t, err)
+			assert.Equal(t, int64(len(data)), stat.Size(), "nothing should be cut")
+		})
+	}
+}
+
+func TestTornRecordInSealedSegment(t *testing.T) {
+	dir := t.TempDir()
+	w, err := New(Config{Dir: dir})
+	require.NoError(t, err)
+	require.NoError(t, w.Write(&Record{Type: RecordTypeEnqueue, Queue: "test", JobID: "first"}))
+	require.NoError(t, w.Close())
+
+	// A partial record at the end of a segment that is no longer the last
+	path := fmt.Sprintf("%s/"+SegmentFilePattern, dir, 0)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0x40, 0x00, 0x00, 0x00, 0xaa, 0xbb})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, os.WriteFile(fmt.Sprintf("%s/"+SegmentFilePattern, dir, 1), nil, 0644))
+
+	w, err = New(Config{Dir: dir, TruncateTail: true})
+	require.NoError(t, err)
+	defer w.Close()
+
+	err = w.Replay(func(*Record) error { return nil })
+	require.ErrorIs(t, err, ErrTornRecord)
+	require.ErrorIs(t, w.replaySequential(func(*Record) error { return nil }), ErrTornRecord)
+}
+
+func TestReplaySegmentWithOnlyReadError(t *testing.T) {
+	dir := t.TempDir()
+
+	// A sealed segment holding nothing but a partial record reads as a batch
+	// with no frames, only a read error
+	require.NoError(t, os.WriteFile(fmt.Sprintf("%s/"+SegmentFilePattern, dir, 0), []byte{0x40, 0x00, 0x00, 0x00, 0xaa}, 0644))
+	require.NoError(t, os.WriteFile(fmt.Sprintf("%s/"+SegmentFilePattern, dir, 1), nil, 0644))
+
+	w, err := New(Config{Dir: dir})
+	require.NoError(t, err)
+	defer w.Close()
+
+	for i := 0; i < 10; i++ {
+		require.ErrorIs(t, w.Replay(func(*Record) error { return nil }), ErrTornRecord)
+	}
+}
+
+func TestReplayLive(t *testing.T) {
+	dir := t.TempDir()
+	w, err := New(Config{Dir: dir, SegmentSize: 1024})
+	require.NoError(t, err)
+	defer w.Close()
+	for i := 0; i < 50; i++ {
+		require.NoError(t, w.Write(&Record{Type: RecordTypeEnqueue, Queue: "test", JobID: fmt.Sprintf("job-%d", i)}))
+	}
+	require.Greater(t, w.SegmentCount(), 1)
+
+	// Writes go ahead while the replay is held up, and are not replayed
+	started, resume := make(chan struct{}), make(chan struct{})
+	replayed := make(chan []string, 1)
+	go func() {
+		var ids []string
+		err := w.ReplayLive(func(rec *Record) error {
+			if len(ids) == 0 {
+				close(started)
+				<-resume
+			}
+			ids = append(ids, rec.JobID)
+			return nil
+		})
+		assert.NoError(t, err)
+		replayed <- ids
+	}()
+	<-started
+
+	written := make(chan error, 1)
+	go func() {
+		for i := 50; i < 100; i++ {
+			if err := w.Write(&Record{Type: RecordTypeEnqueue, Queue: "test", JobID: fmt.Sprintf("job-%d", i)}); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+	select {
+	case err := <-written:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes blocked by a live replay")
+	}
+	close(resume)
+
+	ids := <-replayed
+	require.Len(t, ids, 50)
+	assert.Equal(t, "job-0", ids[0])
+	assert.Equal(t, "job-49", ids[49])
+}
+
+func TestPipelinedReplayMatchesSequential(t *testing.T) {
+	dir := t.TempDir()
+	writeTestWAL(t, dir, 64*1024, 5000)
+
+	// Corrupt a record in the middle of the second segment
+	segmentPath := fmt.Sprintf("%s/"+SegmentFilePattern, dir, 1)
+	data, err := os.ReadFile(segmentPath)
+	require.NoError(t, err)
+	data[len(data)/2] ^= 0xff
+	require.NoError(t, os.WriteFile(segmentPath, data, 0644))
+
+	w, err := New(Config{Dir: dir, SegmentSize: 64 * 1024})
+	require.NoError(t, err)
+	defer w.Close()
+	require.Greater(t, w.SegmentCount(), 3)
+
+	var sequential, pipelined []*Record
+	require.NoError(t, w.replaySequential(func(rec *Record) error {
+		sequential = append(sequential, rec)
+		return nil
+	}))
+	require.NoError(t, w.Replay(func(rec *Record) error {
+		pipelined = append(pipelined, rec)
+		return nil
+	}))
+
+	// The corrupted segment is cut short but later segments still replay
+	assert.Less(t, len(sequential), 5000)
+	assert.Equal(t, "job-4999", sequential[len(sequential)-1].JobID)
+	assert.Equal(t, sequential, pipelined)
+
+	// Callback errors abort the replay
+	calls := 0
+	err = w.Replay(func(rec *Record) error {
+		calls++
+		if calls == 10 {
+			return fmt.Errorf("boom")
+		}
+		return nil
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 10, calls)
+}
+
+func BenchmarkReplay(b *testing.B) {
+	dir := b.TempDir()
+	writeTestWAL(b, dir, 1024*1024, 100000)
+
+	w, err := New(Config{Dir: dir, SegmentSize: 1024 * 1024})
+	require.NoError(b, err)
+	defer w.Close()
+
+	noop := func(*Record) error { return nil }
+
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := w.replaySequential(noop); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("pipelined", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := w.replayPipelined(noop); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestLatencyRingPercentile(t *testing.T) {
+	var ring latencyRing
+	assert.Equal(t, time.Duration(0), ring.percentile(99))
+
+	for i := 1; i <= 100; i++ {
+		ring.add(time.Duration(i) * time.Millisecond)
+	}
+	assert.Equal(t, 50*time.Millisecond, ring.percentile(50))
+	assert.Equal(t, 99*time.Millisecond, ring.percentile(99))
+	assert.Equal(t, 100*time.Millisecond, ring.percentile(100))
+
+	// Old samples roll off once the window is full
+	for i := 0; i < latencyWindow; i++ {
+		ring.add(time.Millisecond)
+	}
+	assert.Equal(t, time.Millisecond, ring.percentile(99))
+}
+
+func TestWriteBatchSingleFsync(t *testing.T) {
+	var syncs atomic.Int32
+	origSync := syncFile
+	syncFile = func(f *os.File) error {
+		syncs.Add(1)
+		return f.Sync()
+	}
+	t.Cleanup(func() { syncFile = origSync })
+
+	// Long sync interval so the background loop stays out of the count
+	wal, err := New(Config{Dir: t.TempDir(), Fsync: true, SyncInterval: time.Hour})
+	require.NoError(t, err)
+	defer wal.Close()
+
+	records := make([]*Record, 1000)
+	for i := range records {
+		records[i] = &Record{Type: RecordTypeRequeue, Queue: "test", JobID: fmt.Sprintf("job-%d", i), Tries: 1}
+	}
+
+	require.NoError(t, wal.WriteBatch(records))
+	assert.Equal(t, int32(1), syncs.Load())
+
+	var replayed []string
+	require.NoError(t, wal.Replay(func(rec *Record) error {
+		replayed = append(replayed, rec.JobID)
+		return nil
+	}))
+	require.Len(t, replayed, 1000)
+	assert.Equal(t, "job-0", replayed[0])
+	assert.Equal(t, "job-999", replayed[999])
+}
+
+func BenchmarkWriteBatch(b *testing.B) {
+	records := make([]*Record, 1000)
+	for i := range records {
+		records[i] = &Record{Type: RecordTypeRequeue, Queue: "test", JobID: fmt.Sprintf("job-%d", i), Tries: 1}
+	}
+
+	b.Run("per_record", func(b *testing.B) {
+		w, err := New(Config{Dir: b.TempDir(), Fsync: true})
+		require.NoError(b, err)
+		defer w.Close()
+
+		for i := 0; i < b.N; i++ {
+			for _, record := range records {
+				if err := w.Write(record); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("batch", func(b *testing.B) {
+		w, err := New(Config{Dir: b.TempDir(), Fsync: true})
+		require.NoError(b, err)
+		defer w.Close()
+
+		for i := 0; i < b.N; i++ {
+			if err := w.WriteBatch(records); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestGroupCommit(t *testing.T) {
+	var syncs atomic.Int32
+	origSync := syncFile
+	syncFile = func(f *os.File) error {
+		syncs.Add(1)
+		time.Sleep(time.Millisecond) // A disk slow enough for writers to pile up
+		return f.Sync()
+	}
+	t.Cleanup(func() { syncFile = origSync })
+
+	dir := t.TempDir()
+	wal, err := New(Config{Dir: dir, Fsync: true, SyncInterval: time.Hour, GroupCommitInterval: 5 * time.Millisecond})
+	require.NoError(t, err)
+
+	const writers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, wal.Write(&Record{Type: RecordTypeEnqueue, Queue: "test", JobID: fmt.Sprintf("job-%d", i)}))
+		}(i)
+	}
+	wg.Wait()
+
+	// Every write returned after an fsync covering it, far fewer than one each
+	synced := syncs.Load()
+	assert.GreaterOrEqual(t, synced, int32(1))
+	assert.Less(t, synced, int32(writers/2))
+	assert.False(t, wal.activeSegment.dirty)
+
+	require.NoError(t, wal.Close())
+
+	reopened, err := New(Config{Dir: dir, Fsync: true})
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	replayed := 0
+	require.NoError(t, reopened.Replay(func(rec *Record) error {
+		replayed++
+		return nil
+	}))
+	assert.Equal(t, writers, replayed)
+}
+
+func BenchmarkGroupCommit(b *testing.B) {
+	record := &Record{Type: RecordTypeEnqueue, Queue: "test", JobID: "job", Payload: make([]byte, 256)}
+
+	run := func(b *testing.B, cfg Config) {
+		cfg.Dir = b.TempDir()
+		cfg.Fsync = true
+		w, err := New(cfg)
+		require.NoError(b, err)
+		defer w.Close()
+
+		// Many concurrent producers, as under enqueue load
+		b.SetParallelism(128)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if err := w.Write(record); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "writes/s")
+	}
+
+	b.Run("per_write_fsync", func(b *testing.B) {
+		run(b, Config{})
+	})
+	b.Run("group_commit", func(b *testing.B) {
+		run(b, Config{GroupCommitInterval: time.Millisecond})
+	})
 }
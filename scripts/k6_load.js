@@ -65,13 +65,14 @@ export default function() {
   );
 
   leaseLatency.add(Date.now() - leaseStart);
-  leaseRate.add(leaseRes.status === 200);
+  leaseRate.add(leaseRes.status === 200 || leaseRes.status === 204);
   
   const leaseSuccess = check(leaseRes, {
-    'lease status is 200': (r) => r.status === 200,
+    'lease status is 200 or 204': (r) => r.status === 200 || r.status === 204,
   });
 
-  if (leaseSuccess) {
+  // 204 means the queue had no ready jobs
+  if (leaseSuccess && leaseRes.status === 200) {
     const leaseData = JSON.parse(leaseRes.body);
     
     if (leaseData.jobs && leaseData.jobs.length > 0) {